@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"time"
+)
+
+// AccessLevelResolver resolves access levels of Access Context Manager, as accessPolicies/{policy}/accessLevels/{level},
+// satisfied by principal. Must be safe for concurrent use.
+type AccessLevelResolver interface {
+	ResolveAccessLevels(ctx context.Context, principal GoogleServiceAccount) ([]string, error)
+}
+
+// CachedAccessLevelResolver is an implementation of AccessLevelResolver caching access levels per principal.
+type CachedAccessLevelResolver struct {
+	resolver AccessLevelResolver
+	cache    cache.Cache[string, cache.ExpiryCacheValue[[]string]]
+	ttl      time.Duration
+}
+
+// NewCachedAccessLevelResolver returns resolver caching access levels resolved by resolver for ttl.
+func NewCachedAccessLevelResolver(resolver AccessLevelResolver, c cache.Cache[string, cache.ExpiryCacheValue[[]string]], ttl time.Duration) *CachedAccessLevelResolver {
+	return &CachedAccessLevelResolver{
+		resolver: resolver,
+		cache:    c,
+		ttl:      ttl,
+	}
+}
+
+// ResolveAccessLevels returns access levels of principal from cache, else from resolver. Errors are not cached.
+func (c *CachedAccessLevelResolver) ResolveAccessLevels(ctx context.Context, principal GoogleServiceAccount) ([]string, error) {
+	if entry, ok := c.cache.Get(string(principal)); ok && entry.Exp > time.Now().Unix() {
+		return entry.Val, nil
+	}
+	levels, err := c.resolver.ResolveAccessLevels(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+	exp := time.Now().Add(c.ttl).Unix()
+	writeCache(func() { c.cache.Set(string(principal), cache.ExpiryCacheValue[[]string]{Val: levels, Exp: exp}) })
+	return levels, nil
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const trustedAccessLevel = "accessPolicies/123456789/accessLevels/trusted"
+
+func TestAccessLevelConditionalExpression(t *testing.T) {
+	var (
+		resolver = &fakeAccessLevelResolver{levels: map[GoogleServiceAccount][]string{
+			"trusted@p.iam.gserviceaccount.com": {trustedAccessLevel},
+		}}
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"trusted":   "trusted@p.iam.gserviceaccount.com",
+			"untrusted": "untrusted@p.iam.gserviceaccount.com",
+		}}
+		condition = PolicyBindings{{Expression: "\"" + trustedAccessLevel + "\" in request.auth.access_levels", Title: "trusted"}}
+		bindings  = fakeIdentityAccessManagementReader{
+			"trusted@p.iam.gserviceaccount.com":   condition,
+			"untrusted@p.iam.gserviceaccount.com": condition,
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	authenticator.SetAccessLevelResolver(NewCachedAccessLevelResolver(resolver,
+		cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[[]string]](), time.Minute))
+
+	var tests = []struct {
+		name          string
+		token         string
+		expectedError error
+	}{
+		{"TestSatisfiedAccessLevel", "trusted", nil},
+		{"TestCachedSatisfiedAccessLevel", "trusted", nil},
+		{"TestUnsatisfiedAccessLevel", "untrusted", ErrInvalidGoogleCloudAuthentication},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.expectedError, err)
+			}
+		})
+	}
+	if calls := resolver.calls.Load(); calls != 2 {
+		t.Fatalf("Expected access levels to be resolved once per identity, %d resolutions were made.", calls)
+	}
+}
+
+func TestAccessLevelConditionalExpressionWithoutResolver(t *testing.T) {
+	var (
+		verifier      = &fakeTokenVerifier{emails: map[string]string{"trusted": "trusted@p.iam.gserviceaccount.com"}}
+		authenticator = newFakeAuthenticator(t, verifier, fakeIdentityAccessManagementReader{
+			"trusted@p.iam.gserviceaccount.com": {{Expression: "\"" + trustedAccessLevel + "\" in request.auth.access_levels"}},
+		}, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	if _, err := authenticator.Authenticate(context.Background(), "trusted", *requestUrl); !errors.Is(err, ErrInvalidGoogleCloudAuthentication) {
+		t.Fatalf("Expected error %v, error %v was returned.", ErrInvalidGoogleCloudAuthentication, err)
+	}
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	googleTokenInfoEndpoint = "https://oauth2.googleapis.com/tokeninfo"
+	// labelAccessToken is issuer label of token verification metrics of access tokens.
+	labelAccessToken = "access_token"
+)
+
+// ErrInvalidAccessToken is given when access token is rejected by introspection.
+var ErrInvalidAccessToken = errors.New("invalid access token")
+
+// AccessTokenFallbackVerifier verifies ID tokens given verifier, falling back to introspection of opaque access
+// tokens given token is not a JWT. Access tokens are verified given OAuth client id, claim aud of introspection, is
+// any of audiences, since an access token is not bound to audience of request url. Principal is email of token.
+type AccessTokenFallbackVerifier struct {
+	verifier  TokenVerifier[*GoogleTokenClaims]
+	audiences []string
+	endpoint  string
+	client    http.Client
+	limiter   *APILimiter
+	// grace accepts access tokens expired within grace, given introspection.
+	grace time.Duration
+}
+
+// tokenInfo is response of introspection of access token. Numbers are encoded as strings.
+type tokenInfo struct {
+	Audience      string `json:"aud"`
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified string `json:"email_verified"`
+	Expiry        string `json:"exp"`
+}
+
+// NewAccessTokenFallbackVerifier creates a verifier of which introspection of access tokens is bounded by timeout and
+// limiter, nil is unbounded. Verified access tokens are cached as verified ID tokens, until expiry of access token.
+func NewAccessTokenFallbackVerifier(verifier TokenVerifier[*GoogleTokenClaims], audiences []string, timeout time.Duration,
+	limiter *APILimiter) *AccessTokenFallbackVerifier {
+	return &AccessTokenFallbackVerifier{
+		verifier:  verifier,
+		audiences: audiences,
+		endpoint:  googleTokenInfoEndpoint,
+		client:    http.Client{Timeout: timeout},
+		limiter:   limiter,
+	}
+}
+
+// SetExpiryGrace accepts access tokens expired within grace, given introspection still confirms token, i.e. token is
+// not revoked. Such tokens are introspected on every request, unless served stale given stale while revalidate, and
+// each is audit logged. ID tokens are never accepted
+// beyond leeway of claim exp. Zero is disabled. Must be invoked before Verify is used.
+func (a *AccessTokenFallbackVerifier) SetExpiryGrace(grace time.Duration) {
+	a.grace = grace
+}
+
+// Verify verifies tokenString as ID token, else as access token given tokenString is not a JWT.
+func (a *AccessTokenFallbackVerifier) Verify(ctx context.Context, tokenString, aud string, claims *GoogleTokenClaims) error {
+	err := a.verifier.Verify(ctx, tokenString, aud, claims)
+	if !errors.Is(err, jwt.ErrTokenMalformed) || strings.Count(tokenString, ".") == 2 {
+		// Only tokens of which JWT segments are absent are opaque, a malformed JWT is never introspected.
+		return err
+	}
+	err = a.introspect(ctx, tokenString, claims)
+	observeTokenVerification(labelAccessToken, labelUnknown, err)
+	return err
+}
+
+// introspect verifies access token given introspection endpoint.
+func (a *AccessTokenFallbackVerifier) introspect(ctx context.Context, tokenString string, claims *GoogleTokenClaims) error {
+	if err := a.limiter.Acquire(ctx); err != nil {
+		return err
+	}
+	defer a.limiter.Release()
+
+	// Token is posted as form, never part of url.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint,
+		strings.NewReader(url.Values{"access_token": {tokenString}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rsp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: introspection failed: %s", ErrInvalidAccessToken, err)
+	}
+	defer rsp.Body.Close()
+
+	var info tokenInfo
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: introspection returned status code %d", ErrInvalidAccessToken, rsp.StatusCode)
+	} else if err = json.NewDecoder(rsp.Body).Decode(&info); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAccessToken, err)
+	}
+	exp, err := strconv.ParseInt(info.Expiry, 10, 64)
+	now := time.Now()
+	switch {
+	case err != nil:
+		return fmt.Errorf("%w: invalid exp %s", ErrInvalidAccessToken, info.Expiry)
+	case time.Unix(exp, 0).Add(a.grace).Before(now):
+		return fmt.Errorf("%w: token is expired", ErrInvalidAccessToken)
+	case !slices.Contains(a.audiences, info.Audience):
+		return fmt.Errorf("%w: token audience %s is not any of %v", ErrInvalidAudience, info.Audience, a.audiences)
+	case len(info.Email) > 0 && info.EmailVerified != "true":
+		return fmt.Errorf("%w: email %s is not verified", ErrInvalidAccessToken, info.Email)
+	}
+	if expiry := time.Unix(exp, 0); expiry.Before(now) {
+		// Expiry is retained, cached identity is expired such that token is introspected again on next request.
+		log.WithContext(ctx).WithFields(log.Fields{
+			"audit":  "expiry-grace",
+			"user":   info.Email,
+			"expiry": expiry,
+			"grace":  a.grace,
+		}).Warningf("EXPIRY-GRACE: Access token expired %s ago is accepted given introspection.", now.Sub(expiry).Round(time.Second))
+	}
+	claims.Email = info.Email
+	claims.Principal = info.Email
+	claims.Subject = info.Subject
+	claims.Issuer = googlePublicIssuerIdToken
+	claims.Audience = jwt.ClaimStrings{info.Audience}
+	claims.ExpiresAt = jwt.NewNumericDate(time.Unix(exp, 0))
+	return nil
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTokenInfo introspects access tokens of tokens, unknown access tokens are rejected with 400.
+type fakeTokenInfo struct {
+	tokens   map[string]tokenInfo
+	requests atomic.Int32
+}
+
+func (f *fakeTokenInfo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	info, ok := f.tokens[r.PostFormValue("access_token")]
+	if r.Method != http.MethodPost || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(info)
+}
+
+func TestAccessTokenFallbackVerifier(t *testing.T) {
+	var (
+		issuer    = newFakeOpenIDIssuer(t)
+		email     = "user@example.com"
+		exp       = strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		tokeninfo = &fakeTokenInfo{tokens: map[string]tokenInfo{
+			"ya29.valid":      {Audience: "client-id", Subject: "1234", Email: email, EmailVerified: "true", Expiry: exp},
+			"ya29.other":      {Audience: "other-client-id", Subject: "1234", Email: email, EmailVerified: "true", Expiry: exp},
+			"ya29.unverified": {Audience: "client-id", Subject: "1234", Email: email, EmailVerified: "false", Expiry: exp},
+			"ya29.expired": {Audience: "client-id", Subject: "1234", Email: email, EmailVerified: "true",
+				Expiry: strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)},
+		}}
+		server   = httptest.NewServer(tokeninfo)
+		verifier = NewAccessTokenFallbackVerifier(issuer.newTokenService(t, PrincipalClaimEmail), []string{"client-id"},
+			time.Second, nil)
+		bindings      = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		idToken       = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email})
+	)
+	t.Cleanup(server.Close)
+	verifier.endpoint = server.URL
+
+	var tests = []struct {
+		name          string
+		token         string
+		statusCode    int
+		introspection int32
+	}{
+		{"TestIdTokenIsNotIntrospected", idToken, http.StatusOK, 0},
+		{"TestAccessTokenFallsThroughToIntrospection", "ya29.valid", http.StatusOK, 1},
+		{"TestCachedAccessTokenIsNotIntrospected", "ya29.valid", http.StatusOK, 1},
+		{"TestAccessTokenOfOtherClientId", "ya29.other", http.StatusUnauthorized, 2},
+		{"TestAccessTokenOfUnverifiedEmail", "ya29.unverified", http.StatusUnauthorized, 3},
+		{"TestExpiredAccessToken", "ya29.expired", http.StatusUnauthorized, 4},
+		{"TestInvalidAccessTokenFailsBoth", "ya29.invalid", http.StatusUnauthorized, 5},
+		{"TestInvalidIdTokenIsNotIntrospected", idToken[:len(idToken)-4] + "abcd", http.StatusUnauthorized, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if n := tokeninfo.requests.Load(); n != tt.introspection {
+				t.Fatalf("Expected %d introspections, %d introspections were made.", tt.introspection, n)
+			}
+		})
+	}
+}
+
+func TestAccessTokenExpiryGrace(t *testing.T) {
+	var (
+		issuer    = newFakeOpenIDIssuer(t)
+		email     = "user@example.com"
+		expiry    = func(d time.Duration) string { return strconv.FormatInt(time.Now().Add(d).Unix(), 10) }
+		tokeninfo = &fakeTokenInfo{tokens: map[string]tokenInfo{
+			"ya29.valid":  {Audience: "client-id", Subject: "1234", Email: email, EmailVerified: "true", Expiry: expiry(time.Hour)},
+			"ya29.grace":  {Audience: "client-id", Subject: "1234", Email: email, EmailVerified: "true", Expiry: expiry(-time.Minute)},
+			"ya29.beyond": {Audience: "client-id", Subject: "1234", Email: email, EmailVerified: "true", Expiry: expiry(-10 * time.Minute)},
+		}}
+		server   = httptest.NewServer(tokeninfo)
+		verifier = NewAccessTokenFallbackVerifier(issuer.newTokenService(t, PrincipalClaimEmail), []string{"client-id"},
+			time.Second, nil)
+		bindings      = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		// ID token expired beyond leeway of exp, but within grace.
+		idToken = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email,
+			"exp": time.Now().Add(-3 * time.Minute).Unix()})
+	)
+	t.Cleanup(server.Close)
+	verifier.endpoint = server.URL
+	verifier.SetExpiryGrace(5 * time.Minute)
+
+	var tests = []struct {
+		name          string
+		token         string
+		statusCode    int
+		introspection int32
+	}{
+		{"TestValidAccessToken", "ya29.valid", http.StatusOK, 1},
+		{"TestAccessTokenWithinGrace", "ya29.grace", http.StatusOK, 2},
+		{"TestAccessTokenWithinGraceIsIntrospectedAgain", "ya29.grace", http.StatusOK, 3},
+		{"TestAccessTokenBeyondGrace", "ya29.beyond", http.StatusUnauthorized, 4},
+		{"TestExpiredIdTokenIsStrictlyEnforced", idToken, http.StatusUnauthorized, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if n := tokeninfo.requests.Load(); n != tt.introspection {
+				t.Fatalf("Expected %d introspections, %d introspections were made.", tt.introspection, n)
+			}
+		})
+	}
+}
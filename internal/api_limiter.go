@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"context"
+)
+
+// APILimiter bounds concurrent outbound calls to Google APIs, shared between clients to protect quota. Calls exceeding
+// limit are queued until a call is released or ctx is done. A nil APILimiter is unbounded.
+type APILimiter struct {
+	slots chan struct{}
+}
+
+// NewAPILimiter creates a limiter of at most limit concurrent calls. Limit of zero is unbounded.
+func NewAPILimiter(limit int) *APILimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &APILimiter{slots: make(chan struct{}, limit)}
+}
+
+// Acquire blocks until a call is allowed or ctx is done. Release must be invoked once call is done, given no error.
+func (l *APILimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		googleAPICallsQueuedGauge.Inc()
+		defer googleAPICallsQueuedGauge.Dec()
+
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Release a call of Acquire.
+func (l *APILimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
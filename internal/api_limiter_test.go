@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAPILimiterConcurrency(t *testing.T) {
+	const limit = 3
+	var (
+		limiter           = NewAPILimiter(limit)
+		inFlight, maximum atomic.Int32
+		wg                sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := limiter.Acquire(context.Background()); err != nil {
+				t.Errorf("Unexpected error returned, error: %s.", err)
+				return
+			}
+			defer limiter.Release()
+
+			n := inFlight.Add(1)
+			for m := maximum.Load(); n > m && !maximum.CompareAndSwap(m, n); m = maximum.Load() {
+			}
+			time.Sleep(time.Millisecond)
+			inFlight.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if n := maximum.Load(); n > limit {
+		t.Fatalf("Expected at most %d concurrent calls, %d concurrent calls were given.", limit, n)
+	} else if n < limit {
+		t.Fatalf("Expected queued calls to reach %d concurrent calls, %d concurrent calls were given.", limit, n)
+	}
+}
+
+func TestAPILimiterQueuedCallIsCancelled(t *testing.T) {
+	limiter := NewAPILimiter(1)
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error %v, error %v was returned.", context.DeadlineExceeded, err)
+	}
+	limiter.Release()
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+}
+
+func TestUnboundedAPILimiter(t *testing.T) {
+	limiter := NewAPILimiter(0)
+	for i := 0; i < 10; i++ {
+		if err := limiter.Acquire(context.Background()); err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+	}
+	limiter.Release()
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AssertionSigner signs ES256 JWT assertions of verified identity, as X-Goog-Iap-Jwt-Assertion of Identity Aware Proxy,
+// for upstream to verify. Signing key is rotated on interval. Next key is published one interval before it is primary,
+// such that upstreams caching published keys verify assertions of next key, and previous key is published until next
+// rotation, such that assertions signed before rotation remain verifiable.
+type AssertionSigner struct {
+	issuer   string
+	lifetime time.Duration
+	mu       sync.RWMutex
+	// next is published key of which is primary given next rotation.
+	next assertionKey
+	// keys are published keys, primary key used for signing is first.
+	keys []assertionKey
+}
+
+type assertionKey struct {
+	kid string
+	key *ecdsa.PrivateKey
+}
+
+// assertionKeysRetained is number of published keys, primary and previous, next key excluded.
+const assertionKeysRetained = 2
+
+// ErrInvalidAssertionRotation is given when rotation of AssertionSigner does not exceed lifetime of assertions.
+var ErrInvalidAssertionRotation = errors.New("rotation of assertion signing key must exceed lifetime")
+
+// headerIapJwtAssertion is set on response given verified identity and AssertionSigner.
+const headerIapJwtAssertion = "X-Goog-Iap-Jwt-Assertion"
+
+// NewAssertionSigner creates a signer of assertions valid for lifetime, of which signing key is rotated every rotation.
+// Rotation must exceed lifetime, else ErrInvalidAssertionRotation.
+func NewAssertionSigner(ctx context.Context, issuer string, lifetime, rotation time.Duration) (*AssertionSigner, error) {
+	if rotation <= lifetime {
+		return nil, fmt.Errorf("%w: rotation %s, lifetime %s", ErrInvalidAssertionRotation, rotation, lifetime)
+	}
+	next, err := newAssertionKey()
+	if err != nil {
+		return nil, err
+	}
+	signer := &AssertionSigner{
+		issuer:   issuer,
+		lifetime: lifetime,
+		next:     next,
+	}
+	if err = signer.Rotate(); err != nil {
+		return nil, err
+	}
+	go func() {
+		ticker := time.NewTicker(rotation)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := signer.Rotate(); err != nil {
+					log.WithField("error", err).Error("Failed to rotate assertion signing key.")
+				}
+			}
+		}
+	}()
+	return signer, nil
+}
+
+// Rotate promotes published next key to primary signing key and generates a new next key. Previous primary key is
+// still published.
+func (s *AssertionSigner) Rotate() error {
+	next, err := newAssertionKey()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = append([]assertionKey{s.next}, s.keys...)
+	if len(s.keys) > assertionKeysRetained {
+		s.keys = s.keys[:assertionKeysRetained]
+	}
+	s.next = next
+	log.Infof("Assertion signing key rotated. Primary key is %s, next key is %s.", s.keys[0].kid, s.next.kid)
+	return nil
+}
+
+// newAssertionKey generates a P-256 key of random kid.
+func newAssertionKey() (assertionKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return assertionKey{}, err
+	}
+	kid := make([]byte, 8)
+	if _, err = rand.Read(kid); err != nil {
+		return assertionKey{}, err
+	}
+	return assertionKey{kid: hex.EncodeToString(kid), key: key}, nil
+}
+
+// Sign returns an assertion of email for audience aud, signed with primary key.
+func (s *AssertionSigner) Sign(email GoogleServiceAccount, aud string) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, GoogleTokenClaims{
+		Email: string(email),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   string(email),
+			Audience:  jwt.ClaimStrings{aud},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.lifetime)),
+		},
+	})
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token.Header["kid"] = s.keys[0].kid
+	return token.SignedString(s.keys[0].key)
+}
+
+// JWKS returns published public keys, primary, previous and next, as a JSON Web Key Set.
+func (s *AssertionSigner) JWKS() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]map[string]string, 0, len(s.keys)+1)
+	for _, k := range slices.Concat(s.keys, []assertionKey{s.next}) {
+		keys = append(keys, map[string]string{
+			"kty": "EC",
+			"alg": jwt.SigningMethodES256.Alg(),
+			"use": "sig",
+			"kid": k.kid,
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(k.key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(k.key.Y.FillBytes(make([]byte, 32))),
+		})
+	}
+	return json.Marshal(map[string]any{"keys": keys})
+}
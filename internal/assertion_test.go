@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAssertionSignerRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signer, err := NewAssertionSigner(ctx, "open-iap", 10*time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var (
+		email         = "sa@p.iam.gserviceaccount.com"
+		verifier      = &fakeTokenVerifier{emails: map[string]string{"token": email}}
+		authenticator = newFakeAuthenticator(t, verifier, fakeIdentityAccessManagementReader{
+			GoogleServiceAccount(email): {{}},
+		}, EmailDomainFilter{})
+		listener = newFakeAuthServiceListener(t, authenticator)
+	)
+	listener.SetAssertionSigner(signer)
+	assertion := func(t *testing.T) string {
+		t.Helper()
+		rsp := doAuthRequest(listener, "token", "https://myurl.com/hello")
+		if rsp.Code != http.StatusOK || len(rsp.Header().Get(headerIapJwtAssertion)) == 0 {
+			t.Fatalf("Expected status code 200 OK with assertion, status code %d was returned.", rsp.Code)
+		}
+		return rsp.Header().Get(headerIapJwtAssertion)
+	}
+	jwks := func() []byte {
+		rec := httptest.NewRecorder()
+		listener.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/iap-jwks", nil))
+		return rec.Body.Bytes()
+	}
+	verifyWith := func(t *testing.T, jwks []byte, assertion string) error {
+		t.Helper()
+		keySet, err := keyfunc.NewJWKSetJSON(jwks)
+		if err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+		claims := &GoogleTokenClaims{}
+		if _, err = jwt.ParseWithClaims(assertion, claims, keySet.Keyfunc, jwt.WithAudience("https://myurl.com"),
+			jwt.WithIssuer("open-iap"), jwt.WithExpirationRequired()); err == nil && claims.Email != email {
+			t.Fatalf("Expected assertion of %s, assertion of %s was given.", email, claims.Email)
+		}
+		return err
+	}
+	verify := func(t *testing.T, assertion string) error {
+		t.Helper()
+		return verifyWith(t, jwks(), assertion)
+	}
+	// Upstream caches published keys before rotation.
+	cached := jwks()
+	previous := assertion(t)
+	if err = signer.Rotate(); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	current := assertion(t)
+
+	if err = verifyWith(t, cached, current); err != nil {
+		t.Fatalf("Expected assertion signed with next key to be valid given keys cached before rotation, error: %s.", err)
+	} else if err = verify(t, current); err != nil {
+		t.Fatalf("Expected assertion signed with primary key to be valid, error: %s.", err)
+	} else if err = verify(t, previous); err != nil {
+		t.Fatalf("Expected assertion signed with previous key to be valid, error: %s.", err)
+	} else if err = signer.Rotate(); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if err = verify(t, previous); err == nil {
+		t.Fatal("Expected assertion signed with unpublished key to be invalid.")
+	}
+}
+
+func TestAssertionRotationMustExceedLifetime(t *testing.T) {
+	if _, err := NewAssertionSigner(context.Background(), "open-iap", time.Hour, time.Hour); !errors.Is(err, ErrInvalidAssertionRotation) {
+		t.Fatalf("Expected error %v, error %v was returned.", ErrInvalidAssertionRotation, err)
+	}
+}
+
+func TestJwksWithoutAssertionSigner(t *testing.T) {
+	listener := newFakeAuthServiceListener(t, &recordingAuthenticator{})
+	rec := httptest.NewRecorder()
+	listener.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/iap-jwks", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected status code 404 Not Found, status code %d was returned.", rec.Code)
+	}
+}
@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/logging/v2"
+	"google.golang.org/api/option"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// AuditSink receives a decision record for each request of verified identity. Must be safe for concurrent use.
+type AuditSink interface {
+	Record(record AuditRecord)
+	Close(ctx context.Context) error
+}
+
+// AuditRecord is an authorization decision of a request given verified identity.
+type AuditRecord struct {
+	Principal  GoogleServiceAccount
+	RequestURL url.URL
+	Granted    bool
+	// FailOpen is true given request denied by policy is granted given FailOpen.
+	FailOpen bool
+	// ExplicitDeny is true given request denied by a deny policy, else denial is implicit given no granting binding.
+	ExplicitDeny bool
+	Reason       string
+	// TokenFingerprint is truncated SHA-256 of token given SetTokenFingerprint, never the token itself.
+	TokenFingerprint string
+	// RequestID is id of request given SetRequestID.
+	RequestID string
+	// PolicySource is source of policy bindings of decision given PolicySourceReader, i.e. secondary given failover.
+	PolicySource string
+	Timestamp    time.Time
+}
+
+// CloudLoggingAuditSink is an implementation of AuditSink writing records in batches to Google Cloud Logging.
+type CloudLoggingAuditSink struct {
+	service   *logging.Service
+	logName   string
+	resource  *logging.MonitoredResource
+	batchSize int
+	records   chan AuditRecord
+	closing   chan context.Context
+	flushed   chan struct{}
+	once      sync.Once
+}
+
+// SampledAuditSink is an AuditSink sampling records of denials before recording to sink, i.e. given a denial storm.
+// First denial of each reason within window is always recorded, subsequent denials are recorded at rate. Records of
+// granted requests are never sampled.
+type SampledAuditSink struct {
+	sink   AuditSink
+	rate   float64
+	window time.Duration
+	// mu guards denials and start, denials is number of denials per reason since start of window.
+	mu      sync.Mutex
+	denials map[string]int
+	start   time.Time
+}
+
+// NewSampledAuditSink creates a SampledAuditSink recording to sink. Rate is clamped to [0, 1].
+func NewSampledAuditSink(sink AuditSink, rate float64, window time.Duration) *SampledAuditSink {
+	return &SampledAuditSink{
+		sink:    sink,
+		rate:    min(max(rate, 0), 1),
+		window:  window,
+		denials: make(map[string]int, 10),
+		start:   time.Now(),
+	}
+}
+
+// Record records record to sink given record is granted or sampled.
+func (s *SampledAuditSink) Record(record AuditRecord) {
+	if !record.Granted && !s.sample(record.Reason) {
+		auditDenialsSampledCounter.Inc()
+		return
+	}
+	s.sink.Record(record)
+}
+
+// Close closes sink.
+func (s *SampledAuditSink) Close(ctx context.Context) error {
+	return s.sink.Close(ctx)
+}
+
+// sample returns true given denial of reason is to be recorded. Sampling is deterministic, every 1/rate denial of
+// reason is recorded, such that representative records are retained without source of randomness.
+func (s *SampledAuditSink) sample(reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now := time.Now(); now.Sub(s.start) >= s.window {
+		clear(s.denials)
+		s.start = now
+	}
+	n := s.denials[reason]
+	s.denials[reason] = n + 1
+	if n == 0 {
+		return true
+	}
+	return int(float64(n)*s.rate) > int(float64(n-1)*s.rate)
+}
+
+// AuditSinks is an AuditSink recording each record to each sink in order.
+type AuditSinks []AuditSink
+
+// Record records record to each sink.
+func (s AuditSinks) Record(record AuditRecord) {
+	for _, sink := range s {
+		sink.Record(record)
+	}
+}
+
+// Close closes each sink, errors of sinks are joined.
+func (s AuditSinks) Close(ctx context.Context) error {
+	var errs []error
+	for _, sink := range s {
+		errs = append(errs, sink.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+const (
+	auditLogType              = "type.googleapis.com/google.cloud.audit.AuditLog"
+	auditLogServiceName       = "open-iap"
+	auditLogMethodName        = "open-iap.auth"
+	iapAccessViaIapPermission = "iap.webServiceVersions.accessViaIAP"
+	// Status codes of google.rpc.Code.
+	auditLogStatusOk               = 0
+	auditLogStatusPermissionDenied = 7
+)
+
+// NewCloudLoggingAuditSink creates an AuditSink writing to log logName of project of credentials. Records are
+// written given batchSize records are pending or at flushInterval, and flushed on Close.
+func NewCloudLoggingAuditSink(ctx context.Context, credentials *google.Credentials, logName string, batchSize int,
+	flushInterval time.Duration) (*CloudLoggingAuditSink, error) {
+	service, err := logging.NewService(ctx, option.WithCredentials(credentials))
+	if err != nil {
+		return nil, err
+	}
+	return newCloudLoggingAuditSink(service, credentials.ProjectID, logName, batchSize, flushInterval), nil
+}
+
+func newCloudLoggingAuditSink(service *logging.Service, pid, logName string, batchSize int,
+	flushInterval time.Duration) *CloudLoggingAuditSink {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	sink := &CloudLoggingAuditSink{
+		service: service,
+		logName: fmt.Sprintf("projects/%s/logs/%s", pid, url.PathEscape(logName)),
+		resource: &logging.MonitoredResource{
+			Type:   "global",
+			Labels: map[string]string{"project_id": pid},
+		},
+		batchSize: batchSize,
+		// Buffer is sized to absorb bursts while a batch is written, records are dropped when full.
+		records: make(chan AuditRecord, 10*batchSize),
+		closing: make(chan context.Context, 1),
+		flushed: make(chan struct{}),
+	}
+	go sink.run(flushInterval)
+	return sink
+}
+
+// Record enqueues record for writing. Never blocks, record is dropped given buffer is full.
+func (c *CloudLoggingAuditSink) Record(record AuditRecord) {
+	select {
+	case c.records <- record:
+	default:
+		auditRecordsDroppedCounter.Inc()
+		log.Warningf("Audit record for user %s dropped, buffer is full.", record.Principal)
+	}
+}
+
+// Close flushes pending records. Records recorded after Close are not written.
+func (c *CloudLoggingAuditSink) Close(ctx context.Context) error {
+	c.once.Do(func() { c.closing <- ctx })
+
+	select {
+	case <-c.flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *CloudLoggingAuditSink) run(interval time.Duration) {
+	defer close(c.flushed)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]*logging.LogEntry, 0, c.batchSize)
+	for {
+		select {
+		case record := <-c.records:
+			if batch = append(batch, c.entry(record)); len(batch) < c.batchSize {
+				continue
+			}
+			batch = c.write(context.Background(), batch)
+		case <-ticker.C:
+			batch = c.write(context.Background(), batch)
+		case ctx := <-c.closing:
+			// Drain pending records before final write, run is single consumer of records.
+			for len(c.records) > 0 {
+				batch = append(batch, c.entry(<-c.records))
+			}
+			c.write(ctx, batch)
+			return
+		}
+	}
+}
+
+// write batch of entries and return batch for reuse. Failed writes are logged and dropped.
+func (c *CloudLoggingAuditSink) write(ctx context.Context, batch []*logging.LogEntry) []*logging.LogEntry {
+	if len(batch) == 0 {
+		return batch
+	}
+	_, err := c.service.Entries.Write(&logging.WriteLogEntriesRequest{
+		LogName:  c.logName,
+		Resource: c.resource,
+		Entries:  batch,
+	}).Context(ctx).Do()
+	if err != nil {
+		auditRecordsDroppedCounter.Add(float64(len(batch)))
+		log.WithField("error", err).Errorf("Failed to write %d audit records to Cloud Logging.", len(batch))
+	}
+	return batch[:0]
+}
+
+// entry transforms record into a log entry with payload following conventions of Cloud Audit Logs.
+func (c *CloudLoggingAuditSink) entry(record AuditRecord) *logging.LogEntry {
+	var (
+		resource = record.RequestURL.String()
+		severity = "NOTICE"
+		status   = map[string]any{"code": auditLogStatusOk}
+	)
+	if !record.Granted {
+		severity = "WARNING"
+		status = map[string]any{"code": auditLogStatusPermissionDenied, "message": record.Reason}
+	} else if record.FailOpen {
+		severity = "WARNING"
+	}
+	metadata := map[string]any{
+		"failOpen": record.FailOpen,
+		"reason":   record.Reason,
+	}
+	if !record.Granted {
+		metadata["denial"] = "implicit"
+		if record.ExplicitDeny {
+			metadata["denial"] = "explicit"
+		}
+	}
+	if len(record.TokenFingerprint) > 0 {
+		metadata["tokenFingerprint"] = record.TokenFingerprint
+	}
+	if len(record.RequestID) > 0 {
+		metadata["requestId"] = record.RequestID
+	}
+	if len(record.PolicySource) > 0 {
+		metadata["policySource"] = record.PolicySource
+	}
+	payload, _ := json.Marshal(map[string]any{
+		"@type":        auditLogType,
+		"serviceName":  auditLogServiceName,
+		"methodName":   auditLogMethodName,
+		"resourceName": resource,
+		"authenticationInfo": map[string]any{
+			"principalEmail": record.Principal,
+		},
+		"authorizationInfo": []map[string]any{{
+			"resource":   resource,
+			"permission": iapAccessViaIapPermission,
+			"granted":    record.Granted,
+		}},
+		"status":   status,
+		"metadata": metadata,
+	})
+	return &logging.LogEntry{
+		JsonPayload: payload,
+		Severity:    severity,
+		Timestamp:   record.Timestamp.UTC().Format(time.RFC3339Nano),
+	}
+}
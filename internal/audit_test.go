@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func auditRecord(email string, granted bool) AuditRecord {
+	requestUrl, _ := url.Parse("https://myurl.com/hello")
+	return AuditRecord{
+		Principal:  GoogleServiceAccount(email),
+		RequestURL: *requestUrl,
+		Granted:    granted,
+		Timestamp:  time.Now(),
+	}
+}
+
+func TestCloudLoggingAuditSinkFlushOnClose(t *testing.T) {
+	sink, fake := newFakeCloudLoggingAuditSink(t, 10, time.Hour)
+
+	sink.Record(auditRecord("sa@p.iam.gserviceaccount.com", true))
+	sink.Record(auditRecord("sa@p.iam.gserviceaccount.com", false))
+	time.Sleep(10 * time.Millisecond)
+
+	if writes := fake.writes(); len(writes) != 0 {
+		t.Fatalf("Expected no write before batch is full, %d writes were given.", len(writes))
+	} else if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	writes := fake.writes()
+	if len(writes) != 1 || len(writes[0].Entries) != 2 {
+		t.Fatalf("Expected single write of 2 entries on close, %d writes were given.", len(writes))
+	} else if writes[0].LogName != "projects/test-project/logs/open-iap-audit" {
+		t.Fatalf("Expected log name of project, log name %s was given.", writes[0].LogName)
+	}
+	var payload struct {
+		Type               string `json:"@type"`
+		AuthenticationInfo struct {
+			PrincipalEmail string `json:"principalEmail"`
+		} `json:"authenticationInfo"`
+		AuthorizationInfo []struct {
+			Granted bool `json:"granted"`
+		} `json:"authorizationInfo"`
+	}
+	if err := json.Unmarshal(writes[0].Entries[1].JsonPayload, &payload); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if payload.Type != auditLogType || payload.AuthenticationInfo.PrincipalEmail != "sa@p.iam.gserviceaccount.com" {
+		t.Fatalf("Expected audit log payload of principal, payload %s was given.", writes[0].Entries[1].JsonPayload)
+	} else if len(payload.AuthorizationInfo) != 1 || payload.AuthorizationInfo[0].Granted {
+		t.Fatalf("Expected denied authorization, payload %s was given.", writes[0].Entries[1].JsonPayload)
+	}
+}
+
+func TestCloudLoggingAuditSinkBatchWrite(t *testing.T) {
+	sink, fake := newFakeCloudLoggingAuditSink(t, 2, time.Hour)
+
+	for i := 0; i < 5; i++ {
+		sink.Record(auditRecord("sa@p.iam.gserviceaccount.com", true))
+	}
+	for deadline := time.Now().Add(time.Second); len(fake.writes()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if writes := fake.writes(); len(writes) != 2 {
+		t.Fatalf("Expected 2 batch writes of 2 entries, %d writes were given.", len(writes))
+	} else if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var entries int
+	for _, write := range fake.writes() {
+		entries += len(write.Entries)
+	}
+	if entries != 5 {
+		t.Fatalf("Expected 5 entries to be written, %d entries were written.", entries)
+	}
+}
+
+func TestAuthenticatorAuditRecords(t *testing.T) {
+	var (
+		sink, fake = newFakeCloudLoggingAuditSink(t, 10, time.Hour)
+		verifier   = &fakeTokenVerifier{emails: map[string]string{
+			"allowed": "allowed@p.iam.gserviceaccount.com",
+			"denied":  "denied@p.iam.gserviceaccount.com",
+		}}
+		bindings      = fakeIdentityAccessManagementReader{"allowed@p.iam.gserviceaccount.com": {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	authenticator.SetAuditSink(sink)
+
+	for _, token := range []string{"allowed", "denied", "unknown"} {
+		_, _ = authenticator.Authenticate(context.Background(), token, *requestUrl)
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	// Unverified token has no identity, no decision is recorded.
+	if writes := fake.writes(); len(writes) != 1 || len(writes[0].Entries) != 2 {
+		t.Fatalf("Expected 2 decision records to be written, %d writes were given.", len(writes))
+	} else if writes[0].Entries[0].Severity != "NOTICE" || writes[0].Entries[1].Severity != "WARNING" {
+		t.Fatalf("Expected granted then denied decision record, severity %s and %s were given.",
+			writes[0].Entries[0].Severity, writes[0].Entries[1].Severity)
+	}
+}
+
+func TestTokenFingerprint(t *testing.T) {
+	const (
+		allowedToken = "eyJhbGciOiJSUzI1NiJ9.allowed-token.signature"
+		unknownToken = "eyJhbGciOiJSUzI1NiJ9.unknown-token.signature"
+	)
+	var (
+		sink, fake = newFakeCloudLoggingAuditSink(t, 10, time.Hour)
+		verifier   = &fakeTokenVerifier{emails: map[string]string{allowedToken: "allowed@p.iam.gserviceaccount.com"}}
+		bindings   = fakeIdentityAccessManagementReader{"allowed@p.iam.gserviceaccount.com": {{}}}
+		// Token cache is disabled such that every request is logged.
+		authenticator, _ = NewGoogleCloudTokenAuthenticator(verifier, noopCache[GoogleServiceAccount]{}, bindings,
+			fakeGoogleWorkspaceClient{}, nil, EmailDomainFilter{}, 50*time.Millisecond, FailOpen{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+		output        = &bytes.Buffer{}
+	)
+	authenticator.SetAuditSink(sink)
+	authenticator.SetTokenFingerprint(true)
+	log.SetOutput(output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, token := range []string{allowedToken, allowedToken, unknownToken} {
+		_, _ = authenticator.Authenticate(context.Background(), token, *requestUrl)
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var fingerprints []string
+	for _, write := range fake.writes() {
+		for _, entry := range write.Entries {
+			var payload struct {
+				Metadata struct {
+					TokenFingerprint string `json:"tokenFingerprint"`
+				} `json:"metadata"`
+			}
+			if err := json.Unmarshal(entry.JsonPayload, &payload); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			fingerprints = append(fingerprints, payload.Metadata.TokenFingerprint)
+			output.Write(entry.JsonPayload)
+		}
+	}
+	if len(fingerprints) != 2 {
+		t.Fatalf("Expected 2 decision records to be written, %d records were given.", len(fingerprints))
+	} else if fingerprints[0] != fingerprints[1] {
+		t.Fatalf("Expected stable fingerprint, fingerprints %s and %s were given.", fingerprints[0], fingerprints[1])
+	} else if _, err := hex.DecodeString(fingerprints[0]); err != nil || len(fingerprints[0]) != tokenFingerprintLength {
+		t.Fatalf("Expected fingerprint of %d hex characters, fingerprint %s was given.", tokenFingerprintLength, fingerprints[0])
+	} else if unknown := authenticator.tokenFingerprint(unknownToken); !strings.Contains(output.String(), unknown) {
+		t.Fatalf("Expected fingerprint %s of unverified token to be logged.", unknown)
+	}
+	for _, token := range []string{allowedToken, unknownToken, "allowed-token", "unknown-token"} {
+		if strings.Contains(output.String(), token) {
+			t.Fatalf("Expected token %s to never be logged.", token)
+		}
+	}
+}
+
+func TestSampledAuditSink(t *testing.T) {
+	var tests = []struct {
+		name            string
+		rate            float64
+		denials         int
+		expectedDenials int
+	}{
+		{"TestEveryDenialRecordedGivenFullRate", 1, 100, 200},
+		{"TestDenialsSampledGivenRate", 0.1, 100, 20},
+		{"TestFirstDenialRecordedGivenZeroRate", 0, 100, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				fake = &recordingAuditSink{}
+				sink = NewSampledAuditSink(fake, tt.rate, time.Hour)
+			)
+			for i := 0; i < tt.denials; i++ {
+				for _, reason := range []string{"no iap role found", "denied by policy"} {
+					record := auditRecord("denied@p.iam.gserviceaccount.com", false)
+					record.Reason = reason
+					sink.Record(record)
+				}
+				sink.Record(auditRecord("allowed@p.iam.gserviceaccount.com", true))
+			}
+			var (
+				denials = make(map[string]int)
+				granted int
+			)
+			for _, record := range fake.recorded() {
+				if record.Granted {
+					granted++
+				} else {
+					denials[record.Reason]++
+				}
+			}
+			if granted != tt.denials {
+				t.Fatalf("Expected %d granted records, %d were given.", tt.denials, granted)
+			} else if num := denials["no iap role found"] + denials["denied by policy"]; num != tt.expectedDenials {
+				t.Fatalf("Expected %d denial records, %d were given.", tt.expectedDenials, num)
+			} else if denials["no iap role found"] != denials["denied by policy"] {
+				t.Fatalf("Expected each reason to be represented equally, %v was given.", denials)
+			}
+		})
+	}
+}
+
+func TestSampledAuditSinkWindow(t *testing.T) {
+	var (
+		fake   = &recordingAuditSink{}
+		sink   = NewSampledAuditSink(fake, 0, 50*time.Millisecond)
+		record = auditRecord("denied@p.iam.gserviceaccount.com", false)
+	)
+	sink.Record(record)
+	sink.Record(record)
+	time.Sleep(100 * time.Millisecond)
+	// First denial of reason within a new window is recorded.
+	sink.Record(record)
+
+	if num := len(fake.recorded()); num != 2 {
+		t.Fatalf("Expected first denial of each window to be recorded, %d records were given.", num)
+	}
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+// timeClaims are claims of token available as timestamps of request.auth.claims, i.e. freshness of authentication
+// given request.time - request.auth.claims.auth_time < duration('5m').
+var timeClaims = []string{"iat", "auth_time"}
+
+type authTokenKey struct{}
+
+// withAuthToken returns ctx holding verified token of request, of which claims are parsed only given conditional
+// bindings.
+func withAuthToken(ctx context.Context, tokenString string) context.Context {
+	return context.WithValue(ctx, authTokenKey{}, tokenString)
+}
+
+// authClaims returns time claims of token of ctx as timestamps, absent claims are not given. Token must be verified by
+// Authenticate, as token is parsed without verification. Empty given no token or an opaque access token.
+func authClaims(ctx context.Context) map[string]any {
+	claims := make(map[string]any, len(timeClaims))
+	tokenString, ok := ctx.Value(authTokenKey{}).(string)
+	if !ok {
+		return claims
+	}
+	parsed := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, parsed); err != nil {
+		return claims
+	}
+	for _, claim := range timeClaims {
+		if val, ok := parsed[claim].(float64); ok {
+			claims[claim] = time.Unix(int64(val), 0)
+		}
+	}
+	return claims
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuthTimeCondition(t *testing.T) {
+	var (
+		issuer   = newFakeOpenIDIssuer(t)
+		email    = "user@example.com"
+		bindings = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {
+			{Expression: "request.time - request.auth.claims.auth_time < duration('5m')", Title: "fresh"},
+			{Expression: "request.path.startsWith(\"/iat\") && request.auth.claims.iat <= request.time", Title: "iat"},
+		}}
+		authenticator = newFakeAuthenticator(t, issuer.newTokenService(t, PrincipalClaimEmail), bindings,
+			EmailDomainFilter{})
+		listener = newFakeAuthServiceListener(t, authenticator)
+		mint     = func(claims jwt.MapClaims) string {
+			claims["aud"], claims["email"] = "https://myurl.com", email
+			return issuer.mint(t, claims)
+		}
+	)
+
+	var tests = []struct {
+		name       string
+		token      string
+		requestUrl string
+		statusCode int
+	}{
+		{"TestFreshAuthTime", mint(jwt.MapClaims{"auth_time": time.Now().Add(-time.Minute).Unix()}),
+			"https://myurl.com/hello", http.StatusOK},
+		{"TestStaleAuthTime", mint(jwt.MapClaims{"auth_time": time.Now().Add(-10 * time.Minute).Unix()}),
+			"https://myurl.com/hello", http.StatusUnauthorized},
+		{"TestMissingAuthTime", mint(jwt.MapClaims{}), "https://myurl.com/hello", http.StatusUnauthorized},
+		{"TestIssuedAtTimestamp", mint(jwt.MapClaims{}), "https://myurl.com/iat", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rsp := doAuthRequest(listener, tt.token, tt.requestUrl); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
@@ -3,28 +3,100 @@ package internal
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/golang-jwt/jwt/v5/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // AuthServiceListener is an implementation use authenticator on /auth-path.
 type AuthServiceListener struct {
 	serviceListener
-	xForwardedUrlHeader string
+	xForwardedUrlHeaders []string
+	// strictRequestURL rejects requests of which url headers and forwarded host headers disagree on audience, or of which
+	// token headers disagree on token.
+	strictRequestURL bool
+	maxTokenLength   int
+	cors             CORS
+	assertions       *AssertionSigner
+	// clientCertificateHeader is trusted header of client certificate, i.e. X-Forwarded-Client-Cert. Empty is disabled.
+	clientCertificateHeader string
+	// trustForwardedProto overrides scheme of request url given X-Forwarded-Proto.
+	trustForwardedProto bool
+	// retryAfter is set as Retry-After on 503 given transient failure. Zero is disabled.
+	retryAfter time.Duration
+	// requestBudget bounds authentication of each request. Zero is unbounded.
+	requestBudget time.Duration
+	// deviceHeader is trusted header of device attributes, a JSON object. Empty is disabled.
+	deviceHeader string
+	// headerVariables are trusted headers of variables of conditional expressions.
+	headerVariables []HeaderVariable
+	// components are reported on /readyz.
+	components []HealthReporter
+	// authMethods are methods allowed on /auth, GET includes HEAD.
+	authMethods []string
+	// maxBodyBytes is maximum size of body of /auth. Negative is unbounded.
+	maxBodyBytes int64
+	// claimsBundle is set on response given verified token. Empty header is disabled.
+	claimsBundle ClaimsBundle
+	// exemplars attaches trace id of sampled span context of request to duration of /auth.
+	exemplars bool
+	// bypassPaths are path prefixes or patterns of request url allowed without authentication.
+	bypassPaths []string
+	// requestIDHeader is header of request id, retained given trustRequestID else generated. Empty is disabled.
+	requestIDHeader string
+	trustRequestID  bool
+	// adminToken authorizes requests of /admin endpoints. Empty is disabled.
+	adminToken string
+	// metrics records metrics of /auth.
+	metrics Metrics
+	// serverTiming sets Server-Timing of durations of operations on responses of /auth.
+	serverTiming bool
+	// decisionReason sets X-IAP-Decision-Reason of decision on responses of /auth.
+	decisionReason bool
+	// earlyHints sends 103 Early Hints of verified identity before decision on responses of /auth.
+	earlyHints bool
+	// ipDenylist denies sources of requests of /auth before any processing.
+	ipDenylist ipDenylist
+	// tlsKey and tlsCert serve ListenAndServe with TLS given WithTLS, of tlsPolicy.
+	tlsKey, tlsCert []byte
+	tlsPolicy       tlsPolicy
+}
+
+// CORS is configuration of cross-origin resource sharing for /auth. Preflight requests of allowed origins are answered
+// without authentication. An origin of * allows any origin. CORS is disabled given no allowed origins.
+type CORS struct {
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	MaxAge         time.Duration
 }
 
 type serviceListener struct {
 	httpServer    *http.Server
 	listener      net.Listener
 	port          atomic.Uint32
+	ready         atomic.Bool
 	host          string
 	authenticator Authenticator
+	drainPeriod   time.Duration
 }
 
 // ProxyServiceListener is an implementation of reverse proxy to use authenticator, either HTTP(S) and/or CONNECT.
@@ -32,15 +104,66 @@ type ProxyServiceListener struct {
 	serviceListener
 }
 
+// tokenExpiredChallenge is value of header WWW-Authenticate given token is rejected due to expiry.
+const tokenExpiredChallenge = `Bearer error="invalid_token", error_description="token expired"`
+
+// missingIdentityChallenge is value of header WWW-Authenticate given verified token has no principal claim.
+const missingIdentityChallenge = `Bearer error="invalid_token", error_description="missing_identity"`
+
+// defaultMaxTokenLength is maximum length of token string, including Bearer prefix, if not configured.
+const defaultMaxTokenLength = 8 << 10
+
+// fileDescriptorPrefix is prefix of host to listen on inherited file descriptor, i.e. fd://3.
+const fileDescriptorPrefix = "fd://"
+
+// unixSocketPrefix is prefix of host to listen on unix domain socket, i.e. unix:///var/run/open-iap.sock.
+const unixSocketPrefix = "unix://"
+
+// headerAuthenticatedUserEmail is set on response given verified identity, as with Identity Aware Proxy.
+const headerAuthenticatedUserEmail = "X-Goog-Authenticated-User-Email"
+
+// tokenHeaders are headers of token in order of precedence, value of first non-empty header is used. Proxy-Authorization
+// precedes Authorization, which may hold credentials of upstream.
+var tokenHeaders = request.HeaderExtractor{"Proxy-Authorization", "Authorization"}
+
+// identityHeaders are identity headers as set by Identity Aware Proxy, which are removed from inbound request and
+// always set on response.
+var identityHeaders = []string{
+	headerAuthenticatedUserEmail,
+	"X-Goog-Authenticated-User-Id",
+	"X-Goog-Iap-Jwt-Assertion",
+}
+
+var (
+	// ErrMissingRequestURL is given when no configured url header holds an absolute url.
+	ErrMissingRequestURL = errors.New("missing absolute request url")
+	// ErrConflictingRequestURL is given when url headers disagree on audience given strict request url.
+	ErrConflictingRequestURL = errors.New("conflicting request url headers")
+	// ErrInvalidFileDescriptor is given when file descriptor is not a listener, or listener has no file descriptor.
+	ErrInvalidFileDescriptor = errors.New("invalid listener file descriptor")
+	// ErrNotUnixSocket is given when path of unix domain socket exists and is not a socket, i.e. a regular file.
+	ErrNotUnixSocket = errors.New("not a unix socket")
+	// ErrAmbiguousToken is given when token headers, or repeated values of a token header, disagree on token given strict
+	// request url.
+	ErrAmbiguousToken = errors.New("ambiguous token headers")
+	// ErrTokenTooLong is given when token string exceeds maximum token length.
+	ErrTokenTooLong = errors.New("token too long")
+	// ErrMissingBearerToken is given when token header is not of bearer scheme.
+	ErrMissingBearerToken = errors.New("missing bearer token")
+	// ErrRequestBudgetExceeded is given when authentication of request exceeds request budget.
+	ErrRequestBudgetExceeded = errors.New("request budget exceeded")
+)
+
 // Listener is an interface for a listener implementation.
 type Listener interface {
 	Shutdown(ctx context.Context) error
+	Drain(ctx context.Context) error
 	Port() int
 	ListenAndServe(ctx context.Context) error
 	ListenAndServeWithTLS(ctx context.Context, key, cert []byte)
 }
 
-func newAuthServiceListener(_ context.Context, host, xForwardedUrlHeader string, port uint16, auth Authenticator) (*AuthServiceListener, error) {
+func newAuthServiceListener(_ context.Context, host string, xForwardedUrlHeaders []string, port uint16, auth Authenticator) (*AuthServiceListener, error) {
 	a := &AuthServiceListener{
 		serviceListener: serviceListener{
 			httpServer:    &http.Server{},
@@ -48,30 +171,115 @@ func newAuthServiceListener(_ context.Context, host, xForwardedUrlHeader string,
 			host:          host,
 			authenticator: auth,
 		},
-		xForwardedUrlHeader: xForwardedUrlHeader,
+		xForwardedUrlHeaders: xForwardedUrlHeaders,
+		maxTokenLength:       defaultMaxTokenLength,
+		authMethods:          []string{http.MethodGet},
+		maxBodyBytes:         -1,
+		metrics:              PrometheusMetrics{},
+		tlsPolicy:            defaultTLSPolicy,
 	}
 	a.port.Store(uint32(port))
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /healthz", a.healthz)
-	mux.HandleFunc("GET /auth", a.auth)
+	mux.HandleFunc("GET /readyz", a.readyz)
+	mux.HandleFunc("/auth", a.restrictRequest(a.auth))
+	mux.HandleFunc("OPTIONS /auth", a.preflight)
+	mux.HandleFunc("GET /iap-jwks", a.jwks)
+	mux.HandleFunc("POST /admin/purge", a.purge)
+	// OpenMetrics, including exemplars, is served given negotiated by scraper.
+	mux.Handle("GET /metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 	a.httpServer.Handler = mux
 	log.Info("Listener is successfully configured.")
 	return a, nil
 }
 
 // NewAuthServiceListener creates a new HTTP-server for /auth-endpoint. Open(ctx context.Context) must be invoked to listen.
-func NewAuthServiceListener(ctx context.Context, host, xForwardedUrlHeader string, port uint16, auth Authenticator) (*AuthServiceListener, error) {
-	return newAuthServiceListener(ctx, host, xForwardedUrlHeader, port, auth)
+// Request url is read from first header of xForwardedUrlHeaders, in order, with a value which is an absolute url.
+func NewAuthServiceListener(ctx context.Context, host string, xForwardedUrlHeaders []string, port uint16, auth Authenticator) (*AuthServiceListener, error) {
+	return newAuthServiceListener(ctx, host, xForwardedUrlHeaders, port, auth)
 }
 
-// Port returns port of running listener.
+// SetDrainPeriod sets period of which readiness is not ready before listener is closed on Drain. Must be invoked before
+// listener is started.
+func (a *AuthServiceListener) SetDrainPeriod(drainPeriod time.Duration) {
+	a.drainPeriod = drainPeriod
+}
+
+// SetStrictRequestURL rejects requests of which url headers, X-Forwarded-Host or X-Forwarded-Proto disagree on scheme
+// or host, or of which token headers disagree on token. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetStrictRequestURL(strict bool) {
+	a.strictRequestURL = strict
+}
+
+// SetMaxTokenLength rejects tokens longer than maxTokenLength before parsing, zero is defaultMaxTokenLength. Must be
+// invoked before listener is started.
+func (a *AuthServiceListener) SetMaxTokenLength(maxTokenLength int) {
+	if maxTokenLength <= 0 {
+		maxTokenLength = defaultMaxTokenLength
+	}
+	a.maxTokenLength = maxTokenLength
+}
+
+// File returns a duplicate of file descriptor of running listener, to be inherited by a replacement process
+// given i.e. exec.Cmd.ExtraFiles, and listened on given host fd://3. Caller must close file.
+func (a *AuthServiceListener) File() (*os.File, error) {
+	switch l := a.listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// Socket file is retained for replacement process when listener is closed.
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, ErrInvalidFileDescriptor
+}
+
+// Port returns port of running listener. Port is zero given unix domain socket.
 func (a *AuthServiceListener) Port() int {
 	return int(a.port.Load())
 }
 
-// ListenAndServe listener for incoming requests. Blocking.
-func (a *AuthServiceListener) ListenAndServe(_ context.Context) error {
+// listen on tcp given host and port, on unix domain socket given host as unix:///path/to/socket or on inherited
+// listener given host as fd://3, i.e. file descriptor passed by parent process for restart without downtime.
+func (a *AuthServiceListener) listen() error {
+	if fd, ok := strings.CutPrefix(a.host, fileDescriptorPrefix); ok {
+		n, err := strconv.ParseUint(fd, 10, 0)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidFileDescriptor, fd)
+		}
+		f := os.NewFile(uintptr(n), "listener")
+		defer f.Close()
+		// FileListener duplicates file descriptor, f is closed without closing listener.
+		l, err := net.FileListener(f)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidFileDescriptor, err)
+		}
+		a.listener = l
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			a.port.Store(uint32(addr.Port))
+		}
+		return nil
+	} else if path, ok := strings.CutPrefix(a.host, unixSocketPrefix); ok {
+		// Remove stale socket of a listener not gracefully closed, never a file of other type. Socket is removed when
+		// listener is closed.
+		if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSocket == 0 {
+			return fmt.Errorf("%w: %s is of mode %s", ErrNotUnixSocket, path, info.Mode())
+		} else if err == nil {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+		a.listener = l
+		return nil
+	}
 	port := a.port.Load()
 
 	if l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", a.host, port)); err != nil {
@@ -80,29 +288,31 @@ func (a *AuthServiceListener) ListenAndServe(_ context.Context) error {
 		a.listener = l
 		a.port.Store(uint32(l.Addr().(*net.TCPAddr).Port))
 	}
+	return nil
+}
+
+// ListenAndServe listener for incoming requests, with TLS given WithTLS. Blocking.
+func (a *AuthServiceListener) ListenAndServe(ctx context.Context) error {
+	if len(a.tlsCert) > 0 {
+		return a.ListenAndServeWithTLS(ctx, a.tlsKey, a.tlsCert)
+	}
+	if err := a.listen(); err != nil {
+		return err
+	}
+	a.ready.Store(true)
 	return a.httpServer.Serve(a.listener)
 }
 
 func (a *AuthServiceListener) ListenAndServeWithTLS(_ context.Context, key, cert []byte) error {
-	port := a.port.Load()
-
-	if l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", a.host, port)); err != nil {
+	if err := a.listen(); err != nil {
 		return err
-	} else {
-		a.listener = l
-		a.port.Store(uint32(l.Addr().(*net.TCPAddr).Port))
 	}
 	certificate, err := tls.X509KeyPair(cert, key)
 	if err != nil {
 		return err
 	}
-	config := &tls.Config{
-		MinVersion: tls.VersionTLS13,
-	}
-	config.NextProtos = append(config.NextProtos, "http/1.1")
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0] = certificate
-	listener := tls.NewListener(a.listener, config)
+	listener := tls.NewListener(a.listener, a.tlsPolicy.tlsConfig(certificate))
+	a.ready.Store(true)
 	return a.httpServer.Serve(listener)
 }
 
@@ -111,34 +321,594 @@ func (a *AuthServiceListener) Close(ctx context.Context) error {
 	return a.httpServer.Shutdown(ctx)
 }
 
+// Drain flips readiness to not ready and waits for drain period, allowing load balancers to deregister,
+// before closing listener. In-flight requests are allowed to complete. Blocking.
+func (a *AuthServiceListener) Drain(ctx context.Context) error {
+	a.ready.Store(false)
+	log.Infof("Draining listener. Readiness is not ready, closing listener in %s.", a.drainPeriod.String())
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(a.drainPeriod):
+	}
+	return a.httpServer.Shutdown(ctx)
+}
+
+// SetCORS configures cross-origin resource sharing for /auth. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetCORS(cors CORS) {
+	a.cors = cors
+}
+
+// SetAssertionSigner sets signed assertion of verified identity as X-Goog-Iap-Jwt-Assertion on response, of which
+// public keys are served on /iap-jwks. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetAssertionSigner(signer *AssertionSigner) {
+	a.assertions = signer
+}
+
+// SetBypassPaths allows requests of which path of request url has any prefix, or matches any pattern of path.Match, of
+// paths without authentication. Path is cleaned before matched. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetBypassPaths(paths []string) {
+	a.bypassPaths = paths
+}
+
+// isBypassed returns true given cleaned path of request url has any prefix or matches any pattern of bypass paths.
+func (a *AuthServiceListener) isBypassed(requestURL *url.URL) bool {
+	if len(a.bypassPaths) == 0 {
+		return false
+	}
+	cleaned := cleanPath(requestURL)
+	return slices.ContainsFunc(a.bypassPaths, func(bypass string) bool { return matchesPath(bypass, cleaned) })
+}
+
+// cleanPath returns path of request url of which traversal, i.e. /static/../admin, is resolved. Trailing slash is
+// retained.
+func cleanPath(requestURL *url.URL) string {
+	cleaned := path.Clean("/" + requestURL.Path)
+	if strings.HasSuffix(requestURL.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// matchesPath returns true given cleaned path has prefix, or matches pattern of path.Match given any of *?[, pattern.
+func matchesPath(pattern, cleaned string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, cleaned)
+		return ok
+	}
+	return strings.HasPrefix(cleaned, pattern)
+}
+
+// SetExemplars attaches trace id of sampled span context of request, of an instrumented handler or W3C traceparent
+// header, as exemplar of duration of /auth. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetExemplars(enabled bool) {
+	a.exemplars = enabled
+}
+
+// SetClaimsBundle sets base64 encoded JSON of selected claims of verified token on response as header of bundle, which
+// is removed from inbound request. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetClaimsBundle(bundle ClaimsBundle) {
+	a.claimsBundle = bundle
+}
+
+// SetClientCertificateHeader trusts header, as X-Forwarded-Client-Cert set by Envoy, of which identity of client certificate
+// is authorized given policy bindings, bypassing token verification. Gateway must terminate mTLS and overwrite header of
+// inbound requests. Authenticator must implement ClientCertificateAuthenticator. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetClientCertificateHeader(header string) {
+	a.clientCertificateHeader = header
+}
+
+// SetAuthMethods allows methods on /auth, GET by default. GET includes HEAD. Other methods are rejected with 405. Must
+// be invoked before listener is started.
+func (a *AuthServiceListener) SetAuthMethods(methods []string) {
+	a.authMethods = methods
+}
+
+// SetMaxBodyBytes rejects bodies of /auth exceeding maxBodyBytes with 413, zero rejects any body. Negative is unbounded,
+// default. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetMaxBodyBytes(maxBodyBytes int64) {
+	a.maxBodyBytes = maxBodyBytes
+}
+
+// restrictRequest rejects requests of which method is not allowed or body exceeds maximum size.
+func (a *AuthServiceListener) restrictRequest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(a.authMethods, r.Method) &&
+			!(r.Method == http.MethodHead && slices.Contains(a.authMethods, http.MethodGet)) {
+			w.Header().Set("Allow", strings.Join(a.authMethods, ", "))
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		} else if a.maxBodyBytes < 0 {
+			next(w, r)
+			return
+		}
+		// Content-Length is absent given chunked transfer encoding, body is read until limit.
+		if r.ContentLength > a.maxBodyBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		} else if _, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, a.maxBodyBytes)); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// KeepAlive is HTTP/1.1 keep-alive of connections of listener, i.e. of a proxy reusing connections for ForwardAuth.
+// Idle connections are closed after IdleTimeout, zero is no timeout. Disabled closes connections after each response.
+type KeepAlive struct {
+	Disabled    bool
+	IdleTimeout time.Duration
+}
+
+// SetKeepAlive configures keep-alive of connections, enabled without idle timeout by default. Must be invoked before
+// listener is started.
+func (a *AuthServiceListener) SetKeepAlive(keepAlive KeepAlive) {
+	a.httpServer.SetKeepAlivesEnabled(!keepAlive.Disabled)
+	a.httpServer.IdleTimeout = keepAlive.IdleTimeout
+}
+
+// SetDeviceHeader trusts header, a JSON object of device attributes set by gateway or endpoint verification, as variable
+// device of conditional expressions. Gateway must overwrite header of inbound requests, clients must never be able to
+// set header. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetDeviceHeader(header string) {
+	a.deviceHeader = header
+}
+
+// SetTrustForwardedProto trusts X-Forwarded-Proto, of which http or https overrides scheme of request url, i.e. given
+// TLS terminated by a load balancer in front of proxy. Scheme is used for audience and request.scheme of conditional
+// expressions. Given strict request url, a trusted X-Forwarded-Proto is never conflicting. Must be invoked before
+// listener is started.
+func (a *AuthServiceListener) SetTrustForwardedProto(trust bool) {
+	a.trustForwardedProto = trust
+}
+
+// SetRetryAfter sets header Retry-After, in seconds rounded up, on 503 given transient failure such that clients back off.
+// Must be invoked before listener is started.
+func (a *AuthServiceListener) SetRetryAfter(retryAfter time.Duration) {
+	a.retryAfter = retryAfter
+}
+
+// SetRequestBudget bounds authentication of each request, spanning token verification, policy lookup and evaluation
+// of conditional expressions. Exceeding budget is 503, request is not held on a slow upstream. Zero is unbounded.
+// Must be invoked before listener is started.
+func (a *AuthServiceListener) SetRequestBudget(budget time.Duration) {
+	a.requestBudget = budget
+}
+
+// withinBudget invokes authenticate given context bounded by request budget. Given budget is exceeded,
+// ErrRequestBudgetExceeded is returned without awaiting authenticate, which is cancelled given same context.
+func (a *AuthServiceListener) withinBudget(ctx context.Context,
+	authenticate func(ctx context.Context) (GoogleServiceAccount, error)) (GoogleServiceAccount, error) {
+	if a.requestBudget <= 0 {
+		return authenticate(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.requestBudget)
+	defer cancel()
+
+	type result struct {
+		identity GoogleServiceAccount
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		identity, err := authenticate(ctx)
+		done <- result{identity, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return res.identity, res.err
+		}
+	case <-ctx.Done():
+	}
+	a.metrics.IncCounter(ctx, MetricRequestBudgetExceeded)
+	log.WithField("reason", "timeout").Warningf("Authentication exceeded request budget of %s.", a.requestBudget)
+	return "", fmt.Errorf("%w: %s", ErrRequestBudgetExceeded, a.requestBudget)
+}
+
+// withDevice returns ctx holding device attributes given trusted device header of request.
+func (a *AuthServiceListener) withDevice(ctx context.Context, r *http.Request) (context.Context, error) {
+	if len(a.deviceHeader) == 0 {
+		return ctx, nil
+	}
+	header := r.Header.Get(a.deviceHeader)
+	if len(header) == 0 {
+		return ctx, nil
+	}
+	attributes, err := parseDeviceAttributes(header)
+	if err != nil {
+		return ctx, err
+	}
+	return WithDeviceAttributes(ctx, attributes), nil
+}
+
+// serviceUnavailable writes 503 given transient failure, with Retry-After if configured.
+func (a *AuthServiceListener) serviceUnavailable(w http.ResponseWriter) {
+	if a.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((a.retryAfter+time.Second-1)/time.Second)))
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// isAllowedOrigin verifies if origin is allowed given CORS.
+func (c CORS) isAllowedOrigin(origin string) bool {
+	return len(origin) > 0 && slices.ContainsFunc(c.AllowedOrigins, func(o string) bool {
+		return o == "*" || strings.EqualFold(o, origin)
+	})
+}
+
+// preflight answers CORS preflight requests of allowed origins, bypassing authentication.
+func (a *AuthServiceListener) preflight(w http.ResponseWriter, r *http.Request) {
+	var (
+		origin = r.Header.Get("Origin")
+		method = r.Header.Get("Access-Control-Request-Method")
+	)
+	switch {
+	case len(a.cors.AllowedOrigins) == 0:
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	case len(method) == 0:
+		// Not a preflight request.
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case !a.cors.isAllowedOrigin(origin),
+		!slices.ContainsFunc(a.cors.AllowedMethods, func(m string) bool { return strings.EqualFold(m, method) }):
+		log.Warningf("CORS preflight of origin %s and method %s is not allowed.", origin, method)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(a.cors.AllowedMethods, ", "))
+	if len(a.cors.AllowedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(a.cors.AllowedHeaders, ", "))
+	}
+	if a.cors.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(a.cors.MaxAge.Seconds())))
+	}
+	w.Header().Add("Vary", "Origin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (a *AuthServiceListener) healthz(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// SetHealthReporters reports health of components on /readyz. Unhealthy components degrade report, not readiness, such
+// that cached policy bindings and certificates are still served. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetHealthReporters(components ...HealthReporter) {
+	a.components = components
+}
+
+// Health returns health of listener and of each component.
+func (a *AuthServiceListener) Health() HealthReport {
+	report := HealthReport{Status: healthStatusOK, Components: make([]ComponentHealth, 0, len(a.components))}
+	for _, component := range a.components {
+		health := component.Health()
+		if !health.Healthy {
+			report.Status = healthStatusDegraded
+		}
+		report.Components = append(report.Components, health)
+	}
+	if !a.ready.Load() {
+		report.Status = healthStatusDraining
+	}
+	return report
+}
+
+func (a *AuthServiceListener) readyz(w http.ResponseWriter, r *http.Request) {
+	report := a.Health()
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == healthStatusDraining {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// extractToken returns value of first non-empty header of tokenHeaders. Given strictRequestURL, every non-empty value of
+// token headers must be equal.
+func (a *AuthServiceListener) extractToken(r *http.Request) (string, error) {
+	if a.strictRequestURL {
+		var first string
+		for _, header := range tokenHeaders {
+			for _, val := range r.Header.Values(header) {
+				if len(val) == 0 {
+					continue
+				} else if len(first) == 0 {
+					first = val
+				} else if val != first {
+					return "", fmt.Errorf("%w: %s disagrees with former token header", ErrAmbiguousToken, header)
+				}
+			}
+		}
+	}
+	tokenString, _ := tokenHeaders.ExtractToken(r)
+	return tokenString, nil
+}
+
+// bearerToken returns token of value of token header, of which prefix Bearer is case-insensitive and an optional
+// blank space following prefix is removed. False given no prefix. Independent of transport of value, i.e. given
+// gRPC authorization metadata.
+func bearerToken(val string) (string, bool) {
+	if len(val) < 7 || !strings.EqualFold(val[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(val[7:], " "), true
+}
+
+// requestURL returns value of first url header, in configured order, which parse as an absolute url. Forwarded host
+// headers are ignored unless strictRequestURL, of which any absolute url or forwarded host header must agree on audience.
+func (a *AuthServiceListener) requestURL(r *http.Request) (*url.URL, error) {
+	var first *url.URL
+
+	for _, header := range a.xForwardedUrlHeaders {
+		requestURL, err := url.Parse(r.Header.Get(header))
+		if err != nil || !requestURL.IsAbs() || len(requestURL.Host) == 0 {
+			continue
+		} else if first == nil {
+			first = requestURL
+		}
+		if !a.strictRequestURL {
+			break
+		} else if !strings.EqualFold(requestURL.Scheme, first.Scheme) || !strings.EqualFold(requestURL.Host, first.Host) {
+			return nil, fmt.Errorf("%w: header %s holds %s://%s, expected %s://%s", ErrConflictingRequestURL,
+				header, requestURL.Scheme, requestURL.Host, first.Scheme, first.Host)
+		}
+	}
+	if first == nil {
+		return nil, ErrMissingRequestURL
+	} else if !a.strictRequestURL {
+		return a.forwardedProto(r, first), nil
+	} else if host := r.Header.Get("X-Forwarded-Host"); len(host) > 0 && !strings.EqualFold(host, first.Host) {
+		return nil, fmt.Errorf("%w: header X-Forwarded-Host holds %s, expected %s", ErrConflictingRequestURL, host, first.Host)
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); !a.trustForwardedProto && len(proto) > 0 &&
+		!strings.EqualFold(proto, first.Scheme) {
+		// Trusted X-Forwarded-Proto overrides scheme rather than conflicts, i.e. given TLS terminated in front of proxy.
+		return nil, fmt.Errorf("%w: header X-Forwarded-Proto holds %s, expected %s", ErrConflictingRequestURL, proto, first.Scheme)
+	}
+	return a.forwardedProto(r, first), nil
+}
+
+// forwardedProto returns requestURL with scheme of X-Forwarded-Proto, given trustForwardedProto and header of http or
+// https. Else scheme of requestURL takes precedence.
+func (a *AuthServiceListener) forwardedProto(r *http.Request, requestURL *url.URL) *url.URL {
+	if !a.trustForwardedProto {
+		return requestURL
+	}
+	proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
+	if proto != "http" && proto != "https" {
+		return requestURL
+	}
+	forwarded := *requestURL
+	forwarded.Scheme = proto
+	return &forwarded
+}
+
 func (a *AuthServiceListener) auth(w http.ResponseWriter, r *http.Request) {
-	tokenString, _ := request.HeaderExtractor{"Proxy-Authorization", "Authorization"}.ExtractToken(r)
-	requestURL, err := url.Parse(r.Header.Get(a.xForwardedUrlHeader))
+	if a.denySource(w, r) {
+		return
+	}
+	defer func(start time.Time) {
+		ctx := r.Context()
+		if a.exemplars {
+			ctx = trace.ContextWithSpanContext(ctx, spanContext(r))
+		} else {
+			ctx = trace.ContextWithSpanContext(ctx, trace.SpanContext{})
+		}
+		a.metrics.ObserveHistogram(ctx, MetricAuthDuration, time.Since(start).Seconds())
+	}(time.Now())
+	// Inbound identity headers can't be trusted, prevent header injection of identity by client. Proxy forwards headers
+	// of client, identity headers are always set on response, empty without verified identity, i.e. of excluded host or
+	// bypassed path, such that headers of client are overwritten upstream.
+	for _, header := range identityHeaders {
+		r.Header.Del(header)
+		w.Header().Set(header, "")
+	}
+	if len(a.claimsBundle.Header) > 0 {
+		r.Header.Del(a.claimsBundle.Header)
+		w.Header().Set(a.claimsBundle.Header, "")
+	}
+	rctx := a.withRequestID(context.Background(), w, r)
+	if a.earlyHints {
+		// Interim responses are written on w, never of Server-Timing.
+		rctx = withEarlyHints(rctx, w)
+	}
+	if a.serverTiming {
+		var timing *serverTiming
+		rctx, timing = withServerTiming(rctx)
+		tw := &serverTimingWriter{ResponseWriter: w, timing: timing}
+		defer tw.setHeader()
+		w = tw
+	}
+	if origin := r.Header.Get("Origin"); a.cors.isAllowedOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	tokenString, err := a.extractToken(r)
+	if err != nil {
+		log.WithContext(rctx).WithField("error", err).Error("Token headers are conflicting.")
+		a.setDecisionReason(w, decisionReason(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	requestURL, err := a.requestURL(r)
+	if errors.Is(err, ErrConflictingRequestURL) {
+		log.WithContext(rctx).WithField("error", err).Error("Request url headers are conflicting.")
+		a.setDecisionReason(w, decisionReason(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err == nil && a.isBypassed(requestURL) {
+		log.WithContext(rctx).Debugf("Path of request url %s is bypassed.", requestURL.String())
+		a.setDecisionReason(w, "granted:bypass")
+		return
+	}
+	if len(a.clientCertificateHeader) > 0 && err == nil {
+		if header := r.Header.Get(a.clientCertificateHeader); len(header) > 0 {
+			a.authClientCertificate(rctx, w, r, header, requestURL)
+			return
+		}
+	}
 
 	switch {
 	case err != nil:
-	case len(requestURL.String()) == 0:
-	case len(tokenString) < 7:
-	case !strings.EqualFold(tokenString[:7], "bearer "):
+	case len(tokenString) > a.maxTokenLength:
+		// Reject before hashing and parsing of token.
+		a.metrics.IncCounter(rctx, MetricOversizedTokens)
+		err = fmt.Errorf("%w: token length %d exceeds %d", ErrTokenTooLong, len(tokenString), a.maxTokenLength)
 	default:
-		// Re-slice string that we remove Bearer: prefix - also remove an optional blank space if present.
-		tokenString = strings.TrimPrefix(tokenString[7:], " ")
-		goto authenticate
+		var ok bool
+		if tokenString, ok = bearerToken(tokenString); ok {
+			goto authenticate
+		}
+		err = ErrMissingBearerToken
 	}
-	log.WithField("error", err).Error("Failed to parse request url or token header value.")
+	log.WithContext(rctx).WithField("error", err).Error("Failed to parse request url or token header value.")
+	a.setDecisionReason(w, decisionReason(err))
 	w.WriteHeader(http.StatusUnauthorized)
 	return
 
 authenticate:
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(rctx)
+	defer cancel()
+
+	if ctx, err = a.withDevice(ctx, r); err != nil {
+		log.WithContext(rctx).WithField("error", err).Error("Failed to parse device header.")
+		a.setDecisionReason(w, decisionReason(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if ctx, err = a.withHeaderVariables(ctx, r); err != nil {
+		log.WithContext(rctx).WithField("error", err).Error("Failed to parse header variables.")
+		a.setDecisionReason(w, decisionReason(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	email, err := a.withinBudget(ctx, func(ctx context.Context) (GoogleServiceAccount, error) {
+		return a.authenticator.Authenticate(ctx, tokenString, *requestURL)
+	})
+	closeEarlyHints(rctx)
+	a.setDecisionReason(w, decisionReason(err))
+	if errors.Is(err, ErrEmailDomainNotAllowed) || errors.Is(err, ErrIdentityNotAllowed) ||
+		errors.Is(err, ErrNoIdentityAwareProxyRoleForUser) || errors.Is(err, ErrDeniedByPolicy) ||
+		errors.Is(err, ErrTooManyBindings) || errors.Is(err, ErrDeniedByRoute) {
+		// Legitimate denial of verified identity.
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if errors.Is(err, ErrParamsTooLarge) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if errors.Is(err, ErrPolicyBindingsUnavailable) || errors.Is(err, ErrRequestBudgetExceeded) {
+		// Transient failure, identity can't be authorized.
+		a.serviceUnavailable(w)
+		return
+	} else if errors.Is(err, jwt.ErrTokenExpired) {
+		// Hint client to refresh token rather than re-authenticate, RFC 6750 section 3.1.
+		w.Header().Set("WWW-Authenticate", tokenExpiredChallenge)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if errors.Is(err, ErrMissingIdentity) {
+		log.WithContext(rctx).WithFields(log.Fields{"reason": "missing_identity", "error": err}).Warning("Token has no identity.")
+		w.Header().Set("WWW-Authenticate", missingIdentityChallenge)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if len(email) == 0 {
+		return
+	}
+	if len(a.claimsBundle.Header) > 0 {
+		bundle, err := a.claimsBundle.encode(tokenString)
+		if err != nil {
+			log.WithContext(rctx).WithField("error", err).Error("Failed to encode claims bundle.")
+			a.setDecisionReason(w, "denied:claims_bundle")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(a.claimsBundle.Header, bundle)
+	}
+	a.setIdentity(w, email, requestURL)
+}
+
+// authClientCertificate authorizes identity of trusted client certificate header.
+func (a *AuthServiceListener) authClientCertificate(rctx context.Context, w http.ResponseWriter, r *http.Request, header string, requestURL *url.URL) {
+	authenticator, ok := a.authenticator.(ClientCertificateAuthenticator)
+	if !ok {
+		log.WithContext(rctx).Error("Authenticator does not support client certificate identity.")
+		a.setDecisionReason(w, "denied:client_certificate_unsupported")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	identity, err := clientCertificateIdentity(header)
+	if err != nil {
+		log.WithContext(rctx).WithField("error", err).Error("Failed to parse client certificate header.")
+		a.setDecisionReason(w, decisionReason(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ctx, cancel := context.WithCancel(rctx)
 	defer cancel()
 
-	if err := a.authenticator.Authenticate(ctx, tokenString, *requestURL); err != nil {
+	if ctx, err = a.withDevice(ctx, r); err != nil {
+		log.WithContext(rctx).WithField("error", err).Error("Failed to parse device header.")
+		a.setDecisionReason(w, decisionReason(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if ctx, err = a.withHeaderVariables(ctx, r); err != nil {
+		log.WithContext(rctx).WithField("error", err).Error("Failed to parse header variables.")
+		a.setDecisionReason(w, decisionReason(err))
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	identity, err = a.withinBudget(ctx, func(ctx context.Context) (GoogleServiceAccount, error) {
+		return authenticator.AuthenticateClientCertificate(ctx, identity, *requestURL)
+	})
+	closeEarlyHints(rctx)
+	a.setDecisionReason(w, decisionReason(err))
+	if errors.Is(err, ErrPolicyBindingsUnavailable) || errors.Is(err, ErrRequestBudgetExceeded) {
+		a.serviceUnavailable(w)
+		return
+	} else if errors.Is(err, ErrParamsTooLarge) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	a.setIdentity(w, identity, requestURL)
+}
+
+// setIdentity sets identity headers of verified identity.
+func (a *AuthServiceListener) setIdentity(w http.ResponseWriter, email GoogleServiceAccount, requestURL *url.URL) {
+	if a.assertions != nil {
+		assertion, err := a.assertions.Sign(email, fmt.Sprintf("%s://%s", requestURL.Scheme, requestURL.Host))
+		if err != nil {
+			log.WithField("error", err).Error("Failed to sign assertion.")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(headerIapJwtAssertion, assertion)
+	}
+	// Identity headers are only set given verified identity, prefix as set by Identity Aware Proxy.
+	w.Header().Set(headerAuthenticatedUserEmail, fmt.Sprintf("accounts.google.com:%s", email))
+}
+
+// jwks serves public keys of AssertionSigner for upstream to verify assertions.
+func (a *AuthServiceListener) jwks(w http.ResponseWriter, _ *http.Request) {
+	if a.assertions == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	jwks, err := a.assertions.JWKS()
+	if err != nil {
+		log.WithField("error", err).Error("Failed to marshal assertion jwks.")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(jwks)
 }
@@ -0,0 +1,949 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingAuthenticator blocks authentication until released.
+type blockingAuthenticator struct {
+	entered, release chan struct{}
+}
+
+func (b *blockingAuthenticator) Authenticate(_ context.Context, _ string, _ url.URL) (GoogleServiceAccount, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return "", nil
+}
+
+// startFakeAuthServiceListener starts listener on dynamic port given authenticator.
+func startFakeAuthServiceListener(t *testing.T, drainPeriod time.Duration, auth Authenticator) *AuthServiceListener {
+	t.Helper()
+	listener, err := newAuthServiceListener(context.Background(), "127.0.0.1", []string{"X-Original-URL"}, 0, auth)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	listener.SetDrainPeriod(drainPeriod)
+	go func() {
+		if err := listener.ListenAndServe(context.Background()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Unexpected error returned, error: %s.", err)
+		}
+	}()
+	for !listener.ready.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() { _ = listener.Close(context.Background()) })
+	return listener
+}
+
+func readyzStatusCode(t *testing.T, port int) int {
+	t.Helper()
+	rsp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/readyz", port))
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	_ = rsp.Body.Close()
+	return rsp.StatusCode
+}
+
+func TestDrainListener(t *testing.T) {
+	auth := &blockingAuthenticator{entered: make(chan struct{}), release: make(chan struct{})}
+	listener := startFakeAuthServiceListener(t, 200*time.Millisecond, auth)
+	port := listener.Port()
+
+	if code := readyzStatusCode(t, port); code != http.StatusOK {
+		t.Fatalf("Expected status code 200 OK before drain, status code %d was returned.", code)
+	}
+	inFlight := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/auth", port), nil)
+		req.Header.Set("Proxy-Authorization", "Bearer token")
+		req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		_ = rsp.Body.Close()
+		inFlight <- rsp.StatusCode
+	}()
+	<-auth.entered
+
+	drained := make(chan error, 1)
+	go func() { drained <- listener.Drain(context.Background()) }()
+
+	for listener.ready.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if code := readyzStatusCode(t, port); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status code 503 during drain, status code %d was returned.", code)
+	}
+	close(auth.release)
+
+	if code := <-inFlight; code != http.StatusOK {
+		t.Fatalf("Expected in-flight request to complete with 200 OK, status code %d was returned.", code)
+	} else if err := <-drained; err != nil {
+		t.Fatalf("Unexpected error returned from drain, error: %s.", err)
+	} else if _, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/readyz", port)); err == nil {
+		t.Fatal("Expected listener to be closed after drain.")
+	}
+}
+
+func BenchmarkAuthServiceWithFakes(b *testing.B) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"single":   "single@p.iam.gserviceaccount.com",
+			"multiple": "multiple@p.iam.gserviceaccount.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{
+			"single@p.iam.gserviceaccount.com":   {{}},
+			"multiple@p.iam.gserviceaccount.com": conditionalBindings(10, true),
+		}
+		cached   = newFakeAuthenticator(b, verifier, bindings, EmailDomainFilter{})
+		uncached = newFakeAuthenticator(b, verifier, bindings, EmailDomainFilter{})
+	)
+	uncached.cache = noopCache[GoogleServiceAccount]{}
+
+	var benchmarks = []struct {
+		name  string
+		auth  Authenticator
+		token string
+	}{
+		{"BenchmarkCacheHitWithSingleBinding", cached, "single"},
+		{"BenchmarkCacheMissWithSingleBinding", uncached, "single"},
+		{"BenchmarkCacheHitWithMultipleConditionalBindings", cached, "multiple"},
+		{"BenchmarkCacheMissWithMultipleConditionalBindings", uncached, "multiple"},
+	}
+	for _, bb := range benchmarks {
+		listener := newFakeAuthServiceListener(b, bb.auth)
+		// Warm up cache.
+		_ = doAuthRequest(listener, bb.token, "https://myurl.com/something")
+
+		b.Run(bb.name, func(b *testing.B) {
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if rsp := doAuthRequest(listener, bb.token, "https://myurl.com/something"); rsp.Code != http.StatusOK {
+					b.Fatalf("Expected status code 200 OK, status code %d was returned.", rsp.Code)
+				}
+			}
+		})
+	}
+}
+
+// recordingAuthenticator records request url of each authentication.
+type recordingAuthenticator struct {
+	requestUrls chan url.URL
+}
+
+func (r *recordingAuthenticator) Authenticate(_ context.Context, _ string, requestUrl url.URL) (GoogleServiceAccount, error) {
+	r.requestUrls <- requestUrl
+	return "", nil
+}
+
+func TestRequestUrlHeaders(t *testing.T) {
+	auth := &recordingAuthenticator{requestUrls: make(chan url.URL, 1)}
+	listener, _ := newAuthServiceListener(context.Background(), "127.0.0.1",
+		[]string{"X-Original-URL", "X-Original-URI", "X-Forwarded-Uri"}, 0, auth)
+
+	var tests = []struct {
+		name       string
+		headers    map[string]string
+		statusCode int
+		requestUrl string
+	}{
+		{"TestOriginalUrlHeader", map[string]string{"X-Original-URL": "https://a.com/a"}, http.StatusOK, "https://a.com/a"},
+		{"TestOriginalUriHeader", map[string]string{"X-Original-URI": "https://b.com/b"}, http.StatusOK, "https://b.com/b"},
+		{"TestForwardedUriHeader", map[string]string{"X-Forwarded-Uri": "https://c.com/c"}, http.StatusOK, "https://c.com/c"},
+		{"TestHeaderPrecedence", map[string]string{
+			"X-Original-URI":  "https://b.com/b",
+			"X-Forwarded-Uri": "https://c.com/c",
+		}, http.StatusOK, "https://b.com/b"},
+		{"TestFallbackFromRelativeUrl", map[string]string{
+			"X-Original-URL":  "/a",
+			"X-Original-URI":  "%%invalid",
+			"X-Forwarded-Uri": "https://c.com/c",
+		}, http.StatusOK, "https://c.com/c"},
+		{"TestNoAbsoluteUrl", map[string]string{"X-Original-URL": "/a", "X-Forwarded-Uri": "c.com"}, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			} else if tt.statusCode != http.StatusOK {
+				return
+			} else if requestUrl := <-auth.requestUrls; requestUrl.String() != tt.requestUrl {
+				t.Fatalf("Expected request url %s, request url %s was used.", tt.requestUrl, requestUrl.String())
+			}
+		})
+	}
+}
+
+func TestConflictingRequestUrlHeaders(t *testing.T) {
+	var (
+		headers = []string{"X-Original-URL", "X-Forwarded-Uri"}
+		auth    = &recordingAuthenticator{requestUrls: make(chan url.URL, 1)}
+		strict  = func() *AuthServiceListener {
+			listener, _ := newAuthServiceListener(context.Background(), "127.0.0.1", headers, 0, auth)
+			listener.SetStrictRequestURL(true)
+			return listener
+		}()
+		lenient = func() *AuthServiceListener {
+			listener, _ := newAuthServiceListener(context.Background(), "127.0.0.1", headers, 0, auth)
+			return listener
+		}()
+	)
+	var tests = []struct {
+		name       string
+		listener   *AuthServiceListener
+		headers    map[string]string
+		statusCode int
+		requestUrl string
+	}{
+		{"TestStrictAgreeingHeaders", strict, map[string]string{
+			"X-Original-URL":    "https://a.com/a",
+			"X-Forwarded-Uri":   "https://A.com/other",
+			"X-Forwarded-Host":  "a.com",
+			"X-Forwarded-Proto": "https",
+		}, http.StatusOK, "https://a.com/a"},
+		{"TestStrictRelativeHeaderIgnored", strict, map[string]string{
+			"X-Original-URL":  "https://a.com/a",
+			"X-Forwarded-Uri": "/b",
+		}, http.StatusOK, "https://a.com/a"},
+		{"TestStrictConflictingUrlHeaders", strict, map[string]string{
+			"X-Original-URL":  "https://a.com/a",
+			"X-Forwarded-Uri": "https://b.com/a",
+		}, http.StatusBadRequest, ""},
+		{"TestStrictConflictingForwardedHost", strict, map[string]string{
+			"X-Original-URL":   "https://a.com/a",
+			"X-Forwarded-Host": "b.com",
+		}, http.StatusBadRequest, ""},
+		{"TestStrictConflictingForwardedProto", strict, map[string]string{
+			"X-Original-URL":    "https://a.com/a",
+			"X-Forwarded-Proto": "http",
+		}, http.StatusBadRequest, ""},
+		{"TestLenientConflictingHeaders", lenient, map[string]string{
+			"X-Original-URL":   "https://a.com/a",
+			"X-Forwarded-Uri":  "https://b.com/a",
+			"X-Forwarded-Host": "c.com",
+		}, http.StatusOK, "https://a.com/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+			rec := httptest.NewRecorder()
+			tt.listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			} else if tt.statusCode != http.StatusOK {
+				return
+			} else if requestUrl := <-auth.requestUrls; requestUrl.String() != tt.requestUrl {
+				t.Fatalf("Expected request url %s, request url %s was used.", tt.requestUrl, requestUrl.String())
+			}
+		})
+	}
+}
+
+func TestTrustForwardedProto(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {
+			{Expression: "request.scheme == \"https\"", Title: "https"},
+		}}
+	)
+	var tests = []struct {
+		name       string
+		trusted    bool
+		requestUrl string
+		proto      string
+		statusCode int
+	}{
+		{"TestTrustedForwardedProtoTakesPrecedence", true, "http://myurl.com/hello", "https", http.StatusOK},
+		{"TestTrustedForwardedProtoDowngrade", true, "https://myurl.com/hello", "http", http.StatusUnauthorized},
+		{"TestInvalidForwardedProtoIsIgnored", true, "https://myurl.com/hello", "gopher", http.StatusOK},
+		{"TestUntrustedForwardedProtoIsIgnored", false, "http://myurl.com/hello", "https", http.StatusUnauthorized},
+		{"TestSchemeOfRequestUrl", false, "https://myurl.com/hello", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+			listener.SetTrustForwardedProto(tt.trusted)
+
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("Proxy-Authorization", "Bearer token")
+			req.Header.Set("X-Original-URL", tt.requestUrl)
+			if len(tt.proto) > 0 {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			}
+		})
+	}
+}
+
+func TestTrustForwardedProtoOfAudience(t *testing.T) {
+	var (
+		issuer   = newFakeOpenIDIssuer(t)
+		email    = "sa@p.iam.gserviceaccount.com"
+		bindings = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{}}}
+		// Token is minted for audience of scheme https, url header is of scheme http given TLS terminated before proxy.
+		idToken = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email})
+	)
+	var tests = []struct {
+		name       string
+		trusted    bool
+		strict     bool
+		proto      string
+		statusCode int
+	}{
+		{"TestAudienceOfTrustedForwardedProto", true, false, "https", http.StatusOK},
+		{"TestAudienceOfTrustedForwardedProtoGivenStrict", true, true, "https", http.StatusOK},
+		{"TestAudienceOfUntrustedForwardedProto", false, false, "https", http.StatusUnauthorized},
+		{"TestUntrustedForwardedProtoConflictsGivenStrict", false, true, "https", http.StatusBadRequest},
+		{"TestAudienceOfSchemeOfRequestUrl", true, false, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newFakeAuthenticator(t, issuer.newTokenService(t, PrincipalClaimEmail), bindings, EmailDomainFilter{})
+			listener, err := newAuthServiceListener(context.Background(), "127.0.0.1", []string{"X-Original-URL"}, 0, authenticator)
+			if err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			listener.SetStrictRequestURL(tt.strict)
+			listener.SetTrustForwardedProto(tt.trusted)
+
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("Proxy-Authorization", "Bearer "+idToken)
+			req.Header.Set("X-Original-URL", "http://myurl.com/hello")
+			if len(tt.proto) > 0 {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			}
+		})
+	}
+}
+
+func TestSpoofedIdentityHeaders(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"authorized":   "sa@p.iam.gserviceaccount.com",
+			"unauthorized": "unauthorized@p.iam.gserviceaccount.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+	)
+	listener.SetBypassPaths([]string{"/public"})
+
+	var tests = []struct {
+		name       string
+		token      string
+		requestUrl string
+		statusCode int
+		email      string
+	}{
+		{"TestSpoofedIdentityHeaderIsOverwritten", "authorized", "https://myurl.com/hello", http.StatusOK,
+			"accounts.google.com:sa@p.iam.gserviceaccount.com"},
+		{"TestSpoofedIdentityHeaderOfDeniedUserIsEmpty", "unauthorized", "https://myurl.com/hello", http.StatusForbidden, ""},
+		// Upstream is given response headers of a granted request without identity, these must overwrite headers of client.
+		{"TestSpoofedIdentityHeaderOfBypassedPathIsEmpty", "", "https://myurl.com/public/index.html", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			if len(tt.token) > 0 {
+				req.Header.Set("Proxy-Authorization", "Bearer "+tt.token)
+			}
+			req.Header.Set("X-Original-URL", tt.requestUrl)
+			for _, header := range identityHeaders {
+				req.Header.Set(header, "accounts.google.com:spoofed@example.com")
+			}
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			}
+			for _, header := range identityHeaders {
+				expected := ""
+				if header == headerAuthenticatedUserEmail {
+					expected = tt.email
+				}
+				if vals := rec.Header().Values(header); len(vals) != 1 || vals[0] != expected {
+					t.Fatalf("Expected identity header %s of response to be %q, %q was returned.", header, expected, vals)
+				}
+			}
+		})
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "open-iap.sock")
+	listener, err := newAuthServiceListener(context.Background(), "unix://"+socket, []string{"X-Original-URL"}, 0,
+		&recordingAuthenticator{})
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	go func() {
+		if err := listener.ListenAndServe(context.Background()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Unexpected error returned, error: %s.", err)
+		}
+	}()
+	for !listener.ready.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	rsp, err := client.Get("http://unix/healthz")
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	_ = rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200 OK, status code %d was returned.", rsp.StatusCode)
+	}
+	if err = listener.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	if _, err = os.Stat(socket); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected socket %s to be removed on close, error: %v.", socket, err)
+	}
+}
+
+func TestUnixSocketListenerPath(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		regular = filepath.Join(dir, "regular")
+		stale   = filepath.Join(dir, "stale.sock")
+	)
+	if err := os.WriteFile(regular, []byte("data"), 0o600); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	// Socket of a listener not gracefully closed.
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+
+	var tests = []struct {
+		name  string
+		path  string
+		error error
+	}{
+		{"TestRegularFileIsNotRemoved", regular, ErrNotUnixSocket},
+		{"TestDirectoryIsNotRemoved", dir, ErrNotUnixSocket},
+		{"TestStaleSocketIsRemoved", stale, nil},
+		{"TestAbsentSocketIsCreated", filepath.Join(dir, "absent.sock"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := newAuthServiceListener(context.Background(), "unix://"+tt.path, []string{"X-Original-URL"}, 0,
+				&recordingAuthenticator{})
+			if err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			if err = listener.listen(); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.error, err)
+			} else if err == nil {
+				_ = listener.listener.Close()
+			}
+		})
+	}
+	if data, err := os.ReadFile(regular); err != nil || string(data) != "data" {
+		t.Fatalf("Expected regular file %s to be retained, error: %v.", regular, err)
+	}
+}
+
+func TestOversizedToken(t *testing.T) {
+	var (
+		verifier      = &fakeTokenVerifier{emails: map[string]string{}}
+		authenticator = newFakeAuthenticator(t, verifier, fakeIdentityAccessManagementReader{}, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		oversized     = testutil.ToFloat64(oversizedTokensCounter)
+	)
+	if rsp := doAuthRequest(listener, strings.Repeat("a", defaultMaxTokenLength), "https://myurl.com/hello"); rsp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code 401 Unauthorized, status code %d was returned.", rsp.Code)
+	} else if calls := verifier.calls.Load(); calls != 0 {
+		t.Fatalf("Expected oversized token to be rejected before verification, %d verifications were made.", calls)
+	} else if val := testutil.ToFloat64(oversizedTokensCounter); val != oversized+1 {
+		t.Fatalf("Expected oversized token to be counted once, got %f.", val-oversized)
+	}
+	// Token within maximum length, including Bearer prefix, is verified.
+	if rsp := doAuthRequest(listener, strings.Repeat("a", defaultMaxTokenLength-len("Bearer ")), "https://myurl.com/hello"); rsp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code 401 Unauthorized, status code %d was returned.", rsp.Code)
+	} else if calls := verifier.calls.Load(); calls != 1 {
+		t.Fatalf("Expected token within maximum length to be verified, %d verifications were made.", calls)
+	}
+}
+
+func TestInheritedListenerFileDescriptor(t *testing.T) {
+	parent := startFakeAuthServiceListener(t, 0, &recordingAuthenticator{})
+	f, err := parent.File()
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	defer f.Close()
+
+	child, err := newAuthServiceListener(context.Background(), fmt.Sprintf("fd://%d", f.Fd()),
+		[]string{"X-Original-URL"}, 0, &recordingAuthenticator{})
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	go func() {
+		if err := child.ListenAndServe(context.Background()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Unexpected error returned, error: %s.", err)
+		}
+	}()
+	for !child.ready.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer child.Close(context.Background())
+
+	if child.Port() != parent.Port() {
+		t.Fatalf("Expected inherited listener on port %d, port %d was given.", parent.Port(), child.Port())
+	} else if err = parent.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	// Parent is closed, requests are served by child on same port.
+	rsp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/healthz", child.Port()))
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	_ = rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200 OK, status code %d was returned.", rsp.StatusCode)
+	}
+}
+
+func TestInvalidListenerFileDescriptor(t *testing.T) {
+	listener, _ := newAuthServiceListener(context.Background(), "fd://invalid", []string{"X-Original-URL"}, 0,
+		&recordingAuthenticator{})
+	if err := listener.ListenAndServe(context.Background()); !errors.Is(err, ErrInvalidFileDescriptor) {
+		t.Fatalf("Expected error %v, error %v was returned.", ErrInvalidFileDescriptor, err)
+	}
+}
+
+func TestPolicyBindingErrorStatusCodes(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"authorized":   "authorized@p.iam.gserviceaccount.com",
+			"unauthorized": "unauthorized@p.iam.gserviceaccount.com",
+		}}
+		// Policy bindings are never refreshed, i.e. given failure of IAM API since start.
+		unavailable, _ = newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+		loaded, fake   = newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+	)
+	fake.setBindings(http.StatusOK, &cloudresourcemanager.Binding{
+		Role:    iapWebPermission,
+		Members: []string{"serviceAccount:authorized@p.iam.gserviceaccount.com"},
+	})
+	if err := loaded.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var tests = []struct {
+		name       string
+		iamClient  IdentityAccessManagementReader
+		token      string
+		statusCode int
+	}{
+		{"TestAuthorizedIdentity", loaded, "authorized", http.StatusOK},
+		{"TestNoBindingsForIdentity", loaded, "unauthorized", http.StatusForbidden},
+		{"TestPolicyBindingsUnavailable", unavailable, "authorized", http.StatusServiceUnavailable},
+		{"TestUnverifiedToken", loaded, "invalid", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, tt.iamClient, EmailDomainFilter{}))
+			if rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"authorized": "authorized@p.iam.gserviceaccount.com"}}
+		// Policy bindings are never refreshed, i.e. given failure of IAM API since start.
+		unavailable, _ = newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+		bindings       = fakeIdentityAccessManagementReader{"authorized@p.iam.gserviceaccount.com": {{}}}
+	)
+	var tests = []struct {
+		name       string
+		iamClient  IdentityAccessManagementReader
+		retryAfter time.Duration
+		statusCode int
+		header     string
+	}{
+		{"TestRetryAfterInSeconds", unavailable, 30 * time.Second, http.StatusServiceUnavailable, "30"},
+		{"TestRetryAfterIsRoundedUp", unavailable, 1500 * time.Millisecond, http.StatusServiceUnavailable, "2"},
+		{"TestRetryAfterDisabled", unavailable, 0, http.StatusServiceUnavailable, ""},
+		{"TestNoRetryAfterGivenSuccess", bindings, 30 * time.Second, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, tt.iamClient, EmailDomainFilter{}))
+			listener.SetRetryAfter(tt.retryAfter)
+
+			rsp := doAuthRequest(listener, "authorized", "https://myurl.com/hello")
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if header := rsp.Header().Get("Retry-After"); header != tt.header {
+				t.Fatalf("Expected Retry-After %q, Retry-After %q was returned.", tt.header, header)
+			}
+		})
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"authorized": "authorized@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"authorized@p.iam.gserviceaccount.com": {{}}}
+	)
+	var tests = []struct {
+		name       string
+		delay      time.Duration
+		budget     time.Duration
+		statusCode int
+		exceeded   float64
+	}{
+		{"TestSlowPolicyLookupExceedsBudget", 500 * time.Millisecond, 50 * time.Millisecond, http.StatusServiceUnavailable, 1},
+		{"TestPolicyLookupWithinBudget", 0, time.Second, http.StatusOK, 0},
+		{"TestUnboundedBudget", 100 * time.Millisecond, 0, http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iamClient := slowIdentityAccessManagementReader{bindings, tt.delay}
+			listener := newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, iamClient, EmailDomainFilter{}))
+			listener.SetRequestBudget(tt.budget)
+			before := testutil.ToFloat64(requestBudgetExceededCounter)
+
+			start := time.Now()
+			rsp := doAuthRequest(listener, "authorized", "https://myurl.com/hello")
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if val := testutil.ToFloat64(requestBudgetExceededCounter) - before; val != tt.exceeded {
+				t.Fatalf("Expected %f requests exceeding budget, %f were counted.", tt.exceeded, val)
+			} else if elapsed := time.Since(start); tt.exceeded > 0 && elapsed >= tt.delay {
+				t.Fatalf("Expected response given budget of %s, response was given after %s.", tt.budget, elapsed)
+			}
+		})
+	}
+}
+
+func TestAuthMethodsAndBodyLimit(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+	)
+	listener.SetAuthMethods([]string{http.MethodGet, http.MethodPost})
+	listener.SetMaxBodyBytes(16)
+
+	var tests = []struct {
+		name       string
+		method     string
+		body       io.Reader
+		statusCode int
+	}{
+		{"TestGet", http.MethodGet, nil, http.StatusOK},
+		{"TestHeadGivenGet", http.MethodHead, nil, http.StatusOK},
+		{"TestAllowedMethodWithBody", http.MethodPost, strings.NewReader("small"), http.StatusOK},
+		{"TestDisallowedMethod", http.MethodDelete, nil, http.StatusMethodNotAllowed},
+		{"TestOversizedBody", http.MethodPost, strings.NewReader(strings.Repeat("a", 17)), http.StatusRequestEntityTooLarge},
+		// Content-Length is unknown, body is read until limit.
+		{"TestOversizedChunkedBody", http.MethodPost, io.MultiReader(strings.NewReader(strings.Repeat("a", 64))),
+			http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/auth", tt.body)
+			req.Header.Set("Proxy-Authorization", "Bearer token")
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			rsp := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rsp, req)
+
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if allow := rsp.Header().Get("Allow"); tt.statusCode == http.StatusMethodNotAllowed && allow != "GET, POST" {
+				t.Fatalf("Expected Allow %q, Allow %q was returned.", "GET, POST", allow)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	var (
+		verifier      = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		authenticator = newFakeAuthenticator(t, verifier, fakeIdentityAccessManagementReader{
+			"sa@p.iam.gserviceaccount.com": {{}},
+		}, EmailDomainFilter{})
+		enabled  = newFakeAuthServiceListener(t, authenticator)
+		disabled = newFakeAuthServiceListener(t, authenticator)
+	)
+	enabled.SetCORS(CORS{
+		AllowedOrigins: []string{"https://app.myurl.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Authorization"},
+		MaxAge:         10 * time.Minute,
+	})
+	var tests = []struct {
+		name        string
+		listener    *AuthServiceListener
+		method      string
+		headers     map[string]string
+		statusCode  int
+		allowOrigin string
+	}{
+		{"TestPreflightOfAllowedOrigin", enabled, "OPTIONS", map[string]string{
+			"Origin":                        "https://app.myurl.com",
+			"Access-Control-Request-Method": "POST",
+		}, http.StatusNoContent, "https://app.myurl.com"},
+		{"TestPreflightOfOtherOrigin", enabled, "OPTIONS", map[string]string{
+			"Origin":                        "https://evil.com",
+			"Access-Control-Request-Method": "POST",
+		}, http.StatusForbidden, ""},
+		{"TestPreflightOfOtherMethod", enabled, "OPTIONS", map[string]string{
+			"Origin":                        "https://app.myurl.com",
+			"Access-Control-Request-Method": "DELETE",
+		}, http.StatusForbidden, ""},
+		{"TestPreflightWithCORSDisabled", disabled, "OPTIONS", map[string]string{
+			"Origin":                        "https://app.myurl.com",
+			"Access-Control-Request-Method": "POST",
+		}, http.StatusMethodNotAllowed, ""},
+		{"TestAuthenticatedRequestOfAllowedOrigin", enabled, "GET", map[string]string{
+			"Origin":         "https://app.myurl.com",
+			"Authorization":  "Bearer token",
+			"X-Original-URL": "https://myurl.com/hello",
+		}, http.StatusOK, "https://app.myurl.com"},
+		{"TestUnauthenticatedRequestOfAllowedOrigin", enabled, "GET", map[string]string{
+			"Origin":         "https://app.myurl.com",
+			"X-Original-URL": "https://myurl.com/hello",
+		}, http.StatusUnauthorized, "https://app.myurl.com"},
+		{"TestAuthenticatedRequestOfOtherOrigin", enabled, "GET", map[string]string{
+			"Origin":         "https://evil.com",
+			"Authorization":  "Bearer token",
+			"X-Original-URL": "https://myurl.com/hello",
+		}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/auth", nil)
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+			rec := httptest.NewRecorder()
+			tt.listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			} else if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != tt.allowOrigin {
+				t.Fatalf("Expected header Access-Control-Allow-Origin %q, %q was returned.", tt.allowOrigin, origin)
+			} else if tt.statusCode == http.StatusNoContent && rec.Header().Get("Access-Control-Max-Age") != "600" {
+				t.Fatalf("Expected header Access-Control-Max-Age 600, %q was returned.", rec.Header().Get("Access-Control-Max-Age"))
+			}
+		})
+	}
+}
+
+func TestTokenHeaderPrecedence(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"proxy":    "proxy@p.iam.gserviceaccount.com",
+			"upstream": "upstream@p.iam.gserviceaccount.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{"proxy@p.iam.gserviceaccount.com": {
+			{Expression: "true", Title: "proxy"},
+		}}
+	)
+	var tests = []struct {
+		name       string
+		strict     bool
+		headers    [][2]string
+		statusCode int
+	}{
+		{"TestProxyAuthorizationPrecedesAuthorization", false, [][2]string{
+			{"Proxy-Authorization", "Bearer proxy"}, {"Authorization", "Bearer upstream"},
+		}, http.StatusOK},
+		{"TestAuthorizationGivenNoProxyAuthorization", false, [][2]string{
+			{"Authorization", "Bearer upstream"},
+		}, http.StatusForbidden},
+		{"TestStrictDisagreeingTokenHeaders", true, [][2]string{
+			{"Proxy-Authorization", "Bearer proxy"}, {"Authorization", "Bearer upstream"},
+		}, http.StatusBadRequest},
+		{"TestStrictRepeatedTokenHeader", true, [][2]string{
+			{"Proxy-Authorization", "Bearer proxy"}, {"Proxy-Authorization", "Bearer upstream"},
+		}, http.StatusBadRequest},
+		{"TestStrictAgreeingTokenHeaders", true, [][2]string{
+			{"Proxy-Authorization", "Bearer proxy"}, {"Authorization", "Bearer proxy"},
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+			listener.strictRequestURL = tt.strict
+
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("X-Original-URL", "https://a.com/a")
+			for _, header := range tt.headers {
+				req.Header.Add(header[0], header[1])
+			}
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	var tests = []struct {
+		name  string
+		val   string
+		token string
+		ok    bool
+	}{
+		{"TestBearerPrefix", "Bearer token", "token", true},
+		{"TestLowercasePrefix", "bearer token", "token", true},
+		{"TestUppercasePrefix", "BEARER token", "token", true},
+		{"TestDoubleBlankSpace", "Bearer  token", "token", true},
+		{"TestNoPrefix", "token", "", false},
+		{"TestOtherScheme", "Basic dXNlcjpwYXNz", "", false},
+		{"TestPrefixWithoutBlankSpace", "Bearertoken", "", false},
+		{"TestEmpty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if token, ok := bearerToken(tt.val); token != tt.token || ok != tt.ok {
+				t.Fatalf("Expected token %q and %t, token %q and %t was returned.", tt.token, tt.ok, token, ok)
+			}
+		})
+	}
+}
+
+func TestBypassPaths(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {
+			{Expression: "request.path.startsWith(\"/hello\")", Title: "hello"},
+		}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+	)
+	listener.SetBypassPaths([]string{"/healthz", "/static/", "/assets/*.css"})
+
+	var tests = []struct {
+		name       string
+		token      string
+		requestUrl string
+		statusCode int
+	}{
+		{"TestBypassedPrefixWithoutToken", "", "https://myurl.com/healthz", http.StatusOK},
+		{"TestBypassedNestedPrefixWithoutToken", "", "https://myurl.com/static/js/app.js", http.StatusOK},
+		{"TestBypassedPatternWithoutToken", "", "https://myurl.com/assets/site.css", http.StatusOK},
+		{"TestNonMatchingPatternWithoutToken", "", "https://myurl.com/assets/site.js", http.StatusUnauthorized},
+		{"TestTraversalOutOfBypassedPrefix", "", "https://myurl.com/static/../admin", http.StatusUnauthorized},
+		{"TestNonBypassedPathWithoutToken", "", "https://myurl.com/admin", http.StatusUnauthorized},
+		{"TestNonBypassedPathWithToken", "token", "https://myurl.com/hello", http.StatusOK},
+		{"TestNonBypassedPathWithoutBinding", "token", "https://myurl.com/admin", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			if len(tt.token) > 0 {
+				req.Header.Set("Proxy-Authorization", "Bearer "+tt.token)
+			}
+			req.Header.Set("X-Original-URL", tt.requestUrl)
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			} else if len(tt.token) == 0 && len(rec.Header().Get(headerAuthenticatedUserEmail)) > 0 {
+				t.Fatal("Expected no identity header given bypassed path.")
+			}
+		})
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	var tests = []struct {
+		name      string
+		keepAlive KeepAlive
+		closed    bool
+	}{
+		{"TestKeepAliveByDefault", KeepAlive{}, false},
+		{"TestKeepAliveWithIdleTimeout", KeepAlive{IdleTimeout: time.Minute}, false},
+		{"TestKeepAliveDisabled", KeepAlive{Disabled: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := NewAuthServiceListenerWithConfig(context.Background(), ListenerConfig{Host: "127.0.0.1"},
+				newFakeAuthenticator(t, &fakeTokenVerifier{}, fakeIdentityAccessManagementReader{}, EmailDomainFilter{}),
+				WithKeepAlive(tt.keepAlive))
+			if err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			go func() { _ = listener.ListenAndServe(context.Background()) }()
+			for !listener.ready.Load() {
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Cleanup(func() { _ = listener.Close(context.Background()) })
+
+			rsp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/healthz", listener.Port()))
+			if err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			_ = rsp.Body.Close()
+			if rsp.Close != tt.closed {
+				t.Fatalf("Expected connection closed %t, connection closed %t was given.", tt.closed, rsp.Close)
+			} else if listener.httpServer.IdleTimeout != tt.keepAlive.IdleTimeout {
+				t.Fatalf("Expected idle timeout %s, idle timeout %s was given.", tt.keepAlive.IdleTimeout,
+					listener.httpServer.IdleTimeout)
+			}
+		})
+	}
+}
@@ -36,12 +36,12 @@ func newAuthServiceListenerWithClient(ctx context.Context, tlsMode bool) (*AuthS
 		return nil, nil, err
 	}
 	log.Info("Creating Google Workspace client.")
-	gwsClient, err := NewGoogleWorkspaceClient(ctx, credentials)
+	gwsClient, err := NewGoogleWorkspaceClient(ctx, credentials, nil)
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google Workspace client.")
 		return nil, nil, err
 	}
-	iamClient, err := NewIdentityAccessManagementClient(ctx, gwsClient, credentials, 5*time.Minute)
+	iamClient, err := NewIdentityAccessManagementClient(ctx, gwsClient, credentials, 5*time.Minute, BindingDropGuard{}, nil, StartupDeadline{})
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google Cloud IAM-policy client.")
 		return nil, nil, err
@@ -49,19 +49,19 @@ func newAuthServiceListenerWithClient(ctx context.Context, tlsMode bool) (*AuthS
 	log.Info("Creating Google Cloud token service.")
 	tokenService, err := NewGoogleTokenService(ctx,
 		cache.NewExpiryCache[keyfunc.Keyfunc](ctx, 1*time.Minute),
-		1*time.Minute, 1*time.Minute)
+		1*time.Minute, 1*time.Minute, PrincipalClaimEmail, nil)
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google Cloud token service.")
 		return nil, nil, err
 	}
 	log.Info("Creating Google Cloud authenticator service.")
 	authenticator, err := NewGoogleCloudTokenAuthenticator(tokenService,
-		cache.NewExpiryCache[GoogleServiceAccount](ctx, 1*time.Minute), iamClient, gwsClient, nil)
+		cache.NewExpiryCache[GoogleServiceAccount](ctx, 1*time.Minute), iamClient, gwsClient, nil, EmailDomainFilter{}, 50*time.Millisecond, FailOpen{})
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google Cloud authenticator service.")
 		return nil, nil, err
 	}
-	listener, err := NewAuthServiceListener(ctx, "0.0.0.0", "X-Original-URL", 0, authenticator)
+	listener, err := NewAuthServiceListener(ctx, "0.0.0.0", []string{"X-Original-URL"}, 0, authenticator)
 	if err != nil {
 		return nil, nil, err
 	}
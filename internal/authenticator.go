@@ -4,17 +4,23 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/anderslauri/open-iap/internal/cache"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"maps"
 	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Authenticator is generic interface for authentication.
 type Authenticator interface {
-	Authenticate(ctx context.Context, credentials string, requestUrl url.URL) error
+	Authenticate(ctx context.Context, credentials string, requestUrl url.URL) (GoogleServiceAccount, error)
 }
 
 // GoogleCloudTokenAuthenticator is an implementation of Authenticator interface.
@@ -24,98 +30,745 @@ type GoogleCloudTokenAuthenticator struct {
 	gwsClient     GoogleWorkspaceClientReader
 	cache         cache.Cache[string, cache.ExpiryCacheValue[GoogleServiceAccount]]
 	excludedHosts []url.URL
+	emailDomains  EmailDomainFilter
+	timingHook    TimingHook
+	auditSink     AuditSink
+	accessLevels  AccessLevelResolver
+	emptyPolicy   EmptyPolicy
+	denyPolicies  DenyPolicyReader
+	// identityResolver maps verified identity before binding lookup, nil retains verified identity.
+	identityResolver IdentityResolver
+	// tokenFingerprints includes truncated SHA-256 of token in audit records and decision logs.
+	tokenFingerprints bool
+	// metricHosts are hosts labeled verbatim on decision metrics, other hosts are labeled other.
+	metricHosts map[string]struct{}
+	// decisions caches granted decisions of conditional bindings, value is refresh of policy bindings evaluated.
+	decisions cache.Cache[string, cache.ExpiryCacheValue[time.Time]]
+	// evaluateTimeConditions bypasses decision cache given bindings of which conditions depend on time.
+	evaluateTimeConditions bool
+	decisionTTL            time.Duration
+	// negatives caches identities without policy bindings, value is refresh of policy bindings looked up.
+	negatives   cache.Cache[string, cache.ExpiryCacheValue[time.Time]]
+	negativeTTL time.Duration
+	// conditionResults caches results of conditional expressions per hash of expression and params, bucketed by
+	// conditionBucket seconds of request.time.
+	conditionResults cache.Cache[string, cache.ExpiryCacheValue[bool]]
+	conditionBucket  int64
+	// bindingTitles labels duration of evaluation of conditional expressions by title of binding, none given nil.
+	bindingTitles *titleLabels
+	// aliases caches primary and alias emails of users given aliasReader, nil matches email itself only.
+	aliasReader   GoogleWorkspaceAliasReader
+	aliases       cache.Cache[string, cache.ExpiryCacheValue[[]GoogleServiceAccount]]
+	aliasTTL      time.Duration
+	failOpen      FailOpen
+	verifications singleflight.Group
+	// staleWhileRevalidate serves cached identity for window past expiry while token is re-verified. Zero is disabled.
+	staleWhileRevalidate time.Duration
+	// maxCacheTTL caps lifetime of verified tokens in cache, by audience given audienceCacheTTL. Zero is uncapped.
+	maxCacheTTL      time.Duration
+	audienceCacheTTL map[string]time.Duration
+	// paramLimits bounds size of params of conditional expressions.
+	paramLimits ParamLimits
+	// conditionTimeout is deadline for evaluation of conditional expressions per request, zero is no deadline.
+	conditionTimeout time.Duration
+	// maxBindings is maximum conditional bindings evaluated per request. Zero is unbounded.
+	maxBindings int
+	// shadowReader is candidate source of policy bindings, decisions are compared with live decisions only.
+	shadowReader IdentityAccessManagementReader
+	// resources maps host of request url to target resource of conditional expressions.
+	resources map[string]Resource
+	// identityPatterns are lowercase patterns of path.Match of which verified identity must match any, empty is any.
+	identityPatterns []string
+	// routes are static rules of routes of RoutePolicy, combined with policy bindings given routeMode.
+	routes    []routeRule
+	routeMode RouteMode
+	// replays tracks jti of used tokens for replayMaxWindow at most, lookup and write are guarded by replayMu.
+	replays         cache.Cache[string, cache.ExpiryCacheValue[time.Time]]
+	replayMaxWindow time.Duration
+	replayMu        sync.Mutex
 }
 
-// ErrInvalidGoogleCloudAuthentication is given as a general error when Authenticate(...) is not successful.
-var ErrInvalidGoogleCloudAuthentication = errors.New("invalid google cloud authentication")
+// writeCache writes cache entries off path of request. Replaced by a synchronous write in tests.
+var writeCache = func(set func()) { go set() }
+
+// FailOpen allows requests of which policy bindings are unavailable when policy bindings have not been successfully
+// refreshed within StaleAfter, i.e. given an outage of IAM API. Denials given loaded policy bindings are never allowed.
+// Off by default, every such request is audit logged.
+type FailOpen struct {
+	Enabled    bool
+	StaleAfter time.Duration
+}
+
+// EmptyPolicy is behavior given project has no policy bindings for Identity Aware Proxy, i.e. misconfiguration.
+type EmptyPolicy string
+
+const (
+	// EmptyPolicyDeny denies every request given empty policy, default.
+	EmptyPolicyDeny EmptyPolicy = "deny"
+	// EmptyPolicyAllow allows every verified identity given empty policy.
+	EmptyPolicyAllow EmptyPolicy = "allow"
+)
+
+// Operation is a sub-operation of Authenticate observed by TimingHook.
+type Operation string
+
+const (
+	// OperationCacheLookup is lookup of verified token in cache.
+	OperationCacheLookup Operation = "cache_lookup"
+	// OperationVerifyToken is verification of token validity, signature and audience.
+	OperationVerifyToken Operation = "verify_token"
+	// OperationLoadBindings is lookup of policy role bindings for identity.
+	OperationLoadBindings Operation = "load_bindings"
+	// OperationEvaluateConditions is evaluation of conditional expressions of policy role bindings.
+	OperationEvaluateConditions Operation = "evaluate_conditions"
+)
+
+// TimingHook is invoked with latency of each sub-operation of Authenticate. Must be safe for concurrent use.
+type TimingHook func(ctx context.Context, operation Operation, elapsed time.Duration)
+
+// EmailDomainFilter is a coarse gate of email domains applied before evaluation of role bindings.
+// Denied takes precedence over Allowed. An empty Allowed permits all domains not denied. Federated principals have
+// no email domain and are not filtered.
+type EmailDomainFilter struct {
+	Allowed []string
+	Denied  []string
+}
+
+var (
+	// ErrInvalidGoogleCloudAuthentication is given as a general error when Authenticate(...) is not successful.
+	ErrInvalidGoogleCloudAuthentication = errors.New("invalid google cloud authentication")
+	// ErrEmailDomainNotAllowed is given when email domain of identity is not permitted by EmailDomainFilter.
+	ErrEmailDomainNotAllowed = errors.New("email domain not allowed")
+	// ErrTooManyBindings is given when conditional bindings of identity exceed maximum bindings evaluated per request.
+	ErrTooManyBindings = errors.New("too many conditional bindings")
+)
 
 // NewGoogleCloudTokenAuthenticator returns an implementation of interface Authenticator
-func NewGoogleCloudTokenAuthenticator(v TokenVerifier[*GoogleTokenClaims], c cache.Cache[string, cache.ExpiryCacheValue[GoogleServiceAccount]], i IdentityAccessManagementReader, g GoogleWorkspaceClientReader, e []url.URL) (*GoogleCloudTokenAuthenticator, error) {
+func NewGoogleCloudTokenAuthenticator(v TokenVerifier[*GoogleTokenClaims], c cache.Cache[string, cache.ExpiryCacheValue[GoogleServiceAccount]], i IdentityAccessManagementReader, g GoogleWorkspaceClientReader, e []url.URL, d EmailDomainFilter, t time.Duration, f FailOpen) (*GoogleCloudTokenAuthenticator, error) {
+	if f.Enabled {
+		log.Warningf("FAIL-OPEN is enabled. Requests are allowed when policy bindings are stale for %s.", f.StaleAfter)
+	}
 	return &GoogleCloudTokenAuthenticator{
-		token:         v,
-		iamClient:     i,
-		gwsClient:     g,
-		cache:         c,
-		excludedHosts: e,
+		token:            v,
+		iamClient:        i,
+		gwsClient:        g,
+		cache:            c,
+		excludedHosts:    e,
+		emailDomains:     d,
+		conditionTimeout: t,
+		failOpen:         f,
 	}, nil
 }
 
-// Authenticate verifies if Google credentials are valid.
-func (g *GoogleCloudTokenAuthenticator) Authenticate(ctx context.Context, credentials string, requestUrl url.URL) error {
+// SetTimingHook registers hook to observe sub-operation latencies. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetTimingHook(hook TimingHook) {
+	g.timingHook = hook
+}
+
+// SetAuditSink registers sink to receive decision records. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetAuditSink(sink AuditSink) {
+	g.auditSink = sink
+}
+
+// SetEmptyPolicy configures behavior given no policy bindings for Identity Aware Proxy. Must be invoked before
+// Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetEmptyPolicy(emptyPolicy EmptyPolicy) {
+	if emptyPolicy == EmptyPolicyAllow {
+		log.Warning("DEFAULT-ALLOW is enabled. Every verified identity is allowed given no policy bindings for Identity Aware Proxy.")
+	}
+	g.emptyPolicy = emptyPolicy
+}
+
+// isEmptyPolicy verifies if no identity has policy bindings for Identity Aware Proxy.
+func (g *GoogleCloudTokenAuthenticator) isEmptyPolicy() bool {
+	for _, roles := range g.iamClient.LoadRoleCollection() {
+		if len(roles[iapWebPermission]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetDecisionCache registers cache of granted decisions of conditional bindings, keyed on identity and every param of
+// conditional expressions but request.time, for ttl. Decisions are invalidated on refresh of policy bindings. Conditions depending on
+// request.time, i.e. freshness of request.auth.claims.auth_time, may be granted for up to ttl beyond. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetDecisionCache(c cache.Cache[string, cache.ExpiryCacheValue[time.Time]], ttl time.Duration) {
+	g.decisions = c
+	g.decisionTTL = ttl
+}
+
+// SetEvaluateTimeConditions evaluates bindings of which any condition references request.time or request.auth.claims
+// on every request, such decisions are neither served from nor granted to decision cache. Must be invoked before
+// Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetEvaluateTimeConditions(enabled bool) {
+	g.evaluateTimeConditions = enabled
+}
+
+// SetNegativeCache registers cache of identities without policy bindings for ttl, such that repeated requests of
+// unauthorized identities are denied without lookup. Entries are invalidated on refresh of policy bindings. Must be
+// invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetNegativeCache(c cache.Cache[string, cache.ExpiryCacheValue[time.Time]], ttl time.Duration) {
+	g.negatives = c
+	g.negativeTTL = ttl
+}
+
+// SetStaleWhileRevalidate serves cached identity for window past expiry of token, while token is re-verified in
+// background. Failed re-verification invalidates entry. Re-verification of a token past expiry only succeeds within
+// leeway, window beyond leeway has no effect. Cache must retain entries for window. Must be invoked before
+// Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetStaleWhileRevalidate(window time.Duration) {
+	g.staleWhileRevalidate = window
+}
+
+// SetMaxCacheTTL caps lifetime of verified tokens in cache to min(exp, ttl), such that identities of long-lived tokens
+// are re-verified. A ttl of audiences, {scheme}://{host}, takes precedence. Zero is uncapped. Must be invoked before
+// Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetMaxCacheTTL(ttl time.Duration, audiences map[string]time.Duration) {
+	g.maxCacheTTL = ttl
+	g.audienceCacheTTL = audiences
+}
+
+// cacheExpiry returns expiry of cache entry of verified token of aud given exp of token.
+func (g *GoogleCloudTokenAuthenticator) cacheExpiry(aud string, exp time.Time) int64 {
+	ttl, ok := g.audienceCacheTTL[aud]
+	if !ok {
+		ttl = g.maxCacheTTL
+	}
+	if capped := time.Now().Add(ttl); ttl > 0 && capped.Before(exp) {
+		return capped.Unix()
+	}
+	return exp.Unix()
+}
+
+// revalidate re-verifies token of stale cache entry, bounded by window of stale while revalidate. Entry is invalidated
+// given token is no longer valid.
+func (g *GoogleCloudTokenAuthenticator) revalidate(key, credentials, aud string, entry cache.ExpiryCacheValue[GoogleServiceAccount]) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.staleWhileRevalidate)
+	defer cancel()
+
+	if _, err := g.verify(ctx, key, credentials, aud); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		log.WithField("error", err).Warningf("Failed revalidating stale token of user %s, entry is invalidated.", entry.Val)
+		g.cache.Set(key, cache.ExpiryCacheValue[GoogleServiceAccount]{Val: entry.Val})
+	}
+}
+
+// principalIdentifier returns IAM principal identifier of identity, as member of policy bindings. Federated principals
+// are identifiers as is.
+func principalIdentifier(identity GoogleServiceAccount) string {
+	if isFederatedPrincipal(identity) {
+		return string(identity)
+	} else if strings.HasSuffix(string(identity), "iam.gserviceaccount.com") {
+		return "serviceAccount:" + string(identity)
+	}
+	return "user:" + string(identity)
+}
+
+// decisionKey returns key of decision cache given identity and params of conditional expressions but request.time, such
+// that a decision is reused only given equal params, i.e. of scheme, access levels and claims. Key is prefixed by
+// identity for purge. Params failing to encode are never cached.
+func decisionKey(email GoogleServiceAccount, params celParams) string {
+	keyed := maps.Clone(params)
+	delete(keyed, "request.time")
+	// Keys of maps are sorted when encoded, equal params are always equally encoded.
+	encoded, err := json.Marshal(keyed)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(encoded)
+	return string(email) + "\x00" + hex.EncodeToString(hash[:])
+}
+
+// dependsOnTime returns true given any condition of bindings references request.time or request.auth.claims, of which
+// decision may change without change of identity, request url or bindings.
+func dependsOnTime(bindings PolicyBindings) bool {
+	return slices.ContainsFunc(bindings, func(binding PolicyBinding) bool {
+		return strings.Contains(binding.Expression, "request.time") || strings.Contains(binding.Expression, "request.auth.claims")
+	})
+}
+
+// SetDenyPolicyReader registers deny policies, evaluated before policy bindings. Must be invoked before Authenticate
+// is used.
+func (g *GoogleCloudTokenAuthenticator) SetDenyPolicyReader(reader DenyPolicyReader) {
+	g.denyPolicies = reader
+}
+
+// SetIdentityResolver registers resolver of verified identity, of which resolved identity is used for policy bindings,
+// decision cache, audit records and identity headers. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetIdentityResolver(resolver IdentityResolver) {
+	g.identityResolver = resolver
+}
+
+// SetAccessLevelResolver registers resolver of access levels for conditional expressions referencing
+// request.auth.access_levels. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetAccessLevelResolver(resolver AccessLevelResolver) {
+	g.accessLevels = resolver
+}
+
+// resolveAccessLevels returns access levels of identity. Given error, no access level is satisfied.
+func (g *GoogleCloudTokenAuthenticator) resolveAccessLevels(ctx context.Context, email GoogleServiceAccount) []string {
+	if g.accessLevels == nil {
+		return []string{}
+	}
+	levels, err := g.accessLevels.ResolveAccessLevels(ctx, email)
+	if err != nil {
+		log.WithContext(ctx).WithField("error", err).Errorf("Failed to resolve access levels for user %s.", email)
+		return []string{}
+	}
+	return levels
+}
+
+// SetMaxBindings denies identities with more than max conditional bindings without evaluation, bounding evaluation of
+// conditional expressions per request. Zero is unbounded. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetMaxBindings(max int) {
+	g.maxBindings = max
+}
+
+// SetTokenFingerprint includes truncated SHA-256 fingerprint of token in audit records and decision logs, for correlation
+// across systems. Token itself is never logged. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetTokenFingerprint(enabled bool) {
+	g.tokenFingerprints = enabled
+}
+
+// SetMetricHosts labels decision metrics with host of request given host is any of hosts. Other hosts are labeled
+// other, such that cardinality is bounded given arbitrary hosts of requests. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetMetricHosts(hosts []string) {
+	g.metricHosts = make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		g.metricHosts[strings.ToLower(host)] = struct{}{}
+	}
+}
+
+// hostLabel returns label of host of request url given SetMetricHosts.
+func (g *GoogleCloudTokenAuthenticator) hostLabel(requestUrl url.URL) string {
+	host := strings.ToLower(requestUrl.Hostname())
+	if _, ok := g.metricHosts[host]; ok {
+		return host
+	}
+	return labelOther
+}
+
+// tokenCacheKey returns key of token cache, SHA-256 in hex of token and audience.
+func tokenCacheKey(credentials, aud string) string {
+	key := sha256.Sum256([]byte(credentials + ":" + aud))
+	return hex.EncodeToString(key[:])
+}
+
+// cacheKeyIDLength is length of cache key id, in hex.
+const cacheKeyIDLength = 12
+
+// cacheKeyID returns a short id of cache key, stable across runs given token and audience. Key is SHA-256, such that
+// id is not reversible to token.
+func cacheKeyID(key string) string {
+	return key[:cacheKeyIDLength]
+}
+
+// debugCacheLookup logs id of cache key and result of lookup given debug level, to correlate cache behavior.
+func debugCacheLookup(ctx context.Context, key, result string) {
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.WithContext(ctx).WithFields(log.Fields{"cache_key_id": cacheKeyID(key), "result": result}).Debug("Token cache lookup.")
+	}
+}
+
+// tokenFingerprintLength is length of token fingerprint, in hex of SHA-256.
+const tokenFingerprintLength = 16
+
+// tokenFingerprint returns truncated SHA-256 of token, given SetTokenFingerprint.
+func (g *GoogleCloudTokenAuthenticator) tokenFingerprint(token string) string {
+	if !g.tokenFingerprints {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])[:tokenFingerprintLength]
+}
+
+// audit records decision given verified identity, err is reason of denial by policy.
+func (g *GoogleCloudTokenAuthenticator) audit(ctx context.Context, email GoogleServiceAccount, requestUrl url.URL, fingerprint string, err error, failOpen bool) {
+	observeDecision(g.hostLabel(requestUrl), err, failOpen)
+	if g.auditSink == nil {
+		return
+	}
+	record := AuditRecord{
+		Principal:        email,
+		RequestURL:       requestUrl,
+		Granted:          err == nil || failOpen,
+		FailOpen:         failOpen,
+		ExplicitDeny:     errors.Is(err, ErrDeniedByPolicy),
+		TokenFingerprint: fingerprint,
+		RequestID:        requestID(ctx),
+		Timestamp:        time.Now(),
+	}
+	if err != nil {
+		record.Reason = err.Error()
+	}
+	if source, ok := g.iamClient.(PolicySourceReader); ok {
+		record.PolicySource = source.PolicySource()
+	}
+	g.auditSink.Record(record)
+}
+
+// fingerprintFields adds fingerprint to fields of decision log, given SetTokenFingerprint.
+func (g *GoogleCloudTokenAuthenticator) fingerprintFields(fingerprint string, fields log.Fields) log.Fields {
+	if len(fingerprint) > 0 {
+		fields["fingerprint"] = fingerprint
+	}
+	return fields
+}
+
+func (g *GoogleCloudTokenAuthenticator) observe(ctx context.Context, operation Operation, start time.Time) {
+	elapsed := time.Since(start)
+	recordServerTiming(ctx, operation, elapsed)
+	if g.timingHook != nil {
+		g.timingHook(ctx, operation, elapsed)
+	}
+}
+
+// isAllowed verifies if domain part of email is permitted.
+func (f EmailDomainFilter) isAllowed(email GoogleServiceAccount) bool {
+	if isFederatedPrincipal(email) {
+		return true
+	}
+	domain := string(email[strings.LastIndex(string(email), "@")+1:])
+
+	if slices.ContainsFunc(f.Denied, func(d string) bool { return strings.EqualFold(d, domain) }) {
+		return false
+	}
+	return len(f.Allowed) == 0 ||
+		slices.ContainsFunc(f.Allowed, func(d string) bool { return strings.EqualFold(d, domain) })
+}
+
+// verificationTimeout bounds coalesced verification of a token, not bound by context of any request.
+const verificationTimeout = 10 * time.Second
+
+// verify token given key of token hash. Concurrent verifications of identical token are coalesced
+// into a single verification, of which result is shared and appended to cache once.
+func (g *GoogleCloudTokenAuthenticator) verify(ctx context.Context, key, credentials, aud string) (GoogleServiceAccount, error) {
+	// Verification is shared by waiters, never cancelled given cancellation or budget of first request.
+	flight := g.verifications.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), verificationTimeout)
+		defer cancel()
+
+		claims := getGoogleTokenClaims()
+		defer putGoogleTokenClaims(claims)
+
+		if err := g.token.Verify(ctx, credentials, aud, claims); err != nil {
+			return nil, err
+		} else if len(claims.Principal) == 0 {
+			// Never looked up as an identity without bindings.
+			return nil, ErrMissingIdentity
+		}
+		email := GoogleServiceAccount(claims.Principal)
+		// Append to cache.
+		exp := g.cacheExpiry(aud, claims.ExpiresAt.Time)
+		writeCache(func() { g.cache.Set(key, cache.ExpiryCacheValue[GoogleServiceAccount]{Val: email, Exp: exp}) })
+		return email, nil
+	})
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case result := <-flight:
+		if result.Err != nil {
+			return "", result.Err
+		}
+		return result.Val.(GoogleServiceAccount), nil
+	}
+}
+
+// Authenticate verifies if Google credentials are valid. Identity is returned once token is verified,
+// also when identity is not authorized by policy.
+func (g *GoogleCloudTokenAuthenticator) Authenticate(ctx context.Context, credentials string, requestUrl url.URL) (GoogleServiceAccount, error) {
 	var (
-		aud       = fmt.Sprintf("%s://%s", requestUrl.Scheme, requestUrl.Host)
-		now       = time.Now().Unix()
-		tokenHash = fmt.Sprintf("%s:%s", credentials, aud)
-		email     GoogleServiceAccount
-		claims    *GoogleTokenClaims
+		aud = fmt.Sprintf("%s://%s", requestUrl.Scheme, requestUrl.Host)
+		now = time.Now().Unix()
+		// fingerprint is empty unless SetTokenFingerprint.
+		fingerprint = g.tokenFingerprint(credentials)
+		email       GoogleServiceAccount
+		key         string
+		start       time.Time
+		err         error
 	)
 
 	for _, host := range g.excludedHosts {
 		if host.Host == aud {
-			log.Warningf("Host %s is excluded from authentication.", host.Host)
-			return nil
+			log.WithContext(ctx).Warningf("Host %s is excluded from authentication.", host.Host)
+			return "", nil
 		}
 	}
-	hasher := sha256.New()
 	// Verify if Google Service Account JWT is present within local cache, if found and exp is valid,
 	// jump to role binding processing as token requires no re-processing given the fully valid status.
-	if _, err := hasher.Write([]byte(tokenHash)); err != nil {
-		log.WithField("error", err).Warning("hasher.Write: returned error. Unexpected.")
-	} else if entry, ok := g.cache.Get(hex.EncodeToString(hasher.Sum(nil))); ok && entry.Exp < now {
+	start = time.Now()
+	key = tokenCacheKey(credentials, aud)
+	if entry, ok := g.cache.Get(key); ok && entry.Exp > now {
 		email = entry.Val
+		g.observe(ctx, OperationCacheLookup, start)
+		debugCacheLookup(ctx, key, "hit")
+		goto verifyGoogleCloudPolicyBindings
+	} else if ok && entry.Exp+int64(g.staleWhileRevalidate.Seconds()) > now {
+		// Stale identity is served within window, token is re-verified in background.
+		email = entry.Val
+		g.observe(ctx, OperationCacheLookup, start)
+		debugCacheLookup(ctx, key, "stale")
+		go g.revalidate(key, credentials, aud, entry)
 		goto verifyGoogleCloudPolicyBindings
 	}
-	claims = getGoogleTokenClaims()
-	defer putGoogleTokenClaims(claims)
+	g.observe(ctx, OperationCacheLookup, start)
+	debugCacheLookup(ctx, key, "miss")
 	// Verify token validity, signature and audience.
-	if err := g.token.Verify(ctx, credentials, aud, claims); err != nil {
-		log.WithField("error", err).Error("Failed verifying token.")
-		return err
+	start = time.Now()
+	if email, err = g.verify(ctx, key, credentials, aud); err != nil {
+		log.WithContext(ctx).WithFields(g.fingerprintFields(fingerprint, log.Fields{"error": err})).Error("Failed verifying token.")
+		return "", err
 	}
-	email = GoogleServiceAccount(claims.Email)
-	// Append to cache.
-	go g.cache.Set(tokenHash,
-		cache.ExpiryCacheValue[GoogleServiceAccount]{
-			Val: email,
-			Exp: claims.ExpiresAt.Unix(),
-		})
+	g.observe(ctx, OperationVerifyToken, start)
 	// Identify if user has role bindings in project.
 verifyGoogleCloudPolicyBindings:
-	bindings, err := g.iamClient.LoadBindingForGoogleServiceAccount(email)
+	if err = g.verifyReplay(credentials); err != nil {
+		log.WithContext(ctx).WithFields(g.fingerprintFields(fingerprint, log.Fields{"error": err})).Warningf("Token of user %s is denied given replay protection.", email)
+		return "", err
+	}
+	if err = g.verifyIdentityAllowed(ctx, email, requestUrl, fingerprint); err != nil {
+		return email, err
+	}
+	if email, err = g.resolveIdentity(ctx, email); err != nil {
+		log.WithContext(ctx).WithFields(g.fingerprintFields(fingerprint, log.Fields{"error": err})).Error("Failed resolving identity.")
+		return "", err
+	}
+	ctx = withAuthToken(ctx, credentials)
+	sendEarlyHints(ctx, email)
+	shadow := g.shadowAuthorize(ctx, email, requestUrl, now)
+	err = g.authorize(ctx, email, requestUrl, now)
+	compareShadow(ctx, shadow, email, requestUrl, err)
+	if err == nil {
+		g.audit(ctx, email, requestUrl, fingerprint, nil, false)
+		return email, nil
+	} else if g.failOpen.Enabled && g.isOutage(err) {
+		log.WithContext(ctx).WithFields(g.fingerprintFields(fingerprint, log.Fields{
+			"audit":       "fail-open",
+			"user":        email,
+			"url":         requestUrl.String(),
+			"lastRefresh": g.iamClient.LastSuccessfulRefresh(),
+			"error":       err,
+		})).Warning("FAIL-OPEN: Policy bindings are stale, request denied by policy is allowed.")
+		g.audit(ctx, email, requestUrl, fingerprint, err, true)
+		return email, nil
+	}
+	g.audit(ctx, email, requestUrl, fingerprint, err, false)
+	return email, err
+}
+
+// verifyIdentityAllowed verifies if email domain and identity patterns allow user, before lookup of policy bindings.
+// Denial is audited.
+func (g *GoogleCloudTokenAuthenticator) verifyIdentityAllowed(ctx context.Context, email GoogleServiceAccount, requestUrl url.URL, fingerprint string) error {
+	if !g.emailDomains.isAllowed(email) {
+		log.WithContext(ctx).WithFields(g.fingerprintFields(fingerprint, log.Fields{})).Warningf("Email domain of user %s is not allowed.", email)
+		g.audit(ctx, email, requestUrl, fingerprint, ErrEmailDomainNotAllowed, false)
+		return ErrEmailDomainNotAllowed
+	} else if !g.isIdentityAllowed(email) {
+		log.WithContext(ctx).WithFields(g.fingerprintFields(fingerprint, log.Fields{})).Warningf("User %s matches no allowed identity pattern.", email)
+		g.audit(ctx, email, requestUrl, fingerprint, ErrIdentityNotAllowed, false)
+		return ErrIdentityNotAllowed
+	}
+	return nil
+}
+
+// isOutage returns true given err is of unavailable policy bindings, which are stale beyond StaleAfter of FailOpen.
+// Absence of a binding, unsatisfied conditions and any explicit denial are of loaded policy and never an outage.
+func (g *GoogleCloudTokenAuthenticator) isOutage(err error) bool {
+	return errors.Is(err, ErrPolicyBindingsUnavailable) && !errors.Is(err, ErrDenyPoliciesUnavailable) &&
+		time.Since(g.iamClient.LastSuccessfulRefresh()) > g.failOpen.StaleAfter
+}
+
+// AuthenticateClientCertificate authorizes identity of client certificate, verified by a trusted gateway terminating
+// mTLS, given policy bindings. Token verification is bypassed, email domain filter and identity patterns are not.
+// Identity is returned given IdentityResolver.
+func (g *GoogleCloudTokenAuthenticator) AuthenticateClientCertificate(ctx context.Context, identity GoogleServiceAccount, requestUrl url.URL) (GoogleServiceAccount, error) {
+	aud := fmt.Sprintf("%s://%s", requestUrl.Scheme, requestUrl.Host)
+	for _, host := range g.excludedHosts {
+		if host.Host == aud {
+			log.WithContext(ctx).Warningf("Host %s is excluded from authentication.", host.Host)
+			return identity, nil
+		}
+	}
+	if err := g.verifyIdentityAllowed(ctx, identity, requestUrl, ""); err != nil {
+		return identity, err
+	}
+	identity, err := g.resolveIdentity(ctx, identity)
+	if err != nil {
+		log.WithContext(ctx).WithField("error", err).Error("Failed resolving identity.")
+		return "", err
+	}
+	now := time.Now().Unix()
+	sendEarlyHints(ctx, identity)
+	shadow := g.shadowAuthorize(ctx, identity, requestUrl, now)
+	err = g.authorize(ctx, identity, requestUrl, now)
+	compareShadow(ctx, shadow, identity, requestUrl, err)
+	g.audit(ctx, identity, requestUrl, "", err, false)
+	return identity, err
+}
+
+// authorize verifies if user is authorized to request url given policy bindings and rule of route of RoutePolicy.
+func (g *GoogleCloudTokenAuthenticator) authorize(ctx context.Context, email GoogleServiceAccount, requestUrl url.URL, now int64) error {
+	err := g.authorizeBindings(ctx, email, requestUrl, now)
+	return g.authorizeRoute(ctx, email, requestUrl, now, err)
+}
+
+// authorizeBindings verifies if user is not denied by deny policies and has role bindings in project, of which any
+// grants access to request url. Deny takes precedence over any role binding.
+func (g *GoogleCloudTokenAuthenticator) authorizeBindings(ctx context.Context, email GoogleServiceAccount, requestUrl url.URL, now int64) error {
+	if g.denyPolicies != nil {
+		if policy, denied, err := g.denyPolicies.LoadDenyPolicyForGoogleServiceAccount(email); err != nil {
+			return err
+		} else if denied {
+			log.WithContext(ctx).Warningf("User %s is explicitly denied by deny policy %s.", email, policy)
+			return fmt.Errorf("%w: %s", ErrDeniedByPolicy, policy)
+		}
+	}
+	// Refresh is read before lookup, a concurrent refresh invalidates a negative entry of former bindings.
+	lookupRefresh := g.iamClient.LastSuccessfulRefresh()
+	if g.isNegative(email, lookupRefresh) {
+		log.WithContext(ctx).Debugf("Cached absence of policy bindings for user %s.", email)
+		return ErrNoIdentityAwareProxyRoleForUser
+	}
+	start := time.Now()
+	bindings, err := g.loadIdentityBindings(ctx, email)
+	g.observe(ctx, OperationLoadBindings, start)
+	if errors.Is(err, ErrNoIdentityAwareProxyRoleForUser) && g.emptyPolicy == EmptyPolicyAllow && g.isEmptyPolicy() {
+		log.WithContext(ctx).Warningf("DEFAULT-ALLOW: No policy bindings for Identity Aware Proxy. User %s is allowed.", email)
+		return nil
+	} else if errors.Is(err, ErrNoIdentityAwareProxyRoleForUser) {
+		g.setNegative(email, lookupRefresh)
+	}
 	if err != nil {
-		log.WithField("error", err).Warningf("No policy role binding found for user %s.", email)
+		log.WithContext(ctx).WithField("error", err).Warningf("No policy role binding found for user %s.", email)
 		return err
-	} else if len(bindings) == 1 && len(bindings[0].Expression) == 0 {
-		// We have a single role binding without a conditional expression. User is authenticated.
+	}
+	// Bindings of other resources are never granted, neither unconditional ones.
+	resource := g.resource(requestUrl.Host).Name
+	if bindings = bindings.scopedTo(resource); len(bindings) == 0 {
+		log.WithContext(ctx).Warningf("No policy role binding of resource %s found for user %s.", resource, email)
+		return ErrNoIdentityAwareProxyRoleForUser
+	} else if slices.ContainsFunc(bindings, func(binding PolicyBinding) bool { return len(binding.Expression) == 0 }) {
+		// We have a role binding without a conditional expression. User is authenticated regardless of
+		// any other conditional role bindings.
 		return nil
 	}
-	// Identity Aware Proxy supported parameters for evaluating conditional expression given bindings.
-	params := map[string]any{
-		"request.path": requestUrl.Path,
-		"request.host": requestUrl.Host,
-		"request.time": now,
+	if g.maxBindings > 0 && len(bindings) > g.maxBindings {
+		log.WithContext(ctx).Warningf("User %s has %d conditional bindings exceeding maximum of %d. Denied without evaluation.",
+			email, len(bindings), g.maxBindings)
+		tooManyBindingsCounter.Inc()
+		return fmt.Errorf("%w: %d exceeds %d", ErrTooManyBindings, len(bindings), g.maxBindings)
 	}
+	params := g.conditionParams(ctx, email, requestUrl, now)
+	if err = g.paramLimits.verify(params); err != nil {
+		log.WithContext(ctx).WithField("error", err).Warningf("Params of request of user %s are too large. Denied without evaluation.", email)
+		return err
+	}
+	var (
+		key     string
+		refresh = g.iamClient.LastSuccessfulRefresh()
+	)
+	if g.decisions != nil && !(g.evaluateTimeConditions && dependsOnTime(bindings)) {
+		key = decisionKey(email, params)
+		if entry, ok := g.decisions.Get(key); ok && entry.Exp > time.Now().Unix() && entry.Val.Equal(refresh) {
+			log.WithContext(ctx).Debugf("Cached decision for user %s and url %s is granted.", email, requestUrl.String())
+			return nil
+		}
+	}
+	ctx, cancel := g.withConditionTimeout(ctx)
+	defer cancel()
+
+	resultKey := g.conditionResultKey(params, refresh, now)
 	if len(bindings) == 1 && len(bindings[0].Expression) > 0 {
-		log.Debugf("User %s has single conditional policy expression. Evaluating.", email)
-		isAuthorized, err := doesConditionalExpressionEvaluateToTrue(bindings[0].Expression, params)
-		if !isAuthorized || err != nil {
-			log.WithField("error", err).Errorf("Conditional expression with title %s is not valid for user %s.",
+		log.WithContext(ctx).Debugf("User %s has single conditional policy expression. Evaluating.", email)
+		start = time.Now()
+		isAuthorized, err := g.evaluateCondition(ctx, resultKey, bindings[0], params)
+		g.observe(ctx, OperationEvaluateConditions, start)
+		if err != nil {
+			log.WithContext(ctx).WithField("error", err).Errorf("Conditional expression with title %s failed evaluation for user %s.",
+				bindings[0].Title, email)
+			return ErrInvalidGoogleCloudAuthentication
+		} else if !isAuthorized {
+			log.WithContext(ctx).Warningf("Conditional expression with title %s evaluated to false for user %s.",
 				bindings[0].Title, email)
 			return ErrInvalidGoogleCloudAuthentication
 		}
+		g.grant(key, refresh)
 		return nil
 	}
-	log.Debugf("User %s has multiple conditional policy expressions. Evaluating", email)
+	log.WithContext(ctx).Debugf("User %s has multiple conditional policy expressions. Evaluating", email)
 
-	for _, binding := range bindings {
-		if len(binding.Expression) == 0 {
-			continue
-		} else if ok, err := doesConditionalExpressionEvaluateToTrue(binding.Expression, params); !ok || err != nil {
-			log.WithField("error", err).Errorf("Conditional expression %s is not valid for user %s.",
-				binding.Title, email)
-			return ErrInvalidGoogleCloudAuthentication
-		}
+	// Bindings are granted with OR-semantics, a single binding evaluating to true is sufficient.
+	start = time.Now()
+	isAuthorized := anyConditionalExpressionEvaluatesToTrue(ctx, bindings,
+		func(ctx context.Context, binding PolicyBinding) (bool, error) {
+			return g.evaluateCondition(ctx, resultKey, binding, params)
+		})
+	g.observe(ctx, OperationEvaluateConditions, start)
+	if !isAuthorized {
+		log.WithContext(ctx).Warningf("No conditional expression evaluated to true for user %s.", email)
+		return ErrInvalidGoogleCloudAuthentication
 	}
-	log.Debugf("Processing successful request with email: %s and audience: %s.", email, requestUrl.String())
+	log.WithContext(ctx).Debugf("Processing successful request with email: %s and audience: %s.", email, requestUrl.String())
+	g.grant(key, refresh)
 	return nil
 }
+
+// withConditionTimeout returns ctx bound by deadline for evaluation of conditional expressions, zero is no deadline.
+func (g *GoogleCloudTokenAuthenticator) withConditionTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if g.conditionTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, g.conditionTimeout)
+}
+
+// conditionParams returns params of conditional expressions of request of user, supported by Identity Aware Proxy.
+func (g *GoogleCloudTokenAuthenticator) conditionParams(ctx context.Context, email GoogleServiceAccount, requestUrl url.URL, now int64) celParams {
+	resource := g.resource(requestUrl.Host)
+	params := celParams{
+		"request.path":   requestUrl.Path,
+		"request.host":   requestUrl.Host,
+		"request.scheme": strings.ToLower(requestUrl.Scheme),
+		"request.time":   time.Unix(now, 0),
+		"request.query":  map[string][]string(requestUrl.Query()),
+		// Empty without trusted device header, conditions of device are not satisfied.
+		"device": map[string]any(deviceAttributes(ctx)),
+		// Resolved only given conditional bindings.
+		"request.auth.access_levels": g.resolveAccessLevels(ctx, email),
+		"request.auth.principal":     principalIdentifier(email),
+		"request.auth.claims":        authClaims(ctx),
+		"resource.name":              resource.Name,
+		"resource.type":              resource.Type,
+	}
+	// Absent header variables are not set, conditions of such fail evaluation.
+	for variable, val := range headerVariables(ctx) {
+		params[variable] = val
+	}
+	return params
+}
+
+// isNegative verifies if absence of policy bindings of identity is cached given current refresh of policy bindings.
+func (g *GoogleCloudTokenAuthenticator) isNegative(email GoogleServiceAccount, refresh time.Time) bool {
+	if g.negatives == nil {
+		return false
+	}
+	entry, ok := g.negatives.Get(string(email))
+	return ok && entry.Exp > time.Now().Unix() && entry.Val.Equal(refresh)
+}
+
+// setNegative caches absence of policy bindings of identity given refresh of policy bindings looked up, given negative
+// cache.
+func (g *GoogleCloudTokenAuthenticator) setNegative(email GoogleServiceAccount, refresh time.Time) {
+	if g.negatives == nil {
+		return
+	}
+	exp := time.Now().Add(g.negativeTTL).Unix()
+	writeCache(func() { g.negatives.Set(string(email), cache.ExpiryCacheValue[time.Time]{Val: refresh, Exp: exp}) })
+}
+
+// grant appends granted decision to decision cache, given decision cache.
+func (g *GoogleCloudTokenAuthenticator) grant(key string, refresh time.Time) {
+	if g.decisions == nil || len(key) == 0 {
+		return
+	}
+	exp := time.Now().Add(g.decisionTTL).Unix()
+	writeCache(func() { g.decisions.Set(key, cache.ExpiryCacheValue[time.Time]{Val: refresh, Exp: exp}) })
+}
@@ -0,0 +1,759 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEmailDomainFilter(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"allowed": "sa@example.com",
+			"blocked": "sa@other.com",
+			"denied":  "sa@denied.example.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{
+			"sa@example.com":        {{}},
+			"sa@other.com":          {{}},
+			"sa@denied.example.com": {{}},
+		}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings,
+			EmailDomainFilter{
+				Allowed: []string{"example.com", "denied.example.com"},
+				Denied:  []string{"denied.example.com"},
+			}))
+	)
+	var tests = []struct {
+		name       string
+		token      string
+		statusCode int
+	}{
+		{"TestAllowedEmailDomain", "allowed", http.StatusOK},
+		{"TestEmailDomainNotInAllowList", "blocked", http.StatusForbidden},
+		{"TestEmailDomainInDenyList", "denied", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithCachedToken(t *testing.T) {
+	var (
+		verifier      = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings      = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	for i := 0; i < 10; i++ {
+		if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+	}
+	if calls := verifier.calls.Load(); calls != 1 {
+		t.Fatalf("Expected token to be verified once, verified %d times.", calls)
+	}
+}
+
+func TestTimingHook(t *testing.T) {
+	var (
+		verifier      = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings      = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": conditionalBindings(3, true)}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/something")
+		mu            sync.Mutex
+		observed      = make(map[Operation]int)
+	)
+	authenticator.SetTimingHook(func(_ context.Context, operation Operation, _ time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		observed[operation]++
+	})
+	if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	for _, operation := range []Operation{OperationCacheLookup, OperationVerifyToken,
+		OperationLoadBindings, OperationEvaluateConditions} {
+		if observed[operation] != 1 {
+			t.Fatalf("Expected operation %s to be observed once, observed %d times.", operation, observed[operation])
+		}
+	}
+}
+
+func TestConcurrentIdenticalVerificationsAreCoalesced(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{
+			emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"},
+			delay:  100 * time.Millisecond,
+		}
+		bindings      = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+		wg            sync.WaitGroup
+		start         = make(chan struct{})
+		errs          = make(chan error, 50)
+	)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := authenticator.Authenticate(context.Background(), "token", *requestUrl)
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+	}
+	if calls := verifier.calls.Load(); calls != 1 {
+		t.Fatalf("Expected token to be verified once, verified %d times.", calls)
+	}
+}
+
+func TestCoalescedVerificationIsNotBoundByFirstRequest(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{
+			emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"},
+			delay:  100 * time.Millisecond,
+		}
+		bindings      = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+		first         = make(chan error, 1)
+	)
+	// First request exceeds its deadline while verification is pending.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go func() {
+		_, err := authenticator.Authenticate(ctx, "token", *requestUrl)
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if err = <-first; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error %v of first request, error %v was returned.", context.DeadlineExceeded, err)
+	} else if calls := verifier.calls.Load(); calls != 1 {
+		t.Fatalf("Expected token to be verified once, verified %d times.", calls)
+	}
+}
+
+func TestUnconditionalBindingGrantsAccess(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {
+			{Expression: "request.path.startsWith(\"/admin\")", Title: "failing"},
+			{},
+			{Expression: "request.host == \"other.com\"", Title: "failing"},
+		}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+		t.Fatalf("Expected unconditional binding to grant access, error returned: %s.", err)
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"unauthorized": "unauthorized@p.iam.gserviceaccount.com",
+			"conditional":  "conditional@p.iam.gserviceaccount.com",
+		}}
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+		stale         = time.Now().Add(-time.Hour)
+		failOpen      = FailOpen{Enabled: true, StaleAfter: 30 * time.Minute}
+		bindings      = fakeIdentityAccessManagementReader{"conditional@p.iam.gserviceaccount.com": {
+			{Expression: "request.host == \"other.com\"", Title: "other"},
+		}}
+	)
+	var tests = []struct {
+		name     string
+		token    string
+		failOpen FailOpen
+		reader   IdentityAccessManagementReader
+		error    error
+	}{
+		{"TestFailClosedByDefaultWithUnavailablePolicy", "unauthorized", FailOpen{}, unavailableIdentityAccessManagementReader{},
+			ErrPolicyBindingsUnavailable},
+		{"TestFailOpenWithUnavailablePolicy", "unauthorized", failOpen, unavailableIdentityAccessManagementReader{}, nil},
+		{"TestNoBindingIsDeniedWithStalePolicy", "unauthorized", failOpen, staleIdentityAccessManagementReader{bindings, stale},
+			ErrNoIdentityAwareProxyRoleForUser},
+		{"TestUnsatisfiedConditionIsDeniedWithStalePolicy", "conditional", failOpen,
+			staleIdentityAccessManagementReader{bindings, stale}, ErrInvalidGoogleCloudAuthentication},
+		{"TestNoBindingIsDeniedWithFreshPolicy", "unauthorized", failOpen, staleIdentityAccessManagementReader{bindings, time.Now()},
+			ErrNoIdentityAwareProxyRoleForUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newFakeAuthenticator(t, verifier, tt.reader, EmailDomainFilter{})
+			authenticator.failOpen = tt.failOpen
+
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithQueryCondition(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {
+			{Expression: "\"env\" in request.query && request.query[\"env\"] == [\"prod\"]", Title: "prod"},
+		}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+	)
+	var tests = []struct {
+		name       string
+		requestUrl string
+		error      error
+	}{
+		{"TestMatchingQueryParameter", "https://myurl.com/hello?env=prod", nil},
+		{"TestOtherQueryParameter", "https://myurl.com/hello?env=dev", ErrInvalidGoogleCloudAuthentication},
+		{"TestMissingQueryParameter", "https://myurl.com/hello", ErrInvalidGoogleCloudAuthentication},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestUrl, _ := url.Parse(tt.requestUrl)
+			if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithSchemeCondition(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {
+			{Expression: "request.scheme == \"https\"", Title: "https"},
+		}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+	)
+	var tests = []struct {
+		name       string
+		requestUrl string
+		error      error
+	}{
+		{"TestHttpsScheme", "https://myurl.com/hello", nil},
+		{"TestUpperCaseHttpsScheme", "HTTPS://myurl.com/hello", nil},
+		{"TestHttpScheme", "http://myurl.com/hello", ErrInvalidGoogleCloudAuthentication},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestUrl, _ := url.Parse(tt.requestUrl)
+			if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			}
+		})
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{email: {
+				{Expression: "request.host == \"other.com\"", Title: "other"},
+				{Expression: "request.host == \"myurl.com\"", Title: "myurl"},
+			}},
+			lastRefresh: time.Now(),
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		evaluations   atomic.Int32
+	)
+	authenticator.SetDecisionCache(cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[time.Time]](), time.Second)
+	authenticator.SetTimingHook(func(_ context.Context, operation Operation, _ time.Duration) {
+		if operation == OperationEvaluateConditions {
+			evaluations.Add(1)
+		}
+	})
+	authenticate := func(t *testing.T, requestUrl string) {
+		t.Helper()
+		u, _ := url.Parse(requestUrl)
+		if _, err := authenticator.Authenticate(context.Background(), "token", *u); err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+	}
+	var tests = []struct {
+		name        string
+		requestUrl  string
+		before      func()
+		evaluations int32
+	}{
+		{"TestDecisionIsEvaluated", "https://myurl.com/something", nil, 1},
+		{"TestCachedDecisionSkipsEvaluation", "https://myurl.com/something", nil, 1},
+		{"TestOtherPathIsEvaluated", "https://myurl.com/other", nil, 2},
+		{"TestOtherQueryIsEvaluated", "https://myurl.com/something?a=b", nil, 3},
+		{"TestRefreshInvalidatesDecision", "https://myurl.com/something",
+			func() { bindings.lastRefresh = bindings.lastRefresh.Add(time.Minute) }, 4},
+		{"TestCachedDecisionAfterRefreshSkipsEvaluation", "https://myurl.com/something", nil, 4},
+		{"TestExpiredDecisionIsEvaluated", "https://myurl.com/something",
+			func() { time.Sleep(2 * time.Second) }, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+			if authenticate(t, tt.requestUrl); evaluations.Load() != tt.evaluations {
+				t.Fatalf("Expected %d evaluations of conditions, %d evaluations were made.", tt.evaluations, evaluations.Load())
+			}
+		})
+	}
+}
+
+func TestDecisionCacheIsKeyedOnConditionParams(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		level    = "accessPolicies/1/accessLevels/corp"
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{email: {
+				{Expression: "request.scheme == \"https\" && \"" + level + "\" in request.auth.access_levels", Title: "https"},
+			}},
+			lastRefresh: time.Now(),
+		}
+		resolver      = &fakeAccessLevelResolver{levels: map[GoogleServiceAccount][]string{email: {level}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+	)
+	authenticator.SetDecisionCache(cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[time.Time]](), time.Minute)
+	authenticator.SetAccessLevelResolver(resolver)
+
+	var tests = []struct {
+		name       string
+		requestUrl string
+		levels     []string
+		error      error
+	}{
+		{"TestHttpsIsGranted", "https://myurl.com/hello", []string{level}, nil},
+		{"TestHttpsGrantIsNotReusedForHttp", "http://myurl.com/hello", []string{level}, ErrInvalidGoogleCloudAuthentication},
+		{"TestHttpsGrantIsNotReusedWithoutAccessLevel", "https://myurl.com/hello", nil, ErrInvalidGoogleCloudAuthentication},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver.levels[email] = tt.levels
+			requestUrl, _ := url.Parse(tt.requestUrl)
+			if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			}
+		})
+	}
+}
+
+func TestCachedTokenEvaluatesConditions(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = fakeIdentityAccessManagementReader{email: {
+			{Expression: "request.path.startsWith(\"/hello\")", Title: "hello"},
+			{Expression: "request.time < timestamp(\"2000-01-01T00:00:00Z\")", Title: "expired"},
+		}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		evaluations   atomic.Int32
+	)
+	authenticator.SetTimingHook(func(_ context.Context, operation Operation, _ time.Duration) {
+		if operation == OperationEvaluateConditions {
+			evaluations.Add(1)
+		}
+	})
+	var tests = []struct {
+		name        string
+		requestUrl  string
+		error       error
+		verified    int32
+		evaluations int32
+	}{
+		{"TestTokenIsVerified", "https://myurl.com/hello", nil, 1, 1},
+		{"TestCachedTokenIsEvaluated", "https://myurl.com/hello/world", nil, 1, 2},
+		{"TestCachedTokenIsDeniedByCondition", "https://myurl.com/other", ErrInvalidGoogleCloudAuthentication, 1, 3},
+		{"TestCachedTokenIsDeniedByTimeCondition", "https://myurl.com/", ErrInvalidGoogleCloudAuthentication, 1, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(tt.requestUrl)
+			if _, err := authenticator.Authenticate(context.Background(), "token", *u); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			} else if calls := verifier.calls.Load(); calls != tt.verified {
+				t.Fatalf("Expected %d verifications of token, %d verifications were made.", tt.verified, calls)
+			} else if evaluations.Load() != tt.evaluations {
+				t.Fatalf("Expected %d evaluations of conditions, %d evaluations were made.", tt.evaluations, evaluations.Load())
+			}
+		})
+	}
+}
+
+func TestEvaluateTimeConditions(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{email: {
+				{Expression: "request.time < timestamp(\"2100-01-01T00:00:00Z\")", Title: "time"},
+			}},
+			lastRefresh: time.Now(),
+		}
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	var tests = []struct {
+		name        string
+		enabled     bool
+		evaluations int32
+	}{
+		{"TestTimeConditionIsCached", false, 1},
+		{"TestTimeConditionIsEvaluated", true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+				evaluations   atomic.Int32
+			)
+			authenticator.SetDecisionCache(cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[time.Time]](), time.Minute)
+			authenticator.SetEvaluateTimeConditions(tt.enabled)
+			authenticator.SetTimingHook(func(_ context.Context, operation Operation, _ time.Duration) {
+				if operation == OperationEvaluateConditions {
+					evaluations.Add(1)
+				}
+			})
+			for range 3 {
+				if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+					t.Fatalf("Unexpected error returned, error: %s.", err)
+				}
+			}
+			if evaluations.Load() != tt.evaluations {
+				t.Fatalf("Expected %d evaluations of conditions, %d evaluations were made.", tt.evaluations, evaluations.Load())
+			}
+		})
+	}
+}
+
+func TestEmptyPolicy(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"token": "sa@p.iam.gserviceaccount.com",
+		}}
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+		nonEmpty      = fakeIdentityAccessManagementReader{"other@p.iam.gserviceaccount.com": {{}}}
+	)
+	var tests = []struct {
+		name          string
+		emptyPolicy   EmptyPolicy
+		bindings      fakeIdentityAccessManagementReader
+		expectedError error
+	}{
+		{"TestDefaultWithZeroBindings", "", fakeIdentityAccessManagementReader{}, ErrNoIdentityAwareProxyRoleForUser},
+		{"TestDenyWithZeroBindings", EmptyPolicyDeny, fakeIdentityAccessManagementReader{}, ErrNoIdentityAwareProxyRoleForUser},
+		{"TestAllowWithZeroBindings", EmptyPolicyAllow, fakeIdentityAccessManagementReader{}, nil},
+		{"TestAllowWithBindingsForOtherIdentity", EmptyPolicyAllow, nonEmpty, ErrNoIdentityAwareProxyRoleForUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newFakeAuthenticator(t, verifier, tt.bindings, EmailDomainFilter{})
+			authenticator.SetEmptyPolicy(tt.emptyPolicy)
+
+			if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestDecisionMetricHostLabels(t *testing.T) {
+	var (
+		verifier      = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings      = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		allowed       = decisionsCounter.WithLabelValues("app.decisions.test", "granted")
+		other         = decisionsCounter.WithLabelValues(labelOther, "granted")
+	)
+	authenticator.SetMetricHosts([]string{"App.Decisions.Test"})
+	var (
+		allowedBefore, otherBefore = testutil.ToFloat64(allowed), testutil.ToFloat64(other)
+		series                     = testutil.CollectAndCount(decisionsCounter)
+	)
+	for _, requestUrl := range []string{"https://app.decisions.test/hello", "https://APP.decisions.test:8443/hello"} {
+		requestUrl, _ := url.Parse(requestUrl)
+		if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+	}
+	// Arbitrary hosts of requests must not add series.
+	for i := 0; i < 50; i++ {
+		requestUrl, _ := url.Parse(fmt.Sprintf("https://unknown-%d.decisions.test/hello", i))
+		if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+	}
+	if val := testutil.ToFloat64(allowed) - allowedBefore; val != 2 {
+		t.Fatalf("Expected 2 decisions labeled with allowed host, %f were counted.", val)
+	} else if val = testutil.ToFloat64(other) - otherBefore; val < 50 {
+		// Abandoned authentications of other tests may complete and be labeled other.
+		t.Fatalf("Expected at least 50 decisions labeled %s, %f were counted.", labelOther, val)
+	} else if n := testutil.CollectAndCount(decisionsCounter) - series; n > 0 {
+		t.Fatalf("Expected no series of unknown hosts, %d series were added.", n)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"unbound": "unbound@p.iam.gserviceaccount.com"}}
+		bindings = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{
+				"sa@p.iam.gserviceaccount.com": {{}},
+			},
+			lastRefresh: time.Now(),
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		lookups       atomic.Int32
+	)
+	authenticator.SetNegativeCache(cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[time.Time]](), time.Second)
+	authenticator.SetTimingHook(func(_ context.Context, operation Operation, _ time.Duration) {
+		if operation == OperationLoadBindings {
+			lookups.Add(1)
+		}
+	})
+	var tests = []struct {
+		name    string
+		before  func()
+		lookups int32
+	}{
+		{"TestUnauthorizedIsLookedUp", nil, 1},
+		{"TestCachedUnauthorizedSkipsLookup", nil, 1},
+		{"TestRefreshInvalidatesNegative", func() { bindings.lastRefresh = bindings.lastRefresh.Add(time.Minute) }, 2},
+		{"TestCachedUnauthorizedAfterRefreshSkipsLookup", nil, 2},
+		{"TestExpiredNegativeIsLookedUp", func() { time.Sleep(2 * time.Second) }, 3},
+	}
+	requestUrl, _ := url.Parse("https://myurl.com/hello")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+			if _, err := authenticator.Authenticate(context.Background(), "unbound", *requestUrl); !errors.Is(err, ErrNoIdentityAwareProxyRoleForUser) {
+				t.Fatalf("Expected error %v, error %v was returned.", ErrNoIdentityAwareProxyRoleForUser, err)
+			} else if lookups.Load() != tt.lookups {
+				t.Fatalf("Expected %d lookups of policy bindings, %d lookups were made.", tt.lookups, lookups.Load())
+			}
+		})
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"revalidated": string(email)}}
+		bindings = fakeIdentityAccessManagementReader{email: {{}}}
+		jwtCache = cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[GoogleServiceAccount]]()
+		now      = time.Now()
+	)
+	authenticator, err := NewGoogleCloudTokenAuthenticator(verifier, jwtCache, bindings, fakeGoogleWorkspaceClient{},
+		nil, EmailDomainFilter{}, 50*time.Millisecond, FailOpen{})
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	authenticator.SetStaleWhileRevalidate(30 * time.Second)
+	requestUrl, _ := url.Parse("https://myurl.com/hello")
+
+	var tests = []struct {
+		name string
+		// token is unknown by verifier unless revalidated.
+		token string
+		exp   time.Time
+		err   error
+		// revalidatedErr is error of request once token is revalidated in background.
+		revalidatedErr error
+	}{
+		{"TestFreshEntry", "fresh", now.Add(time.Minute), nil, nil},
+		{"TestStaleEntryWithinWindowInvalidated", "stale", now.Add(-5 * time.Second), nil, ErrUnknownTokenType},
+		{"TestStaleEntryWithinWindowRevalidated", "revalidated", now.Add(-5 * time.Second), nil, nil},
+		{"TestExpiredEntryBeyondWindow", "expired", now.Add(-time.Minute), ErrUnknownTokenType, ErrUnknownTokenType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwtCache.Set(tokenCacheKey(tt.token, "https://myurl.com"), cache.ExpiryCacheValue[GoogleServiceAccount]{Val: email, Exp: tt.exp.Unix()})
+
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.err, err)
+			}
+			// Revalidation and cache entries are written asynchronously.
+			time.Sleep(50 * time.Millisecond)
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.revalidatedErr) {
+				t.Fatalf("Expected error %v once revalidated, error %v was returned.", tt.revalidatedErr, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithPrincipalCondition(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"sa":    "sa@p.iam.gserviceaccount.com",
+			"other": "other@p.iam.gserviceaccount.com",
+			"user":  "user@example.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{
+			"sa@p.iam.gserviceaccount.com": {
+				{Expression: "request.auth.principal == \"serviceAccount:sa@p.iam.gserviceaccount.com\"", Title: "sa"},
+			},
+			"other@p.iam.gserviceaccount.com": {
+				{Expression: "request.auth.principal == \"serviceAccount:sa@p.iam.gserviceaccount.com\"", Title: "sa"},
+			},
+			"user@example.com": {
+				{Expression: "request.auth.principal.startsWith(\"user:\")", Title: "users"},
+			},
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+	)
+	var tests = []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"TestServiceAccountPrincipalMatches", "sa", nil},
+		{"TestOtherServiceAccountPrincipalDoesNotMatch", "other", ErrInvalidGoogleCloudAuthentication},
+		{"TestUserPrincipalMatches", "user", nil},
+	}
+	requestUrl, _ := url.Parse("https://myurl.com/hello")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestMaxBindings(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"capped":   "capped@p.iam.gserviceaccount.com",
+			"bounded":  "bounded@p.iam.gserviceaccount.com",
+			"optional": "optional@p.iam.gserviceaccount.com",
+		}}
+		conditional = func(n int) PolicyBindings {
+			bindings := make(PolicyBindings, 0, n)
+			for i := 0; i < n; i++ {
+				bindings = append(bindings, PolicyBinding{
+					Expression: fmt.Sprintf("request.path == \"/%d\"", i), Title: fmt.Sprintf("binding-%d", i)})
+			}
+			return bindings
+		}
+		bindings = fakeIdentityAccessManagementReader{
+			"capped@p.iam.gserviceaccount.com":   conditional(5),
+			"bounded@p.iam.gserviceaccount.com":  conditional(3),
+			"optional@p.iam.gserviceaccount.com": append(conditional(5), PolicyBinding{}),
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+	)
+	authenticator.SetMaxBindings(3)
+	requestUrl, _ := url.Parse("https://myurl.com/2")
+
+	var tests = []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"TestBindingsExceedingMaximumDenied", "capped", ErrTooManyBindings},
+		{"TestBindingsWithinMaximumEvaluated", "bounded", nil},
+		// Unconditional binding is granted without evaluation.
+		{"TestUnconditionalBindingNotCapped", "optional", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			denied := testutil.ToFloat64(tooManyBindingsCounter)
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.err, err)
+			} else if tt.err != nil && testutil.ToFloat64(tooManyBindingsCounter) != denied+1 {
+				t.Fatal("Expected denial given too many bindings to be counted.")
+			}
+		})
+	}
+}
+
+func TestCacheKeyID(t *testing.T) {
+	var tests = []struct {
+		name  string
+		token string
+		aud   string
+		id    string
+	}{
+		// Ids are fixed, such that ids of logs are comparable across runs.
+		{"TestCacheKeyIDOfAudience", "token", "https://myurl.com", "f2a5d8ea36c9"},
+		{"TestCacheKeyIDOfOtherAudience", "token", "https://other.com", "df0cbf80ae6c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tokenCacheKey(tt.token, tt.aud)
+			if id := cacheKeyID(key); id != tt.id {
+				t.Fatalf("Expected cache key id %s, cache key id %s was returned.", tt.id, id)
+			} else if id != cacheKeyID(tokenCacheKey(tt.token, tt.aud)) {
+				t.Fatal("Expected cache key id to be stable.")
+			}
+		})
+	}
+}
+
+func TestMaxCacheTTL(t *testing.T) {
+	var (
+		issuer   = newFakeOpenIDIssuer(t)
+		email    = "sa@p.iam.gserviceaccount.com"
+		bindings = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{}}}
+		exp      = time.Now().Add(10 * time.Hour)
+	)
+	var tests = []struct {
+		name       string
+		requestUrl string
+		maxTTL     time.Duration
+		expected   time.Time
+	}{
+		{"TestUncappedTTLIsExpiry", "https://myurl.com/hello", 0, exp},
+		{"TestTTLIsCapped", "https://myurl.com/hello", time.Hour, time.Now().Add(time.Hour)},
+		{"TestTTLBeyondExpiryIsExpiry", "https://myurl.com/hello", 24 * time.Hour, exp},
+		{"TestTTLOfAudienceTakesPrecedence", "https://other.com/hello", time.Hour, time.Now().Add(time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				tokenCache       = cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[GoogleServiceAccount]]()
+				authenticator, _ = NewGoogleCloudTokenAuthenticator(issuer.newTokenService(t, PrincipalClaimEmail), tokenCache,
+					bindings, fakeGoogleWorkspaceClient{}, nil, EmailDomainFilter{}, 50*time.Millisecond, FailOpen{})
+				requestUrl, _ = url.Parse(tt.requestUrl)
+				aud           = requestUrl.Scheme + "://" + requestUrl.Host
+				token         = issuer.mint(t, jwt.MapClaims{"aud": aud, "email": email, "exp": exp.Unix()})
+			)
+			authenticator.SetMaxCacheTTL(tt.maxTTL, map[string]time.Duration{"https://other.com": time.Minute})
+			if _, err := authenticator.Authenticate(context.Background(), token, *requestUrl); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			entry, ok := tokenCache.Get(tokenCacheKey(token, aud))
+			if !ok {
+				t.Fatal("Expected verified token to be cached.")
+			} else if diff := entry.Exp - tt.expected.Unix(); diff < -1 || diff > 1 {
+				t.Fatalf("Expected cache expiry %d, expiry %d was given.", tt.expected.Unix(), entry.Exp)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// titleLabels labels bindings by title, the first max distinct titles are labels and others are labeled other, such
+// that cardinality is bounded given arbitrary titles of policy. Bindings without title are labeled unknown.
+type titleLabels struct {
+	mu     sync.Mutex
+	titles map[string]struct{}
+	max    int
+}
+
+// SetBindingMetrics observes duration of evaluation of conditional expressions by title of binding, for at most
+// maxTitles distinct titles. Titles beyond are labeled other. Zero is disabled. Results of condition result cache are
+// not observed. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetBindingMetrics(maxTitles int) {
+	if maxTitles <= 0 {
+		g.bindingTitles = nil
+		return
+	}
+	g.bindingTitles = &titleLabels{titles: make(map[string]struct{}, maxTitles), max: maxTitles}
+}
+
+// label returns label of title.
+func (l *titleLabels) label(title string) string {
+	if len(title) == 0 {
+		return labelUnknown
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.titles[title]; ok {
+		return title
+	} else if len(l.titles) < l.max {
+		l.titles[title] = struct{}{}
+		return title
+	}
+	return labelOther
+}
+
+// evaluateBinding evaluates expression of binding given params, duration is observed by title given SetBindingMetrics.
+// Evaluations cancelled given ctx are not observed.
+func (g *GoogleCloudTokenAuthenticator) evaluateBinding(ctx context.Context, binding PolicyBinding, params celParams) (bool, error) {
+	if g.bindingTitles == nil {
+		return doesConditionalExpressionEvaluateToTrue(ctx, binding.Expression, params)
+	}
+	start := time.Now()
+	result, err := doesConditionalExpressionEvaluateToTrue(ctx, binding.Expression, params)
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		bindingEvaluationDurationHistogram.WithLabelValues(g.bindingTitles.label(binding.Title)).Observe(time.Since(start).Seconds())
+	}
+	return result, err
+}
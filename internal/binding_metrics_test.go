@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"testing"
+)
+
+func TestBindingMetrics(t *testing.T) {
+	var (
+		first    = GoogleServiceAccount("first@p.iam.gserviceaccount.com")
+		second   = GoogleServiceAccount("second@p.iam.gserviceaccount.com")
+		untitled = GoogleServiceAccount("untitled@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"first": string(first), "second": string(second), "untitled": string(untitled)}}
+		bindings = fakeIdentityAccessManagementReader{
+			first:    {{Expression: "request.path.startsWith(\"/hello\")", Title: "binding-metrics-first"}},
+			second:   {{Expression: "request.path.startsWith(\"/other\")", Title: "binding-metrics-second"}},
+			untitled: {{Expression: "request.path.startsWith(\"/hello\")"}},
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	// Only first title is a label, others are labeled other.
+	authenticator.SetBindingMetrics(1)
+
+	var tests = []struct {
+		name       string
+		token      string
+		statusCode int
+		label      string
+	}{
+		{"TestBindingIsObservedByTitle", "first", http.StatusOK, "binding-metrics-first"},
+		{"TestBindingIsObservedByTitleOnEveryEvaluation", "first", http.StatusOK, "binding-metrics-first"},
+		{"TestBindingBeyondMaxTitlesIsObservedAsOther", "second", http.StatusUnauthorized, labelOther},
+		{"TestBindingWithoutTitleIsObservedAsUnknown", "untitled", http.StatusOK, labelUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			histogram := bindingEvaluationDurationHistogram.WithLabelValues(tt.label).(prometheus.Histogram)
+			observations := histogramSampleCount(t, histogram)
+			if rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if n := histogramSampleCount(t, histogram) - observations; n != 1 {
+				t.Fatalf("Expected evaluation labeled %s to be observed once, %d observations were made.", tt.label, n)
+			}
+		})
+	}
+	t.Run("TestBindingMetricsIsDisabled", func(t *testing.T) {
+		authenticator := newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		histogram := bindingEvaluationDurationHistogram.WithLabelValues("binding-metrics-first").(prometheus.Histogram)
+		observations := histogramSampleCount(t, histogram)
+		if rsp := doAuthRequest(newFakeAuthServiceListener(t, authenticator), "first", "https://myurl.com/hello"); rsp.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, status code %d was returned.", http.StatusOK, rsp.Code)
+		} else if n := histogramSampleCount(t, histogram) - observations; n != 0 {
+			t.Fatalf("Expected no observations, %d observations were made.", n)
+		}
+	})
+}
@@ -67,6 +67,15 @@ func (c *CopyOnWriteCache[K, V]) Set(key K, val V) {
 	c.cache.Store(&newMap)
 }
 
+// Range calls f for each item of a snapshot of cache, until f returns false. Neither write nor delete is blocked.
+func (c *CopyOnWriteCache[K, V]) Range(f func(key K, val V) bool) {
+	for k, v := range *c.cache.Load() {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
 // Get value from cache.
 func (c *CopyOnWriteCache[K, V]) Get(key K) (V, bool) {
 	orgMap := *c.cache.Load()
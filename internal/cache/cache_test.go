@@ -21,6 +21,33 @@ func TestNewCopyOnWriteCache(t *testing.T) {
 	}
 }
 
+func TestCopyOnWriteCacheRange(t *testing.T) {
+	copyWriteCache := cache.NewCopyOnWriteCache[string, int]()
+	copyWriteCache.Set("a", 1)
+	copyWriteCache.Set("b", 2)
+
+	visited := make(map[string]int)
+	copyWriteCache.Range(func(key string, val int) bool {
+		visited[key] = val
+		return true
+	})
+	if len(visited) != 2 || visited["a"] != 1 || visited["b"] != 2 {
+		t.Fatalf("Expected entries a and b, got %v.", visited)
+	}
+	if _, ok := copyWriteCache.Get("a"); !ok {
+		t.Fatal("Expected entry to remain after range.")
+	}
+
+	var calls int
+	copyWriteCache.Range(func(string, int) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Fatalf("Expected range to stop after first entry, got %d calls.", calls)
+	}
+}
+
 func BenchmarkCopyOnWriteCacheReading(b *testing.B) {
 	copyOnWriteCache := cache.NewCopyOnWriteCache[string, string]()
 
@@ -2,12 +2,15 @@ package cache
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 )
 
 // ExpiryCache is an implementation of Cache interface with cache expiration built in.
 type ExpiryCache[V any] struct {
 	Cache[string, ExpiryCacheValue[V]]
+	// retention is seconds entries are retained past expiration.
+	retention atomic.Int64
 }
 
 // ExpiryCacheValue is cache value for expiry cache. Exp represents unix timestamp in seconds.
@@ -25,6 +28,39 @@ func NewExpiryCache[V any](ctx context.Context, interval time.Duration) *ExpiryC
 	return c
 }
 
+// SetRetention retains entries for retention past expiration before purged, i.e. to serve stale entries.
+func (e *ExpiryCache[V]) SetRetention(retention time.Duration) {
+	e.retention.Store(int64(retention.Seconds()))
+}
+
+// ranger is a Cache of which entries are visited read-only, i.e. CopyOnWriteCache.
+type ranger[K comparable, V any] interface {
+	Range(f func(key K, val V) bool)
+}
+
+// Entries returns entries of cache not expired at now.
+func (e *ExpiryCache[V]) Entries(now int64) map[string]ExpiryCacheValue[V] {
+	entries := make(map[string]ExpiryCacheValue[V])
+	visit := func(key string, val ExpiryCacheValue[V]) {
+		if val.Exp > now {
+			entries[key] = val
+		}
+	}
+	if r, ok := e.Cache.(ranger[string, ExpiryCacheValue[V]]); ok {
+		r.Range(func(key string, val ExpiryCacheValue[V]) bool {
+			visit(key, val)
+			return true
+		})
+		return entries
+	}
+	// Every entry is visited, none is deleted.
+	e.Delete(func(key string, val ExpiryCacheValue[V]) bool {
+		visit(key, val)
+		return false
+	})
+	return entries
+}
+
 func (e *ExpiryCache[V]) cleaner(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -34,13 +70,10 @@ func (e *ExpiryCache[V]) cleaner(ctx context.Context, interval time.Duration) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			now := time.Now().Unix()
+			// Entries are purged once expired, beyond retention.
+			expired := time.Now().Unix() - e.retention.Load()
 			e.Delete(func(_ string, val ExpiryCacheValue[V]) bool {
-				// Consider interval when looking at expiration timestamp.
-				if (val.Exp + int64(interval.Seconds())) >= now {
-					return true
-				}
-				return false
+				return val.Exp < expired
 			})
 		}
 	}
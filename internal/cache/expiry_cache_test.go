@@ -13,7 +13,7 @@ func TestExpiryCacheCleanerRoutine(t *testing.T) {
 	cache.Set(key,
 		ExpiryCacheValue[string]{
 			Val: "",
-			Exp: time.Now().Unix(),
+			Exp: time.Now().Unix() - 1,
 		})
 	for i := 0; i < 10; i++ {
 		if _, ok := cache.Get(key); !ok {
@@ -23,3 +23,43 @@ func TestExpiryCacheCleanerRoutine(t *testing.T) {
 	}
 	t.Fatal("Expected entry to be purged from cache.")
 }
+
+func TestExpiryCacheCleanerRetainsEntries(t *testing.T) {
+	var tests = []struct {
+		name      string
+		exp       int64
+		retention time.Duration
+	}{
+		{"TestFreshEntryRetained", time.Now().Add(time.Minute).Unix(), 0},
+		{"TestExpiredEntryWithinRetention", time.Now().Add(-time.Second).Unix(), time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cache := NewExpiryCache[string](ctx, 10*time.Millisecond)
+			cache.SetRetention(tt.retention)
+
+			cache.Set("test", ExpiryCacheValue[string]{Exp: tt.exp})
+			time.Sleep(100 * time.Millisecond)
+			if _, ok := cache.Get("test"); !ok {
+				t.Fatal("Expected entry to be retained in cache.")
+			}
+		})
+	}
+}
+
+func TestExpiryCacheEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := NewExpiryCache[string](ctx, time.Minute)
+
+	now := time.Now().Unix()
+	cache.Set("fresh", ExpiryCacheValue[string]{Val: "fresh", Exp: now + 60})
+	cache.Set("expired", ExpiryCacheValue[string]{Val: "expired", Exp: now})
+	if entries := cache.Entries(now); len(entries) != 1 || entries["fresh"].Val != "fresh" {
+		t.Fatalf("Expected only fresh entry, entries %v were given.", entries)
+	} else if _, ok := cache.Get("expired"); !ok {
+		t.Fatal("Expected expired entry to be retained in cache.")
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrInvalidCacheSnapshot is given when snapshot of cache is malformed or signature of snapshot is not valid, i.e.
+// given tampering.
+var ErrInvalidCacheSnapshot = errors.New("invalid cache snapshot")
+
+// cacheSnapshot is entries of token cache, signed by HMAC-SHA256 of entries.
+type cacheSnapshot struct {
+	Entries   json.RawMessage `json:"entries"`
+	Signature string          `json:"signature"`
+}
+
+// signCacheSnapshot returns HMAC-SHA256 of entries given key.
+func signCacheSnapshot(key, entries []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(entries)
+	return mac.Sum(nil)
+}
+
+// WriteCacheSnapshot writes entries of token cache not expired to file, signed given key, such that cache is restored
+// given restart without re-verification of tokens. Keys of entries are SHA-256 of token and audience, tokens are never
+// written. Snapshot is renamed into place, a partial snapshot is never read. Number of written entries is returned.
+func WriteCacheSnapshot(file string, key []byte, c *cache.ExpiryCache[GoogleServiceAccount]) (int, error) {
+	if len(key) == 0 {
+		return 0, fmt.Errorf("%w: key is required", ErrInvalidCacheSnapshot)
+	}
+	entries := c.Entries(time.Now().Unix())
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		return 0, err
+	}
+	snapshot, err := json.Marshal(cacheSnapshot{
+		Entries:   encoded,
+		Signature: base64.StdEncoding.EncodeToString(signCacheSnapshot(key, encoded)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(snapshot); err != nil {
+		_ = tmp.Close()
+		return 0, err
+	} else if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	return len(entries), os.Rename(tmp.Name(), file)
+}
+
+// ReadCacheSnapshot restores entries of snapshot file not expired into c, given signature of snapshot is valid given
+// key. Snapshot is never partially restored. Number of restored entries is returned.
+func ReadCacheSnapshot(file string, key []byte, c cache.Cache[string, cache.ExpiryCacheValue[GoogleServiceAccount]]) (int, error) {
+	if len(key) == 0 {
+		return 0, fmt.Errorf("%w: key is required", ErrInvalidCacheSnapshot)
+	}
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	var snapshot cacheSnapshot
+	if err = json.Unmarshal(buf, &snapshot); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidCacheSnapshot, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(snapshot.Signature)
+	if err != nil || !hmac.Equal(signature, signCacheSnapshot(key, snapshot.Entries)) {
+		return 0, fmt.Errorf("%w: signature is not valid", ErrInvalidCacheSnapshot)
+	}
+	var entries map[string]cache.ExpiryCacheValue[GoogleServiceAccount]
+	if err = json.Unmarshal(snapshot.Entries, &entries); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidCacheSnapshot, err)
+	}
+	var (
+		now      = time.Now().Unix()
+		restored int
+	)
+	for k, entry := range entries {
+		if entry.Exp > now && len(entry.Val) > 0 {
+			c.Set(k, entry)
+			restored++
+		}
+	}
+	return restored, nil
+}
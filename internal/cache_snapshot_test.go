@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		file        = filepath.Join(t.TempDir(), "jwt-cache.json")
+		key         = []byte("snapshot-key")
+		source      = cache.NewExpiryCache[GoogleServiceAccount](ctx, time.Minute)
+		valid       = tokenCacheKey("token", "https://myurl.com")
+		expired     = tokenCacheKey("expired", "https://myurl.com")
+	)
+	t.Cleanup(cancel)
+	source.Set(valid, cache.ExpiryCacheValue[GoogleServiceAccount]{Val: "user@example.com", Exp: time.Now().Add(time.Hour).Unix()})
+	source.Set(expired, cache.ExpiryCacheValue[GoogleServiceAccount]{Val: "user@example.com", Exp: time.Now().Add(-time.Minute).Unix()})
+	if written, err := WriteCacheSnapshot(file, key, source); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if written != 1 {
+		t.Fatalf("Expected 1 written entry, %d entries were written.", written)
+	}
+	snapshot, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+
+	var tests = []struct {
+		name     string
+		key      []byte
+		snapshot []byte
+		restored int
+		err      error
+	}{
+		{"TestSnapshotRoundTrip", key, snapshot, 1, nil},
+		{"TestTamperedIdentityIsRejected", key, bytes.Replace(snapshot, []byte("user@example.com"),
+			[]byte("admin@example.com"), 1), 0, ErrInvalidCacheSnapshot},
+		{"TestTamperedEntryIsRejected", key, bytes.Replace(snapshot, []byte(valid),
+			[]byte(tokenCacheKey("forged", "https://myurl.com")), 1), 0, ErrInvalidCacheSnapshot},
+		{"TestSnapshotOfOtherKeyIsRejected", []byte("other-key"), snapshot, 0, ErrInvalidCacheSnapshot},
+		{"TestMalformedSnapshotIsRejected", key, snapshot[:len(snapshot)/2], 0, ErrInvalidCacheSnapshot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(file, tt.snapshot, 0o600); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			target := cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[GoogleServiceAccount]]()
+			restored, err := ReadCacheSnapshot(file, tt.key, target)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.err, err)
+			} else if restored != tt.restored {
+				t.Fatalf("Expected %d restored entries, %d entries were restored.", tt.restored, restored)
+			} else if entry, ok := target.Get(valid); ok != (tt.restored > 0) || (ok && entry.Val != "user@example.com") {
+				t.Fatalf("Expected entry to be restored given %d restored entries, entry %v was given.", tt.restored, entry)
+			} else if _, ok = target.Get(expired); ok {
+				t.Fatal("Expected expired entry not to be restored.")
+			}
+		})
+	}
+}
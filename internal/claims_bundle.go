@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ClaimsBundle is configuration of base64 encoded JSON of selected claims of verified token, set as Header on response.
+// Bundle is not signed, only use with upstream on trusted network. Claims not present in token are omitted.
+type ClaimsBundle struct {
+	Header string
+	Claims []string
+}
+
+// encode returns base64 encoded JSON of selected claims of token. Token must be verified by Authenticate, as token is
+// parsed without verification.
+func (c ClaimsBundle) encode(tokenString string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return "", err
+	}
+	selected := make(map[string]any, len(c.Claims))
+	for _, claim := range c.Claims {
+		if val, ok := claims[claim]; ok {
+			selected[claim] = val
+		}
+	}
+	bundle, err := json.Marshal(selected)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(bundle), nil
+}
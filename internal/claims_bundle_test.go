@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClaimsBundleHeader(t *testing.T) {
+	var (
+		issuer   = newFakeOpenIDIssuer(t)
+		email    = "sa@p.iam.gserviceaccount.com"
+		bindings = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{Title: "all"}}}
+		listener = newFakeAuthServiceListener(t,
+			newFakeAuthenticator(t, issuer.newTokenService(t, PrincipalClaimEmail), bindings, EmailDomainFilter{}))
+		idToken = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email, "sub": "1234567890"})
+	)
+	listener.SetClaimsBundle(ClaimsBundle{Header: "X-Auth-Claims", Claims: []string{"email", "sub", "acr"}})
+
+	req := httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+idToken)
+	req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+	req.Header.Set("X-Auth-Claims", "injected")
+	rec := httptest.NewRecorder()
+	listener.httpServer.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200 OK, status code %d was returned.", rec.Code)
+	} else if len(req.Header.Get("X-Auth-Claims")) > 0 {
+		t.Fatal("Expected inbound claims bundle header to be removed.")
+	}
+	bundle, err := base64.StdEncoding.DecodeString(rec.Header().Get("X-Auth-Claims"))
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var claims map[string]any
+	if err = json.Unmarshal(bundle, &claims); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if len(claims) != 2 || claims["email"] != email || claims["sub"] != "1234567890" {
+		t.Fatalf("Expected claims email and sub of token, claims %v were returned.", claims)
+	}
+}
+
+func TestClaimsBundleHeaderDisabled(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{Title: "all"}}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+	)
+	rec := doAuthRequest(listener, "token", "https://myurl.com/hello")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200 OK, status code %d was returned.", rec.Code)
+	} else if len(rec.Header().Get("X-Auth-Claims")) > 0 {
+		t.Fatal("Expected no claims bundle header given claims bundle is disabled.")
+	}
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ClientCertificateAuthenticator is an optional interface of Authenticator to authorize identity of a client
+// certificate, as verified by a trusted gateway terminating mTLS. Authorized identity is returned.
+type ClientCertificateAuthenticator interface {
+	AuthenticateClientCertificate(ctx context.Context, identity GoogleServiceAccount, requestUrl url.URL) (GoogleServiceAccount, error)
+}
+
+// ErrInvalidClientCertificate is given when header X-Forwarded-Client-Cert holds no identity.
+var ErrInvalidClientCertificate = errors.New("invalid forwarded client certificate")
+
+// clientCertificateIdentity returns identity of first element of X-Forwarded-Client-Cert header, as set by Envoy.
+// Identity is in order of precedence URI SAN, DNS SAN and common name of Subject.
+func clientCertificateIdentity(header string) (GoogleServiceAccount, error) {
+	elements := splitUnquoted(header, ',')
+	if len(elements) == 0 {
+		return "", fmt.Errorf("%w: empty header", ErrInvalidClientCertificate)
+	}
+	fields := make(map[string]string, 5)
+	for _, pair := range splitUnquoted(elements[0], ';') {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return "", fmt.Errorf("%w: malformed pair %s", ErrInvalidClientCertificate, pair)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		// Only first value of each key is used, i.e. the first SAN.
+		if _, ok = fields[key]; !ok {
+			fields[key] = unquote(strings.TrimSpace(value))
+		}
+	}
+	switch {
+	case len(fields["uri"]) > 0:
+		return GoogleServiceAccount(fields["uri"]), nil
+	case len(fields["dns"]) > 0:
+		return GoogleServiceAccount(fields["dns"]), nil
+	}
+	for _, rdn := range splitUnquoted(fields["subject"], ',') {
+		if cn, ok := strings.CutPrefix(strings.TrimSpace(rdn), "CN="); ok && len(cn) > 0 {
+			return GoogleServiceAccount(cn), nil
+		}
+	}
+	return "", fmt.Errorf("%w: no uri, dns or subject common name", ErrInvalidClientCertificate)
+}
+
+// splitUnquoted splits s on sep, ignoring sep within double quotes.
+func splitUnquoted(s string, sep rune) []string {
+	var (
+		parts    = make([]string, 0, 4)
+		start    int
+		isQuoted bool
+		escaped  bool
+	)
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			isQuoted = !isQuoted
+		case r == sep && !isQuoted:
+			if part := strings.TrimSpace(s[start:i]); len(part) > 0 {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	if part := strings.TrimSpace(s[start:]); len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// unquote removes surrounding double quotes and escaping of double quotes.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.ReplaceAll(s[1:len(s)-1], `\"`, `"`)
+	}
+	return s
+}
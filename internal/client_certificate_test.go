@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCertificateIdentity(t *testing.T) {
+	var tests = []struct {
+		name     string
+		header   string
+		identity GoogleServiceAccount
+		error    error
+	}{
+		{"TestUriSubjectAlternativeName",
+			`By=spiffe://cluster.local/ns/default/sa/proxy;Hash=468ed33be74eee6556d90c0149c1309e9ba61d6425303443c0748a02dd8de688;Subject="CN=client,OU=Open IAP";URI=spiffe://cluster.local/ns/default/sa/client;DNS=client.example.com`,
+			"spiffe://cluster.local/ns/default/sa/client", nil},
+		{"TestDnsSubjectAlternativeName",
+			`Hash=468ed33b;DNS=client.example.com;DNS=other.example.com`, "client.example.com", nil},
+		{"TestSubjectCommonName",
+			`Hash=468ed33b;Subject="OU=Open IAP,CN=sa@p.iam.gserviceaccount.com"`, "sa@p.iam.gserviceaccount.com", nil},
+		{"TestFirstElementIsUsed",
+			`Hash=1;URI=spiffe://first,Hash=2;URI=spiffe://second`, "spiffe://first", nil},
+		{"TestQuotedSeparators",
+			`Hash=1;Subject="CN=sa@p.iam.gserviceaccount.com,O=\"Open; IAP\""`, "sa@p.iam.gserviceaccount.com", nil},
+		{"TestNoIdentity", `Hash=468ed33b;Subject="OU=Open IAP"`, "", ErrInvalidClientCertificate},
+		{"TestMalformedHeader", `Hash`, "", ErrInvalidClientCertificate},
+		{"TestEmptyHeader", ` `, "", ErrInvalidClientCertificate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := clientCertificateIdentity(tt.header)
+			if !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.error, err)
+			} else if identity != tt.identity {
+				t.Fatalf("Expected identity %s, identity %s was returned.", tt.identity, identity)
+			}
+		})
+	}
+}
+
+func TestClientCertificateAuthorization(t *testing.T) {
+	var (
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, &fakeTokenVerifier{}, bindings, EmailDomainFilter{}))
+	)
+	listener.SetClientCertificateHeader("X-Forwarded-Client-Cert")
+
+	var tests = []struct {
+		name       string
+		header     string
+		statusCode int
+		email      string
+	}{
+		{"TestAuthorizedClientCertificate", `Hash=1;Subject="CN=sa@p.iam.gserviceaccount.com"`, http.StatusOK,
+			"accounts.google.com:sa@p.iam.gserviceaccount.com"},
+		{"TestUnauthorizedClientCertificate", `Hash=1;URI=spiffe://cluster.local/ns/default/sa/client`,
+			http.StatusForbidden, ""},
+		{"TestInvalidClientCertificate", `Hash=1`, http.StatusUnauthorized, ""},
+		// Without header, token is required.
+		{"TestNoClientCertificate", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			if len(tt.header) > 0 {
+				req.Header.Set("X-Forwarded-Client-Cert", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			} else if email := rec.Header().Get(headerAuthenticatedUserEmail); email != tt.email {
+				t.Fatalf("Expected identity header %q, identity header %q was returned.", tt.email, email)
+			}
+		})
+	}
+}
+
+func TestClientCertificateIdentityIsFiltered(t *testing.T) {
+	var (
+		bindings = fakeIdentityAccessManagementReader{
+			"sa@p.iam.gserviceaccount.com":     {{}},
+			"other@p.iam.gserviceaccount.com":  {{}},
+			"sa@other.iam.gserviceaccount.com": {{}},
+		}
+		authenticator = newFakeAuthenticator(t, &fakeTokenVerifier{}, bindings,
+			EmailDomainFilter{Allowed: []string{"p.iam.gserviceaccount.com"}})
+		listener = newFakeAuthServiceListener(t, authenticator)
+	)
+	if err := authenticator.SetIdentityPatterns([]string{"sa@*"}); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	listener.SetClientCertificateHeader("X-Forwarded-Client-Cert")
+
+	var tests = []struct {
+		name       string
+		identity   string
+		statusCode int
+	}{
+		{"TestAllowedClientCertificate", "sa@p.iam.gserviceaccount.com", http.StatusOK},
+		{"TestClientCertificateOfDeniedEmailDomain", "sa@other.iam.gserviceaccount.com", http.StatusForbidden},
+		{"TestClientCertificateOfDeniedIdentityPattern", "other@p.iam.gserviceaccount.com", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			req.Header.Set("X-Forwarded-Client-Cert", `Hash=1;Subject="CN=`+tt.identity+`"`)
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rec.Code)
+			}
+		})
+	}
+}
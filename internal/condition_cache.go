@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"maps"
+	"time"
+)
+
+// SetConditionResultCache registers cache of results of conditional expressions, keyed on hash of expression and
+// params, with request.time truncated to buckets of bucket. Results are reused within bucket and invalidated on
+// refresh of policy bindings. Conditions on request.time are evaluated at time of first request of bucket. Must be
+// invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetConditionResultCache(c cache.Cache[string, cache.ExpiryCacheValue[bool]], bucket time.Duration) {
+	g.conditionResults = c
+	g.conditionBucket = int64(max(bucket, time.Second).Seconds())
+}
+
+// conditionResultKey returns key of params given refresh of policy bindings and time bucket of now, empty given no
+// condition result cache. Params failing to encode are never cached.
+func (g *GoogleCloudTokenAuthenticator) conditionResultKey(params celParams, refresh time.Time, now int64) string {
+	if g.conditionResults == nil {
+		return ""
+	}
+	bucketed := maps.Clone(params)
+	bucketed["request.time"] = now / g.conditionBucket
+	bucketed["refresh"] = refresh.UnixNano()
+	// Keys of maps are sorted when encoded, equal params are always equally encoded.
+	encoded, err := json.Marshal(bucketed)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:])
+}
+
+// evaluateCondition evaluates expression of binding given params, result is looked up in and written to condition
+// result cache given key. Failed evaluations are never cached.
+func (g *GoogleCloudTokenAuthenticator) evaluateCondition(ctx context.Context, key string, binding PolicyBinding, params celParams) (bool, error) {
+	if len(key) == 0 {
+		return g.evaluateBinding(ctx, binding, params)
+	}
+	hash := sha256.Sum256([]byte(key + ":" + binding.Expression))
+	key = hex.EncodeToString(hash[:])
+	if entry, ok := g.conditionResults.Get(key); ok && entry.Exp > time.Now().Unix() {
+		conditionResultCacheHitsCounter.Inc()
+		return entry.Val, nil
+	}
+	result, err := g.evaluateBinding(ctx, binding, params)
+	if err != nil {
+		return false, err
+	}
+	// Entry expires at end of bucket, result of a later bucket is never served.
+	bucket := time.Now().Unix()/g.conditionBucket + 1
+	writeCache(func() {
+		g.conditionResults.Set(key, cache.ExpiryCacheValue[bool]{Val: result, Exp: bucket * g.conditionBucket})
+	})
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConditionResultCache(t *testing.T) {
+	var (
+		authenticator = newFakeAuthenticator(t, &fakeTokenVerifier{}, fakeIdentityAccessManagementReader{}, EmailDomainFilter{})
+		expression    = "request.path.startsWith(\"/something\")"
+		refresh       = time.Now()
+		now           = time.Now().Unix() / 60 * 60
+	)
+	authenticator.SetConditionResultCache(cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[bool]](), time.Minute)
+
+	var tests = []struct {
+		name    string
+		path    string
+		now     int64
+		refresh time.Time
+		cached  bool
+	}{
+		{"TestResultIsEvaluated", "/something", now, refresh, false},
+		{"TestResultIsReusedWithinBucket", "/something", now + 59, refresh, true},
+		{"TestResultIsEvaluatedAcrossBuckets", "/something", now + 60, refresh, false},
+		{"TestResultIsEvaluatedGivenOtherPath", "/something/else", now, refresh, false},
+		{"TestResultIsEvaluatedGivenRefresh", "/something", now, refresh.Add(time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := celParams{
+				"request.path": tt.path,
+				"request.host": "myurl.com",
+				"request.time": time.Unix(tt.now, 0),
+			}
+			hits := testutil.ToFloat64(conditionResultCacheHitsCounter)
+			key := authenticator.conditionResultKey(params, tt.refresh, tt.now)
+			if ok, err := authenticator.evaluateCondition(context.Background(), key, PolicyBinding{Expression: expression}, params); err != nil || !ok {
+				t.Fatalf("Expected condition to evaluate to true, error: %v.", err)
+			}
+			if cached := testutil.ToFloat64(conditionResultCacheHitsCounter) > hits; cached != tt.cached {
+				t.Fatalf("Expected result cached %t, cached %t was given.", tt.cached, cached)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithConditionResultCache(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{email: {
+				{Expression: "request.host == \"other.com\"", Title: "other"},
+				{Expression: "request.host == \"myurl.com\"", Title: "myurl"},
+			}},
+			lastRefresh: time.Now(),
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/something")
+	)
+	authenticator.SetConditionResultCache(cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[bool]](), time.Hour)
+
+	hits := testutil.ToFloat64(conditionResultCacheHitsCounter)
+	for i := 0; i < 2; i++ {
+		if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+	}
+	// Second request reuses result of at least the granting expression.
+	if testutil.ToFloat64(conditionResultCacheHitsCounter) <= hits {
+		t.Fatal("Expected results of conditional expressions to be reused.")
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ParamLimits bounds size in bytes of params of conditional expressions, such that oversized request values, i.e.
+// path or query of request url, can't exhaust memory of evaluation. MaxValueBytes bounds each param and MaxTotalBytes
+// all params. Zero is unbounded.
+type ParamLimits struct {
+	MaxValueBytes int
+	MaxTotalBytes int
+}
+
+// ErrParamsTooLarge is given when params of conditional expressions exceed ParamLimits. Request is rejected rather
+// than truncated, a truncated path could match a prefix not requested.
+var ErrParamsTooLarge = errors.New("params of conditional expression too large")
+
+// SetParamLimits bounds size of params of conditional expressions. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetParamLimits(limits ParamLimits) {
+	g.paramLimits = limits
+}
+
+// verify returns ErrParamsTooLarge given params exceed limits.
+func (l ParamLimits) verify(params celParams) error {
+	var total int
+	for name, val := range params {
+		size := paramSize(val)
+		if l.MaxValueBytes > 0 && size > l.MaxValueBytes {
+			oversizedParamsCounter.WithLabelValues(name).Inc()
+			return fmt.Errorf("%w: %s of %d bytes exceeds %d", ErrParamsTooLarge, name, size, l.MaxValueBytes)
+		}
+		total += size
+	}
+	if l.MaxTotalBytes > 0 && total > l.MaxTotalBytes {
+		oversizedParamsCounter.WithLabelValues("total").Inc()
+		return fmt.Errorf("%w: params of %d bytes exceeds %d", ErrParamsTooLarge, total, l.MaxTotalBytes)
+	}
+	return nil
+}
+
+// paramSize returns size in bytes of val, keys of maps included. Scalars are of 8 bytes.
+func paramSize(val any) int {
+	switch val := val.(type) {
+	case string:
+		return len(val)
+	case []string:
+		var size int
+		for _, s := range val {
+			size += len(s)
+		}
+		return size
+	case []any:
+		var size int
+		for _, v := range val {
+			size += paramSize(v)
+		}
+		return size
+	case map[string][]string:
+		var size int
+		for k, v := range val {
+			size += len(k) + paramSize(v)
+		}
+		return size
+	case map[string]any:
+		var size int
+		for k, v := range val {
+			size += len(k) + paramSize(v)
+		}
+		return size
+	default:
+		return 8
+	}
+}
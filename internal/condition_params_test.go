@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParamLimits(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = fakeIdentityAccessManagementReader{email: {
+			{Expression: "request.path.startsWith(\"/hello\")", Title: "hello"},
+		}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	authenticator.SetParamLimits(ParamLimits{MaxValueBytes: 1024, MaxTotalBytes: 2048})
+
+	var tests = []struct {
+		name       string
+		requestUrl string
+		statusCode int
+		param      string
+	}{
+		{"TestParamsWithinLimits", "https://myurl.com/hello?a=b", http.StatusOK, ""},
+		{"TestOversizedPathIsRejected", "https://myurl.com/hello/" + strings.Repeat("a", 1024), http.StatusBadRequest,
+			"request.path"},
+		{"TestOversizedQueryIsRejected", "https://myurl.com/hello?a=" + strings.Repeat("a", 1024), http.StatusBadRequest,
+			"request.query"},
+		{"TestOversizedTotalIsRejected", "https://myurl.com/hello/" + strings.Repeat("a", 1000) + "?a=" +
+			strings.Repeat("a", 1000), http.StatusBadRequest, "total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var oversized float64
+			if len(tt.param) > 0 {
+				oversized = testutil.ToFloat64(oversizedParamsCounter.WithLabelValues(tt.param))
+			}
+			if rsp := doAuthRequest(listener, "token", tt.requestUrl); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if len(tt.param) > 0 && testutil.ToFloat64(oversizedParamsCounter.WithLabelValues(tt.param)) != oversized+1 {
+				t.Fatalf("Expected oversized param %s to be counted.", tt.param)
+			}
+		})
+	}
+}
+
+func TestParamSize(t *testing.T) {
+	var tests = []struct {
+		name string
+		val  any
+		size int
+	}{
+		{"TestString", "hello", 5},
+		{"TestList", []string{"a", "bc"}, 3},
+		{"TestQuery", map[string][]string{"a": {"b", "cd"}}, 4},
+		{"TestNestedMap", map[string]any{"os": "MAC_OS", "nested": map[string]any{"a": true}}, 2 + 6 + 6 + 1 + 8},
+		{"TestScalar", int64(1), 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if size := paramSize(tt.val); size != tt.size {
+				t.Fatalf("Expected size %d, size %d was given.", tt.size, size)
+			}
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/anderslauri/open-iap/internal/cache"
 	"github.com/google/cel-go/cel"
+	log "github.com/sirupsen/logrus"
+	"sync"
 )
 
 type celParams map[string]any
@@ -12,14 +16,33 @@ type celParams map[string]any
 // assuming more are required. Those should be appended here below. The conditional parser will use these.
 var celVars = func() *cel.Env {
 	// Based on: https://cloud.google.com/iam/docs/conditions-overview#example-url-host-path
+	// Standard library is included, i.e. string functions startsWith, endsWith, contains and matches.
 	env, _ := cel.NewEnv(
 		cel.Variable("request.path", cel.StringType),
 		cel.Variable("request.host", cel.StringType),
 		cel.Variable("request.time", cel.TimestampType),
+		// Scheme of request url, http or https, given trusted X-Forwarded-Proto scheme as forwarded.
+		cel.Variable("request.scheme", cel.StringType),
+		// URL decoded query parameters of request url, repeated parameters are retained in order.
+		cel.Variable("request.query", cel.MapType(cel.StringType, cel.ListType(cel.StringType))),
+		// Access levels of Access Context Manager satisfied by identity, empty without AccessLevelResolver.
+		cel.Variable("request.auth.access_levels", cel.ListType(cel.StringType)),
+		// IAM principal identifier of verified identity, i.e. serviceAccount:{email}, user:{email} or principal://{subject}.
+		cel.Variable("request.auth.principal", cel.StringType),
+		// Claims iat and auth_time of verified token as timestamps, empty given client certificate.
+		cel.Variable("request.auth.claims", cel.MapType(cel.StringType, cel.TimestampType)),
+		// Target resource of request given mapping of host, empty given none.
+		cel.Variable("resource.name", cel.StringType),
+		cel.Variable("resource.type", cel.StringType),
+		// Attributes of device given trusted device header, i.e. device.is_corp_owned.
+		cel.Variable("device", cel.MapType(cel.StringType, cel.DynType)),
 	)
 	return env
 }()
 
+// maxConcurrentConditionEvaluations bounds the number of conditional expressions evaluated in parallel per request.
+const maxConcurrentConditionEvaluations = 8
+
 // Cache for compiled programs.
 var prgCache = cache.NewCopyOnWriteCache[string, cel.Program]()
 
@@ -31,7 +54,8 @@ func compileProgram(expression string) (cel.Program, error) {
 	if issues != nil && issues.Err() != nil {
 		return nil, fmt.Errorf("type-check error: %s", issues.Err())
 	}
-	prg, err := celVars.Program(ast)
+	// Interrupt comprehensions on each iteration if context of evaluation is done.
+	prg, err := celVars.Program(ast, cel.InterruptCheckFrequency(1))
 	if err != nil {
 		return nil, err
 	}
@@ -40,16 +64,99 @@ func compileProgram(expression string) (cel.Program, error) {
 	return prg, err
 }
 
-func doesConditionalExpressionEvaluateToTrue(expression string, params celParams) (bool, error) {
+// ErrConditionEvaluationTimeout is given when evaluation of conditional expression exceeds deadline of context.
+var ErrConditionEvaluationTimeout = errors.New("conditional expression evaluation timeout")
+
+// doesConditionalExpressionEvaluateToTrue evaluates expression given params. An error is a failure to compile or evaluate
+// expression, distinct from expression evaluating to false. Evaluations cancelled given ctx are not counted.
+func doesConditionalExpressionEvaluateToTrue(ctx context.Context, expression string, params celParams) (result bool, err error) {
+	defer func() {
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			observeConditionEvaluation(result, err)
+		}
+	}()
 	prg, err := compileProgram(expression)
 	if err != nil {
 		return false, err
 	}
-	out, _, err := prg.Eval(map[string]any(params))
-	if err != nil {
+	out, _, err := prg.ContextEval(ctx, map[string]any(params))
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		conditionEvaluationTimeoutsCounter.Inc()
+		return false, fmt.Errorf("%w: %s", ErrConditionEvaluationTimeout, err)
+	} else if err != nil {
 		return false, err
 	} else if val, ok := out.Value().(bool); val && ok == true {
 		return true, nil
 	}
 	return false, nil
 }
+
+// doesAnyConditionalExpressionEvaluateToTrue evaluates conditional expressions of bindings concurrently and returns
+// true as soon as one evaluates to true. Both cel.Env and cel.Program are safe for concurrent use.
+func doesAnyConditionalExpressionEvaluateToTrue(ctx context.Context, bindings PolicyBindings, params celParams) bool {
+	return anyConditionalExpressionEvaluatesToTrue(ctx, bindings,
+		func(ctx context.Context, binding PolicyBinding) (bool, error) {
+			return doesConditionalExpressionEvaluateToTrue(ctx, binding.Expression, params)
+		})
+}
+
+// conditionEvaluator evaluates conditional expression of a single binding given params of request.
+type conditionEvaluator func(ctx context.Context, binding PolicyBinding) (bool, error)
+
+// anyConditionalExpressionEvaluatesToTrue is doesAnyConditionalExpressionEvaluateToTrue given evaluate.
+func anyConditionalExpressionEvaluatesToTrue(ctx context.Context, bindings PolicyBindings, evaluate conditionEvaluator) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, maxConcurrentConditionEvaluations)
+		match     = make(chan struct{}, 1)
+	)
+evaluate:
+	for _, binding := range bindings {
+		if len(binding.Expression) == 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			break evaluate
+		case semaphore <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(binding PolicyBinding) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			if ctx.Err() != nil {
+				return
+			}
+			ok, err := evaluate(ctx, binding)
+			if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+				// Evaluation is short-circuited given match of other binding.
+				return
+			} else if err != nil {
+				log.WithContext(ctx).WithField("error", err).Errorf("Conditional expression with title %s failed evaluation.", binding.Title)
+				return
+			} else if !ok {
+				log.WithContext(ctx).Debugf("Conditional expression with title %s evaluated to false.", binding.Title)
+				return
+			}
+			select {
+			case match <- struct{}{}:
+				// Short-circuit remaining evaluations.
+				cancel()
+			default:
+			}
+		}(binding)
+	}
+	wg.Wait()
+
+	select {
+	case <-match:
+		return true
+	default:
+		return false
+	}
+}
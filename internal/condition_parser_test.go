@@ -1,6 +1,15 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -50,7 +59,7 @@ func TestExpressionParser(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			isTrue, err := doesConditionalExpressionEvaluateToTrue(tt.condition, tt.params)
+			isTrue, err := doesConditionalExpressionEvaluateToTrue(context.Background(), tt.condition, tt.params)
 			if err != nil {
 				t.Fatalf("Test %s returned error %s", tt.name, err)
 			} else if tt.isConditionTrue && !isTrue {
@@ -64,8 +73,208 @@ func TestExpressionParser(t *testing.T) {
 
 func BenchmarkConditionalParserWithCache(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		_, _ = doesConditionalExpressionEvaluateToTrue(
+		_, _ = doesConditionalExpressionEvaluateToTrue(context.Background(),
 			"request.path.endsWith(\"/something\")",
 			params("/something", "myurl.com", time.Now()))
 	}
 }
+
+// conditionalBindings generates n bindings which evaluates to false, including a single binding evaluating to true if match.
+func conditionalBindings(n int, match bool) PolicyBindings {
+	bindings := make(PolicyBindings, 0, n+1)
+	for i := 0; i < n; i++ {
+		bindings = append(bindings, PolicyBinding{
+			Expression: fmt.Sprintf("request.path.startsWith(\"/path-%d\")", i),
+			Title:      fmt.Sprintf("binding-%d", i),
+		})
+	}
+	if match {
+		bindings = append(bindings, PolicyBinding{
+			Expression: "request.path.endsWith(\"/something\")",
+			Title:      "match",
+		})
+	}
+	return bindings
+}
+
+func TestMultipleConditionalExpressionsParser(t *testing.T) {
+	var tests = []struct {
+		name            string
+		bindings        PolicyBindings
+		isConditionTrue bool
+	}{
+		{"TestManyBindingsWithSingleMatchEvaluateToTrue", conditionalBindings(100, true), true},
+		{"TestManyBindingsWithoutMatchEvaluateToFalse", conditionalBindings(100, false), false},
+		{"TestNoBindingsEvaluateToFalse", PolicyBindings{}, false},
+		{"TestInvalidExpressionIsIgnored", append(conditionalBindings(10, true),
+			PolicyBinding{Expression: "request.unknown == 1", Title: "invalid"}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isTrue := doesAnyConditionalExpressionEvaluateToTrue(context.Background(), tt.bindings,
+				params("/something", "myurl.com", time.Now()))
+			if tt.isConditionTrue && !isTrue {
+				t.Fatalf("Test %s is expected to be true.", tt.name)
+			} else if !tt.isConditionTrue && isTrue {
+				t.Fatalf("Test %s is expected not to be true.", tt.name)
+			}
+		})
+	}
+}
+
+func BenchmarkMultipleConditionalExpressionsParser(b *testing.B) {
+	bindings := conditionalBindings(50, true)
+	defaultParams := params("/something", "myurl.com", time.Now())
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_ = doesAnyConditionalExpressionEvaluateToTrue(context.Background(), bindings, defaultParams)
+	}
+}
+
+func TestQueryConditionalExpression(t *testing.T) {
+	requestUrl, _ := url.Parse("https://myurl.com/something?role=reader&role=admin&q=a%20b")
+	queryParams := params(requestUrl.Path, requestUrl.Host, time.Now())
+	queryParams["request.query"] = map[string][]string(requestUrl.Query())
+
+	var tests = []struct {
+		name            string
+		condition       string
+		isConditionTrue bool
+	}{
+		{"TestRepeatedQueryParameterEvaluateToTrue", "\"admin\" in request.query[\"role\"]", true},
+		{"TestRepeatedQueryParameterOrderEvaluateToTrue", "request.query[\"role\"][0] == \"reader\"", true},
+		{"TestDecodedQueryParameterEvaluateToTrue", "request.query[\"q\"] == [\"a b\"]", true},
+		{"TestQueryParameterValueEvaluateToFalse", "\"owner\" in request.query[\"role\"]", false},
+		{"TestMissingQueryParameterEvaluateToFalse",
+			"\"missing\" in request.query && \"a\" in request.query[\"missing\"]", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isTrue, err := doesConditionalExpressionEvaluateToTrue(context.Background(), tt.condition, queryParams)
+			if err != nil {
+				t.Fatalf("Test %s returned error %s", tt.name, err)
+			} else if isTrue != tt.isConditionTrue {
+				t.Fatalf("Test %s is expected to evaluate to %t.", tt.name, tt.isConditionTrue)
+			}
+		})
+	}
+}
+
+func TestStringFunctionConditionalExpression(t *testing.T) {
+	var tests = []struct {
+		name            string
+		condition       string
+		requestPath     string
+		isConditionTrue bool
+	}{
+		{"TestStartsWithEvaluateToTrue", "request.path.startsWith(\"/admin\")", "/admin/users", true},
+		{"TestStartsWithEvaluateToFalse", "request.path.startsWith(\"/admin\")", "/users/admin", false},
+		{"TestEndsWithEvaluateToTrue", "request.path.endsWith(\".json\")", "/api/users.json", true},
+		{"TestContainsEvaluateToTrue", "request.path.contains(\"/v1/\")", "/api/v1/users", true},
+		{"TestContainsEvaluateToFalse", "request.path.contains(\"/v1/\")", "/api/v2/users", false},
+		{"TestMatchesEvaluateToTrue", "request.path.matches(\"^/admin/[0-9]+$\")", "/admin/42", true},
+		{"TestMatchesEvaluateToFalse", "request.path.matches(\"^/admin/[0-9]+$\")", "/admin/users", false},
+		{"TestStartsWithAndHostEvaluateToTrue",
+			"request.path.startsWith(\"/admin\") && request.host.endsWith(\".myurl.com\")", "/admin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isTrue, err := doesConditionalExpressionEvaluateToTrue(context.Background(), tt.condition,
+				params(tt.requestPath, "internal.myurl.com", time.Now()))
+			if err != nil {
+				t.Fatalf("Test %s returned error %s", tt.name, err)
+			} else if isTrue != tt.isConditionTrue {
+				t.Fatalf("Test %s is expected to evaluate to %t.", tt.name, tt.isConditionTrue)
+			}
+		})
+	}
+}
+
+func TestConditionalExpressionEvaluationTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	timeouts := testutil.ToFloat64(conditionEvaluationTimeoutsCounter)
+	// Nested comprehension is interrupted when deadline of context is exceeded.
+	isTrue, err := doesConditionalExpressionEvaluateToTrue(ctx,
+		"[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(x, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(y, request.path.size() > 0))",
+		params("/something", "myurl.com", time.Now()))
+	if isTrue {
+		t.Fatal("Expected condition not to be true given timeout.")
+	} else if !errors.Is(err, ErrConditionEvaluationTimeout) {
+		t.Fatalf("Expected error %s, error returned: %v.", ErrConditionEvaluationTimeout, err)
+	} else if val := testutil.ToFloat64(conditionEvaluationTimeoutsCounter); val != timeouts+1 {
+		t.Fatalf("Expected timeout to be counted once, counted %f.", val-timeouts)
+	}
+}
+
+func TestZeroConditionTimeoutIsNoDeadline(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		// Comprehension is interrupted given exceeded deadline, unlike a single comparison.
+		bindings = fakeIdentityAccessManagementReader{email: {
+			{Expression: "[1, 2, 3].all(x, request.host == \"myurl.com\")", Title: "myurl"},
+		}}
+		authenticator, _ = NewGoogleCloudTokenAuthenticator(verifier, noopCache[GoogleServiceAccount]{}, bindings,
+			fakeGoogleWorkspaceClient{}, nil, EmailDomainFilter{}, 0, FailOpen{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+}
+
+func TestConditionEvaluationErrorIsDistinctFromFalse(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"false": "false@p.iam.gserviceaccount.com",
+			"error": "error@p.iam.gserviceaccount.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{
+			"false@p.iam.gserviceaccount.com": {{Expression: "request.host == \"other.com\"", Title: "false"}},
+			// Type-check error of misconfigured policy.
+			"error@p.iam.gserviceaccount.com": {{Expression: "request.host == 1", Title: "error"}},
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	var tests = []struct {
+		name   string
+		token  string
+		result string
+		log    string
+	}{
+		{"TestFalseConditionIsCountedAsFalse", "false", "false", "level=warning msg=\"Conditional expression with title false evaluated to false"},
+		{"TestErroredConditionIsCountedAsError", "error", "error", "level=error msg=\"Conditional expression with title error failed evaluation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				output   = &bytes.Buffer{}
+				counted  = testutil.ToFloat64(conditionEvaluationsCounter.WithLabelValues(tt.result))
+				falses   = testutil.ToFloat64(conditionEvaluationsCounter.WithLabelValues("false"))
+				errored  = testutil.ToFloat64(conditionEvaluationsCounter.WithLabelValues("error"))
+				expected = map[string]float64{"false": falses, "error": errored}
+			)
+			log.SetOutput(output)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			// Both are denied, only an error is a misconfigured policy.
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, ErrInvalidGoogleCloudAuthentication) {
+				t.Fatalf("Expected error %v, error returned: %v.", ErrInvalidGoogleCloudAuthentication, err)
+			}
+			expected[tt.result] = counted + 1
+			for result, val := range expected {
+				if n := testutil.ToFloat64(conditionEvaluationsCounter.WithLabelValues(result)); n != val {
+					t.Fatalf("Expected %f evaluations of result %s, %f were counted.", val, result, n)
+				}
+			}
+			if !strings.Contains(output.String(), tt.log) {
+				t.Fatalf("Expected log %s, logs %s were given.", tt.log, output.String())
+			}
+		})
+	}
+}
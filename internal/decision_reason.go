@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+)
+
+// decisionReasonHeader is response header of decision reason of /auth given SetDecisionReason.
+const decisionReasonHeader = "X-IAP-Decision-Reason"
+
+// decisionReasons are reason of denial given error, in order. Errors not of any reason are of invalid_token.
+var decisionReasons = []struct {
+	err    error
+	reason string
+}{
+	{ErrAmbiguousToken, "ambiguous_token"},
+	{ErrConflictingRequestURL, "conflicting_request_url"},
+	{ErrMissingRequestURL, "missing_request_url"},
+	{ErrTokenTooLong, "token_too_long"},
+	{ErrMissingBearerToken, "missing_bearer_token"},
+	{ErrInvalidDeviceAttributes, "invalid_device_attributes"},
+	{ErrInvalidHeaderVariable, "invalid_header_variable"},
+	{ErrInvalidClientCertificate, "invalid_client_certificate"},
+	{ErrEmailDomainNotAllowed, "email_domain_not_allowed"},
+	{ErrIdentityNotAllowed, "identity_not_allowed"},
+	{ErrDeniedByPolicy, "deny_policy"},
+	{ErrNoIdentityAwareProxyRoleForUser, "no_role"},
+	{ErrTooManyBindings, "too_many_bindings"},
+	{ErrDeniedByRoute, "route_policy"},
+	{ErrParamsTooLarge, "params_too_large"},
+	{ErrInvalidGoogleCloudAuthentication, "condition_not_satisfied"},
+	{ErrPolicyBindingsUnavailable, "policy_bindings_unavailable"},
+	{ErrRequestBudgetExceeded, "request_budget_exceeded"},
+	{jwt.ErrTokenExpired, "token_expired"},
+	{jwt.ErrTokenUsedBeforeIssued, "issued_in_future"},
+	{ErrMissingIdentity, "missing_identity"},
+	{ErrUnknownKid, "unknown_kid"},
+	{ErrInvalidAudience, "invalid_audience"},
+	{ErrInsufficientAssurance, "insufficient_assurance"},
+	{ErrTokenReplayed, "token_replayed"},
+	{ErrMissingJti, "missing_jti"},
+}
+
+// SetDecisionReason sets X-IAP-Decision-Reason on responses of /auth, granted or denied and reason of decision, i.e.
+// denied:no_role or granted:bypass. Reveals internals of decision to clients, intended for debugging of integrations
+// only. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetDecisionReason(enabled bool) {
+	a.decisionReason = enabled
+}
+
+// setDecisionReason sets reason on w given SetDecisionReason.
+func (a *AuthServiceListener) setDecisionReason(w http.ResponseWriter, reason string) {
+	if a.decisionReason {
+		w.Header().Set(decisionReasonHeader, reason)
+	}
+}
+
+// decisionReason returns decision and reason of err, i.e. denied:no_role. Reason of nil err is granted:identity.
+func decisionReason(err error) string {
+	if err == nil {
+		return "granted:identity"
+	}
+	for _, r := range decisionReasons {
+		if errors.Is(err, r.err) {
+			return "denied:" + r.reason
+		}
+	}
+	return "denied:invalid_token"
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecisionReason(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		denied   = GoogleServiceAccount("denied@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"token": string(email), "denied": string(denied), "norole": "norole@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{
+			email:  {{Expression: "request.path.startsWith(\"/hello\")", Title: "hello"}},
+			denied: {{Expression: "request.path.startsWith(\"/other\")", Title: "other"}},
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	listener.SetDecisionReason(true)
+	listener.SetBypassPaths([]string{"/healthz"})
+
+	var tests = []struct {
+		name       string
+		token      string
+		requestUrl string
+		statusCode int
+		reason     string
+	}{
+		{"TestGrantedIdentity", "token", "https://myurl.com/hello", http.StatusOK, "granted:identity"},
+		{"TestBypassedPath", "", "https://myurl.com/healthz", http.StatusOK, "granted:bypass"},
+		{"TestConditionNotSatisfied", "denied", "https://myurl.com/hello", http.StatusUnauthorized,
+			"denied:condition_not_satisfied"},
+		{"TestNoRole", "norole", "https://myurl.com/hello", http.StatusForbidden, "denied:no_role"},
+		{"TestInvalidToken", "invalid", "https://myurl.com/hello", http.StatusUnauthorized, "denied:invalid_token"},
+		{"TestMissingRequestURL", "token", "/hello", http.StatusUnauthorized, "denied:missing_request_url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp := doAuthRequest(listener, tt.token, tt.requestUrl)
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if reason := rsp.Header().Get(decisionReasonHeader); reason != tt.reason {
+				t.Fatalf("Expected decision reason %s, decision reason %s was returned.", tt.reason, reason)
+			}
+		})
+	}
+	t.Run("TestMissingBearerToken", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/auth", nil)
+		req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+		req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+		rsp := httptest.NewRecorder()
+		listener.httpServer.Handler.ServeHTTP(rsp, req)
+		if reason := rsp.Header().Get(decisionReasonHeader); reason != "denied:missing_bearer_token" {
+			t.Fatalf("Expected decision reason denied:missing_bearer_token, decision reason %s was returned.", reason)
+		}
+	})
+	t.Run("TestDecisionReasonIsDisabled", func(t *testing.T) {
+		listener := newFakeAuthServiceListener(t, authenticator)
+		if reason := doAuthRequest(listener, "norole", "https://myurl.com/hello").Header().Get(decisionReasonHeader); len(reason) > 0 {
+			t.Fatalf("Expected no decision reason, decision reason %s was returned.", reason)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+	iam "google.golang.org/api/iam/v2"
+	"google.golang.org/api/option"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DenyPolicyReader is an interface to load IAM deny policies, which are evaluated before policy bindings.
+type DenyPolicyReader interface {
+	RefreshDenyPolicies(ctx context.Context) error
+	LoadDenyPolicyForGoogleServiceAccount(uid GoogleServiceAccount) (policy string, denied bool, err error)
+}
+
+// DenyPolicyClient is an implementation of DenyPolicyReader reading deny policies attached to project from IAM API.
+// Deny rules of permission iap.googleapis.com/webServiceVersions.accessViaIAP are applied. Deny rules with a denial
+// condition are not applied, conditions of resource tags can't be evaluated.
+type DenyPolicyClient struct {
+	service   *iam.Service
+	pid       string
+	gwsClient GoogleWorkspaceClientReader
+	limiter   *APILimiter
+	rules     atomic.Pointer[denyRuleCollection]
+}
+
+// denyRuleCollection is applied deny rules, of which value is name of deny policy.
+type denyRuleCollection struct {
+	principals map[GoogleServiceAccount]string
+	// public are rules of principalSet://goog/public:all, denying every identity except exceptions.
+	public []publicDenyRule
+}
+
+type publicDenyRule struct {
+	policy     string
+	exceptions map[GoogleServiceAccount]struct{}
+}
+
+const (
+	iapDenyPermission         = "iap.googleapis.com/webServiceVersions.accessViaIAP"
+	iapDenyPermissionWildcard = "iap.googleapis.com/*"
+	denyPrincipalPublic       = "principalSet://goog/public:all"
+)
+
+var (
+	// ErrDeniedByPolicy is returned when identity is explicitly denied by a deny policy.
+	ErrDeniedByPolicy = errors.New("denied by deny policy")
+	// ErrDenyPoliciesUnavailable is returned when deny policies are not loaded. Never allowed given FailOpen, absence
+	// of an explicit deny is unknown.
+	ErrDenyPoliciesUnavailable = fmt.Errorf("%w: deny policies not loaded", ErrPolicyBindingsUnavailable)
+)
+
+// NewDenyPolicyClient creates a client of deny policies attached to project, refreshed every refresh. Calls are bounded
+// by limiter, nil is unbounded. Initial load of deny policies is bounded by startup.
+func NewDenyPolicyClient(ctx context.Context, googleWorkspaceClient GoogleWorkspaceClientReader,
+	credentials *google.Credentials, refresh time.Duration, limiter *APILimiter, startup StartupDeadline) (*DenyPolicyClient, error) {
+	service, err := iam.NewService(ctx, option.WithCredentials(credentials))
+	if err != nil {
+		return nil, err
+	}
+	d := newDenyPolicyClient(service, credentials.ProjectID, googleWorkspaceClient, limiter)
+	if err = startup.load(ctx, "deny policies", d.RefreshDenyPolicies); err != nil {
+		return nil, err
+	}
+	go d.refreshDenyPolicies(ctx, refresh)
+	return d, nil
+}
+
+func newDenyPolicyClient(service *iam.Service, pid string, gws GoogleWorkspaceClientReader, limiter *APILimiter) *DenyPolicyClient {
+	return &DenyPolicyClient{
+		service:   service,
+		pid:       pid,
+		gwsClient: gws,
+		limiter:   limiter,
+	}
+}
+
+func (d *DenyPolicyClient) refreshDenyPolicies(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.RefreshDenyPolicies(ctx); err != nil {
+				log.WithField("error", err).Error("Could not refresh deny policies.")
+			}
+		}
+	}
+}
+
+// LoadDenyPolicyForGoogleServiceAccount returns name of deny policy given identity is denied.
+func (d *DenyPolicyClient) LoadDenyPolicyForGoogleServiceAccount(uid GoogleServiceAccount) (string, bool, error) {
+	rules := d.rules.Load()
+	if rules == nil {
+		return "", false, ErrDenyPoliciesUnavailable
+	} else if policy, ok := rules.principals[uid]; ok {
+		return policy, true, nil
+	}
+	for _, rule := range rules.public {
+		if _, ok := rule.exceptions[uid]; !ok {
+			return rule.policy, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// RefreshDenyPolicies loads deny rules of Identity Aware Proxy of every deny policy attached to project.
+func (d *DenyPolicyClient) RefreshDenyPolicies(ctx context.Context) error {
+	// Rules are omitted when listing, each policy is retrieved.
+	names := make([]string, 0, 10)
+	if err := d.limiter.Acquire(ctx); err != nil {
+		return err
+	}
+	err := d.service.Policies.ListPolicies(
+		fmt.Sprintf("policies/cloudresourcemanager.googleapis.com%%2Fprojects%%2F%s/denypolicies", d.pid)).Pages(ctx,
+		func(rsp *iam.GoogleIamV2ListPoliciesResponse) error {
+			for _, policy := range rsp.Policies {
+				names = append(names, policy.Name)
+			}
+			return nil
+		})
+	d.limiter.Release()
+	if err != nil {
+		return err
+	}
+	rules := &denyRuleCollection{principals: make(map[GoogleServiceAccount]string, 10)}
+
+	for _, name := range names {
+		if err = d.limiter.Acquire(ctx); err != nil {
+			return err
+		}
+		policy, err := d.service.Policies.Get(name).Context(ctx).Do()
+		d.limiter.Release()
+		if err != nil {
+			return err
+		}
+		for _, rule := range policy.Rules {
+			if err = d.applyDenyRule(ctx, policy.Name, rule.DenyRule, rules); err != nil {
+				return err
+			}
+		}
+	}
+	d.rules.Store(rules)
+	log.Infof("Loaded %d deny policies with %d denied identities and %d public deny rules.",
+		len(names), len(rules.principals), len(rules.public))
+	return nil
+}
+
+// applyDenyRule adds denied identities of rule to rules, given rule denies permission of Identity Aware Proxy.
+func (d *DenyPolicyClient) applyDenyRule(ctx context.Context, policy string, rule *iam.GoogleIamV2DenyRule, rules *denyRuleCollection) error {
+	if rule == nil || slices.Contains(rule.ExceptionPermissions, iapDenyPermission) ||
+		!slices.ContainsFunc(rule.DeniedPermissions, func(p string) bool {
+			return p == iapDenyPermission || p == iapDenyPermissionWildcard
+		}) {
+		return nil
+	} else if rule.DenialCondition != nil {
+		log.Warningf("Deny rule of policy %s has a denial condition, which is not supported. Ignored.", policy)
+		return nil
+	}
+	exceptions, _, err := d.expandDenyPrincipals(ctx, rule.ExceptionPrincipals)
+	if err != nil {
+		return err
+	}
+	denied, isPublic, err := d.expandDenyPrincipals(ctx, rule.DeniedPrincipals)
+	if err != nil {
+		return err
+	} else if isPublic {
+		rules.public = append(rules.public, publicDenyRule{policy: policy, exceptions: exceptions})
+	}
+	for uid := range denied {
+		if _, ok := exceptions[uid]; !ok {
+			rules.principals[uid] = policy
+		}
+	}
+	return nil
+}
+
+// expandDenyPrincipals returns service accounts and users of principals, of which groups are expanded given Google
+// Workspace. Given principalSet://goog/public:all, isPublic is true. Other principals are ignored.
+func (d *DenyPolicyClient) expandDenyPrincipals(ctx context.Context, principals []string) (map[GoogleServiceAccount]struct{}, bool, error) {
+	var (
+		identities = make(map[GoogleServiceAccount]struct{}, len(principals))
+		isPublic   bool
+	)
+	for _, principal := range principals {
+		if principal == denyPrincipalPublic {
+			isPublic = true
+		} else if email, ok := strings.CutPrefix(principal, "principal://iam.googleapis.com/projects/-/serviceAccounts/"); ok {
+			identities[GoogleServiceAccount(email)] = struct{}{}
+		} else if email, ok = strings.CutPrefix(principal, "principal://goog/subject/"); ok {
+			identities[GoogleServiceAccount(email)] = struct{}{}
+		} else if group, ok := strings.CutPrefix(principal, "principalSet://goog/group/"); ok {
+			// Group of a deny rule which can't be expanded must fail refresh, identities would be allowed.
+			members, err := d.gwsClient.ListGoogleServiceAccounts(ctx, group)
+			if err != nil {
+				return nil, false, fmt.Errorf("can't expand group %s of deny rule: %w", group, err)
+			}
+			for _, member := range members {
+				identities[member] = struct{}{}
+			}
+		} else {
+			log.Debugf("Principal %s of deny rule is not supported. Ignored.", principal)
+		}
+	}
+	return identities, isPublic, nil
+}
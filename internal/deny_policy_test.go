@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	iam "google.golang.org/api/iam/v2"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testDenyPolicy = "policies/cloudresourcemanager.googleapis.com%2Fprojects%2Ftest-project/denypolicies/deny-iap"
+
+// denyPolicy returns a deny policy of rules.
+func denyPolicy(name string, rules ...*iam.GoogleIamV2DenyRule) *iam.GoogleIamV2Policy {
+	policy := &iam.GoogleIamV2Policy{Name: name}
+	for _, rule := range rules {
+		policy.Rules = append(policy.Rules, &iam.GoogleIamV2PolicyRule{DenyRule: rule})
+	}
+	return policy
+}
+
+func TestDenyPolicyRules(t *testing.T) {
+	var tests = []struct {
+		name   string
+		rule   *iam.GoogleIamV2DenyRule
+		denied map[GoogleServiceAccount]bool
+	}{
+		{"TestDeniedServiceAccount", &iam.GoogleIamV2DenyRule{
+			DeniedPrincipals:  []string{"principal://iam.googleapis.com/projects/-/serviceAccounts/denied@p.iam.gserviceaccount.com"},
+			DeniedPermissions: []string{iapDenyPermission},
+		}, map[GoogleServiceAccount]bool{"denied@p.iam.gserviceaccount.com": true, "other@p.iam.gserviceaccount.com": false}},
+		{"TestDeniedGroupIsExpanded", &iam.GoogleIamV2DenyRule{
+			DeniedPrincipals:    []string{"principalSet://goog/group/group@example.com"},
+			ExceptionPrincipals: []string{"principal://iam.googleapis.com/projects/-/serviceAccounts/excepted@p.iam.gserviceaccount.com"},
+			DeniedPermissions:   []string{iapDenyPermissionWildcard},
+		}, map[GoogleServiceAccount]bool{"member@p.iam.gserviceaccount.com": true, "excepted@p.iam.gserviceaccount.com": false}},
+		{"TestPublicDenyWithException", &iam.GoogleIamV2DenyRule{
+			DeniedPrincipals:    []string{denyPrincipalPublic},
+			ExceptionPrincipals: []string{"principal://iam.googleapis.com/projects/-/serviceAccounts/excepted@p.iam.gserviceaccount.com"},
+			DeniedPermissions:   []string{iapDenyPermission},
+		}, map[GoogleServiceAccount]bool{"any@p.iam.gserviceaccount.com": true, "excepted@p.iam.gserviceaccount.com": false}},
+		{"TestOtherPermissionIsIgnored", &iam.GoogleIamV2DenyRule{
+			DeniedPrincipals:  []string{"principal://iam.googleapis.com/projects/-/serviceAccounts/denied@p.iam.gserviceaccount.com"},
+			DeniedPermissions: []string{"iam.googleapis.com/roles.list"},
+		}, map[GoogleServiceAccount]bool{"denied@p.iam.gserviceaccount.com": false}},
+		{"TestConditionalDenyIsIgnored", &iam.GoogleIamV2DenyRule{
+			DeniedPrincipals:  []string{"principal://iam.googleapis.com/projects/-/serviceAccounts/denied@p.iam.gserviceaccount.com"},
+			DeniedPermissions: []string{iapDenyPermission},
+			DenialCondition:   &iam.GoogleTypeExpr{Expression: "resource.matchTag('123/env', 'prod')"},
+		}, map[GoogleServiceAccount]bool{"denied@p.iam.gserviceaccount.com": false}},
+	}
+	gws := fakeGoogleWorkspaceClient{"group@example.com": {"member@p.iam.gserviceaccount.com", "excepted@p.iam.gserviceaccount.com"}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, fake := newFakeDenyPolicyClient(t, gws)
+			fake.setPolicies(denyPolicy(testDenyPolicy, tt.rule))
+			if err := client.RefreshDenyPolicies(context.Background()); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			for uid, expected := range tt.denied {
+				policy, denied, err := client.LoadDenyPolicyForGoogleServiceAccount(uid)
+				if err != nil {
+					t.Fatalf("Unexpected error returned, error: %s.", err)
+				} else if denied != expected {
+					t.Fatalf("Expected denied %t of %s, denied %t was returned.", expected, uid, denied)
+				} else if denied && policy != testDenyPolicy {
+					t.Fatalf("Expected deny policy %s, deny policy %s was returned.", testDenyPolicy, policy)
+				}
+			}
+		})
+	}
+}
+
+func TestDenyPoliciesUnavailable(t *testing.T) {
+	client, _ := newFakeDenyPolicyClient(t, fakeGoogleWorkspaceClient{})
+	if _, _, err := client.LoadDenyPolicyForGoogleServiceAccount("sa@p.iam.gserviceaccount.com"); !errors.Is(err, ErrPolicyBindingsUnavailable) {
+		t.Fatalf("Expected error %v, error %v was returned.", ErrPolicyBindingsUnavailable, err)
+	}
+}
+
+func TestUnavailableDenyPoliciesAreNeverFailOpen(t *testing.T) {
+	var (
+		denyPolicies, _ = newFakeDenyPolicyClient(t, fakeGoogleWorkspaceClient{})
+		verifier        = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		authenticator   = newFakeAuthenticator(t, verifier, unavailableIdentityAccessManagementReader{}, EmailDomainFilter{})
+		requestUrl, _   = url.Parse("https://myurl.com/hello")
+	)
+	authenticator.SetDenyPolicyReader(denyPolicies)
+	authenticator.failOpen = FailOpen{Enabled: true, StaleAfter: time.Nanosecond}
+
+	if _, err := authenticator.Authenticate(context.Background(), "token", *requestUrl); !errors.Is(err, ErrDenyPoliciesUnavailable) {
+		t.Fatalf("Expected error %v, error %v was returned.", ErrDenyPoliciesUnavailable, err)
+	}
+}
+
+func TestExplicitDenyBeforeAllow(t *testing.T) {
+	var (
+		sink, fakeLogging  = newFakeCloudLoggingAuditSink(t, 10, time.Hour)
+		denyPolicies, fake = newFakeDenyPolicyClient(t, fakeGoogleWorkspaceClient{})
+		verifier           = &fakeTokenVerifier{emails: map[string]string{
+			"denied":  "denied@p.iam.gserviceaccount.com",
+			"unbound": "unbound@p.iam.gserviceaccount.com",
+		}}
+		// Identity of deny policy has an unconditional binding, deny takes precedence.
+		bindings      = fakeIdentityAccessManagementReader{"denied@p.iam.gserviceaccount.com": {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	fake.setPolicies(denyPolicy(testDenyPolicy, &iam.GoogleIamV2DenyRule{
+		DeniedPrincipals:  []string{"principal://iam.googleapis.com/projects/-/serviceAccounts/denied@p.iam.gserviceaccount.com"},
+		DeniedPermissions: []string{iapDenyPermission},
+	}))
+	if err := denyPolicies.RefreshDenyPolicies(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	authenticator.SetDenyPolicyReader(denyPolicies)
+	authenticator.SetAuditSink(sink)
+	// Explicit deny is never allowed given stale policy bindings.
+	authenticator.failOpen = FailOpen{Enabled: true, StaleAfter: time.Nanosecond}
+
+	requestUrl, _ := url.Parse("https://myurl.com/hello")
+	if _, err := authenticator.Authenticate(context.Background(), "denied", *requestUrl); !errors.Is(err, ErrDeniedByPolicy) {
+		t.Fatalf("Expected error %v, error %v was returned.", ErrDeniedByPolicy, err)
+	}
+	authenticator.failOpen = FailOpen{}
+	if _, err := authenticator.Authenticate(context.Background(), "unbound", *requestUrl); !errors.Is(err, ErrNoIdentityAwareProxyRoleForUser) {
+		t.Fatalf("Expected error %v, error %v was returned.", ErrNoIdentityAwareProxyRoleForUser, err)
+	}
+	for _, token := range []string{"denied", "unbound"} {
+		if rsp := doAuthRequest(listener, token, requestUrl.String()); rsp.Code != http.StatusForbidden {
+			t.Fatalf("Expected status code %d, status code %d was returned.", http.StatusForbidden, rsp.Code)
+		}
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var denials, reasons []string
+	for _, write := range fakeLogging.writes() {
+		for _, entry := range write.Entries {
+			var payload struct {
+				Metadata struct {
+					Denial string `json:"denial"`
+					Reason string `json:"reason"`
+				} `json:"metadata"`
+			}
+			if err := json.Unmarshal(entry.JsonPayload, &payload); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			denials = append(denials, payload.Metadata.Denial)
+			reasons = append(reasons, payload.Metadata.Reason)
+		}
+	}
+	if len(denials) != 4 || denials[0] != "explicit" || denials[1] != "implicit" {
+		t.Fatalf("Expected explicit then implicit denial records, denials %v were given.", denials)
+	} else if reasons[0] == reasons[1] {
+		t.Fatalf("Expected distinct reasons of explicit and implicit denial, reason %s was given.", reasons[0])
+	}
+}
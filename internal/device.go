@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// DeviceAttributes are attributes of device of request, i.e. is_corp_owned, given trusted device header. Available
+// as variable device of conditional expressions.
+type DeviceAttributes map[string]any
+
+// ErrInvalidDeviceAttributes is given when trusted device header is not a JSON object.
+var ErrInvalidDeviceAttributes = errors.New("invalid device attributes")
+
+type deviceAttributesKey struct{}
+
+// parseDeviceAttributes parses value of trusted device header, a JSON object.
+func parseDeviceAttributes(header string) (DeviceAttributes, error) {
+	attributes := make(DeviceAttributes)
+	if err := json.Unmarshal([]byte(header), &attributes); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDeviceAttributes, err)
+	}
+	return attributes, nil
+}
+
+// WithDeviceAttributes returns ctx holding device attributes of request, evaluated by Authenticate.
+func WithDeviceAttributes(ctx context.Context, attributes DeviceAttributes) context.Context {
+	return context.WithValue(ctx, deviceAttributesKey{}, attributes)
+}
+
+// deviceAttributes returns device attributes of ctx, empty given none.
+func deviceAttributes(ctx context.Context) DeviceAttributes {
+	if attributes, ok := ctx.Value(deviceAttributesKey{}).(DeviceAttributes); ok {
+		return attributes
+	}
+	return DeviceAttributes{}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"github.com/anderslauri/open-iap/internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeviceAttributeCondition(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{email: {
+				{Expression: "device.is_corp_owned == true && request.path.startsWith(\"/hello\")", Title: "corp"},
+			}},
+			lastRefresh: time.Now(),
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	// Granted decision of a corp owned device must not be given to other devices.
+	authenticator.SetDecisionCache(cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[time.Time]](), time.Minute)
+	listener.SetDeviceHeader("X-Device-Attributes")
+
+	var tests = []struct {
+		name       string
+		device     string
+		statusCode int
+	}{
+		{"TestCorpOwnedDevice", `{"is_corp_owned": true, "os_type": "MAC_OS"}`, http.StatusOK},
+		{"TestCachedCorpOwnedDevice", `{"os_type": "MAC_OS", "is_corp_owned": true}`, http.StatusOK},
+		{"TestPersonalDevice", `{"is_corp_owned": false, "os_type": "MAC_OS"}`, http.StatusUnauthorized},
+		{"TestNoDeviceHeader", "", http.StatusUnauthorized},
+		{"TestInvalidDeviceHeader", `is_corp_owned=true`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("Proxy-Authorization", "Bearer token")
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			if len(tt.device) > 0 {
+				req.Header.Set("X-Device-Attributes", tt.device)
+			}
+			rsp := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rsp, req)
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestUntrustedDeviceHeaderIsIgnored(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {
+			{Expression: "device.is_corp_owned == true", Title: "corp"},
+		}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+		req      = httptest.NewRequest("GET", "/auth", nil)
+		rsp      = httptest.NewRecorder()
+	)
+	req.Header.Set("Proxy-Authorization", "Bearer token")
+	req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+	req.Header.Set("X-Device-Attributes", `{"is_corp_owned": true}`)
+	listener.httpServer.Handler.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d, status code %d was returned.", http.StatusUnauthorized, rsp.Code)
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+type earlyHintsKey struct{}
+
+// earlyHints sends 103 Early Hints of identity of request before decision given SetEarlyHints. Safe for concurrent
+// use, authentication may continue given exceeded request budget.
+type earlyHints struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	closed bool
+}
+
+// SetEarlyHints sends 103 Early Hints holding X-Goog-Authenticated-User-Email of verified identity before policy
+// bindings are evaluated, i.e. for streaming proxies to prepare upstream request. Hints are not a decision, identity
+// headers of final response are only set given granted decision. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetEarlyHints(enabled bool) {
+	a.earlyHints = enabled
+}
+
+// withEarlyHints returns ctx of which verified identity is hinted on w until hints are closed.
+func withEarlyHints(ctx context.Context, w http.ResponseWriter) context.Context {
+	return context.WithValue(ctx, earlyHintsKey{}, &earlyHints{w: w})
+}
+
+// sendEarlyHints sends 103 Early Hints of identity given ctx of withEarlyHints, unless hints are closed.
+func sendEarlyHints(ctx context.Context, identity GoogleServiceAccount) {
+	hints, ok := ctx.Value(earlyHintsKey{}).(*earlyHints)
+	if !ok || hints == nil {
+		return
+	}
+	hints.mu.Lock()
+	defer hints.mu.Unlock()
+
+	if hints.closed {
+		return
+	}
+	// Header of interim response is emptied once sent, final response holds identity only given granted decision.
+	header := hints.w.Header()
+	header.Set(headerAuthenticatedUserEmail, fmt.Sprintf("accounts.google.com:%s", identity))
+	hints.w.WriteHeader(http.StatusEarlyHints)
+	header.Set(headerAuthenticatedUserEmail, "")
+}
+
+// closeEarlyHints closes hints of ctx of withEarlyHints, such that no hint is sent once final response is written.
+func closeEarlyHints(ctx context.Context) {
+	hints, ok := ctx.Value(earlyHintsKey{}).(*earlyHints)
+	if !ok || hints == nil {
+		return
+	}
+	hints.mu.Lock()
+	defer hints.mu.Unlock()
+	hints.closed = true
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+)
+
+func TestEarlyHints(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"token": string(email), "norole": "norole@p.iam.gserviceaccount.com"}}
+		bindings      = fakeIdentityAccessManagementReader{email: {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+	)
+	var tests = []struct {
+		name       string
+		enabled    bool
+		token      string
+		statusCode int
+		hint       string
+		identity   string
+	}{
+		{"TestEarlyHintsIsDisabled", false, "token", http.StatusOK, "", "accounts.google.com:" + string(email)},
+		{"TestEarlyHintsOfGrantedIdentity", true, "token", http.StatusOK, "accounts.google.com:" + string(email),
+			"accounts.google.com:" + string(email)},
+		{"TestEarlyHintsOfDeniedIdentity", true, "norole", http.StatusForbidden,
+			"accounts.google.com:norole@p.iam.gserviceaccount.com", ""},
+		{"TestNoEarlyHintsOfInvalidToken", true, "invalid", http.StatusUnauthorized, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := newFakeAuthServiceListener(t, authenticator)
+			listener.SetEarlyHints(tt.enabled)
+			server := httptest.NewServer(listener.httpServer.Handler)
+			t.Cleanup(server.Close)
+
+			var hints []textproto.MIMEHeader
+			ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					if code == http.StatusEarlyHints {
+						hints = append(hints, header)
+					}
+					return nil
+				},
+			})
+			req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/auth", nil)
+			req.Header.Set("Proxy-Authorization", "Bearer "+tt.token)
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			rsp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			_ = rsp.Body.Close()
+
+			if rsp.StatusCode != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.StatusCode)
+			} else if identity := rsp.Header.Get(headerAuthenticatedUserEmail); identity != tt.identity {
+				t.Fatalf("Expected identity %q of final response, identity %q was returned.", tt.identity, identity)
+			} else if len(tt.hint) == 0 && len(hints) > 0 {
+				t.Fatalf("Expected no early hints, %v was returned.", hints)
+			} else if len(tt.hint) > 0 && (len(hints) != 1 || hints[0].Get(headerAuthenticatedUserEmail) != tt.hint) {
+				t.Fatalf("Expected early hint of identity %s, %v was returned.", tt.hint, hints)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/anderslauri/open-iap/internal/cache"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// GoogleWorkspaceAliasReader resolves primary and alias emails of a user in Google Workspace.
+type GoogleWorkspaceAliasReader interface {
+	ListEmailAliases(ctx context.Context, email GoogleServiceAccount) ([]GoogleServiceAccount, error)
+}
+
+// SetEmailAliases matches bindings of primary and alias emails of users given reader, such that a token of an alias
+// is authorized by bindings of primary email, and conversely. Emails of user are cached for ttl. Service accounts and
+// federated principals have no aliases. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetEmailAliases(reader GoogleWorkspaceAliasReader, c cache.Cache[string, cache.ExpiryCacheValue[[]GoogleServiceAccount]], ttl time.Duration) {
+	g.aliasReader = reader
+	g.aliases = c
+	g.aliasTTL = ttl
+}
+
+// emailAliases returns primary and alias emails of user, empty given none or failure of lookup.
+func (g *GoogleCloudTokenAuthenticator) emailAliases(ctx context.Context, email GoogleServiceAccount) []GoogleServiceAccount {
+	if strings.HasSuffix(string(email), "iam.gserviceaccount.com") || isFederatedPrincipal(email) {
+		return nil
+	} else if entry, ok := g.aliases.Get(string(email)); ok && entry.Exp > time.Now().Unix() {
+		return entry.Val
+	}
+	aliases, err := g.aliasReader.ListEmailAliases(ctx, email)
+	if err != nil {
+		// Failure of lookup is not cached, bindings of email itself are still matched.
+		log.WithContext(ctx).WithField("error", err).Warningf("Couldn't resolve email aliases of user %s.", email)
+		return nil
+	}
+	g.aliases.Set(string(email), cache.ExpiryCacheValue[[]GoogleServiceAccount]{
+		Val: aliases,
+		Exp: time.Now().Add(g.aliasTTL).Unix(),
+	})
+	return aliases
+}
+
+// loadIdentityBindings returns bindings of identity, given alias reader including bindings of primary and alias
+// emails of identity.
+func (g *GoogleCloudTokenAuthenticator) loadIdentityBindings(ctx context.Context, identity GoogleServiceAccount) (PolicyBindings, error) {
+	bindings, err := g.loadBindings(identity)
+	if g.aliasReader == nil || (err != nil && !errors.Is(err, ErrNoIdentityAwareProxyRoleForUser)) {
+		return bindings, err
+	}
+	for _, alias := range g.emailAliases(ctx, identity) {
+		if alias == identity {
+			continue
+		}
+		aliasBindings, aliasErr := g.loadBindings(alias)
+		if aliasErr != nil {
+			continue
+		}
+		// Bindings of policy are shared, never appended in place.
+		bindings = append(append(make(PolicyBindings, 0, len(bindings)+len(aliasBindings)), bindings...), aliasBindings...)
+		err = nil
+	}
+	return bindings, err
+}
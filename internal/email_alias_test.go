@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/anderslauri/open-iap/internal/cache"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAliasReader returns primary and alias emails given email, counting lookups.
+type fakeAliasReader struct {
+	aliases map[GoogleServiceAccount][]GoogleServiceAccount
+	calls   atomic.Int32
+}
+
+func (f *fakeAliasReader) ListEmailAliases(_ context.Context, email GoogleServiceAccount) ([]GoogleServiceAccount, error) {
+	f.calls.Add(1)
+	return f.aliases[email], nil
+}
+
+func TestEmailAliasBindings(t *testing.T) {
+	var (
+		primary  = GoogleServiceAccount("user@example.com")
+		alias    = GoogleServiceAccount("alias@example.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"alias":   string(alias),
+			"primary": string(primary),
+			"other":   "other@example.com",
+			"sa":      "sa@p.iam.gserviceaccount.com",
+		}}
+		bindings      = fakeIdentityAccessManagementReader{primary: {{}}}
+		reader        = &fakeAliasReader{aliases: map[GoogleServiceAccount][]GoogleServiceAccount{alias: {primary, alias}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+	)
+	authenticator.SetEmailAliases(reader, cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[[]GoogleServiceAccount]](), time.Minute)
+
+	var tests = []struct {
+		name    string
+		token   string
+		err     error
+		lookups int32
+	}{
+		{"TestAliasAuthorizedByPrimaryBinding", "alias", nil, 1},
+		{"TestPrimaryAuthorized", "primary", nil, 2},
+		{"TestUserWithoutAliasesIsDenied", "other", ErrNoIdentityAwareProxyRoleForUser, 3},
+		// Aliases are looked up once per user within ttl.
+		{"TestCachedUserWithoutAliasesIsDenied", "other", ErrNoIdentityAwareProxyRoleForUser, 3},
+		{"TestCachedAliasAuthorized", "alias", nil, 3},
+		{"TestServiceAccountWithoutLookup", "sa", ErrNoIdentityAwareProxyRoleForUser, 3},
+	}
+	requestUrl, _ := url.Parse("https://myurl.com/hello")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.err, err)
+			} else if reader.calls.Load() != tt.lookups {
+				t.Fatalf("Expected %d lookups of aliases, %d lookups were made.", tt.lookups, reader.calls.Load())
+			}
+		})
+	}
+}
+
+func TestListEmailAliases(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"primaryEmail":"user@example.com","aliases":["alias@example.com"],` +
+			`"nonEditableAliases":["user@example.test-google-a.com"]}`))
+	}))
+	defer srv.Close()
+
+	service, err := admin.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	gws := &GoogleWorkspaceClient{admin: service}
+	aliases, err := gws.ListEmailAliases(context.Background(), "alias@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if expected := []GoogleServiceAccount{"user@example.com", "alias@example.com",
+		"user@example.test-google-a.com"}; !slices.Equal(aliases, expected) {
+		t.Fatalf("Expected aliases %v, aliases %v were returned.", expected, aliases)
+	}
+}
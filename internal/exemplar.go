@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// spanContext returns span context of request, of request context given an instrumented handler, else of W3C
+// traceparent header. Span context is invalid given neither.
+func spanContext(r *http.Request) trace.SpanContext {
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		return sc
+	}
+	// Format is {version}-{trace-id}-{parent-id}-{trace-flags}, i.e. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return trace.SpanContext{}
+	}
+	traceID, err := trace.TraceIDFromHex(parts[1])
+	if err != nil {
+		return trace.SpanContext{}
+	}
+	spanID, err := trace.SpanIDFromHex(parts[2])
+	if err != nil {
+		return trace.SpanContext{}
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return trace.SpanContext{}
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.TraceFlags(flags) & trace.FlagsSampled,
+		Remote:     true,
+	})
+}
+
+// observeWithExemplar observes val on histogram, with trace_id of span context as exemplar given a sampled span context.
+func observeWithExemplar(histogram prometheus.Histogram, val float64, sc trace.SpanContext) {
+	if observer, ok := histogram.(prometheus.ExemplarObserver); ok && sc.IsSampled() {
+		observer.ObserveWithExemplar(val, prometheus.Labels{"trace_id": sc.TraceID().String()})
+		return
+	}
+	histogram.Observe(val)
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// hasExemplar returns true given any bucket of histogram holds exemplar of trace id.
+func hasExemplar(t *testing.T, traceID string) bool {
+	t.Helper()
+	metric := &dto.Metric{}
+	if err := authDurationHistogram.Write(metric); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	for _, bucket := range metric.GetHistogram().GetBucket() {
+		for _, label := range bucket.GetExemplar().GetLabel() {
+			if label.GetName() == "trace_id" && label.GetValue() == traceID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestAuthDurationExemplars(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": "sa@p.iam.gserviceaccount.com"}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+	)
+	var tests = []struct {
+		name        string
+		exemplars   bool
+		traceID     string
+		traceparent string
+		recorded    bool
+	}{
+		{"TestSampledSpanContextRecorded", true, "4bf92f3577b34da6a3ce929d0e0e4736",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"TestUnsampledSpanContextNotRecorded", true, "5bf92f3577b34da6a3ce929d0e0e4736",
+			"00-5bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+		{"TestExemplarsDisabled", false, "6bf92f3577b34da6a3ce929d0e0e4736",
+			"00-6bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+			listener.SetExemplars(tt.exemplars)
+
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("Proxy-Authorization", "Bearer token")
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			req.Header.Set("traceparent", tt.traceparent)
+			rec := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected status code 200 OK, status code %d was returned.", rec.Code)
+			} else if recorded := hasExemplar(t, tt.traceID); recorded != tt.recorded {
+				t.Fatalf("Expected exemplar of trace id %s recorded to be %t.", tt.traceID, tt.recorded)
+			}
+		})
+	}
+}
+
+func TestSpanContextOfRequestContext(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("7bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+
+	req := httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("traceparent", "invalid")
+	if spanContext(req).IsValid() {
+		t.Fatal("Expected invalid span context given invalid traceparent.")
+	}
+	req = req.WithContext(trace.ContextWithSpanContext(req.Context(), sc))
+	if got := spanContext(req); !got.Equal(sc) {
+		t.Fatalf("Expected span context of request context %v, span context %v was returned.", sc, got)
+	}
+}
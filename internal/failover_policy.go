@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+// Sources of policy bindings of FailoverPolicyReader.
+const (
+	PolicySourcePrimary   = "primary"
+	PolicySourceSecondary = "secondary"
+)
+
+// PolicySourceReader is an optional interface of IdentityAccessManagementReader, reporting source currently serving
+// policy bindings. Source is recorded in audit records.
+type PolicySourceReader interface {
+	PolicySource() string
+}
+
+// FailoverPolicyReader reads policy bindings of primary, failing over to secondary, i.e. mirrored policy of another
+// project, given primary is unavailable. Primary takes precedence given its bindings are loaded and refreshed within
+// staleAfter, else secondary given same, else primary. Bindings of sources are never merged. Both sources refresh
+// independently, secondary is a warm standby.
+type FailoverPolicyReader struct {
+	primary, secondary IdentityAccessManagementReader
+	staleAfter         time.Duration
+	// failedOver is true given secondary served latest read, transitions are logged.
+	failedOver atomic.Bool
+}
+
+// NewFailoverPolicyReader creates a FailoverPolicyReader of which primary is stale given no successful refresh within
+// staleAfter.
+func NewFailoverPolicyReader(primary, secondary IdentityAccessManagementReader, staleAfter time.Duration) *FailoverPolicyReader {
+	return &FailoverPolicyReader{
+		primary:    primary,
+		secondary:  secondary,
+		staleAfter: staleAfter,
+	}
+}
+
+// isAvailable returns true given bindings of reader are loaded and refreshed within staleAfter.
+func (f *FailoverPolicyReader) isAvailable(reader IdentityAccessManagementReader) bool {
+	return reader.LoadRoleCollection() != nil && time.Since(reader.LastSuccessfulRefresh()) <= f.staleAfter
+}
+
+// source returns reader serving policy bindings given precedence. Transitions between sources are logged.
+func (f *FailoverPolicyReader) source() (IdentityAccessManagementReader, string) {
+	reader, source := f.primary, PolicySourcePrimary
+	if !f.isAvailable(f.primary) && f.isAvailable(f.secondary) {
+		reader, source = f.secondary, PolicySourceSecondary
+	}
+	failedOver := source == PolicySourceSecondary
+	if f.failedOver.Swap(failedOver) == failedOver {
+		return reader, source
+	}
+	fields := log.Fields{"audit": "failover", "lastRefresh": f.primary.LastSuccessfulRefresh()}
+	if failedOver {
+		log.WithFields(fields).Warning("FAILOVER: Policy bindings of primary are unavailable, policy bindings are served by secondary.")
+	} else {
+		log.WithFields(fields).Info("FAILOVER: Policy bindings of primary are available, policy bindings are served by primary.")
+	}
+	return reader, source
+}
+
+// PolicySource returns source currently serving policy bindings, primary or secondary.
+func (f *FailoverPolicyReader) PolicySource() string {
+	_, source := f.source()
+	return source
+}
+
+// RefreshRoleAndBindingsForIdentityAwareProxy refreshes primary, given failure secondary is refreshed. Error is given
+// only given both fail.
+func (f *FailoverPolicyReader) RefreshRoleAndBindingsForIdentityAwareProxy(ctx context.Context) error {
+	err := f.primary.RefreshRoleAndBindingsForIdentityAwareProxy(ctx)
+	if err == nil {
+		return nil
+	}
+	log.WithField("error", err).Warning("Could not refresh policy bindings of primary. Refreshing secondary.")
+	if serr := f.secondary.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); serr != nil {
+		return errors.Join(err, serr)
+	}
+	return nil
+}
+
+// LoadBindingForGoogleServiceAccount looks up bindings of uid given source serving policy bindings.
+func (f *FailoverPolicyReader) LoadBindingForGoogleServiceAccount(uid GoogleServiceAccount) (PolicyBindings, error) {
+	reader, _ := f.source()
+	return reader.LoadBindingForGoogleServiceAccount(uid)
+}
+
+// LoadRoleCollection returns collection of source serving policy bindings.
+func (f *FailoverPolicyReader) LoadRoleCollection() GoogleServiceAccountRoleCollection {
+	reader, _ := f.source()
+	return reader.LoadRoleCollection()
+}
+
+// LastSuccessfulRefresh returns latest successful refresh of source serving policy bindings, such that cached decisions
+// are invalidated given failover.
+func (f *FailoverPolicyReader) LastSuccessfulRefresh() time.Time {
+	reader, _ := f.source()
+	return reader.LastSuccessfulRefresh()
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// unreachableIdentityAccessManagementReader is a fake of which refresh fails given err, i.e. given outage of IAM API.
+type unreachableIdentityAccessManagementReader struct {
+	*staleIdentityAccessManagementReader
+	err error
+}
+
+func (u unreachableIdentityAccessManagementReader) RefreshRoleAndBindingsForIdentityAwareProxy(_ context.Context) error {
+	return u.err
+}
+
+func TestFailoverPolicyReader(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		primary  = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{email: {{}}},
+			lastRefresh:                        time.Now(),
+		}
+		// Mirrored policy is distinguishable, only /mirror is granted.
+		secondary = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{email: {
+				{Expression: "request.path.startsWith(\"/mirror\")", Title: "mirror"},
+			}},
+			lastRefresh: time.Now(),
+		}
+		reader        = NewFailoverPolicyReader(primary, secondary, time.Minute)
+		authenticator = newFakeAuthenticator(t, verifier, reader, EmailDomainFilter{})
+		sink          = &recordingAuditSink{}
+	)
+	authenticator.SetAuditSink(sink)
+
+	var tests = []struct {
+		name       string
+		before     func()
+		requestUrl string
+		granted    bool
+		source     string
+	}{
+		{"TestPrimaryServesDecision", nil, "https://myurl.com/hello", true, PolicySourcePrimary},
+		{"TestSecondaryServesDecisionGivenPrimaryOutage", func() { primary.lastRefresh = time.Now().Add(-time.Hour) },
+			"https://myurl.com/hello", false, PolicySourceSecondary},
+		{"TestSecondaryGrantsMirroredPolicy", nil, "https://myurl.com/mirror", true, PolicySourceSecondary},
+		{"TestPrimaryPrecedesGivenBothStale", func() { secondary.lastRefresh = time.Now().Add(-time.Hour) },
+			"https://myurl.com/hello", true, PolicySourcePrimary},
+		{"TestPrimaryServesDecisionGivenRecovery", func() {
+			primary.lastRefresh, secondary.lastRefresh = time.Now(), time.Now()
+		}, "https://myurl.com/hello", true, PolicySourcePrimary},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+			u, _ := url.Parse(tt.requestUrl)
+			if _, err := authenticator.Authenticate(context.Background(), "token", *u); (err == nil) != tt.granted {
+				t.Fatalf("Expected granted %t, error returned: %v.", tt.granted, err)
+			} else if records := sink.recorded(); len(records) != i+1 {
+				t.Fatalf("Expected %d audit records, %d records were given.", i+1, len(records))
+			} else if source := records[i].PolicySource; source != tt.source {
+				t.Fatalf("Expected decision of source %s, source %s was recorded.", tt.source, source)
+			}
+		})
+	}
+}
+
+func TestFailoverPolicyReaderRefresh(t *testing.T) {
+	var (
+		errOutage = errors.New("outage")
+		fresh     = &staleIdentityAccessManagementReader{lastRefresh: time.Now()}
+	)
+	var tests = []struct {
+		name                     string
+		primaryErr, secondaryErr error
+		expectedErr              error
+	}{
+		{"TestPrimaryIsRefreshed", nil, errOutage, nil},
+		{"TestSecondaryIsRefreshedGivenPrimaryOutage", errOutage, nil, nil},
+		{"TestErrorGivenOutageOfBoth", errOutage, errOutage, errOutage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewFailoverPolicyReader(unreachableIdentityAccessManagementReader{fresh, tt.primaryErr},
+				unreachableIdentityAccessManagementReader{fresh, tt.secondaryErr}, time.Minute)
+			if err := reader.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.expectedErr, err)
+			}
+		})
+	}
+}
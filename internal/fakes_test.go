@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	iam "google.golang.org/api/iam/v2"
+	"google.golang.org/api/logging/v2"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Cache entries are written before return, such that a subsequent request is deterministically served from cache.
+	writeCache = func(set func()) { set() }
+}
+
+// fakeGoogleWorkspaceClient is a static implementation of GoogleWorkspaceClientReader.
+type fakeGoogleWorkspaceClient map[string][]GoogleServiceAccount
+
+func (f fakeGoogleWorkspaceClient) ListGoogleServiceAccounts(_ context.Context, groupEmail string) ([]GoogleServiceAccount, error) {
+	return f[groupEmail], nil
+}
+
+// fakeResourceManager serves project iam policy bindings in place of Cloud Resource Manager API.
+type fakeResourceManager struct {
+	mu       sync.Mutex
+	bindings []*cloudresourcemanager.Binding
+	status   int
+	// delay is latency of every response, failures is number of leading responses of 503.
+	delay    time.Duration
+	failures int
+}
+
+func (f *fakeResourceManager) setBindings(status int, bindings ...*cloudresourcemanager.Binding) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+	f.bindings = bindings
+}
+
+func (f *fakeResourceManager) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	time.Sleep(f.delay)
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if f.status != http.StatusOK {
+		w.WriteHeader(f.status)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&cloudresourcemanager.Policy{Bindings: f.bindings})
+}
+
+// newFakeIdentityAccessManagementClient returns a client reading policy bindings from a local fake resource manager.
+func newFakeIdentityAccessManagementClient(t *testing.T, gws GoogleWorkspaceClientReader) (*IdentityAccessManagementClient, *fakeResourceManager) {
+	t.Helper()
+	fake := &fakeResourceManager{status: http.StatusOK}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	service, err := cloudresourcemanager.NewService(context.Background(),
+		option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return &IdentityAccessManagementClient{
+		service:   service,
+		pid:       "test-project",
+		gwsClient: gws,
+	}, fake
+}
+
+// fakeCloudLogging receives log entries in place of Cloud Logging API, each write request is retained.
+type fakeCloudLogging struct {
+	mu       sync.Mutex
+	requests []*logging.WriteLogEntriesRequest
+}
+
+func (f *fakeCloudLogging) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &logging.WriteLogEntriesRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	_, _ = w.Write([]byte("{}"))
+}
+
+// writes returns retained write requests.
+func (f *fakeCloudLogging) writes() []*logging.WriteLogEntriesRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*logging.WriteLogEntriesRequest(nil), f.requests...)
+}
+
+// fakeDenyPolicies serves deny policies of project in place of IAM API.
+type fakeDenyPolicies struct {
+	mu       sync.Mutex
+	policies []*iam.GoogleIamV2Policy
+}
+
+func (f *fakeDenyPolicies) setPolicies(policies ...*iam.GoogleIamV2Policy) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.policies = policies
+}
+
+func (f *fakeDenyPolicies) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if strings.HasSuffix(r.URL.Path, "/denypolicies") {
+		// Rules are omitted when listing.
+		rsp := &iam.GoogleIamV2ListPoliciesResponse{}
+		for _, policy := range f.policies {
+			rsp.Policies = append(rsp.Policies, &iam.GoogleIamV2Policy{Name: policy.Name})
+		}
+		_ = json.NewEncoder(w).Encode(rsp)
+		return
+	}
+	for _, policy := range f.policies {
+		// Name is URL encoded full resource name, i.e. %2F is retained once decoded.
+		if r.URL.Path == "/v2/"+policy.Name {
+			_ = json.NewEncoder(w).Encode(policy)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// newFakeDenyPolicyClient returns a client reading deny policies from a local fake IAM API.
+func newFakeDenyPolicyClient(t *testing.T, gws GoogleWorkspaceClientReader) (*DenyPolicyClient, *fakeDenyPolicies) {
+	t.Helper()
+	fake := &fakeDenyPolicies{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	service, err := iam.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return newDenyPolicyClient(service, "test-project", gws, nil), fake
+}
+
+// newFakeCloudLoggingAuditSink returns an audit sink writing to a local fake Cloud Logging.
+func newFakeCloudLoggingAuditSink(t *testing.T, batchSize int, flushInterval time.Duration) (*CloudLoggingAuditSink, *fakeCloudLogging) {
+	t.Helper()
+	fake := &fakeCloudLogging{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	service, err := logging.NewService(context.Background(),
+		option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return newCloudLoggingAuditSink(service, "test-project", "open-iap-audit", batchSize, flushInterval), fake
+}
+
+// fakePubSub serves queued messages on pull from subscription in place of Pub/Sub API, acknowledged ids are retained.
+type recordingAuditSink struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (r *recordingAuditSink) Record(record AuditRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record)
+}
+
+func (r *recordingAuditSink) Close(_ context.Context) error { return nil }
+
+func (r *recordingAuditSink) recorded() []AuditRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]AuditRecord(nil), r.records...)
+}
+
+type fakePubSub struct {
+	mu       sync.Mutex
+	messages []*pubsub.ReceivedMessage
+	acked    []string
+}
+
+func (f *fakePubSub) publish(messages ...*pubsub.ReceivedMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, messages...)
+}
+
+func (f *fakePubSub) acknowledged() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.acked...)
+}
+
+func (f *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, ":pull"):
+		f.mu.Lock()
+		messages := f.messages
+		f.messages = nil
+		f.mu.Unlock()
+		if len(messages) == 0 {
+			// Pull is long-lived given no messages.
+			time.Sleep(10 * time.Millisecond)
+		}
+		_ = json.NewEncoder(w).Encode(&pubsub.PullResponse{ReceivedMessages: messages})
+	case strings.HasSuffix(r.URL.Path, ":acknowledge"):
+		req := &pubsub.AcknowledgeRequest{}
+		_ = json.NewDecoder(r.Body).Decode(req)
+		f.mu.Lock()
+		f.acked = append(f.acked, req.AckIds...)
+		f.mu.Unlock()
+		_, _ = w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// fakePolicyRefresher is an implementation of PolicyRefresher counting refreshes, failing given err.
+type fakePolicyRefresher struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+}
+
+func (f *fakePolicyRefresher) RefreshRoleAndBindingsForIdentityAwareProxy(_ context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return f.err
+}
+
+func (f *fakePolicyRefresher) refreshes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// newFakePolicyChangeSubscriber returns a subscriber pulling from a local fake Pub/Sub.
+func newFakePolicyChangeSubscriber(t *testing.T, refresher PolicyRefresher) (*PolicyChangeSubscriber, *fakePubSub) {
+	t.Helper()
+	fake := &fakePubSub{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	service, err := pubsub.NewService(context.Background(),
+		option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return newPolicyChangeSubscriber(service, "projects/test-project/subscriptions/policy-changes", refresher,
+		time.Millisecond, 10*time.Millisecond), fake
+}
+
+// fakeTokenVerifier is an implementation of TokenVerifier which maps token string to email.
+type fakeTokenVerifier struct {
+	emails map[string]string
+	delay  time.Duration
+	calls  atomic.Int32
+}
+
+func (f *fakeTokenVerifier) Verify(ctx context.Context, tokenString, _ string, claims *GoogleTokenClaims) error {
+	f.calls.Add(1)
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	email, ok := f.emails[tokenString]
+	if !ok {
+		return ErrUnknownTokenType
+	}
+	claims.Email = email
+	claims.Principal = email
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	return nil
+}
+
+// fakeAccessLevelResolver is a static implementation of AccessLevelResolver counting resolutions.
+type fakeAccessLevelResolver struct {
+	levels map[GoogleServiceAccount][]string
+	calls  atomic.Int32
+}
+
+func (f *fakeAccessLevelResolver) ResolveAccessLevels(_ context.Context, principal GoogleServiceAccount) ([]string, error) {
+	f.calls.Add(1)
+	return f.levels[principal], nil
+}
+
+// fakeIdentityAccessManagementReader is a static implementation of IdentityAccessManagementReader.
+type fakeIdentityAccessManagementReader map[GoogleServiceAccount]PolicyBindings
+
+func (f fakeIdentityAccessManagementReader) RefreshRoleAndBindingsForIdentityAwareProxy(_ context.Context) error {
+	return nil
+}
+
+func (f fakeIdentityAccessManagementReader) LoadBindingForGoogleServiceAccount(uid GoogleServiceAccount) (PolicyBindings, error) {
+	bindings, ok := f[uid]
+	if !ok {
+		return nil, ErrNoIdentityAwareProxyRoleForUser
+	}
+	return bindings, nil
+}
+
+func (f fakeIdentityAccessManagementReader) LastSuccessfulRefresh() time.Time {
+	return time.Now()
+}
+
+func (f fakeIdentityAccessManagementReader) LoadRoleCollection() GoogleServiceAccountRoleCollection {
+	collection := make(GoogleServiceAccountRoleCollection, len(f))
+	for uid, bindings := range f {
+		collection[uid] = PolicyBindingCollection{iapWebPermission: bindings}
+	}
+	return collection
+}
+
+// newFakeAuthenticator returns an authenticator given fake token verifier and policy bindings.
+func newFakeAuthenticator(t testing.TB, v TokenVerifier[*GoogleTokenClaims], i IdentityAccessManagementReader, d EmailDomainFilter) *GoogleCloudTokenAuthenticator {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	authenticator, err := NewGoogleCloudTokenAuthenticator(v,
+		cache.NewExpiryCache[GoogleServiceAccount](ctx, time.Minute), i, fakeGoogleWorkspaceClient{}, nil, d, 50*time.Millisecond, FailOpen{})
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return authenticator
+}
+
+// newFakeAuthServiceListener returns a listener, which is not started, given authenticator.
+func newFakeAuthServiceListener(t testing.TB, auth Authenticator) *AuthServiceListener {
+	t.Helper()
+	listener, err := newAuthServiceListener(context.Background(), "127.0.0.1", []string{"X-Original-URL"}, 0, auth)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return listener
+}
+
+// doAuthRequest invokes /auth on listener handler without network given token and request url.
+func doAuthRequest(listener *AuthServiceListener, token, requestUrl string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+token)
+	req.Header.Set("X-Original-URL", requestUrl)
+	rec := httptest.NewRecorder()
+	listener.httpServer.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// noopCache is a cache implementation which never retains any entry.
+type noopCache[V any] struct{}
+
+func (noopCache[V]) Set(_ string, _ cache.ExpiryCacheValue[V]) {}
+
+func (noopCache[V]) Get(_ string) (cache.ExpiryCacheValue[V], bool) {
+	return cache.ExpiryCacheValue[V]{}, false
+}
+
+func (noopCache[V]) Delete(_ func(key string, val cache.ExpiryCacheValue[V]) bool) {}
+
+// staleIdentityAccessManagementReader is a fake of which latest successful refresh is given.
+type staleIdentityAccessManagementReader struct {
+	fakeIdentityAccessManagementReader
+	lastRefresh time.Time
+}
+
+func (s staleIdentityAccessManagementReader) LastSuccessfulRefresh() time.Time {
+	return s.lastRefresh
+}
+
+// unavailableIdentityAccessManagementReader is a fake of which policy bindings were never loaded, i.e. given an outage
+// of IAM API at startup.
+type unavailableIdentityAccessManagementReader struct {
+	fakeIdentityAccessManagementReader
+}
+
+func (unavailableIdentityAccessManagementReader) LoadBindingForGoogleServiceAccount(_ GoogleServiceAccount) (PolicyBindings, error) {
+	return nil, ErrPolicyBindingsUnavailable
+}
+
+func (unavailableIdentityAccessManagementReader) LastSuccessfulRefresh() time.Time {
+	return time.Unix(0, 0)
+}
+
+// slowIdentityAccessManagementReader is a fake of which lookup of bindings is delayed, i.e. given a slow upstream.
+type slowIdentityAccessManagementReader struct {
+	fakeIdentityAccessManagementReader
+	delay time.Duration
+}
+
+func (s slowIdentityAccessManagementReader) LoadBindingForGoogleServiceAccount(uid GoogleServiceAccount) (PolicyBindings, error) {
+	time.Sleep(s.delay)
+	return s.fakeIdentityAccessManagementReader.LoadBindingForGoogleServiceAccount(uid)
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FederatedIssuer is a trusted OpenID issuer of a workforce or workload identity pool, i.e. an external identity
+// provider. Verified subject is identity principal://iam.googleapis.com/{Pool}/subject/{sub}. Given Audience, claim
+// aud must be Audience rather than url of request.
+type FederatedIssuer struct {
+	Issuer string
+	// Pool is resource name of pool, i.e. locations/global/workforcePools/{pool}.
+	Pool     string
+	Audience string
+}
+
+const (
+	federatedPrincipalPrefix    = "principal://iam.googleapis.com/"
+	federatedPrincipalSetPrefix = "principalSet://iam.googleapis.com/"
+)
+
+// principal returns identity of subject in pool.
+func (f FederatedIssuer) principal(subject string) string {
+	return fmt.Sprintf("%s%s/subject/%s", federatedPrincipalPrefix, f.Pool, subject)
+}
+
+// isFederatedPrincipal verifies if identity is a subject of a pool.
+func isFederatedPrincipal(identity GoogleServiceAccount) bool {
+	return strings.HasPrefix(string(identity), federatedPrincipalPrefix)
+}
+
+// federatedPrincipalSet returns principalSet of every identity of pool of identity, principal://{pool}/subject/{sub}.
+func federatedPrincipalSet(identity GoogleServiceAccount) (GoogleServiceAccount, bool) {
+	pool, ok := strings.CutPrefix(string(identity), federatedPrincipalPrefix)
+	if idx := strings.LastIndex(pool, "/subject/"); ok && idx > 0 {
+		return GoogleServiceAccount(federatedPrincipalSetPrefix + pool[:idx] + "/*"), true
+	}
+	return "", false
+}
+
+// loadBindings returns bindings of identity, for federated principals including bindings of principalSet of pool.
+func (g *GoogleCloudTokenAuthenticator) loadBindings(identity GoogleServiceAccount) (PolicyBindings, error) {
+	bindings, err := g.iamClient.LoadBindingForGoogleServiceAccount(identity)
+	set, ok := federatedPrincipalSet(identity)
+	if !ok || (err != nil && !errors.Is(err, ErrNoIdentityAwareProxyRoleForUser)) {
+		return bindings, err
+	}
+	setBindings, setErr := g.iamClient.LoadBindingForGoogleServiceAccount(set)
+	if setErr != nil {
+		return bindings, err
+	}
+	return append(append(make(PolicyBindings, 0, len(bindings)+len(setBindings)), bindings...), setBindings...), nil
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"net/http"
+	"testing"
+)
+
+func TestFederatedPrincipalBindings(t *testing.T) {
+	var (
+		issuer, partners = newFakeOpenIDIssuer(t), newFakeOpenIDIssuer(t)
+		tokenService     = issuer.newTokenService(t, PrincipalClaimEmail)
+		pool             = "locations/global/workforcePools/corp"
+		other            = "locations/global/workforcePools/partners"
+		iamClient, fake  = newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+	)
+	fake.setBindings(http.StatusOK,
+		&cloudresourcemanager.Binding{Role: iapWebPermission, Members: []string{
+			"principal://iam.googleapis.com/" + pool + "/subject/alice",
+			"principalSet://iam.googleapis.com/" + other + "/*",
+			// Sets of attribute are not supported.
+			"principalSet://iam.googleapis.com/" + pool + "/attribute.department/eng",
+		}})
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	tokenService.SetFederatedIssuers([]FederatedIssuer{
+		{Issuer: issuer.server.URL, Pool: pool},
+		{Issuer: partners.server.URL, Pool: other, Audience: "open-iap"},
+	})
+	var (
+		// Email domain filter is not applied to federated principals.
+		authenticator = newFakeAuthenticator(t, tokenService, iamClient, EmailDomainFilter{Allowed: []string{"example.com"}})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		mint          = func(f *fakeOpenIDIssuer, iss, sub, aud string) string {
+			return f.mint(t, jwt.MapClaims{"iss": iss, "sub": sub, "aud": aud})
+		}
+	)
+	var tests = []struct {
+		name       string
+		token      string
+		statusCode int
+		email      string
+	}{
+		{"TestPrincipalBinding", mint(issuer, issuer.server.URL, "alice", "https://myurl.com"), http.StatusOK,
+			"accounts.google.com:principal://iam.googleapis.com/" + pool + "/subject/alice"},
+		{"TestNoPrincipalBinding", mint(issuer, issuer.server.URL, "bob", "https://myurl.com"), http.StatusForbidden, ""},
+		{"TestPrincipalSetBinding", mint(partners, partners.server.URL, "carol", "open-iap"), http.StatusOK,
+			"accounts.google.com:principal://iam.googleapis.com/" + other + "/subject/carol"},
+		{"TestFederatedTokenWithOtherAudience", mint(partners, partners.server.URL, "carol", "https://myurl.com"),
+			http.StatusUnauthorized, ""},
+		{"TestUntrustedIssuer", mint(issuer, "https://idp.example.com", "alice", "https://myurl.com"), http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello")
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if email := rsp.Header().Get(headerAuthenticatedUserEmail); email != tt.email {
+				t.Fatalf("Expected identity header %q, identity header %q was returned.", tt.email, email)
+			}
+		})
+	}
+}
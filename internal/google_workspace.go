@@ -11,7 +11,10 @@ import (
 
 // GoogleWorkspaceClient is an implementation of interface GoogleWorkspaceReader.
 type GoogleWorkspaceClient struct {
-	admin *admin.Service
+	admin   *admin.Service
+	limiter *APILimiter
+	// health is outcome of latest listing of group members.
+	health healthState
 }
 
 type emailSet map[string]struct{}
@@ -21,19 +24,25 @@ type GoogleWorkspaceClientReader interface {
 	ListGoogleServiceAccounts(ctx context.Context, groupEmail string) ([]GoogleServiceAccount, error)
 }
 
-// NewGoogleWorkspaceClient creates new client for Google Workspace.
-func NewGoogleWorkspaceClient(ctx context.Context, credentials *google.Credentials) (*GoogleWorkspaceClient, error) {
+// NewGoogleWorkspaceClient creates new client for Google Workspace. Calls are bounded by limiter, nil is unbounded.
+func NewGoogleWorkspaceClient(ctx context.Context, credentials *google.Credentials, limiter *APILimiter) (*GoogleWorkspaceClient, error) {
 	gws, err := admin.NewService(ctx, option.WithCredentials(credentials))
 	if err != nil {
 		return nil, err
 	}
 	return &GoogleWorkspaceClient{
-		admin: gws,
+		admin:   gws,
+		limiter: limiter,
 	}, nil
 }
 
 func (g *GoogleWorkspaceClient) traverseGroups(ctx context.Context, email string, doTraverse bool, seenGroupEmails, emailOfAllGroups emailSet, members []GoogleServiceAccount) ([]GoogleServiceAccount, error) {
+	if err := g.limiter.Acquire(ctx); err != nil {
+		return nil, err
+	}
 	response, err := g.admin.Members.List(email).Context(ctx).Do()
+	// Released before traversal of nested groups, a call is never held while waiting for another.
+	g.limiter.Release()
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +68,11 @@ func (g *GoogleWorkspaceClient) traverseGroups(ctx context.Context, email string
 
 // listAllGroupEmails returns a set of group emails which are present within Google Workspace.
 func (g *GoogleWorkspaceClient) listAllGroupEmails(ctx context.Context, domain string) (emailSet, error) {
+	if err := g.limiter.Acquire(ctx); err != nil {
+		return nil, err
+	}
 	allGroups, err := g.admin.Groups.List().Domain(domain).Context(ctx).Do()
+	g.limiter.Release()
 	if err != nil {
 		return nil, err
 	}
@@ -71,8 +84,14 @@ func (g *GoogleWorkspaceClient) listAllGroupEmails(ctx context.Context, domain s
 	return allGroupsEmails, nil
 }
 
+// Health returns health of latest listing of group members.
+func (g *GoogleWorkspaceClient) Health() ComponentHealth {
+	return g.health.health("workspace")
+}
+
 // ListGoogleServiceAccounts returns list of Google Service Accounts inside Google Workspace groups.
-func (g *GoogleWorkspaceClient) ListGoogleServiceAccounts(ctx context.Context, groupEmail string) ([]GoogleServiceAccount, error) {
+func (g *GoogleWorkspaceClient) ListGoogleServiceAccounts(ctx context.Context, groupEmail string) (_ []GoogleServiceAccount, err error) {
+	defer func() { g.health.observe(err) }()
 	var (
 		doTraverse = true
 		domainPart = groupEmail[strings.LastIndex(groupEmail, "@")+1:]
@@ -89,6 +108,24 @@ func (g *GoogleWorkspaceClient) ListGoogleServiceAccounts(ctx context.Context, g
 	return g.traverseGroups(ctx, groupEmail, doTraverse, seenGroups, allGroupsInDomain, members)
 }
 
+// ListEmailAliases returns primary and alias emails of user in Google Workspace.
+func (g *GoogleWorkspaceClient) ListEmailAliases(ctx context.Context, email GoogleServiceAccount) ([]GoogleServiceAccount, error) {
+	if err := g.limiter.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	user, err := g.admin.Users.Get(string(email)).Fields("primaryEmail", "aliases", "nonEditableAliases").Context(ctx).Do()
+	g.limiter.Release()
+	if err != nil {
+		return nil, err
+	}
+	aliases := make([]GoogleServiceAccount, 0, 1+len(user.Aliases)+len(user.NonEditableAliases))
+	aliases = append(aliases, GoogleServiceAccount(user.PrimaryEmail))
+	for _, alias := range append(user.Aliases, user.NonEditableAliases...) {
+		aliases = append(aliases, GoogleServiceAccount(alias))
+	}
+	return aliases, nil
+}
+
 func (e emailSet) hasEmail(email string) bool {
 	_, ok := e[email]
 	return ok
@@ -0,0 +1,566 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeOpenIDIssuer serves an openid discovery document and JWKS in place of Google, while minting RS256 or ES256 tokens.
+// Self-signed JWK of service accounts are served on /service_accounts/v1/jwk/<email> given same keys.
+type fakeOpenIDIssuer struct {
+	server *httptest.Server
+	mu     sync.RWMutex
+	keys   map[string]crypto.Signer
+	kid    string
+	// jwksRequests is number of requests for JWKS, both public and self-signed.
+	jwksRequests atomic.Int32
+	// cacheControl is Cache-Control of JWKS, empty is none.
+	cacheControl string
+	// delay is latency of JWKS in nanoseconds.
+	delay atomic.Int64
+}
+
+// newFakeOpenIDIssuer starts a fake issuer with a single signing key.
+func newFakeOpenIDIssuer(t testing.TB) *fakeOpenIDIssuer {
+	t.Helper()
+	issuer := &fakeOpenIDIssuer{keys: make(map[string]crypto.Signer)}
+	issuer.rotate(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   googlePublicIssuerIdToken,
+			"jwks_uri": issuer.server.URL + "/oauth2/v3/certs",
+		})
+	})
+	mux.HandleFunc("GET /oauth2/v3/certs", issuer.jwks)
+	mux.HandleFunc("GET /service_accounts/v1/jwk/{email}", issuer.jwks)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// rotate generates a new RS256 signing key, previous keys are still published.
+func (f *fakeOpenIDIssuer) rotate(t testing.TB) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return f.use(key)
+}
+
+// rotateES256 generates a new ES256 signing key, previous keys are still published.
+func (f *fakeOpenIDIssuer) rotateES256(t testing.TB) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return f.use(key)
+}
+
+// use key as current signing key.
+func (f *fakeOpenIDIssuer) use(key crypto.Signer) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kid = fmt.Sprintf("kid-%d", len(f.keys))
+	f.keys[f.kid] = key
+	return f.kid
+}
+
+// withdraw unpublishes key of kid, tokens signed by key are still minted given current signing key.
+func (f *fakeOpenIDIssuer) withdraw(kid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.keys, kid)
+}
+
+func (f *fakeOpenIDIssuer) jwks(w http.ResponseWriter, _ *http.Request) {
+	f.jwksRequests.Add(1)
+	time.Sleep(time.Duration(f.delay.Load()))
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if len(f.cacheControl) > 0 {
+		w.Header().Set("Cache-Control", f.cacheControl)
+	}
+
+	keys := make([]map[string]string, 0, len(f.keys))
+	for kid, key := range f.keys {
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case *ecdsa.PrivateKey:
+			keys = append(keys, map[string]string{
+				"kty": "EC",
+				"alg": "ES256",
+				"use": "sig",
+				"kid": kid,
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+// mint signs claims with current signing key. Issuer accounts.google.com, iat and exp are given unless in claims.
+func (f *fakeOpenIDIssuer) mint(t testing.TB, claims jwt.MapClaims) string {
+	t.Helper()
+	defaults := jwt.MapClaims{
+		"iss": googlePublicIssuerIdToken,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for claim, val := range defaults {
+		if _, ok := claims[claim]; !ok {
+			claims[claim] = val
+		}
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var method jwt.SigningMethod = jwt.SigningMethodRS256
+	if _, ok := f.keys[f.kid].(*ecdsa.PrivateKey); ok {
+		method = jwt.SigningMethodES256
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = f.kid
+	tokenString, err := token.SignedString(f.keys[f.kid])
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return tokenString
+}
+
+// newTokenService returns a token service using fake issuer as source of JWK.
+func (f *fakeOpenIDIssuer) newTokenService(t testing.TB, principalClaim string) *GoogleTokenService {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tokenService, err := newGoogleTokenService(ctx, cache.NewExpiryCache[keyfunc.Keyfunc](ctx, time.Minute),
+		time.Minute, time.Minute, principalClaim, f.server.URL+"/.well-known/openid-configuration",
+		f.server.URL+"/service_accounts/v1/jwk/", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return tokenService
+}
+
+func TestEndToEndAuthentication(t *testing.T) {
+	var (
+		issuer       = newFakeOpenIDIssuer(t)
+		tokenService = issuer.newTokenService(t, PrincipalClaimEmail)
+		email        = "sa@p.iam.gserviceaccount.com"
+		bindings     = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {
+			{Expression: "request.path.startsWith(\"/admin\")", Title: "admin"},
+			{Expression: "request.path.startsWith(\"/hello\") && request.host == \"myurl.com\"", Title: "hello"},
+		}}
+		authenticator = newFakeAuthenticator(t, tokenService, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		idToken       = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email, "sub": "1234567890"})
+		selfSigned    = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "iss": email, "sub": email})
+	)
+	var tests = []struct {
+		name       string
+		token      string
+		requestUrl string
+		statusCode int
+	}{
+		{"TestIdTokenWithMatchingBinding", idToken, "https://myurl.com/hello", http.StatusOK},
+		{"TestCachedIdTokenWithMatchingBinding", idToken, "https://myurl.com/hello/world", http.StatusOK},
+		{"TestCachedIdTokenWithoutMatchingBinding", idToken, "https://myurl.com/other", http.StatusUnauthorized},
+		{"TestSelfSignedTokenWithMatchingBinding", selfSigned, "https://myurl.com/admin", http.StatusOK},
+		{"TestIdTokenWithOtherAudience", idToken, "https://other.com/hello", http.StatusUnauthorized},
+		{"TestTamperedIdToken", idToken[:strings.LastIndex(idToken, ".")] + ".invalid", "https://myurl.com/hello",
+			http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rsp := doAuthRequest(listener, tt.token, tt.requestUrl); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestExpiredTokenChallenge(t *testing.T) {
+	var (
+		issuer        = newFakeOpenIDIssuer(t)
+		email         = "sa@p.iam.gserviceaccount.com"
+		bindings      = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{}}}
+		authenticator = newFakeAuthenticator(t, issuer.newTokenService(t, PrincipalClaimEmail), bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		idToken       = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email})
+	)
+	var tests = []struct {
+		name            string
+		token           string
+		wwwAuthenticate string
+	}{
+		{"TestExpiredIdToken", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email,
+			"iat": time.Now().Add(-3 * time.Hour).Unix(), "exp": time.Now().Add(-2 * time.Hour).Unix()}),
+			tokenExpiredChallenge},
+		{"TestMalformedIdToken", "not.a.token", ""},
+		{"TestTamperedIdToken", idToken[:strings.LastIndex(idToken, ".")] + ".invalid", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello")
+			if rsp.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status code 401 Unauthorized, status code %d was returned.", rsp.Code)
+			} else if header := rsp.Header().Get("WWW-Authenticate"); header != tt.wwwAuthenticate {
+				t.Fatalf("Expected header WWW-Authenticate %q, %q was returned.", tt.wwwAuthenticate, header)
+			}
+		})
+	}
+}
+
+func TestFutureIssuedToken(t *testing.T) {
+	var (
+		issuer        = newFakeOpenIDIssuer(t)
+		email         = "user@example.com"
+		bindings      = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{}}}
+		authenticator = newFakeAuthenticator(t, issuer.newTokenService(t, PrincipalClaimEmail), bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		counter       = futureIssuedTokensCounter.WithLabelValues(googlePublicIssuerIdToken)
+	)
+	listener.SetDecisionReason(true)
+
+	var tests = []struct {
+		name       string
+		iat        time.Time
+		statusCode int
+		reason     string
+		counted    float64
+	}{
+		// Leeway of iat is one minute.
+		{"TestIatWithinLeeway", time.Now().Add(30 * time.Second), http.StatusOK, "granted:identity", 0},
+		{"TestIatBeyondLeeway", time.Now().Add(10 * time.Minute), http.StatusUnauthorized, "denied:issued_in_future", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(counter)
+			token := issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email, "iat": tt.iat.Unix()})
+
+			if rsp := doAuthRequest(listener, token, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if reason := rsp.Header().Get(decisionReasonHeader); reason != tt.reason {
+				t.Fatalf("Expected decision reason %s, decision reason %s was returned.", tt.reason, reason)
+			} else if val := testutil.ToFloat64(counter) - before; val != tt.counted {
+				t.Fatalf("Expected %f tokens issued in future to be counted, got %f.", tt.counted, val)
+			}
+		})
+	}
+}
+
+func TestTokenVerificationMetricLabels(t *testing.T) {
+	var (
+		issuer     = newFakeOpenIDIssuer(t)
+		email      = "sa@p.iam.gserviceaccount.com"
+		rs256      = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email})
+		selfSigned = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "iss": email, "sub": email})
+	)
+	// Previous RS256 key is still published.
+	issuer.rotateES256(t)
+	var (
+		es256        = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email})
+		tokenService = issuer.newTokenService(t, PrincipalClaimEmail)
+	)
+
+	var tests = []struct {
+		name                string
+		token, aud          string
+		issuer, alg, result string
+	}{
+		{"TestGoogleRS256Token", rs256, "https://myurl.com", googlePublicIssuerIdToken, "RS256", "success"},
+		{"TestGoogleRS256TokenWithOtherAudience", rs256, "https://other.com", googlePublicIssuerIdToken, "RS256", "failure"},
+		{"TestSelfSignedRS256Token", selfSigned, "https://myurl.com", labelSelfSigned, "RS256", "success"},
+		{"TestFakeES256Token", es256, "https://myurl.com", googlePublicIssuerIdToken, "ES256", "success"},
+		{"TestMalformedToken", "not.a.token", "https://myurl.com", labelUnknown, labelUnknown, "failure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := tokenVerificationsCounter.WithLabelValues(tt.issuer, tt.alg, tt.result)
+			before := testutil.ToFloat64(counter)
+			_ = tokenService.Verify(context.Background(), tt.token, tt.aud, &GoogleTokenClaims{})
+
+			if val := testutil.ToFloat64(counter); val != before+1 {
+				t.Fatalf("Expected verification with issuer %s, alg %s and result %s to be counted once, got %f.",
+					tt.issuer, tt.alg, tt.result, val-before)
+			}
+		})
+	}
+}
+
+func TestWarmJwkCache(t *testing.T) {
+	var (
+		issuer, federated = newFakeOpenIDIssuer(t), newFakeOpenIDIssuer(t)
+		tokenService      = issuer.newTokenService(t, PrincipalClaimEmail)
+		email             = "sa@p.iam.gserviceaccount.com"
+		selfSigned        = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "iss": email, "sub": email})
+	)
+	tokenService.SetFederatedIssuers([]FederatedIssuer{{Issuer: federated.server.URL, Pool: "locations/global/workforcePools/corp"}})
+	if err := tokenService.WarmJwkCache(context.Background(), []string{email, federated.server.URL}, time.Second); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	// Certs are present immediately after warm-up, not populated asynchronously.
+	for _, iss := range []string{email, federated.server.URL} {
+		if _, ok := tokenService.jwkCache.Get(iss); !ok {
+			t.Fatalf("Expected JWK of issuer %s in cache after warm-up.", iss)
+		}
+	}
+	requests := issuer.jwksRequests.Load()
+	if err := tokenService.Verify(context.Background(), selfSigned, "https://myurl.com", &GoogleTokenClaims{}); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if n := issuer.jwksRequests.Load() - requests; n != 0 {
+		t.Fatalf("Expected no JWKS request given warm cache, %d requests were given.", n)
+	}
+	if err := tokenService.WarmJwkCache(context.Background(), []string{"https://unknown.example.com"}, time.Second); !errors.Is(err, ErrMissingJWK) {
+		t.Fatalf("Expected error %v, error %v was returned.", ErrMissingJWK, err)
+	}
+}
+
+func TestTokenWithoutEmailClaim(t *testing.T) {
+	var (
+		issuer        = newFakeOpenIDIssuer(t)
+		bindings      = fakeIdentityAccessManagementReader{"": {{}}}
+		authenticator = newFakeAuthenticator(t, issuer.newTokenService(t, PrincipalClaimEmail), bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		idToken       = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "sub": "1234567890"})
+		lookups       atomic.Int32
+	)
+	authenticator.SetTimingHook(func(_ context.Context, operation Operation, _ time.Duration) {
+		if operation == OperationLoadBindings {
+			lookups.Add(1)
+		}
+	})
+	rsp := doAuthRequest(listener, idToken, "https://myurl.com/hello")
+	if rsp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code 401 Unauthorized, status code %d was returned.", rsp.Code)
+	} else if challenge := rsp.Header().Get("WWW-Authenticate"); challenge != missingIdentityChallenge {
+		t.Fatalf("Expected challenge %s, challenge %s was returned.", missingIdentityChallenge, challenge)
+	} else if lookups.Load() != 0 {
+		t.Fatal("Expected no lookup of policy bindings given token without identity.")
+	}
+}
+
+func TestUnknownKidRefresh(t *testing.T) {
+	var (
+		issuer       = newFakeOpenIDIssuer(t)
+		tokenService = issuer.newTokenService(t, PrincipalClaimEmail)
+		email        = "sa@p.iam.gserviceaccount.com"
+		bindings     = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{}}}
+		listener     = newFakeAuthServiceListener(t, newFakeAuthenticator(t, tokenService, bindings, EmailDomainFilter{}))
+	)
+	var tests = []struct {
+		name       string
+		before     func()
+		statusCode int
+		refreshes  int32
+	}{
+		{"TestKidOfRotatedKeyAfterForcedRefresh", nil, http.StatusOK, 1},
+		{"TestKnownKidWithoutRefresh", func() {}, http.StatusOK, 0},
+		{"TestUnknownKidRefreshIsRateLimited", func() { issuer.rotate(t) }, http.StatusUnauthorized, 0},
+		{"TestUnknownKidRefreshAfterInterval", func() {
+			issuer.rotate(t)
+			tokenService.kidRefreshInterval = 0
+		}, http.StatusOK, 1},
+	}
+	// Key is rotated after public certificates are loaded, kid is unknown until refreshed.
+	issuer.rotate(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+			jwksRequests := issuer.jwksRequests.Load()
+			idToken := issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email, "sub": "1234567890"})
+			if rsp := doAuthRequest(listener, idToken, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if refreshes := issuer.jwksRequests.Load() - jwksRequests; refreshes != tt.refreshes {
+				t.Fatalf("Expected %d refreshes of jwks, %d refreshes were made.", tt.refreshes, refreshes)
+			}
+		})
+	}
+}
+
+func TestUnknownKidAfterRefresh(t *testing.T) {
+	var (
+		issuer       = newFakeOpenIDIssuer(t)
+		tokenService = issuer.newTokenService(t, PrincipalClaimEmail)
+		// Key is withdrawn before public certificates are refreshed, kid is unknown given refresh.
+		kid     = issuer.rotate(t)
+		idToken = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": "sa@p.iam.gserviceaccount.com"})
+	)
+	issuer.withdraw(kid)
+
+	var tests = []struct {
+		name      string
+		before    func()
+		refresh   string
+		refreshes int32
+	}{
+		{"TestUnknownKidAfterForcedRefresh", nil, "refreshed", 1},
+		{"TestUnknownKidGivenRateLimitedRefresh", nil, "limited", 0},
+		{"TestUnknownKidAfterRefreshOfInterval", func() { tokenService.SetUnknownKidRefreshInterval(0) }, "refreshed", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+			var (
+				jwksRequests = issuer.jwksRequests.Load()
+				unknown      = testutil.ToFloat64(unknownKidsCounter.WithLabelValues(googlePublicIssuerIdToken, tt.refresh))
+				err          = tokenService.Verify(context.Background(), idToken, "https://myurl.com", &GoogleTokenClaims{})
+			)
+			if !errors.Is(err, ErrUnknownKid) {
+				t.Fatalf("Expected error %v, error returned: %v.", ErrUnknownKid, err)
+			} else if refreshes := issuer.jwksRequests.Load() - jwksRequests; refreshes != tt.refreshes {
+				t.Fatalf("Expected %d refreshes of jwks, %d refreshes were made.", tt.refreshes, refreshes)
+			} else if val := testutil.ToFloat64(unknownKidsCounter.WithLabelValues(googlePublicIssuerIdToken, tt.refresh)); val != unknown+1 {
+				t.Fatalf("Expected unknown kid given refresh %s to be counted once, got %f.", tt.refresh, val-unknown)
+			}
+		})
+	}
+}
+
+func TestUnknownKidRefreshIsCoalesced(t *testing.T) {
+	const tokens = 20
+	var tests = []struct {
+		name      string
+		coalesced bool
+		refreshes int32
+	}{
+		{"TestConcurrentUnknownKidIsCoalesced", true, 1},
+		{"TestConcurrentUnknownKidIsNotCoalesced", false, tokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				issuer       = newFakeOpenIDIssuer(t)
+				tokenService = issuer.newTokenService(t, PrincipalClaimEmail)
+				kid          = issuer.rotate(t)
+				idToken      = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": "sa@p.iam.gserviceaccount.com"})
+				wg           sync.WaitGroup
+				start        = make(chan struct{})
+			)
+			issuer.withdraw(kid)
+			issuer.delay.Store(int64(50 * time.Millisecond))
+			tokenService.SetUnknownKidRefreshInterval(0)
+			tokenService.SetUnknownKidCoalescing(tt.coalesced)
+			jwksRequests := issuer.jwksRequests.Load()
+
+			for range tokens {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					if err := tokenService.Verify(context.Background(), idToken, "https://myurl.com", &GoogleTokenClaims{}); !errors.Is(err, ErrUnknownKid) {
+						t.Errorf("Expected error %v, error returned: %v.", ErrUnknownKid, err)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+			if refreshes := issuer.jwksRequests.Load() - jwksRequests; refreshes != tt.refreshes {
+				t.Fatalf("Expected %d refreshes of jwks, %d refreshes were made.", tt.refreshes, refreshes)
+			}
+		})
+	}
+}
+
+func TestJwkMaxAge(t *testing.T) {
+	var (
+		issuer = newFakeOpenIDIssuer(t)
+		email  = "sa@p.iam.gserviceaccount.com"
+	)
+	// Upstream advertises a day, max age of JWK takes precedence.
+	issuer.cacheControl = "public, max-age=86400, must-revalidate"
+	tokenService := issuer.newTokenService(t, PrincipalClaimEmail)
+	tokenService.SetJwkMaxAge(2 * time.Second)
+
+	var tests = []struct {
+		name      string
+		token     string
+		before    func()
+		refreshes int32
+	}{
+		{"TestSelfSignedIsLoaded", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "iss": email, "sub": email}), nil, 1},
+		{"TestCachedSelfSignedWithinMaxAge", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "iss": email, "sub": email}), nil, 0},
+		{"TestPublicWithinMaxAge", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email}), nil, 0},
+		{"TestSelfSignedIsRefreshedAtMaxAge", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "iss": email, "sub": email}),
+			func() { time.Sleep(3 * time.Second) }, 1},
+		{"TestPublicIsRefreshedAtMaxAge", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email}), nil, 1},
+		{"TestRefreshedPublicWithinMaxAge", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email}), nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+			jwksRequests := issuer.jwksRequests.Load()
+			if err := tokenService.Verify(context.Background(), tt.token, "https://myurl.com", &GoogleTokenClaims{}); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			} else if refreshes := issuer.jwksRequests.Load() - jwksRequests; refreshes != tt.refreshes {
+				t.Fatalf("Expected %d refreshes of jwks, %d refreshes were made.", tt.refreshes, refreshes)
+			}
+		})
+	}
+}
+
+func TestJwkTTL(t *testing.T) {
+	var tests = []struct {
+		name         string
+		cacheControl string
+		maxAge       time.Duration
+		ttl          time.Duration
+	}{
+		{"TestNoCacheControl", "", 0, defaultJwkTTL},
+		{"TestCacheControlMaxAge", "public, max-age=3600", 0, time.Hour},
+		{"TestMaxAgeBoundsCacheControl", "public, max-age=86400", time.Minute, time.Minute},
+		{"TestShorterCacheControlIsRetained", "max-age=30", time.Minute, 30 * time.Second},
+		{"TestInvalidCacheControl", "max-age=abc", time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Cache-Control", tt.cacheControl)
+			tokenService := &GoogleTokenService{jwkMaxAge: tt.maxAge}
+			if ttl := tokenService.jwkTTL(cacheControlMaxAge(header)); ttl != tt.ttl {
+				t.Fatalf("Expected ttl %s, ttl %s was given.", tt.ttl, ttl)
+			}
+		})
+	}
+}
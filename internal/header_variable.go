@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/cel-go/cel"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HeaderVariable maps trusted header of request to variable of conditional expressions, i.e. X-Geo-Country as
+// geo.country, of Type string, int, bool or double.
+type HeaderVariable struct {
+	Header   string
+	Variable string
+	Type     string
+}
+
+// ErrInvalidHeaderVariable is given when a header variable is invalid or value of header is not of its type.
+var ErrInvalidHeaderVariable = errors.New("invalid header variable")
+
+var (
+	headerVariableName = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)*$`)
+	headerVariableType = map[string]*cel.Type{
+		"string": cel.StringType,
+		"int":    cel.IntType,
+		"bool":   cel.BoolType,
+		"double": cel.DoubleType,
+	}
+	// reservedNamespaces are namespaces of variables of Identity Aware Proxy, header variables can't shadow these.
+	reservedNamespaces = []string{"request", "resource", "device"}
+	// builtinCelVars are variables without header variables, extended by SetHeaderVariables.
+	builtinCelVars = celVars
+)
+
+// HeaderVariables are values of header variables of request, by name of variable.
+type HeaderVariables map[string]any
+
+type headerVariablesKey struct{}
+
+// SetHeaderVariables declares header variables for conditional expressions, of which values are read from trusted
+// headers of each request. Gateway must overwrite headers of inbound requests. Given absent header, conditions of
+// variable fail evaluation, i.e. are not satisfied. Must be invoked before listener is started, and before any
+// conditional expression is compiled, i.e. by SetRoutePolicy.
+func (a *AuthServiceListener) SetHeaderVariables(variables []HeaderVariable) error {
+	options := make([]cel.EnvOption, 0, len(variables))
+	for i, variable := range variables {
+		typ, ok := headerVariableType[variable.Type]
+		if len(variable.Header) == 0 || !ok || !headerVariableName.MatchString(variable.Variable) {
+			return fmt.Errorf("%w: header %q of variable %q of type %q", ErrInvalidHeaderVariable, variable.Header,
+				variable.Variable, variable.Type)
+		} else if namespace, _, _ := strings.Cut(variable.Variable, "."); slices.Contains(reservedNamespaces, namespace) {
+			return fmt.Errorf("%w: variable %s is of reserved namespace %s", ErrInvalidHeaderVariable, variable.Variable, namespace)
+		} else if slices.ContainsFunc(variables[:i], func(other HeaderVariable) bool { return other.Variable == variable.Variable }) {
+			return fmt.Errorf("%w: variable %s is declared twice", ErrInvalidHeaderVariable, variable.Variable)
+		}
+		options = append(options, cel.Variable(variable.Variable, typ))
+	}
+	env, err := builtinCelVars.Extend(options...)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidHeaderVariable, err)
+	}
+	celVars = env
+	a.headerVariables = slices.Clone(variables)
+	return nil
+}
+
+// withHeaderVariables returns ctx holding values of header variables of request.
+func (a *AuthServiceListener) withHeaderVariables(ctx context.Context, r *http.Request) (context.Context, error) {
+	if len(a.headerVariables) == 0 {
+		return ctx, nil
+	}
+	values := make(HeaderVariables, len(a.headerVariables))
+	for _, variable := range a.headerVariables {
+		header := r.Header.Get(variable.Header)
+		if len(header) == 0 {
+			continue
+		}
+		val, err := parseHeaderVariable(variable.Type, header)
+		if err != nil {
+			return ctx, fmt.Errorf("%w: header %s of variable %s: %s", ErrInvalidHeaderVariable, variable.Header,
+				variable.Variable, err)
+		}
+		values[variable.Variable] = val
+	}
+	return context.WithValue(ctx, headerVariablesKey{}, values), nil
+}
+
+// parseHeaderVariable parses value of header given type of variable.
+func parseHeaderVariable(typ, header string) (any, error) {
+	switch typ {
+	case "int":
+		return strconv.ParseInt(header, 10, 64)
+	case "bool":
+		return strconv.ParseBool(header)
+	case "double":
+		return strconv.ParseFloat(header, 64)
+	default:
+		return header, nil
+	}
+}
+
+// headerVariables returns values of header variables of ctx, empty given none.
+func headerVariables(ctx context.Context) HeaderVariables {
+	if values, ok := ctx.Value(headerVariablesKey{}).(HeaderVariables); ok {
+		return values
+	}
+	return HeaderVariables{}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderVariableCondition(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = fakeIdentityAccessManagementReader{email: {
+			{Expression: "geo.country == \"SE\" && risk.score < 50", Title: "geo"},
+		}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+	)
+	if err := listener.SetHeaderVariables([]HeaderVariable{
+		{Header: "X-Geo-Country", Variable: "geo.country", Type: "string"},
+		{Header: "X-Risk-Score", Variable: "risk.score", Type: "int"},
+	}); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+
+	var tests = []struct {
+		name       string
+		country    string
+		score      string
+		statusCode int
+	}{
+		{"TestMappedVariablesSatisfyCondition", "SE", "10", http.StatusOK},
+		{"TestOtherCountryIsDenied", "NO", "10", http.StatusUnauthorized},
+		{"TestHighScoreIsDenied", "SE", "90", http.StatusUnauthorized},
+		{"TestAbsentHeaderIsDenied", "", "10", http.StatusUnauthorized},
+		{"TestInvalidTypeOfHeaderIsDenied", "SE", "low", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("Proxy-Authorization", "Bearer token")
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			if len(tt.country) > 0 {
+				req.Header.Set("X-Geo-Country", tt.country)
+			}
+			req.Header.Set("X-Risk-Score", tt.score)
+			rsp := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rsp, req)
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestInvalidHeaderVariables(t *testing.T) {
+	var tests = []struct {
+		name      string
+		variables []HeaderVariable
+	}{
+		{"TestUnknownType", []HeaderVariable{{Header: "X-Geo-Country", Variable: "geo.country", Type: "timestamp"}}},
+		{"TestEmptyHeader", []HeaderVariable{{Variable: "geo.country", Type: "string"}}},
+		{"TestInvalidName", []HeaderVariable{{Header: "X-Geo-Country", Variable: "geo-country", Type: "string"}}},
+		{"TestReservedNamespace", []HeaderVariable{{Header: "X-Path", Variable: "request.geo", Type: "string"}}},
+		{"TestDuplicateVariable", []HeaderVariable{
+			{Header: "X-Geo-Country", Variable: "geo.country", Type: "string"},
+			{Header: "X-Country", Variable: "geo.country", Type: "string"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := newFakeAuthServiceListener(t, nil)
+			if err := listener.SetHeaderVariables(tt.variables); !errors.Is(err, ErrInvalidHeaderVariable) {
+				t.Fatalf("Expected error %v, error returned: %v.", ErrInvalidHeaderVariable, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// HealthReporter is implemented by components of which health is reported on /readyz, i.e. JWKS fetch, policy refresh
+// and Google Workspace.
+type HealthReporter interface {
+	Health() ComponentHealth
+}
+
+// ComponentHealth is health of a component given latest attempt, i.e. a refresh. LastError is error of latest attempt
+// and retained until an attempt is successful.
+type ComponentHealth struct {
+	Name        string    `json:"name"`
+	Healthy     bool      `json:"healthy"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+}
+
+// HealthReport is health of listener and each component. Status is ok, degraded given an unhealthy component or
+// draining given listener is not ready.
+type HealthReport struct {
+	Status     string            `json:"status"`
+	Components []ComponentHealth `json:"components"`
+}
+
+const (
+	healthStatusOK       = "ok"
+	healthStatusDegraded = "degraded"
+	healthStatusDraining = "draining"
+)
+
+// healthState tracks outcome of latest attempt of a component. Safe for concurrent use.
+type healthState struct {
+	mu          sync.Mutex
+	lastError   error
+	lastSuccess time.Time
+}
+
+// observe records outcome of an attempt.
+func (h *healthState) observe(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastError = err; err == nil {
+		h.lastSuccess = time.Now()
+	}
+}
+
+// health returns health of component name. A component without attempts is healthy.
+func (h *healthState) health(name string) ComponentHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	health := ComponentHealth{Name: name, Healthy: h.lastError == nil, LastSuccess: h.lastSuccess}
+	if h.lastError != nil {
+		health.LastError = h.lastError.Error()
+	}
+	return health
+}
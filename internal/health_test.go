@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newFakeGoogleWorkspaceClient returns a client of Google Workspace of which every call fails given status.
+func newFakeGoogleWorkspaceClient(t *testing.T, status int) *GoogleWorkspaceClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	service, err := admin.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return &GoogleWorkspaceClient{admin: service}
+}
+
+func TestComponentHealth(t *testing.T) {
+	var tests = []struct {
+		name      string
+		unhealthy string
+		fail      func(t *testing.T, issuer *fakeOpenIDIssuer, tokenService *GoogleTokenService,
+			iamClient *IdentityAccessManagementClient, fake *fakeResourceManager, gws *GoogleWorkspaceClient)
+	}{
+		{"TestHealthyComponents", "", func(*testing.T, *fakeOpenIDIssuer, *GoogleTokenService,
+			*IdentityAccessManagementClient, *fakeResourceManager, *GoogleWorkspaceClient) {
+		}},
+		{"TestUnhealthyJwks", "jwks", func(t *testing.T, issuer *fakeOpenIDIssuer, tokenService *GoogleTokenService,
+			_ *IdentityAccessManagementClient, _ *fakeResourceManager, _ *GoogleWorkspaceClient) {
+			issuer.server.Close()
+			if err := tokenService.refreshPublicCerts(context.Background()); err == nil {
+				t.Fatal("Expected error given unavailable issuer, no error was returned.")
+			}
+		}},
+		{"TestUnhealthyPolicy", "policy", func(t *testing.T, _ *fakeOpenIDIssuer, _ *GoogleTokenService,
+			iamClient *IdentityAccessManagementClient, fake *fakeResourceManager, _ *GoogleWorkspaceClient) {
+			fake.setBindings(http.StatusInternalServerError)
+			if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); err == nil {
+				t.Fatal("Expected error given failure of IAM API, no error was returned.")
+			}
+		}},
+		{"TestUnhealthyWorkspace", "workspace", func(t *testing.T, _ *fakeOpenIDIssuer, _ *GoogleTokenService,
+			_ *IdentityAccessManagementClient, _ *fakeResourceManager, gws *GoogleWorkspaceClient) {
+			if _, err := gws.ListGoogleServiceAccounts(context.Background(), "group@example.com"); err == nil {
+				t.Fatal("Expected error given failure of Google Workspace, no error was returned.")
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				issuer          = newFakeOpenIDIssuer(t)
+				tokenService    = issuer.newTokenService(t, PrincipalClaimEmail)
+				iamClient, fake = newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+				gws             = newFakeGoogleWorkspaceClient(t, http.StatusInternalServerError)
+				listener        = newFakeAuthServiceListener(t, newFakeAuthenticator(t, tokenService, iamClient, EmailDomainFilter{}))
+			)
+			if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			listener.SetHealthReporters(tokenService, iamClient, gws)
+			listener.ready.Store(true)
+			tt.fail(t, issuer, tokenService, iamClient, fake, gws)
+
+			rsp := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rsp, httptest.NewRequest("GET", "/readyz", nil))
+			var (
+				report HealthReport
+				status = healthStatusOK
+			)
+			if len(tt.unhealthy) > 0 {
+				status = healthStatusDegraded
+			}
+			if rsp.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d given degraded component, status code %d was returned.", http.StatusOK, rsp.Code)
+			} else if err := json.Unmarshal(rsp.Body.Bytes(), &report); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			} else if report.Status != status {
+				t.Fatalf("Expected status %s, status %s was returned.", status, report.Status)
+			} else if len(report.Components) != 3 {
+				t.Fatalf("Expected 3 components, %d components were reported.", len(report.Components))
+			}
+			for _, component := range report.Components {
+				if unhealthy := component.Name == tt.unhealthy; component.Healthy == unhealthy {
+					t.Fatalf("Expected component %s healthy %t, healthy %t was reported.", component.Name, !unhealthy, component.Healthy)
+				} else if unhealthy && len(component.LastError) == 0 {
+					t.Fatalf("Expected last error of unhealthy component %s.", component.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestDrainingHealthReport(t *testing.T) {
+	listener := newFakeAuthServiceListener(t, newFakeAuthenticator(t, &fakeTokenVerifier{}, fakeIdentityAccessManagementReader{}, EmailDomainFilter{}))
+	rsp := httptest.NewRecorder()
+	listener.httpServer.Handler.ServeHTTP(rsp, httptest.NewRequest("GET", "/readyz", nil))
+
+	var report HealthReport
+	if rsp.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status code %d, status code %d was returned.", http.StatusServiceUnavailable, rsp.Code)
+	} else if err := json.Unmarshal(rsp.Body.Bytes(), &report); err != nil || report.Status != healthStatusDraining {
+		t.Fatalf("Expected status %s, status %s and error %v were returned.", healthStatusDraining, report.Status, err)
+	}
+}
@@ -3,27 +3,63 @@ package internal
 import (
 	"context"
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/iap/v1"
 	"google.golang.org/api/option"
+	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // IdentityAccessManagementClient is a service implementation to retrieve bindings from Google Cloud.
 type IdentityAccessManagementClient struct {
-	service            *cloudresourcemanager.Service
-	pid                string
-	roleCollectionCopy atomic.Value
-	gwsClient          GoogleWorkspaceClientReader
+	service *cloudresourcemanager.Service
+	pid     string
+	// policy is swapped as a whole on refresh, readers never observe a partially applied refresh.
+	policy    atomic.Pointer[policySnapshot]
+	gwsClient GoogleWorkspaceClientReader
+	dropGuard BindingDropGuard
+	limiter   *APILimiter
+	// refreshMu serializes refreshes, an earlier refresh never replaces bindings of a later one.
+	refreshMu sync.Mutex
+	health    healthState
+	// userMembers includes user members of policy, ignored unless set.
+	userMembers atomic.Bool
+	// iapService and resources read policies of resources of Identity Aware Proxy, none given nil iapService. Guarded
+	// by refreshMu.
+	iapService *iap.Service
+	resources  []string
+	// numOfBindings and suspiciousDrops are state of applied policy bindings, guarded by mu.
+	mu                             sync.Mutex
+	numOfBindings, suspiciousDrops int
+}
+
+// policySnapshot is policy bindings of a refresh and time of refresh. Never mutated once stored.
+type policySnapshot struct {
+	collection GoogleServiceAccountRoleCollection
+	refresh    time.Time
+}
+
+// BindingDropGuard detects suspiciously large drops of policy bindings between refreshes, i.e. given a partial
+// API result. A drop by more than ratio Threshold retains previous policy bindings for up to Grace consecutive
+// refreshes, after which the drop is considered legitimate and applied. Threshold of zero disables the guard.
+type BindingDropGuard struct {
+	Threshold float64
+	Grace     int
 }
 
 // PolicyBinding is a struct to retain policy information (of what is relevant).
 type PolicyBinding struct {
 	Expression string
 	Title      string
+	// Resource is name of resource of which binding is granted, empty given binding of project, i.e. granted on every
+	// resource.
+	Resource string
 }
 
 const iapWebPermission = "roles/iap.httpsResourceAccessor"
@@ -48,14 +84,23 @@ type IdentityAccessManagementReader interface {
 	RefreshRoleAndBindingsForIdentityAwareProxy(ctx context.Context) error
 	LoadBindingForGoogleServiceAccount(uid GoogleServiceAccount) (PolicyBindings, error)
 	LoadRoleCollection() GoogleServiceAccountRoleCollection
+	LastSuccessfulRefresh() time.Time
 }
 
-// ErrNoIdentityAwareProxyRoleForUser is returned when user does not have role for IAP.
-var ErrNoIdentityAwareProxyRoleForUser = errors.New("no iap role found")
+var (
+	// ErrNoIdentityAwareProxyRoleForUser is returned when user does not have role for IAP.
+	ErrNoIdentityAwareProxyRoleForUser = errors.New("no iap role found")
+	// ErrPolicyBindingsUnavailable is returned when policy bindings are not loaded, i.e. given failure of IAM API.
+	ErrPolicyBindingsUnavailable = errors.New("policy bindings unavailable")
+	// ErrSuspiciousPolicyBindingsDrop is returned when refresh is not applied given BindingDropGuard.
+	ErrSuspiciousPolicyBindingsDrop = errors.New("suspicious drop of policy bindings")
+)
 
-// NewIdentityAccessManagementClient generates an implementation of PolicyBindingReader.
+// NewIdentityAccessManagementClient generates an implementation of PolicyBindingReader. Calls are bounded by limiter,
+// nil is unbounded. Initial load of policy bindings is bounded by startup.
 func NewIdentityAccessManagementClient(ctx context.Context, googleWorkspaceClient GoogleWorkspaceClientReader,
-	credentials *google.Credentials, refresh time.Duration) (*IdentityAccessManagementClient, error) {
+	credentials *google.Credentials, refresh time.Duration, dropGuard BindingDropGuard, limiter *APILimiter,
+	startup StartupDeadline) (*IdentityAccessManagementClient, error) {
 	service, err := cloudresourcemanager.NewService(ctx, option.WithCredentials(credentials))
 	if err != nil {
 		return nil, err
@@ -64,28 +109,69 @@ func NewIdentityAccessManagementClient(ctx context.Context, googleWorkspaceClien
 		service:   service,
 		pid:       credentials.ProjectID,
 		gwsClient: googleWorkspaceClient,
+		dropGuard: dropGuard,
+		limiter:   limiter,
 	}
-	if err = ps.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+	if err = startup.load(ctx, "policy bindings", ps.RefreshRoleAndBindingsForIdentityAwareProxy); err != nil {
 		return nil, err
 	}
 	go ps.refreshProjectPolicyBindings(ctx, refresh)
 	return ps, nil
 }
 
+// SetUserMembers includes user members of policy, user:{email}, i.e. given email aliases of Google Workspace. Applied
+// from next refresh.
+func (i *IdentityAccessManagementClient) SetUserMembers(enabled bool) {
+	i.userMembers.Store(enabled)
+}
+
+// SetResourcePolicies includes bindings of policies of resources of Identity Aware Proxy, i.e.
+// projects/123/iap_web/compute/services/backend, scoped to resource of binding. Applied from next refresh.
+func (i *IdentityAccessManagementClient) SetResourcePolicies(ctx context.Context, credentials *google.Credentials,
+	resources []string) error {
+	service, err := iap.NewService(ctx, option.WithCredentials(credentials))
+	if err != nil {
+		return err
+	}
+	i.refreshMu.Lock()
+	defer i.refreshMu.Unlock()
+	i.iapService, i.resources = service, resources
+	return nil
+}
+
 // LoadBindingForGoogleServiceAccount look up which bindings (roles and expressions) google service account has.
 func (i *IdentityAccessManagementClient) LoadBindingForGoogleServiceAccount(uid GoogleServiceAccount) (PolicyBindings, error) {
-	collection, ok := i.roleCollectionCopy.Load().(GoogleServiceAccountRoleCollection)
-	val, ok := collection[uid]
+	policy := i.policy.Load()
+	if policy == nil {
+		return nil, ErrPolicyBindingsUnavailable
+	}
+	val, ok := policy.collection[uid]
 	if !ok {
 		return nil, ErrNoIdentityAwareProxyRoleForUser
 	}
 	return val[iapWebPermission], nil
 }
 
-// LoadRoleCollection retrieve entire collection of policy bindings per user.
+// LoadRoleCollection retrieve entire collection of policy bindings per user, nil given policy bindings are not loaded.
+// Collection must not be modified.
 func (i *IdentityAccessManagementClient) LoadRoleCollection() GoogleServiceAccountRoleCollection {
-	val := i.roleCollectionCopy.Load()
-	return val.(GoogleServiceAccountRoleCollection)
+	if policy := i.policy.Load(); policy != nil {
+		return policy.collection
+	}
+	return nil
+}
+
+// Health returns health of refresh of policy bindings.
+func (i *IdentityAccessManagementClient) Health() ComponentHealth {
+	return i.health.health("policy")
+}
+
+// LastSuccessfulRefresh returns time of latest successful refresh of policy bindings.
+func (i *IdentityAccessManagementClient) LastSuccessfulRefresh() time.Time {
+	if policy := i.policy.Load(); policy != nil {
+		return policy.refresh
+	}
+	return time.Unix(0, 0)
 }
 
 func (i *IdentityAccessManagementClient) refreshProjectPolicyBindings(ctx context.Context, interval time.Duration) {
@@ -105,55 +191,166 @@ func (i *IdentityAccessManagementClient) refreshProjectPolicyBindings(ctx contex
 }
 
 // RefreshRoleAndBindingsForIdentityAwareProxy load UserRoleCollection into local memory for usage.
-func (i *IdentityAccessManagementClient) RefreshRoleAndBindingsForIdentityAwareProxy(ctx context.Context) error {
+func (i *IdentityAccessManagementClient) RefreshRoleAndBindingsForIdentityAwareProxy(ctx context.Context) (err error) {
+	i.refreshMu.Lock()
+	defer i.refreshMu.Unlock()
+	defer func() { i.health.observe(err) }()
+
+	start := time.Now()
+	defer func() {
+		policyRefreshDurationHistogram.Observe(time.Since(start).Seconds())
+	}()
+
+	if err := i.limiter.Acquire(ctx); err != nil {
+		return err
+	}
 	policies, err := i.service.Projects.GetIamPolicy(i.pid,
 		&cloudresourcemanager.GetIamPolicyRequest{
 			Options: &cloudresourcemanager.GetPolicyOptions{
 				RequestedPolicyVersion: 3,
 			},
 		}).Context(ctx).Do()
+	i.limiter.Release()
 
 	if err != nil {
 		return err
 	}
-	userRoleCollection := make(GoogleServiceAccountRoleCollection, 100)
-
+	var (
+		userRoleCollection                                 = make(GoogleServiceAccountRoleCollection, 100)
+		numOfBindings, numOfConditionals, numOfIapBindings int
+	)
 	for _, iamPolicy := range policies.Bindings {
-		for _, policyMember := range iamPolicy.Members {
-			if !(strings.HasPrefix(policyMember, "serviceAccount:") || strings.HasPrefix(policyMember, "group:")) {
+		var expression, title string
+		if iamPolicy.Condition != nil {
+			expression, title = iamPolicy.Condition.Expression, iamPolicy.Condition.Title
+		}
+		bindings, conditionals, iapBindings := i.collectBindings(ctx, userRoleCollection, Role(iamPolicy.Role),
+			iamPolicy.Members, iamPolicy.Condition != nil, PolicyBinding{Expression: expression, Title: title})
+		numOfBindings, numOfConditionals, numOfIapBindings = numOfBindings+bindings, numOfConditionals+conditionals,
+			numOfIapBindings+iapBindings
+	}
+	for _, resource := range i.resources {
+		if err := i.limiter.Acquire(ctx); err != nil {
+			return err
+		}
+		policy, err := i.iapService.V1.GetIamPolicy(resource, &iap.GetIamPolicyRequest{
+			Options: &iap.GetPolicyOptions{
+				RequestedPolicyVersion: 3,
+			},
+		}).Context(ctx).Do()
+		i.limiter.Release()
+
+		if err != nil {
+			return fmt.Errorf("policy of resource %s: %w", resource, err)
+		}
+		for _, iamPolicy := range policy.Bindings {
+			var expression, title string
+			if iamPolicy.Condition != nil {
+				expression, title = iamPolicy.Condition.Expression, iamPolicy.Condition.Title
+			}
+			bindings, conditionals, iapBindings := i.collectBindings(ctx, userRoleCollection, Role(iamPolicy.Role),
+				iamPolicy.Members, iamPolicy.Condition != nil,
+				PolicyBinding{Expression: expression, Title: title, Resource: resource})
+			numOfBindings, numOfConditionals, numOfIapBindings = numOfBindings+bindings, numOfConditionals+conditionals,
+				numOfIapBindings+iapBindings
+		}
+	}
+	if err = i.guardBindingDrop(numOfBindings); err != nil {
+		return err
+	} else if numOfIapBindings == 0 {
+		log.Warningf("No policy bindings for role %s found in project %s.", iapWebPermission, i.pid)
+	}
+	i.policy.Store(&policySnapshot{collection: userRoleCollection, refresh: time.Now()})
+	policyBindingsGauge.Set(float64(numOfBindings))
+	conditionalPolicyBindingsGauge.Set(float64(numOfConditionals))
+	return nil
+}
+
+// collectBindings appends binding of role to collection of each member, groups are expanded to members. Number of
+// bindings, conditional bindings and bindings of Identity Aware Proxy appended are returned.
+func (i *IdentityAccessManagementClient) collectBindings(ctx context.Context, collection GoogleServiceAccountRoleCollection,
+	role Role, policyMembers []string, conditional bool, binding PolicyBinding) (numOfBindings, numOfConditionals, numOfIapBindings int) {
+	for _, policyMember := range policyMembers {
+		identifier, isGroup, ok := parsePolicyMember(policyMember)
+		if user, isUser := strings.CutPrefix(policyMember, "user:"); isUser && i.userMembers.Load() {
+			identifier, ok = user, true
+		}
+		if !ok {
+			continue
+		}
+		var (
+			err     error
+			members = make([]GoogleServiceAccount, 0, 100)
+		)
+		// Reference to Group in Google Workspace. Expand group to include members.
+		if isGroup {
+			if members, err = i.gwsClient.ListGoogleServiceAccounts(ctx, identifier); err != nil {
+				log.WithField("error", err).Error("Can't retrieve members from group in Google workspace.")
 				continue
 			}
-			var (
-				expression, title string
-				members           = make([]GoogleServiceAccount, 100)
-				identifier        = strings.Split(policyMember, ":")[1]
-			)
-			// Reference to Group in Google Workspace. Expand group to include members.
-			if strings.HasPrefix(policyMember, "group:") {
-				if members, err = i.gwsClient.ListGoogleServiceAccounts(ctx, identifier); err != nil {
-					log.WithField("error", err).Error("Can't retrieve members from group in Google workspace.")
-					continue
-				}
-			} else {
-				members = append(members, GoogleServiceAccount(identifier))
+		} else {
+			members = append(members, GoogleServiceAccount(identifier))
+		}
+		for _, member := range members {
+			if _, ok := collection[member]; !ok {
+				collection[member] = make(PolicyBindingCollection, 5)
+			}
+			if conditional {
+				numOfConditionals++
 			}
-			for _, member := range members {
-				if _, ok := userRoleCollection[member]; !ok {
-					userRoleCollection[member] = make(PolicyBindingCollection, 5)
-				}
-				if iamPolicy.Condition != nil {
-					expression = iamPolicy.Condition.Expression
-					title = iamPolicy.Condition.Title
-				}
-				userRoleCollection[member][Role(iamPolicy.Role)] = append(
-					userRoleCollection[member][Role(iamPolicy.Role)],
-					PolicyBinding{
-						Expression: expression,
-						Title:      title,
-					})
+			numOfBindings++
+			if role == iapWebPermission {
+				numOfIapBindings++
 			}
+			collection[member][role] = append(collection[member][role], binding)
 		}
 	}
-	i.roleCollectionCopy.Store(userRoleCollection)
+	return numOfBindings, numOfConditionals, numOfIapBindings
+}
+
+// parsePolicyMember returns identifier of member given supported type serviceAccount or group. Deleted service
+// account, deleted:serviceAccount:{email}?uid={uid}, is identified by uid such that binding is never granted to a
+// recreated account of same email. Other deleted members are ignored. Federated principals, principal://{subject} and
+// principalSet://{pool}/*, are identified by member.
+func parsePolicyMember(policyMember string) (identifier string, isGroup, ok bool) {
+	if deleted, ok := strings.CutPrefix(policyMember, "deleted:serviceAccount:"); ok {
+		_, query, _ := strings.Cut(deleted, "?")
+		values, err := url.ParseQuery(query)
+		if uid := values.Get("uid"); err == nil && len(uid) > 0 {
+			return uid, false, true
+		}
+		log.Warningf("Deleted policy member %s has no uid. Ignored.", policyMember)
+		return "", false, false
+	} else if identifier, ok = strings.CutPrefix(policyMember, "serviceAccount:"); ok {
+		return identifier, false, true
+	} else if identifier, ok = strings.CutPrefix(policyMember, "group:"); ok {
+		return identifier, true, true
+	} else if strings.HasPrefix(policyMember, federatedPrincipalPrefix) {
+		return policyMember, false, true
+	} else if strings.HasPrefix(policyMember, federatedPrincipalSetPrefix) {
+		// Sets of group or attribute requires claims of token, only every identity of pool is supported.
+		if strings.HasSuffix(policyMember, "/*") {
+			return policyMember, false, true
+		}
+		log.Warningf("Policy member %s is not supported. Ignored.", policyMember)
+	}
+	return "", false, false
+}
+
+// guardBindingDrop verifies if refreshed number of bindings can be applied given BindingDropGuard.
+func (i *IdentityAccessManagementClient) guardBindingDrop(numOfBindings int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	previous := i.numOfBindings
+	if i.dropGuard.Threshold > 0 && float64(numOfBindings) < float64(previous)*(1-i.dropGuard.Threshold) &&
+		i.suspiciousDrops < i.dropGuard.Grace {
+		i.suspiciousDrops++
+		log.Warningf("Refresh returned %d policy bindings, previously %d. Retaining previous policy bindings (%d/%d).",
+			numOfBindings, previous, i.suspiciousDrops, i.dropGuard.Grace)
+		return fmt.Errorf("%w: %d policy bindings, previously %d", ErrSuspiciousPolicyBindingsDrop, numOfBindings, previous)
+	}
+	i.suspiciousDrops = 0
+	i.numOfBindings = numOfBindings
 	return nil
 }
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// histogramSampleCount returns number of observations made by histogram.
+func histogramSampleCount(t *testing.T, histogram prometheus.Histogram) uint64 {
+	t.Helper()
+	metric := &dto.Metric{}
+	if err := histogram.Write(metric); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestPolicyBindingMetricsAfterRefresh(t *testing.T) {
+	iamClient, fake := newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{
+		"group@example.com": {"a@p.iam.gserviceaccount.com", "b@p.iam.gserviceaccount.com"},
+	})
+	fake.setBindings(http.StatusOK,
+		&cloudresourcemanager.Binding{
+			Role:    iapWebPermission,
+			Members: []string{"serviceAccount:c@p.iam.gserviceaccount.com", "group:group@example.com", "user:u@example.com"},
+		},
+		&cloudresourcemanager.Binding{
+			Role:    iapWebPermission,
+			Members: []string{"serviceAccount:d@p.iam.gserviceaccount.com"},
+			Condition: &cloudresourcemanager.Expr{
+				Expression: "request.path.startsWith(\"/admin\")",
+				Title:      "admin",
+			},
+		})
+	sampleCount := histogramSampleCount(t, policyRefreshDurationHistogram)
+
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if val := testutil.ToFloat64(policyBindingsGauge); val != 4 {
+		t.Fatalf("Expected 4 policy bindings, got %f.", val)
+	} else if val = testutil.ToFloat64(conditionalPolicyBindingsGauge); val != 1 {
+		t.Fatalf("Expected 1 conditional policy binding, got %f.", val)
+	} else if count := histogramSampleCount(t, policyRefreshDurationHistogram); count != sampleCount+1 {
+		t.Fatalf("Expected refresh duration to be observed once, got %d observations.", count-sampleCount)
+	}
+}
+
+// serviceAccountBindings returns a binding with role for IAP given n service accounts.
+func serviceAccountBindings(n int) *cloudresourcemanager.Binding {
+	members := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		members = append(members, fmt.Sprintf("serviceAccount:sa-%d@p.iam.gserviceaccount.com", i))
+	}
+	return &cloudresourcemanager.Binding{Role: iapWebPermission, Members: members}
+}
+
+func TestSuspiciousPolicyBindingsDrop(t *testing.T) {
+	ctx := context.Background()
+	iamClient, fake := newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+	iamClient.dropGuard = BindingDropGuard{Threshold: 0.5, Grace: 1}
+	removed := GoogleServiceAccount("sa-9@p.iam.gserviceaccount.com")
+
+	fake.setBindings(http.StatusOK, serviceAccountBindings(10))
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	// A partial result is retained given grace.
+	fake.setBindings(http.StatusOK, serviceAccountBindings(2))
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); !errors.Is(err, ErrSuspiciousPolicyBindingsDrop) {
+		t.Fatalf("Expected error %s, error returned: %v.", ErrSuspiciousPolicyBindingsDrop, err)
+	} else if _, err = iamClient.LoadBindingForGoogleServiceAccount(removed); err != nil {
+		t.Fatalf("Expected previous policy bindings to be retained, error returned: %s.", err)
+	}
+	// A minor drop is applied.
+	fake.setBindings(http.StatusOK, serviceAccountBindings(9))
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if _, err = iamClient.LoadBindingForGoogleServiceAccount(removed); err == nil {
+		t.Fatal("Expected refreshed policy bindings to be applied.")
+	}
+	// A persistent drop beyond grace is applied.
+	fake.setBindings(http.StatusOK, serviceAccountBindings(2))
+	_ = iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx)
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+		t.Fatalf("Expected persistent drop to be applied, error returned: %s.", err)
+	} else if _, err = iamClient.LoadBindingForGoogleServiceAccount("sa-5@p.iam.gserviceaccount.com"); err == nil {
+		t.Fatal("Expected refreshed policy bindings to be applied.")
+	}
+}
+
+func TestDeletedPolicyMembers(t *testing.T) {
+	iamClient, fake := newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+	fake.setBindings(http.StatusOK, &cloudresourcemanager.Binding{
+		Role: iapWebPermission,
+		Members: []string{
+			"deleted:serviceAccount:old@p.iam.gserviceaccount.com?uid=123456789",
+			"deleted:serviceAccount:nouid@p.iam.gserviceaccount.com",
+			"deleted:group:group@example.com?uid=987654321",
+			"deleted:user:u@example.com?uid=111111111",
+			"serviceAccount:new@p.iam.gserviceaccount.com",
+		},
+	})
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var tests = []struct {
+		name          string
+		uid           GoogleServiceAccount
+		expectedError error
+	}{
+		{"TestDeletedServiceAccountMatchedByUid", "123456789", nil},
+		{"TestDeletedServiceAccountNotMatchedByEmail", "old@p.iam.gserviceaccount.com", ErrNoIdentityAwareProxyRoleForUser},
+		{"TestDeletedServiceAccountWithoutUidIgnored", "nouid@p.iam.gserviceaccount.com", ErrNoIdentityAwareProxyRoleForUser},
+		{"TestDeletedGroupIgnored", "987654321", ErrNoIdentityAwareProxyRoleForUser},
+		{"TestServiceAccountMatchedByEmail", "new@p.iam.gserviceaccount.com", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := iamClient.LoadBindingForGoogleServiceAccount(tt.uid); !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestConcurrentReadsDuringRefresh(t *testing.T) {
+	// Each generation of policy binds every member, readers must never observe members of different generations.
+	const members = 50
+	generation := func(n int) *cloudresourcemanager.Binding {
+		binding := &cloudresourcemanager.Binding{Role: iapWebPermission}
+		for i := 0; i < members; i++ {
+			binding.Members = append(binding.Members, fmt.Sprintf("serviceAccount:sa-%d-%d@p.iam.gserviceaccount.com", n, i))
+		}
+		return binding
+	}
+	client, fake := newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+	fake.setBindings(http.StatusOK, generation(0))
+	if err := client.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		wg          sync.WaitGroup
+	)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				collection := client.LoadRoleCollection()
+				if len(collection) != members {
+					t.Errorf("Expected %d members of a single refresh, %d members were given.", members, len(collection))
+					return
+				}
+				var n int
+				for member := range collection {
+					_, _ = fmt.Sscanf(string(member), "sa-%d-", &n)
+					break
+				}
+				for i := 0; i < members; i++ {
+					if _, ok := collection[GoogleServiceAccount(fmt.Sprintf("sa-%d-%d@p.iam.gserviceaccount.com", n, i))]; !ok {
+						t.Errorf("Expected member %d of refresh %d in collection.", i, n)
+						return
+					}
+				}
+				_, _ = client.LoadBindingForGoogleServiceAccount("sa-0-0@p.iam.gserviceaccount.com")
+				_ = client.LastSuccessfulRefresh()
+			}
+		}()
+	}
+	// Concurrent refreshes, as given by interval and policy change notifications.
+	var refreshes sync.WaitGroup
+	for n := 1; n <= 20; n++ {
+		fake.setBindings(http.StatusOK, generation(n))
+		refreshes.Add(1)
+		go func() {
+			defer refreshes.Done()
+			if err := client.RefreshRoleAndBindingsForIdentityAwareProxy(context.Background()); err != nil {
+				t.Errorf("Unexpected error returned, error: %s.", err)
+			}
+		}()
+	}
+	refreshes.Wait()
+	cancel()
+	wg.Wait()
+
+	if _, err := client.LoadBindingForGoogleServiceAccount("sa-20-0@p.iam.gserviceaccount.com"); err != nil {
+		t.Fatalf("Expected bindings of latest refresh, error %v was returned.", err)
+	}
+}
+
+func TestUserMembers(t *testing.T) {
+	iamClient, fake := newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+	fake.setBindings(http.StatusOK, &cloudresourcemanager.Binding{
+		Role:    iapWebPermission,
+		Members: []string{"user:u@example.com"},
+	})
+	ctx := context.Background()
+
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if _, err = iamClient.LoadBindingForGoogleServiceAccount("u@example.com"); !errors.Is(err, ErrNoIdentityAwareProxyRoleForUser) {
+		t.Fatalf("Expected user member to be ignored, error returned: %v.", err)
+	}
+	iamClient.SetUserMembers(true)
+	if err := iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if _, err = iamClient.LoadBindingForGoogleServiceAccount("u@example.com"); err != nil {
+		t.Fatalf("Expected user member to be included, error returned: %s.", err)
+	}
+}
@@ -25,12 +25,12 @@ func TestLoadUsersWithRoleForIdentityAwareProxy(t *testing.T) {
 
 	credentials, _ := googleCredentials()
 
-	googleWorkspaceClient, err := internal.NewGoogleWorkspaceClient(ctx, credentials)
+	googleWorkspaceClient, err := internal.NewGoogleWorkspaceClient(ctx, credentials, nil)
 	if err != nil {
 		t.Fatalf("Could not load google workspace reader. Error returned: %s", err)
 	}
 	policyClientService, _ := internal.NewIdentityAccessManagementClient(ctx,
-		googleWorkspaceClient, credentials, 5*time.Minute)
+		googleWorkspaceClient, credentials, 5*time.Minute, internal.BindingDropGuard{}, nil, internal.StartupDeadline{})
 
 	if err := policyClientService.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
 		t.Fatalf("Expected no error, returned with error %s.", err.Error())
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrIdentityNotAllowed is given when verified identity matches no pattern of SetIdentityPatterns.
+var ErrIdentityNotAllowed = errors.New("identity not allowed")
+
+// SetIdentityPatterns allows only verified identities matching any pattern of path.Match, case-insensitive, i.e.
+// *@prod-project.iam.gserviceaccount.com. Enforced after verification and email domain filter, before lookup of
+// policy bindings. No patterns allows any identity. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetIdentityPatterns(patterns []string) error {
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: identity pattern %s", err, pattern)
+		}
+		patterns[i] = strings.ToLower(pattern)
+	}
+	g.identityPatterns = patterns
+	return nil
+}
+
+// isIdentityAllowed returns true given identity matches any pattern or no patterns are given.
+func (g *GoogleCloudTokenAuthenticator) isIdentityAllowed(email GoogleServiceAccount) bool {
+	if len(g.identityPatterns) == 0 {
+		return true
+	}
+	identity := strings.ToLower(string(email))
+	for _, pattern := range g.identityPatterns {
+		if ok, _ := path.Match(pattern, identity); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"testing"
+)
+
+func TestIdentityPatterns(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"prod":    "sa@prod-proj.iam.gserviceaccount.com",
+			"upper":   "SA@Prod-Proj.iam.gserviceaccount.com",
+			"dev":     "sa@dev-proj.iam.gserviceaccount.com",
+			"suffix":  "sa@prod-proj.iam.gserviceaccount.com.example.com",
+			"user":    "user@example.com",
+			"unbound": "unbound@prod-proj.iam.gserviceaccount.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{
+			"sa@prod-proj.iam.gserviceaccount.com":             {{}},
+			"SA@Prod-Proj.iam.gserviceaccount.com":             {{}},
+			"sa@dev-proj.iam.gserviceaccount.com":              {{}},
+			"sa@prod-proj.iam.gserviceaccount.com.example.com": {{}},
+			"user@example.com":                                 {{}},
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	if err := authenticator.SetIdentityPatterns([]string{"*@prod-proj.iam.gserviceaccount.com", "user@example.com"}); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+
+	var tests = []struct {
+		name       string
+		token      string
+		statusCode int
+	}{
+		{"TestMatchingServiceAccount", "prod", http.StatusOK},
+		{"TestMatchingServiceAccountIsCaseInsensitive", "upper", http.StatusOK},
+		{"TestMatchingUser", "user", http.StatusOK},
+		{"TestServiceAccountOfOtherProject", "dev", http.StatusForbidden},
+		{"TestServiceAccountOfSuffixedDomain", "suffix", http.StatusForbidden},
+		{"TestMatchingServiceAccountWithoutBindings", "unbound", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestInvalidIdentityPattern(t *testing.T) {
+	authenticator := newFakeAuthenticator(t, &fakeTokenVerifier{}, fakeIdentityAccessManagementReader{}, EmailDomainFilter{})
+	if err := authenticator.SetIdentityPatterns([]string{"[*@prod-proj.iam.gserviceaccount.com"}); !errors.Is(err, path.ErrBadPattern) {
+		t.Fatalf("Expected error %v, error %v was returned.", path.ErrBadPattern, err)
+	}
+}
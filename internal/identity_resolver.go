@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// IdentityResolver maps verified identity to identity of policy bindings, i.e. an internal username, before binding
+// lookup. Invoked per request, after email domain filter. Must be safe for concurrent use.
+type IdentityResolver interface {
+	ResolveIdentity(ctx context.Context, principal GoogleServiceAccount) (GoogleServiceAccount, error)
+}
+
+// IdentityResolverFunc is an adapter to use a function as IdentityResolver.
+type IdentityResolverFunc func(ctx context.Context, principal GoogleServiceAccount) (GoogleServiceAccount, error)
+
+// ResolveIdentity invokes f.
+func (f IdentityResolverFunc) ResolveIdentity(ctx context.Context, principal GoogleServiceAccount) (GoogleServiceAccount, error) {
+	return f(ctx, principal)
+}
+
+// TableIdentityResolver is an implementation of IdentityResolver mapping identities given a static table. Identities
+// not in table are retained, domain part is removed given StripDomain.
+type TableIdentityResolver struct {
+	Table       map[GoogleServiceAccount]GoogleServiceAccount
+	StripDomain bool
+}
+
+// ErrIdentityNotResolved is given when IdentityResolver fails to resolve verified identity.
+var ErrIdentityNotResolved = errors.New("identity not resolved")
+
+// ResolveIdentity returns mapped identity of principal.
+func (t TableIdentityResolver) ResolveIdentity(_ context.Context, principal GoogleServiceAccount) (GoogleServiceAccount, error) {
+	if identity, ok := t.Table[principal]; ok {
+		return identity, nil
+	} else if t.StripDomain {
+		name, _, _ := strings.Cut(string(principal), "@")
+		return GoogleServiceAccount(name), nil
+	}
+	return principal, nil
+}
+
+// resolveIdentity returns identity of principal given IdentityResolver, else principal.
+func (g *GoogleCloudTokenAuthenticator) resolveIdentity(ctx context.Context, principal GoogleServiceAccount) (GoogleServiceAccount, error) {
+	if g.identityResolver == nil {
+		return principal, nil
+	}
+	identity, err := g.identityResolver.ResolveIdentity(ctx, principal)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %s", ErrIdentityNotResolved, principal, err)
+	} else if len(identity) == 0 {
+		return "", fmt.Errorf("%w: %s resolved to empty identity", ErrIdentityNotResolved, principal)
+	}
+	return identity, nil
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTableIdentityResolver(t *testing.T) {
+	var tests = []struct {
+		name     string
+		resolver TableIdentityResolver
+		identity GoogleServiceAccount
+	}{
+		{"TestMappedIdentity", TableIdentityResolver{
+			Table: map[GoogleServiceAccount]GoogleServiceAccount{"sa@p.iam.gserviceaccount.com": "svc-billing"},
+		}, "svc-billing"},
+		{"TestMappedIdentityTakesPrecedence", TableIdentityResolver{
+			Table:       map[GoogleServiceAccount]GoogleServiceAccount{"sa@p.iam.gserviceaccount.com": "svc-billing"},
+			StripDomain: true,
+		}, "svc-billing"},
+		{"TestStripDomain", TableIdentityResolver{StripDomain: true}, "sa"},
+		{"TestUnmappedIdentityIsRetained", TableIdentityResolver{}, "sa@p.iam.gserviceaccount.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := tt.resolver.ResolveIdentity(context.Background(), "sa@p.iam.gserviceaccount.com")
+			if err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			} else if identity != tt.identity {
+				t.Fatalf("Expected identity %s, identity %s was returned.", tt.identity, identity)
+			}
+		})
+	}
+}
+
+func TestIdentityResolver(t *testing.T) {
+	var (
+		sink, fake = newFakeCloudLoggingAuditSink(t, 10, time.Hour)
+		verifier   = &fakeTokenVerifier{emails: map[string]string{
+			"mapped":     "alice@example.com",
+			"unmapped":   "bob@example.com",
+			"unresolved": "mallory@example.com",
+		}}
+		// Binding is granted on internal identity, not on verified email.
+		bindings      = fakeIdentityAccessManagementReader{"u-1001": {{}}, "alice@example.com": {}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	authenticator.SetAuditSink(sink)
+	authenticator.SetIdentityResolver(IdentityResolverFunc(
+		func(_ context.Context, principal GoogleServiceAccount) (GoogleServiceAccount, error) {
+			switch principal {
+			case "alice@example.com":
+				return "u-1001", nil
+			case "bob@example.com":
+				return "u-1002", nil
+			}
+			return "", errors.New("not found in directory")
+		}))
+	var tests = []struct {
+		name       string
+		token      string
+		statusCode int
+		email      string
+	}{
+		{"TestBindingOfMappedIdentity", "mapped", http.StatusOK, "accounts.google.com:u-1001"},
+		{"TestNoBindingOfMappedIdentity", "unmapped", http.StatusForbidden, ""},
+		{"TestUnresolvedIdentity", "unresolved", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello")
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if email := rsp.Header().Get(headerAuthenticatedUserEmail); email != tt.email {
+				t.Fatalf("Expected identity header %q, identity header %q was returned.", tt.email, email)
+			}
+		})
+	}
+	// Resolution is applied given cached token.
+	requestUrl, _ := url.Parse("https://myurl.com/hello")
+	if email, err := authenticator.Authenticate(context.Background(), "mapped", *requestUrl); err != nil || email != "u-1001" {
+		t.Fatalf("Expected identity u-1001 of cached token, identity %s and error %v were returned.", email, err)
+	} else if err = sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	var principals []string
+	for _, write := range fake.writes() {
+		for _, entry := range write.Entries {
+			var payload struct {
+				AuthenticationInfo struct {
+					PrincipalEmail string `json:"principalEmail"`
+				} `json:"authenticationInfo"`
+			}
+			if err := json.Unmarshal(entry.JsonPayload, &payload); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			principals = append(principals, payload.AuthenticationInfo.PrincipalEmail)
+		}
+	}
+	if len(principals) != 3 || principals[0] != "u-1001" || principals[1] != "u-1002" || principals[2] != "u-1001" {
+		t.Fatalf("Expected audit records of resolved identities, principals %v were given.", principals)
+	}
+}
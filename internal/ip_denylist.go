@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// IPDenylist is addresses or CIDR prefixes of sources denied with 403 before any processing of /auth, i.e.
+// 203.0.113.7 or 203.0.113.0/24. Source is remote address of request, or given remote address of any of
+// TrustedProxies, rightmost address of X-Forwarded-For not of TrustedProxies.
+type IPDenylist struct {
+	Denied         []string
+	TrustedProxies []string
+}
+
+// ErrInvalidIPDenylist is given when an address or prefix of IPDenylist can't be parsed.
+var ErrInvalidIPDenylist = errors.New("invalid ip denylist")
+
+// ipDenylist is parsed IPDenylist.
+type ipDenylist struct {
+	denied, trustedProxies []netip.Prefix
+}
+
+// SetIPDenylist denies requests of /auth of sources of denylist with 403, before any processing of request. Must be
+// invoked before listener is started.
+func (a *AuthServiceListener) SetIPDenylist(denylist IPDenylist) error {
+	denied, err := parsePrefixes(denylist.Denied)
+	if err != nil {
+		return err
+	}
+	trustedProxies, err := parsePrefixes(denylist.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	a.ipDenylist = ipDenylist{denied: denied, trustedProxies: trustedProxies}
+	return nil
+}
+
+// parsePrefixes parses addresses or CIDR prefixes, an address is a prefix of its own.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, val := range values {
+		if prefix, err := netip.ParsePrefix(val); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(val); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			return nil, fmt.Errorf("%w: %s is neither address nor prefix", ErrInvalidIPDenylist, val)
+		}
+	}
+	return prefixes, nil
+}
+
+// isDenied verifies if source of r is denied.
+func (d ipDenylist) isDenied(r *http.Request) (netip.Addr, bool) {
+	if len(d.denied) == 0 {
+		return netip.Addr{}, false
+	}
+	source, ok := d.source(r)
+	return source, ok && containsAddr(d.denied, source)
+}
+
+// source returns source address of r, false given remote address can't be parsed.
+func (d ipDenylist) source(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	source, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	source = source.Unmap()
+	// Forwarded addresses are appended by each proxy, rightmost address not of trusted proxy is source. Given an
+	// invalid forwarded address, source is the trusted proxy forwarding it.
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && containsAddr(d.trustedProxies, source); i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		source = addr.Unmap()
+	}
+	return source, true
+}
+
+// containsAddr verifies if addr is of any of prefixes.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
+
+// denySource responds 403 given source of r is denied.
+func (a *AuthServiceListener) denySource(w http.ResponseWriter, r *http.Request) bool {
+	source, denied := a.ipDenylist.isDenied(r)
+	if denied {
+		deniedSourcesCounter.Inc()
+		log.Debugf("Source %s of request is denied.", source)
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return denied
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPDenylist(t *testing.T) {
+	var (
+		email         = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier      = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings      = fakeIdentityAccessManagementReader{email: {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	if err := listener.SetIPDenylist(IPDenylist{
+		Denied:         []string{"203.0.113.0/24", "2001:db8::1"},
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+
+	var tests = []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		statusCode   int
+	}{
+		{"TestAllowedSource", "198.51.100.7:1234", nil, http.StatusOK},
+		{"TestDeniedSourceOfPrefix", "203.0.113.7:1234", nil, http.StatusForbidden},
+		{"TestDeniedSourceOfAddress", "[2001:db8::1]:1234", nil, http.StatusForbidden},
+		{"TestDeniedSourceOfMappedAddress", "[::ffff:203.0.113.7]:1234", nil, http.StatusForbidden},
+		{"TestDeniedSourceForwardedByTrustedProxy", "10.0.0.1:1234", []string{"203.0.113.7, 10.0.0.2"}, http.StatusForbidden},
+		{"TestAllowedSourceForwardedByTrustedProxy", "10.0.0.1:1234", []string{"203.0.113.7, 198.51.100.7"}, http.StatusOK},
+		{"TestForwardedForOfUntrustedSourceIsIgnored", "198.51.100.7:1234", []string{"203.0.113.7"}, http.StatusOK},
+		{"TestDeniedSourceOfRepeatedForwardedFor", "10.0.0.1:1234", []string{"198.51.100.7", "203.0.113.7"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifications := verifier.calls.Load()
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("Proxy-Authorization", "Bearer token")
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			for _, forwardedFor := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+			rsp := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rsp, req)
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if calls := verifier.calls.Load() - verifications; tt.statusCode == http.StatusForbidden && calls != 0 {
+				t.Fatalf("Expected no verification of denied source, %d verifications were made.", calls)
+			}
+		})
+	}
+}
+
+func TestInvalidIPDenylist(t *testing.T) {
+	listener := newFakeAuthServiceListener(t, nil)
+	for _, denylist := range []IPDenylist{{Denied: []string{"203.0.113.0/33"}}, {TrustedProxies: []string{"proxy"}}} {
+		if err := listener.SetIPDenylist(denylist); !errors.Is(err, ErrInvalidIPDenylist) {
+			t.Fatalf("Expected error %v, error returned: %v.", ErrInvalidIPDenylist, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Names of metrics recorded by AuthServiceListener given Metrics.
+const (
+	// MetricAuthDuration is histogram of duration of each request of /auth in seconds.
+	MetricAuthDuration = "auth_duration_seconds"
+	// MetricOversizedTokens is counter of tokens rejected given length exceeding maximum token length.
+	MetricOversizedTokens = "oversized_tokens_total"
+	// MetricRequestBudgetExceeded is counter of requests of which authentication exceeded request budget.
+	MetricRequestBudgetExceeded = "request_budget_exceeded_total"
+)
+
+// Metrics records metrics of /auth, i.e. given a metrics system other than Prometheus. Must be safe for concurrent use.
+type Metrics interface {
+	// IncCounter increments counter of name.
+	IncCounter(ctx context.Context, name string)
+	// ObserveHistogram observes val of histogram of name, ctx holds span context of request given exemplars.
+	ObserveHistogram(ctx context.Context, name string, val float64)
+}
+
+// PrometheusMetrics records metrics as collectors of default Prometheus registerer, served on /metrics. Default of
+// AuthServiceListener.
+type PrometheusMetrics struct{}
+
+func (PrometheusMetrics) IncCounter(_ context.Context, name string) {
+	switch name {
+	case MetricOversizedTokens:
+		oversizedTokensCounter.Inc()
+	case MetricRequestBudgetExceeded:
+		requestBudgetExceededCounter.Inc()
+	}
+}
+
+func (PrometheusMetrics) ObserveHistogram(ctx context.Context, name string, val float64) {
+	if name == MetricAuthDuration {
+		observeWithExemplar(authDurationHistogram, val, trace.SpanContextFromContext(ctx))
+	}
+}
+
+// NoopMetrics records no metrics.
+type NoopMetrics struct{}
+
+func (NoopMetrics) IncCounter(_ context.Context, _ string) {}
+
+func (NoopMetrics) ObserveHistogram(_ context.Context, _ string, _ float64) {}
+
+// SetMetrics sets recorder of metrics of /auth, PrometheusMetrics by default. Nil is NoopMetrics. Must be invoked
+// before listener is started.
+func (a *AuthServiceListener) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	a.metrics = metrics
+}
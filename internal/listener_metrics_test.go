@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMetrics records names of incremented counters and observed histograms in order.
+type fakeMetrics struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeMetrics) IncCounter(_ context.Context, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "counter:"+name)
+}
+
+func (f *fakeMetrics) ObserveHistogram(_ context.Context, name string, _ float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "histogram:"+name)
+}
+
+func (f *fakeMetrics) reset() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func TestMetrics(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email), "slow": string(email)}}
+		bindings = fakeIdentityAccessManagementReader{email: {{}}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{}))
+		metrics  = &fakeMetrics{}
+	)
+	listener.SetMetrics(metrics)
+
+	var tests = []struct {
+		name       string
+		token      string
+		budget     time.Duration
+		delay      time.Duration
+		statusCode int
+		calls      []string
+	}{
+		{"TestAllowedRequest", "token", 0, 0, http.StatusOK, []string{"histogram:" + MetricAuthDuration}},
+		{"TestOversizedToken", strings.Repeat("a", defaultMaxTokenLength), 0, 0, http.StatusUnauthorized,
+			[]string{"counter:" + MetricOversizedTokens, "histogram:" + MetricAuthDuration}},
+		{"TestRequestBudgetExceeded", "slow", 10 * time.Millisecond, 100 * time.Millisecond, http.StatusServiceUnavailable,
+			[]string{"counter:" + MetricRequestBudgetExceeded, "histogram:" + MetricAuthDuration}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier.delay = tt.delay
+			listener.SetRequestBudget(tt.budget)
+			if rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello"); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if calls := metrics.reset(); !slices.Equal(calls, tt.calls) {
+				t.Fatalf("Expected metric calls %v, calls %v were made.", tt.calls, calls)
+			}
+		})
+	}
+}
+
+func TestNoopMetrics(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{}}
+		listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, verifier, fakeIdentityAccessManagementReader{}, EmailDomainFilter{}))
+	)
+	listener.SetMetrics(nil)
+	if _, ok := listener.metrics.(NoopMetrics); !ok {
+		t.Fatalf("Expected NoopMetrics given nil, %T was given.", listener.metrics)
+	} else if rsp := doAuthRequest(listener, "token", "https://myurl.com/hello"); rsp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d, status code %d was returned.", http.StatusUnauthorized, rsp.Code)
+	}
+}
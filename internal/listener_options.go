@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// ListenerConfig is configuration of AuthServiceListener, equivalent to parameters of NewAuthServiceListener and
+// SetStrictRequestURL, SetDrainPeriod and SetMaxTokenLength.
+type ListenerConfig struct {
+	Host string
+	// URLHeaders hold request url, read in order until a header holds an absolute url.
+	URLHeaders []string
+	// StrictRequestURL rejects requests of which url headers, X-Forwarded-Host or X-Forwarded-Proto disagree on
+	// scheme or host, or of which token headers disagree on token.
+	StrictRequestURL bool
+	Port             uint16
+	DrainPeriod      time.Duration
+	// MaxTokenLength is maximum length of token, zero is defaultMaxTokenLength.
+	MaxTokenLength int
+}
+
+// ListenerOption configures an optional feature of AuthServiceListener, equivalent to its setter.
+type ListenerOption func(a *AuthServiceListener)
+
+// NewAuthServiceListenerWithConfig creates a new HTTP-server for /auth-endpoint given config, options are applied in
+// order. Open(ctx context.Context) must be invoked to listen.
+func NewAuthServiceListenerWithConfig(ctx context.Context, config ListenerConfig, auth Authenticator,
+	options ...ListenerOption) (*AuthServiceListener, error) {
+	a, err := newAuthServiceListener(ctx, config.Host, config.URLHeaders, config.Port, auth)
+	if err != nil {
+		return nil, err
+	}
+	a.SetStrictRequestURL(config.StrictRequestURL)
+	a.SetDrainPeriod(config.DrainPeriod)
+	a.SetMaxTokenLength(config.MaxTokenLength)
+	for _, option := range options {
+		option(a)
+	}
+	return a, nil
+}
+
+// WithTLS serves ListenAndServe with TLS given PEM encoded key and certificate.
+func WithTLS(key, cert []byte) ListenerOption {
+	return func(a *AuthServiceListener) {
+		a.tlsKey, a.tlsCert = key, cert
+	}
+}
+
+// WithCORS is SetCORS.
+func WithCORS(cors CORS) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetCORS(cors) }
+}
+
+// WithAssertionSigner is SetAssertionSigner.
+func WithAssertionSigner(signer *AssertionSigner) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetAssertionSigner(signer) }
+}
+
+// WithBypassPaths is SetBypassPaths.
+func WithBypassPaths(paths []string) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetBypassPaths(paths) }
+}
+
+// WithExemplars is SetExemplars.
+func WithExemplars(enabled bool) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetExemplars(enabled) }
+}
+
+// WithClaimsBundle is SetClaimsBundle.
+func WithClaimsBundle(bundle ClaimsBundle) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetClaimsBundle(bundle) }
+}
+
+// WithClientCertificateHeader is SetClientCertificateHeader.
+func WithClientCertificateHeader(header string) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetClientCertificateHeader(header) }
+}
+
+// WithAuthMethods is SetAuthMethods.
+func WithAuthMethods(methods []string) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetAuthMethods(methods) }
+}
+
+// WithMaxBodyBytes is SetMaxBodyBytes.
+func WithMaxBodyBytes(maxBodyBytes int64) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetMaxBodyBytes(maxBodyBytes) }
+}
+
+// WithKeepAlive is SetKeepAlive.
+func WithKeepAlive(keepAlive KeepAlive) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetKeepAlive(keepAlive) }
+}
+
+// WithMetrics is SetMetrics.
+func WithMetrics(metrics Metrics) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetMetrics(metrics) }
+}
+
+// WithServerTiming is SetServerTiming.
+func WithServerTiming(enabled bool) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetServerTiming(enabled) }
+}
+
+// WithDecisionReason is SetDecisionReason.
+func WithDecisionReason(enabled bool) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetDecisionReason(enabled) }
+}
+
+// WithEarlyHints is SetEarlyHints.
+func WithEarlyHints(enabled bool) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetEarlyHints(enabled) }
+}
+
+// WithDeviceHeader is SetDeviceHeader.
+func WithDeviceHeader(header string) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetDeviceHeader(header) }
+}
+
+// WithTrustForwardedProto is SetTrustForwardedProto.
+func WithTrustForwardedProto(trust bool) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetTrustForwardedProto(trust) }
+}
+
+// WithRetryAfter is SetRetryAfter.
+func WithRetryAfter(retryAfter time.Duration) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetRetryAfter(retryAfter) }
+}
+
+// WithRequestBudget is SetRequestBudget.
+func WithRequestBudget(budget time.Duration) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetRequestBudget(budget) }
+}
+
+// WithHealthReporters is SetHealthReporters.
+func WithHealthReporters(components ...HealthReporter) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetHealthReporters(components...) }
+}
+
+// WithRequestID is SetRequestID.
+func WithRequestID(header string, trusted bool) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetRequestID(header, trusted) }
+}
+
+// WithAdminToken is SetAdminToken.
+func WithAdminToken(token string) ListenerOption {
+	return func(a *AuthServiceListener) { a.SetAdminToken(token) }
+}
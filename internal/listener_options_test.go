@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewAuthServiceListenerWithConfig(t *testing.T) {
+	var (
+		verifier      = &fakeTokenVerifier{}
+		authenticator = newFakeAuthenticator(t, verifier, fakeIdentityAccessManagementReader{}, EmailDomainFilter{})
+		config        = ListenerConfig{
+			Host:             "127.0.0.1",
+			URLHeaders:       []string{"X-Original-URL"},
+			StrictRequestURL: true,
+			DrainPeriod:      time.Second,
+			MaxTokenLength:   1024,
+		}
+	)
+	listener, err := NewAuthServiceListenerWithConfig(context.Background(), config, authenticator,
+		WithTLS([]byte("key"), []byte("cert")),
+		WithRetryAfter(5*time.Second),
+		WithRequestBudget(time.Second),
+		WithBypassPaths([]string{"/healthz"}),
+		WithAdminToken("admin"),
+		WithRequestID("X-Request-Id", true),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	switch {
+	case !slices.Equal(listener.xForwardedUrlHeaders, config.URLHeaders) || !listener.strictRequestURL:
+		t.Fatalf("Expected url headers %v of strict request url.", config.URLHeaders)
+	case listener.maxTokenLength != config.MaxTokenLength:
+		t.Fatalf("Expected max token length %d, max token length %d was given.", config.MaxTokenLength,
+			listener.maxTokenLength)
+	case string(listener.tlsKey) != "key" || string(listener.tlsCert) != "cert":
+		t.Fatal("Expected TLS key and certificate to be set.")
+	case listener.retryAfter != 5*time.Second || listener.requestBudget != time.Second:
+		t.Fatal("Expected retry after and request budget to be set.")
+	case !slices.Equal(listener.bypassPaths, []string{"/healthz"}) || listener.adminToken != "admin":
+		t.Fatal("Expected bypass paths and admin token to be set.")
+	case listener.requestIDHeader != "X-Request-Id" || !listener.trustRequestID:
+		t.Fatal("Expected request id header to be trusted.")
+	}
+}
+
+func TestNewAuthServiceListenerWithConfigDefaults(t *testing.T) {
+	listener, err := NewAuthServiceListenerWithConfig(context.Background(), ListenerConfig{Host: "127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if listener.maxTokenLength != defaultMaxTokenLength {
+		t.Fatalf("Expected default max token length %d, max token length %d was given.", defaultMaxTokenLength,
+			listener.maxTokenLength)
+	} else if len(listener.tlsCert) > 0 || listener.maxBodyBytes != -1 {
+		t.Fatal("Expected listener without TLS of unbounded body.")
+	}
+}
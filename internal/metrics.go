@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "open_iap"
+
+const (
+	labelUnknown    = "unknown"
+	labelSelfSigned = "self-signed"
+	labelOther      = "other"
+)
+
+var (
+	// policyBindingsGauge is number of policy bindings loaded into memory during latest refresh.
+	policyBindingsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_bindings",
+		Help:      "Number of policy bindings loaded from latest refresh.",
+	})
+	// googleAPICallsQueuedGauge is number of outbound Google API calls queued by APILimiter.
+	googleAPICallsQueuedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "google_api_calls_queued",
+		Help:      "Number of outbound Google API calls waiting for concurrency limit.",
+	})
+	// conditionalPolicyBindingsGauge is number of policy bindings with a conditional expression.
+	conditionalPolicyBindingsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "conditional_policy_bindings",
+		Help:      "Number of policy bindings with conditional expression loaded from latest refresh.",
+	})
+	// policyRefreshDurationHistogram observes duration of each policy refresh.
+	policyRefreshDurationHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_refresh_duration_seconds",
+		Help:      "Duration of policy binding refresh in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+	// authDurationHistogram observes duration of each request of /auth, with trace id exemplars given exemplars.
+	authDurationHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_duration_seconds",
+		Help:      "Duration of authentication requests in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+	// conditionEvaluationTimeoutsCounter counts evaluations of conditional expressions exceeding deadline.
+	conditionEvaluationTimeoutsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "condition_evaluation_timeouts_total",
+		Help:      "Number of conditional expression evaluations which exceeded deadline.",
+	})
+	// conditionEvaluationsCounter counts evaluations of conditional expressions by result, true, false or error. Errors
+	// are misconfigured policy, i.e. expressions failing type-check or evaluation, distinct from denial given false.
+	conditionEvaluationsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "condition_evaluations_total",
+		Help:      "Number of conditional expression evaluations by result, true, false or error.",
+	}, []string{"result"})
+	// requestBudgetExceededCounter counts requests of which authentication exceeded request budget.
+	requestBudgetExceededCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_budget_exceeded_total",
+		Help:      "Number of requests of which authentication exceeded request budget.",
+	})
+	// tooManyBindingsCounter counts requests denied given conditional bindings exceeding maximum bindings.
+	tooManyBindingsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "too_many_bindings_total",
+		Help:      "Number of requests denied given conditional bindings exceeding maximum bindings evaluated.",
+	})
+	// conditionResultCacheHitsCounter counts results of conditional expressions served from condition result cache.
+	conditionResultCacheHitsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "condition_result_cache_hits_total",
+		Help:      "Number of results of conditional expressions served from condition result cache.",
+	})
+	// auditRecordsDroppedCounter counts audit records not written to audit sink.
+	auditRecordsDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_records_dropped_total",
+		Help:      "Number of audit records dropped given full buffer or failed write.",
+	})
+	// auditDenialsSampledCounter counts audit records of denials not recorded given sampling of denials.
+	auditDenialsSampledCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_denials_sampled_total",
+		Help:      "Number of audit records of denials not recorded given sampling of denials.",
+	})
+	// oversizedParamsCounter counts requests denied given params of conditional expressions exceeding limits.
+	oversizedParamsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "oversized_params_total",
+		Help:      "Number of requests denied given params of conditional expressions exceeding limits, by param or total.",
+	}, []string{"param"})
+	// oversizedTokensCounter counts tokens rejected given length exceeding maximum token length.
+	oversizedTokensCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "oversized_tokens_total",
+		Help:      "Number of tokens rejected given length exceeding maximum token length.",
+	})
+	// tokenVerificationsCounter counts token verifications by issuer, signing algorithm and result.
+	tokenVerificationsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_verifications_total",
+		Help:      "Number of token verifications by issuer, signing algorithm and result.",
+	}, []string{"issuer", "alg", "result"})
+	// futureIssuedTokensCounter counts tokens denied given iat beyond leeway of iat in future, by issuer.
+	futureIssuedTokensCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "future_issued_tokens_total",
+		Help:      "Number of tokens denied given iat in future beyond leeway, by issuer.",
+	}, []string{"issuer"})
+	// replayedTokensCounter counts tokens denied given jti already used within replay window.
+	replayedTokensCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "replayed_tokens_total",
+		Help:      "Number of tokens denied given jti already used within replay window.",
+	})
+	// unknownKidsCounter counts tokens denied given kid not in JWK of issuer, by issuer and refresh, i.e. refreshed
+	// given withdrawn key.
+	unknownKidsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unknown_kids_total",
+		Help:      "Number of tokens denied given kid not in JWK of issuer, by issuer and refresh, refreshed, limited or failed.",
+	}, []string{"issuer", "refresh"})
+	// shadowDecisionsCounter counts decisions of shadow policy source by match with live decision.
+	shadowDecisionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "shadow_decisions_total",
+		Help:      "Number of decisions of shadow policy source by match or divergence with live decision.",
+	}, []string{"result"})
+	// decisionsCounter counts authorization decisions of verified identities by host and decision.
+	decisionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "decisions_total",
+		Help:      "Number of authorization decisions by host and decision.",
+	}, []string{"host", "decision"})
+	// deniedSourcesCounter counts requests of /auth denied given IPDenylist.
+	deniedSourcesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "denied_sources_total",
+		Help:      "Number of requests denied given source address of ip denylist.",
+	})
+	// bindingEvaluationDurationHistogram observes duration of evaluation of conditional expressions by title of binding,
+	// given SetBindingMetrics.
+	bindingEvaluationDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "binding_evaluation_duration_seconds",
+		Help:      "Duration of evaluation of conditional expressions in seconds by title of binding.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"title"})
+)
+
+// observeDecision counts decision given host label, error of decision and if granted given fail-open.
+func observeDecision(host string, err error, failOpen bool) {
+	decision := "granted"
+	if failOpen {
+		decision = "fail-open"
+	} else if err != nil {
+		decision = "denied"
+	}
+	decisionsCounter.WithLabelValues(host, decision).Inc()
+}
+
+// observeConditionEvaluation counts evaluation of conditional expression given result and error of evaluation.
+func observeConditionEvaluation(result bool, err error) {
+	label := "false"
+	if err != nil {
+		label = "error"
+	} else if result {
+		label = "true"
+	}
+	conditionEvaluationsCounter.WithLabelValues(label).Inc()
+}
+
+// observeTokenVerification counts token verification given issuer, signing algorithm and error of verification.
+func observeTokenVerification(issuer, alg string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	tokenVerificationsCounter.WithLabelValues(issuer, alg, result).Inc()
+}
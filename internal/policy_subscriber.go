@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+	"strings"
+	"time"
+)
+
+// PolicyRefresher is an interface to trigger refresh of policy bindings, as implemented by IdentityAccessManagementReader.
+type PolicyRefresher interface {
+	RefreshRoleAndBindingsForIdentityAwareProxy(ctx context.Context) error
+}
+
+// PolicyChangeSubscriber pulls policy change notifications from a Pub/Sub subscription, either a feed of Cloud Asset
+// Inventory or a log sink of audit logs, and refreshes policy bindings once per batch of relevant messages.
+type PolicyChangeSubscriber struct {
+	service      *pubsub.Service
+	subscription string
+	refresher    PolicyRefresher
+	// seen is message id of recently processed messages, Pub/Sub delivers at least once.
+	seen                   map[string]time.Time
+	minBackoff, maxBackoff time.Duration
+}
+
+const (
+	maxPolicyChangeMessages = 100
+	// policyChangeDedupWindow is duration of which processed message ids are retained for deduplication.
+	policyChangeDedupWindow = 10 * time.Minute
+)
+
+// NewPolicyChangeSubscriber creates a subscriber given subscription as projects/{project}/subscriptions/{subscription}.
+// Run must be invoked to start pulling.
+func NewPolicyChangeSubscriber(ctx context.Context, credentials *google.Credentials, subscription string,
+	refresher PolicyRefresher) (*PolicyChangeSubscriber, error) {
+	service, err := pubsub.NewService(ctx, option.WithCredentials(credentials))
+	if err != nil {
+		return nil, err
+	}
+	return newPolicyChangeSubscriber(service, subscription, refresher, time.Second, time.Minute), nil
+}
+
+func newPolicyChangeSubscriber(service *pubsub.Service, subscription string, refresher PolicyRefresher,
+	minBackoff, maxBackoff time.Duration) *PolicyChangeSubscriber {
+	return &PolicyChangeSubscriber{
+		service:      service,
+		subscription: subscription,
+		refresher:    refresher,
+		seen:         make(map[string]time.Time, maxPolicyChangeMessages),
+		minBackoff:   minBackoff,
+		maxBackoff:   maxBackoff,
+	}
+}
+
+// Run pulls messages until ctx is done. Given failure of pull or refresh, pulling is retried with exponential backoff.
+// Messages are acknowledged given successful refresh, else redelivered. Blocking.
+func (p *PolicyChangeSubscriber) Run(ctx context.Context) {
+	backoff := p.minBackoff
+
+	for ctx.Err() == nil {
+		if err := p.pull(ctx); err != nil && ctx.Err() == nil {
+			log.WithField("error", err).Errorf("Failed processing policy change notifications. Retrying in %s.", backoff)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, p.maxBackoff)
+			continue
+		}
+		backoff = p.minBackoff
+	}
+}
+
+// pull a single batch of messages, refreshing policy bindings once given any relevant message.
+func (p *PolicyChangeSubscriber) pull(ctx context.Context) error {
+	rsp, err := p.service.Projects.Subscriptions.Pull(p.subscription,
+		&pubsub.PullRequest{MaxMessages: maxPolicyChangeMessages}).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	var (
+		now       = time.Now()
+		ackIds    = make([]string, 0, len(rsp.ReceivedMessages))
+		isRelated bool
+	)
+	for id, processed := range p.seen {
+		if now.Sub(processed) > policyChangeDedupWindow {
+			delete(p.seen, id)
+		}
+	}
+	for _, msg := range rsp.ReceivedMessages {
+		ackIds = append(ackIds, msg.AckId)
+		if msg.Message == nil {
+			continue
+		} else if _, ok := p.seen[msg.Message.MessageId]; ok {
+			log.Debugf("Policy change notification %s is already processed.", msg.Message.MessageId)
+			continue
+		}
+		isRelated = isRelated || isPolicyChange(msg.Message)
+	}
+	if len(ackIds) == 0 {
+		return nil
+	}
+	if isRelated {
+		log.Info("Policy change notification received. Refreshing policy bindings.")
+		if err = p.refresher.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+			return err
+		}
+	}
+	for _, msg := range rsp.ReceivedMessages {
+		if msg.Message != nil {
+			p.seen[msg.Message.MessageId] = now
+		}
+	}
+	_, err = p.service.Projects.Subscriptions.Acknowledge(p.subscription,
+		&pubsub.AcknowledgeRequest{AckIds: ackIds}).Context(ctx).Do()
+	return err
+}
+
+// isPolicyChange verifies if message is change of an iam policy, either as asset of Cloud Asset Inventory feed, or
+// audit log of method SetIamPolicy given log sink.
+func isPolicyChange(msg *pubsub.PubsubMessage) bool {
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return false
+	}
+	var notification struct {
+		Asset *struct {
+			IamPolicy json.RawMessage `json:"iamPolicy"`
+		} `json:"asset"`
+		ProtoPayload *struct {
+			MethodName string `json:"methodName"`
+		} `json:"protoPayload"`
+	}
+	if err = json.Unmarshal(data, &notification); err != nil {
+		log.WithField("error", err).Warningf("Policy change notification %s is not json. Ignored.", msg.MessageId)
+		return false
+	}
+	return (notification.Asset != nil && len(notification.Asset.IamPolicy) > 0) ||
+		(notification.ProtoPayload != nil && strings.HasSuffix(notification.ProtoPayload.MethodName, "SetIamPolicy"))
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"google.golang.org/api/pubsub/v1"
+	"testing"
+	"time"
+)
+
+// policyChangeMessage returns a received message of id given notification as json.
+func policyChangeMessage(id, notification string) *pubsub.ReceivedMessage {
+	return &pubsub.ReceivedMessage{
+		AckId: "ack-" + id,
+		Message: &pubsub.PubsubMessage{
+			MessageId: id,
+			Data:      base64.StdEncoding.EncodeToString([]byte(notification)),
+		},
+	}
+}
+
+const (
+	assetPolicyChange    = `{"asset":{"name":"//cloudresourcemanager.googleapis.com/projects/1","iamPolicy":{"bindings":[]}}}`
+	auditLogPolicyChange = `{"protoPayload":{"methodName":"SetIamPolicy"}}`
+	unrelatedChange      = `{"asset":{"name":"//compute.googleapis.com/projects/1/zones/a/instances/b"}}`
+)
+
+// waitFor polls condition until true or deadline is exceeded.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not satisfied before deadline.")
+		}
+	}
+}
+
+func TestPolicyChangeSubscriber(t *testing.T) {
+	var (
+		refresher        = &fakePolicyRefresher{}
+		subscriber, fake = newFakePolicyChangeSubscriber(t, refresher)
+		ctx, cancel      = context.WithCancel(context.Background())
+	)
+	defer cancel()
+	go subscriber.Run(ctx)
+
+	// Batch of relevant messages, including a duplicate delivery, is a single refresh.
+	fake.publish(policyChangeMessage("1", assetPolicyChange), policyChangeMessage("2", auditLogPolicyChange),
+		policyChangeMessage("1", assetPolicyChange))
+	waitFor(t, func() bool { return len(fake.acknowledged()) == 3 })
+	if calls := refresher.refreshes(); calls != 1 {
+		t.Fatalf("Expected single refresh given batch of policy changes, %d refreshes were made.", calls)
+	}
+	// Redelivery of processed message and unrelated messages are acknowledged without refresh.
+	fake.publish(policyChangeMessage("2", auditLogPolicyChange), policyChangeMessage("3", unrelatedChange),
+		policyChangeMessage("4", "not json"))
+	waitFor(t, func() bool { return len(fake.acknowledged()) == 6 })
+	if calls := refresher.refreshes(); calls != 1 {
+		t.Fatalf("Expected no refresh given duplicate and unrelated messages, %d refreshes were made.", calls)
+	}
+	fake.publish(policyChangeMessage("5", assetPolicyChange))
+	waitFor(t, func() bool { return len(fake.acknowledged()) == 7 })
+	if calls := refresher.refreshes(); calls != 2 {
+		t.Fatalf("Expected refresh given policy change, %d refreshes were made.", calls)
+	}
+}
+
+func TestPolicyChangeSubscriberFailedRefresh(t *testing.T) {
+	var (
+		refresher        = &fakePolicyRefresher{err: errors.New("iam api unavailable")}
+		subscriber, fake = newFakePolicyChangeSubscriber(t, refresher)
+	)
+	fake.publish(policyChangeMessage("1", assetPolicyChange))
+	if err := subscriber.pull(context.Background()); err == nil {
+		t.Fatal("Expected error given failed refresh.")
+	} else if acked := fake.acknowledged(); len(acked) != 0 {
+		t.Fatalf("Expected message not to be acknowledged given failed refresh, %d were acknowledged.", len(acked))
+	}
+	// Message is redelivered and refreshed once refresh succeeds.
+	refresher.mu.Lock()
+	refresher.err = nil
+	refresher.mu.Unlock()
+	fake.publish(policyChangeMessage("1", assetPolicyChange))
+
+	if err := subscriber.pull(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if acked := fake.acknowledged(); len(acked) != 1 {
+		t.Fatalf("Expected redelivered message to be acknowledged, %d were acknowledged.", len(acked))
+	} else if calls := refresher.refreshes(); calls != 2 {
+		t.Fatalf("Expected 2 refreshes, %d refreshes were made.", calls)
+	}
+}
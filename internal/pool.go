@@ -25,10 +25,15 @@ func getGoogleTokenClaims() *GoogleTokenClaims {
 
 func putGoogleTokenClaims(claims *GoogleTokenClaims) {
 	claims.Email = ""
+	claims.Principal = ""
+	claims.Acr = ""
+	claims.Amr = nil
 	claims.Issuer = ""
 	claims.Audience = []string{""}
 	claims.Subject = ""
 	claims.ID = ""
+	// Optional claims are retained unless reset, i.e. nbf of a former token.
+	claims.ExpiresAt, claims.NotBefore, claims.IssuedAt = nil, nil, nil
 	googleTokenClaimsPool.Put(claims)
 }
 
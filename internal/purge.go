@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/anderslauri/open-iap/internal/cache"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IdentityPurger is an optional interface of Authenticator to purge cached state of identity, i.e. given offboarding
+// of user. Number of purged entries is returned.
+type IdentityPurger interface {
+	PurgeIdentity(email GoogleServiceAccount) int
+}
+
+// PurgeIdentity purges cached tokens, decisions, absence of bindings and aliases of email, such that subsequent
+// requests are re-verified and re-authorized. Tokens are purged by identity of cached value, decisions by identity of
+// key, no index of tokens by identity is required.
+func (g *GoogleCloudTokenAuthenticator) PurgeIdentity(email GoogleServiceAccount) int {
+	var purged int
+	g.cache.Delete(func(_ string, val cache.ExpiryCacheValue[GoogleServiceAccount]) bool {
+		if val.Val == email {
+			purged++
+			return true
+		}
+		return false
+	})
+	prefix := string(email) + "\x00"
+	for _, c := range []cache.Cache[string, cache.ExpiryCacheValue[time.Time]]{g.decisions, g.negatives} {
+		if c == nil {
+			continue
+		}
+		c.Delete(func(key string, _ cache.ExpiryCacheValue[time.Time]) bool {
+			if key == string(email) || strings.HasPrefix(key, prefix) {
+				purged++
+				return true
+			}
+			return false
+		})
+	}
+	if g.aliases != nil {
+		g.aliases.Delete(func(key string, _ cache.ExpiryCacheValue[[]GoogleServiceAccount]) bool {
+			if key == string(email) {
+				purged++
+				return true
+			}
+			return false
+		})
+	}
+	log.Infof("Purged %d cached entries of user %s.", purged, email)
+	return purged
+}
+
+// SetAdminToken enables POST /admin/purge?email={email}, authorized by bearer token. Empty is disabled. Must be invoked
+// before listener is started.
+func (a *AuthServiceListener) SetAdminToken(token string) {
+	a.adminToken = token
+}
+
+// purge purges cached state of identity of query parameter email given IdentityPurger.
+func (a *AuthServiceListener) purge(w http.ResponseWriter, r *http.Request) {
+	if len(a.adminToken) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+		log.Warning("Unauthorized request to purge cached identity.")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	purger, ok := a.authenticator.(IdentityPurger)
+	email := r.URL.Query().Get("email")
+	if !ok {
+		log.Error("Authenticator does not support purge of cached identity.")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if len(email) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	purged := purger.PurgeIdentity(GoogleServiceAccount(email))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurgeIdentity(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"offboarded":  "offboarded@p.iam.gserviceaccount.com",
+			"offboarded2": "offboarded@p.iam.gserviceaccount.com",
+			"other":       "other@p.iam.gserviceaccount.com",
+		}}
+		bindings = &staleIdentityAccessManagementReader{
+			fakeIdentityAccessManagementReader: fakeIdentityAccessManagementReader{
+				"offboarded@p.iam.gserviceaccount.com": {{Expression: "request.host == \"myurl.com\"", Title: "myurl"}},
+				"other@p.iam.gserviceaccount.com":      {{Expression: "request.host == \"myurl.com\"", Title: "myurl"}},
+			},
+			lastRefresh: time.Now(),
+		}
+		tokens           = cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[GoogleServiceAccount]]()
+		decisions        = cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[time.Time]]()
+		authenticator, _ = NewGoogleCloudTokenAuthenticator(verifier, tokens, bindings, fakeGoogleWorkspaceClient{},
+			nil, EmailDomainFilter{}, 50*time.Millisecond, FailOpen{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+		aud           = "https://myurl.com"
+	)
+	authenticator.SetDecisionCache(decisions, time.Minute)
+	listener.SetAdminToken("secret")
+
+	for _, token := range []string{"offboarded", "offboarded2", "other"} {
+		if _, err := authenticator.Authenticate(context.Background(), token, *requestUrl); err != nil {
+			t.Fatalf("Unexpected error returned, error: %s.", err)
+		}
+	}
+
+	var tests = []struct {
+		name       string
+		token      string
+		email      string
+		statusCode int
+		purged     int
+	}{
+		{"TestPurgeWithoutAdminTokenIsUnauthorized", "", "offboarded@p.iam.gserviceaccount.com", http.StatusUnauthorized, 0},
+		{"TestPurgeWithInvalidAdminTokenIsUnauthorized", "invalid", "offboarded@p.iam.gserviceaccount.com", http.StatusUnauthorized, 0},
+		{"TestPurgeWithoutEmailIsBadRequest", "secret", "", http.StatusBadRequest, 0},
+		// Two tokens and a single decision are cached for user.
+		{"TestPurgeOfUser", "secret", "offboarded@p.iam.gserviceaccount.com", http.StatusOK, 3},
+		{"TestPurgeOfPurgedUser", "secret", "offboarded@p.iam.gserviceaccount.com", http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/admin/purge?email="+url.QueryEscape(tt.email), nil)
+			if len(tt.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rsp := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rsp, req)
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			} else if rsp.Code != http.StatusOK {
+				return
+			}
+			var body struct {
+				Purged int `json:"purged"`
+			}
+			if err := json.NewDecoder(rsp.Body).Decode(&body); err != nil || body.Purged != tt.purged {
+				t.Fatalf("Expected %d purged entries, %d were given.", tt.purged, body.Purged)
+			}
+		})
+	}
+	for token, cached := range map[string]bool{"offboarded": false, "offboarded2": false, "other": true} {
+		if _, ok := tokens.Get(tokenCacheKey(token, aud)); ok != cached {
+			t.Fatalf("Expected token %s cached %t, cached %t was given.", token, cached, ok)
+		}
+	}
+	for email, cached := range map[GoogleServiceAccount]bool{
+		"offboarded@p.iam.gserviceaccount.com": false,
+		"other@p.iam.gserviceaccount.com":      true,
+	} {
+		var ok bool
+		decisions.Range(func(key string, _ cache.ExpiryCacheValue[time.Time]) bool {
+			ok = strings.HasPrefix(key, string(email)+"\x00")
+			return !ok
+		})
+		if ok != cached {
+			t.Fatalf("Expected decision of %s cached %t, cached %t was given.", email, cached, ok)
+		}
+	}
+}
+
+func TestPurgeDisabled(t *testing.T) {
+	listener := newFakeAuthServiceListener(t, newFakeAuthenticator(t, &fakeTokenVerifier{},
+		fakeIdentityAccessManagementReader{}, EmailDomainFilter{}))
+
+	req := httptest.NewRequest("POST", "/admin/purge?email=sa@p.iam.gserviceaccount.com", nil)
+	rsp := httptest.NewRecorder()
+	listener.httpServer.Handler.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusNotFound {
+		t.Fatalf("Expected status code %d, status code %d was returned.", http.StatusNotFound, rsp.Code)
+	}
+}
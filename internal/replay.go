@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+var (
+	// ErrTokenReplayed is given when jti of token of issuer is already used within replay window of SetReplayProtection.
+	ErrTokenReplayed = errors.New("token replayed")
+	// ErrMissingJti is given when token has no claim jti given SetReplayProtection.
+	ErrMissingJti = errors.New("missing jti")
+)
+
+// SetReplayProtection denies repeated use of a token by issuer and claim jti, i.e. of single-use tokens, tracked in c
+// until exp of token. Given maxWindow, tracking is capped at maxWindow, bounding memory given tokens of long lifetime,
+// such that a token is accepted again past maxWindow. Zero is uncapped. Tokens without jti are denied. Must be invoked
+// before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetReplayProtection(c cache.Cache[string, cache.ExpiryCacheValue[time.Time]], maxWindow time.Duration) {
+	g.replays = c
+	g.replayMaxWindow = maxWindow
+}
+
+// replayWindow returns window of which jti of token of exp is tracked, capped by max window. Without exp, window is
+// max window.
+func (g *GoogleCloudTokenAuthenticator) replayWindow(exp *jwt.NumericDate, now time.Time) time.Duration {
+	if exp == nil {
+		return g.replayMaxWindow
+	} else if window := exp.Sub(now); g.replayMaxWindow == 0 || window < g.replayMaxWindow {
+		return window
+	}
+	return g.replayMaxWindow
+}
+
+// verifyReplay verifies if jti of verified token is not used within replay window, given replay protection. Jti of
+// token is tracked once verified.
+func (g *GoogleCloudTokenAuthenticator) verifyReplay(tokenString string) error {
+	if g.replays == nil {
+		return nil
+	}
+	// Token is verified, claims are read without verification.
+	claims := jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, &claims); err != nil || len(claims.ID) == 0 {
+		return fmt.Errorf("%w: claim jti is absent", ErrMissingJti)
+	}
+	key := claims.Issuer + "\x00" + claims.ID
+	now := time.Now()
+	// Lookup and write are a single operation, concurrent requests of a token are never both accepted.
+	g.replayMu.Lock()
+	defer g.replayMu.Unlock()
+	if entry, ok := g.replays.Get(key); ok && entry.Exp > now.Unix() {
+		replayedTokensCounter.Inc()
+		return fmt.Errorf("%w: jti %s of issuer %s first used at %s", ErrTokenReplayed, claims.ID, claims.Issuer,
+			entry.Val.Format(time.RFC3339))
+	}
+	g.replays.Set(key, cache.ExpiryCacheValue[time.Time]{Val: now, Exp: now.Add(g.replayWindow(claims.ExpiresAt, now)).Unix()})
+	return nil
+}
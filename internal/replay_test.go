@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/anderslauri/open-iap/internal/cache"
+	"github.com/golang-jwt/jwt/v5"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReplayProtection(t *testing.T) {
+	var (
+		email = "sa@p.iam.gserviceaccount.com"
+		mint  = func(jti string, lifetime time.Duration) string {
+			claims := jwt.MapClaims{"iss": email, "exp": time.Now().Add(lifetime).Unix()}
+			if len(jti) > 0 {
+				claims["jti"] = jti
+			}
+			return unsignedToken(t, claims)
+		}
+		first         = mint("first", time.Hour)
+		second        = mint("second", time.Hour)
+		longLived     = mint("long-lived", 12*time.Hour)
+		noJti         = mint("", time.Hour)
+		verifier      = &fakeTokenVerifier{emails: map[string]string{first: email, second: email, longLived: email, noJti: email}}
+		bindings      = fakeIdentityAccessManagementReader{GoogleServiceAccount(email): {{}}}
+		replays       = cache.NewCopyOnWriteCache[string, cache.ExpiryCacheValue[time.Time]]()
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+		maxWindow     = 2 * time.Hour
+	)
+	authenticator.SetReplayProtection(replays, maxWindow)
+
+	var tests = []struct {
+		name  string
+		token string
+		error error
+	}{
+		{"TestFirstUseIsGranted", first, nil},
+		{"TestReplayIsDenied", first, ErrTokenReplayed},
+		{"TestOtherJtiIsGranted", second, nil},
+		{"TestLongLivedTokenIsGranted", longLived, nil},
+		{"TestReplayOfLongLivedTokenIsDenied", longLived, ErrTokenReplayed},
+		{"TestTokenWithoutJtiIsDenied", noJti, ErrMissingJti},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			}
+		})
+	}
+
+	// Replay entry of long-lived token is capped at max window, others are tracked until exp.
+	for jti, window := range map[string]time.Duration{"first": time.Hour, "long-lived": maxWindow} {
+		entry, ok := replays.Get(email + "\x00" + jti)
+		if !ok {
+			t.Fatalf("Expected replay entry of jti %s.", jti)
+		} else if exp := time.Now().Add(window).Unix(); entry.Exp > exp || entry.Exp < exp-5 {
+			t.Fatalf("Expected replay entry of jti %s to expire at %d, expires at %d.", jti, exp, entry.Exp)
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	now := time.Now()
+	var tests = []struct {
+		name      string
+		maxWindow time.Duration
+		exp       *jwt.NumericDate
+		window    time.Duration
+	}{
+		{"TestWindowIsUntilExp", time.Hour, jwt.NewNumericDate(now.Add(time.Minute)), time.Minute},
+		{"TestWindowIsCappedAtMaxWindow", time.Hour, jwt.NewNumericDate(now.Add(12 * time.Hour)), time.Hour},
+		{"TestZeroMaxWindowIsUncapped", 0, jwt.NewNumericDate(now.Add(12 * time.Hour)), 12 * time.Hour},
+		{"TestWindowWithoutExpIsMaxWindow", time.Hour, nil, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := &GoogleCloudTokenAuthenticator{replayMaxWindow: tt.maxWindow}
+			// NumericDate is truncated to seconds.
+			if window := authenticator.replayWindow(tt.exp, now); window > tt.window || window < tt.window-time.Second {
+				t.Fatalf("Expected window %s, window %s was returned.", tt.window, window)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// maxRequestIDLength is maximum length of inbound request id, longer request ids are replaced.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestIDHook is a logrus hook adding field request_id of context of entry, given log.WithContext.
+type RequestIDHook struct{}
+
+// Levels returns all levels.
+func (RequestIDHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire adds request id of context of entry.
+func (RequestIDHook) Fire(entry *log.Entry) error {
+	if id := requestID(entry.Context); len(id) > 0 {
+		entry.Data["request_id"] = id
+	}
+	return nil
+}
+
+// SetRequestID sets header of request id echoed on response of /auth and included in logs and audit records of
+// request. Request id of inbound header is retained given trusted, i.e. set by a trusted proxy, else generated as a
+// UUID. Empty header is disabled. Must be invoked before listener is started.
+func (a *AuthServiceListener) SetRequestID(header string, trusted bool) {
+	a.requestIDHeader = http.CanonicalHeaderKey(header)
+	a.trustRequestID = trusted
+}
+
+// withRequestID returns ctx holding request id of r, given request id header. Request id is set on response.
+func (a *AuthServiceListener) withRequestID(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if len(a.requestIDHeader) == 0 {
+		return ctx
+	}
+	id := r.Header.Get(a.requestIDHeader)
+	if !a.trustRequestID || !isValidRequestID(id) {
+		id = uuid.NewString()
+	}
+	w.Header().Set(a.requestIDHeader, id)
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns request id of ctx, empty given none.
+func requestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// isValidRequestID verifies id is of printable ASCII without space, such that id can't inject into logs or headers.
+func isValidRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"token":  "sa@p.iam.gserviceaccount.com",
+			"denied": "denied@p.iam.gserviceaccount.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{"sa@p.iam.gserviceaccount.com": {{}}}
+	)
+	var tests = []struct {
+		name      string
+		trusted   bool
+		requestID string
+		token     string
+		expected  string
+	}{
+		{"TestTrustedRequestIDIsRetained", true, "abc-123", "token", "abc-123"},
+		{"TestTrustedRequestIDIsRetainedGivenDenial", true, "abc-123", "denied", "abc-123"},
+		{"TestRequestIDIsGeneratedGivenAbsent", true, "", "token", ""},
+		{"TestUntrustedRequestIDIsReplaced", false, "abc-123", "token", ""},
+		{"TestInvalidRequestIDIsReplaced", true, "abc 123", "token", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				sink          = &recordingAuditSink{}
+				authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+				listener      = newFakeAuthServiceListener(t, authenticator)
+				output        = &bytes.Buffer{}
+				hooks         = log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+			)
+			log.AddHook(RequestIDHook{})
+			log.SetOutput(output)
+			t.Cleanup(func() {
+				log.StandardLogger().ReplaceHooks(hooks)
+				log.SetOutput(os.Stderr)
+			})
+			authenticator.SetAuditSink(sink)
+			listener.SetRequestID("X-Request-Id", tt.trusted)
+
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Header.Set("Proxy-Authorization", "Bearer "+tt.token)
+			req.Header.Set("X-Original-URL", "https://myurl.com/hello")
+			if len(tt.requestID) > 0 {
+				req.Header.Set("X-Request-Id", tt.requestID)
+			}
+			rsp := httptest.NewRecorder()
+			listener.httpServer.Handler.ServeHTTP(rsp, req)
+
+			id := rsp.Header().Get("X-Request-Id")
+			if len(tt.expected) > 0 && id != tt.expected {
+				t.Fatalf("Expected request id %s, request id %s was given.", tt.expected, id)
+			} else if _, err := uuid.Parse(id); len(tt.expected) == 0 && err != nil {
+				t.Fatalf("Expected generated UUID as request id, request id %s was given.", id)
+			}
+			if records := sink.recorded(); len(records) != 1 || records[0].RequestID != id {
+				t.Fatalf("Expected audit record of request id %s, records %v were given.", id, records)
+			}
+			// Each log of request holds request id.
+			for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+				if !strings.Contains(line, "request_id="+id) {
+					t.Fatalf("Expected log of request id %s, log %s was given.", id, line)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestIDDisabled(t *testing.T) {
+	var listener = newFakeAuthServiceListener(t, newFakeAuthenticator(t, &fakeTokenVerifier{},
+		fakeIdentityAccessManagementReader{}, EmailDomainFilter{}))
+
+	req := httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("X-Request-Id", "abc-123")
+	rsp := httptest.NewRecorder()
+	listener.httpServer.Handler.ServeHTTP(rsp, req)
+	if rsp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d, status code %d was returned.", http.StatusUnauthorized, rsp.Code)
+	} else if id := rsp.Header().Get("X-Request-Id"); len(id) > 0 {
+		t.Fatalf("Expected no request id given disabled, request id %s was given.", id)
+	}
+}
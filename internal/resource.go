@@ -0,0 +1,36 @@
+package internal
+
+import "slices"
+
+// Resource is target resource of request, available as resource.name and resource.type of conditional expressions,
+// i.e. resource.name == "projects/123/iap_web/compute/services/backend".
+type Resource struct {
+	Name string
+	Type string
+}
+
+// SetResources maps host of request url to target resource. Unmapped hosts are of empty resource, conditions on
+// resource are not satisfied. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetResources(resources map[string]Resource) {
+	g.resources = resources
+}
+
+// resource returns target resource of host, empty given no mapping.
+func (g *GoogleCloudTokenAuthenticator) resource(host string) Resource {
+	return g.resources[host]
+}
+
+// scopedTo returns bindings granted on resource, bindings of project are granted on every resource. Bindings are
+// shared with policy, never filtered in place.
+func (p PolicyBindings) scopedTo(resource string) PolicyBindings {
+	if !slices.ContainsFunc(p, func(binding PolicyBinding) bool { return len(binding.Resource) > 0 }) {
+		return p
+	}
+	scoped := make(PolicyBindings, 0, len(p))
+	for _, binding := range p {
+		if len(binding.Resource) == 0 || binding.Resource == resource {
+			scoped = append(scoped, binding)
+		}
+	}
+	return scoped
+}
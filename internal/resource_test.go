@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResourceCondition(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = fakeIdentityAccessManagementReader{email: {
+			{Expression: "resource.name == \"projects/123/iap_web/compute/services/backend\" && " +
+				"resource.type == \"iap.googleapis.com/WebBackendService\"", Title: "backend"},
+		}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	authenticator.SetResources(map[string]Resource{
+		"myurl.com":    {Name: "projects/123/iap_web/compute/services/backend", Type: "iap.googleapis.com/WebBackendService"},
+		"frontend.com": {Name: "projects/123/iap_web/compute/services/frontend", Type: "iap.googleapis.com/WebBackendService"},
+	})
+
+	var tests = []struct {
+		name       string
+		requestUrl string
+		statusCode int
+	}{
+		{"TestMappedResourceMatches", "https://myurl.com/hello", http.StatusOK},
+		{"TestOtherMappedResource", "https://frontend.com/hello", http.StatusUnauthorized},
+		{"TestUnmappedHost", "https://other.com/hello", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rsp := doAuthRequest(listener, "token", tt.requestUrl); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestResourceScopedBinding(t *testing.T) {
+	var (
+		backend  = GoogleServiceAccount("backend@p.iam.gserviceaccount.com")
+		project  = GoogleServiceAccount("project@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"backend": string(backend), "project": string(project)}}
+		bindings = fakeIdentityAccessManagementReader{
+			backend: {{Resource: "projects/123/iap_web/compute/services/backend"}},
+			project: {{}},
+		}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		listener      = newFakeAuthServiceListener(t, authenticator)
+	)
+	authenticator.SetResources(map[string]Resource{
+		"myurl.com":    {Name: "projects/123/iap_web/compute/services/backend", Type: "iap.googleapis.com/WebBackendService"},
+		"frontend.com": {Name: "projects/123/iap_web/compute/services/frontend", Type: "iap.googleapis.com/WebBackendService"},
+	})
+
+	var tests = []struct {
+		name       string
+		token      string
+		requestUrl string
+		statusCode int
+	}{
+		{"TestUnconditionalBindingOfResource", "backend", "https://myurl.com/hello", http.StatusOK},
+		{"TestUnconditionalBindingOfOtherResource", "backend", "https://frontend.com/hello", http.StatusForbidden},
+		{"TestUnconditionalBindingOfUnmappedHost", "backend", "https://other.com/hello", http.StatusForbidden},
+		{"TestUnconditionalBindingOfResourceAfterDenial", "backend", "https://myurl.com/hello", http.StatusOK},
+		{"TestUnconditionalBindingOfProject", "project", "https://frontend.com/hello", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rsp := doAuthRequest(listener, tt.token, tt.requestUrl); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestPolicyBindingsScopedTo(t *testing.T) {
+	var (
+		resource = "projects/123/iap_web/compute/services/backend"
+		bindings = PolicyBindings{
+			{Title: "project"},
+			{Title: "resource", Resource: resource},
+			{Title: "other", Resource: "projects/123/iap_web/compute/services/frontend"},
+		}
+	)
+	scoped := bindings.scopedTo(resource)
+	if len(scoped) != 2 || scoped[0].Title != "project" || scoped[1].Title != "resource" {
+		t.Fatalf("Expected bindings of project and resource, %v was given.", scoped)
+	} else if bindings[1].Title != "resource" || bindings[2].Title != "other" {
+		t.Fatal("Expected bindings not to be filtered in place.")
+	}
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// RouteRule is static rule of requests of which path of request url has prefix, or matches pattern of path.Match given
+// any of *?[, Path. Identity must be any of Members, i.e. user:{email}, serviceAccount:{email} or group:{email}, and
+// Condition must evaluate to true. Empty Members or Condition is not required.
+type RouteRule struct {
+	Path      string   `json:"path"`
+	Members   []string `json:"members"`
+	Condition string   `json:"condition"`
+}
+
+// RouteMode is combination of rule of route with policy bindings.
+type RouteMode string
+
+const (
+	// RouteModeAnd requires both rule of route and policy bindings, default.
+	RouteModeAnd RouteMode = "and"
+	// RouteModeOr requires either rule of route or policy bindings. Deny policies take precedence over rule of route.
+	RouteModeOr RouteMode = "or"
+)
+
+// RoutePolicy is static rules of routes evaluated alongside policy bindings given Mode, i.e. /metrics requiring
+// membership of a group. First rule of which path matches request url applies, requests of other paths are authorized
+// by policy bindings only.
+type RoutePolicy struct {
+	Mode  RouteMode   `json:"mode"`
+	Rules []RouteRule `json:"rules"`
+}
+
+var (
+	// ErrDeniedByRoute is given when identity is not allowed by rule of route of RoutePolicy.
+	ErrDeniedByRoute = errors.New("denied by route policy")
+	// ErrInvalidRoutePolicy is given when mode or condition of RoutePolicy is invalid.
+	ErrInvalidRoutePolicy = errors.New("invalid route policy")
+)
+
+// routeRule is RouteRule of which members are principal identifiers, groups expanded.
+type routeRule struct {
+	RouteRule
+	members map[string]struct{}
+}
+
+// ReadRoutePolicy reads RoutePolicy of JSON file.
+func ReadRoutePolicy(name string) (RoutePolicy, error) {
+	var policy RoutePolicy
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return policy, err
+	} else if err = json.Unmarshal(content, &policy); err != nil {
+		return policy, fmt.Errorf("%w: %s: %s", ErrInvalidRoutePolicy, name, err)
+	}
+	return policy, nil
+}
+
+// SetRoutePolicy registers static rules of routes. Groups of members are expanded once given Google Workspace and
+// conditions are compiled, either failing is an error. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetRoutePolicy(ctx context.Context, policy RoutePolicy) error {
+	switch policy.Mode {
+	case "":
+		policy.Mode = RouteModeAnd
+	case RouteModeAnd, RouteModeOr:
+	default:
+		return fmt.Errorf("%w: unknown mode %s", ErrInvalidRoutePolicy, policy.Mode)
+	}
+	rules := make([]routeRule, 0, len(policy.Rules))
+	for _, rule := range policy.Rules {
+		if len(rule.Condition) > 0 {
+			if _, err := compileProgram(rule.Condition); err != nil {
+				return fmt.Errorf("%w: condition of route %s: %s", ErrInvalidRoutePolicy, rule.Path, err)
+			}
+		}
+		compiled := routeRule{RouteRule: rule, members: make(map[string]struct{}, len(rule.Members))}
+		for _, member := range rule.Members {
+			group, ok := strings.CutPrefix(member, "group:")
+			if !ok {
+				compiled.members[member] = struct{}{}
+				continue
+			}
+			identities, err := g.gwsClient.ListGoogleServiceAccounts(ctx, group)
+			if err != nil {
+				return fmt.Errorf("can't expand group %s of route %s: %w", group, rule.Path, err)
+			}
+			for _, identity := range identities {
+				compiled.members[principalIdentifier(identity)] = struct{}{}
+			}
+		}
+		rules = append(rules, compiled)
+	}
+	g.routeMode, g.routes = policy.Mode, rules
+	log.Infof("Loaded route policy with %d rules of mode %s.", len(rules), policy.Mode)
+	return nil
+}
+
+// route returns first rule of which path matches request url, nil given none.
+func (g *GoogleCloudTokenAuthenticator) route(requestUrl url.URL) *routeRule {
+	if len(g.routes) == 0 {
+		return nil
+	}
+	cleaned := cleanPath(&requestUrl)
+	for i := range g.routes {
+		if matchesPath(g.routes[i].Path, cleaned) {
+			return &g.routes[i]
+		}
+	}
+	return nil
+}
+
+// authorizeRoute combines err of policy bindings with rule of route of request url given RouteMode, err is returned
+// given no rule. Given neither grants, err of policy bindings is returned given RouteModeOr.
+func (g *GoogleCloudTokenAuthenticator) authorizeRoute(ctx context.Context, email GoogleServiceAccount, requestUrl url.URL, now int64, err error) error {
+	rule := g.route(requestUrl)
+	switch {
+	case rule == nil:
+		return err
+	case g.routeMode == RouteModeAnd && err != nil:
+		return err
+	case g.routeMode == RouteModeOr && (err == nil || errors.Is(err, ErrDeniedByPolicy)):
+		return err
+	}
+	routeErr := g.evaluateRoute(ctx, rule, email, requestUrl, now)
+	if routeErr != nil && g.routeMode == RouteModeOr {
+		return err
+	}
+	return routeErr
+}
+
+// evaluateRoute verifies if user is any of members of rule and condition of rule evaluates to true.
+func (g *GoogleCloudTokenAuthenticator) evaluateRoute(ctx context.Context, rule *routeRule, email GoogleServiceAccount, requestUrl url.URL, now int64) error {
+	if _, ok := rule.members[principalIdentifier(email)]; len(rule.members) > 0 && !ok {
+		log.WithContext(ctx).Warningf("User %s is not a member of route %s.", email, rule.Path)
+		return fmt.Errorf("%w: %s", ErrDeniedByRoute, rule.Path)
+	} else if len(rule.Condition) == 0 {
+		return nil
+	}
+	params := g.conditionParams(ctx, email, requestUrl, now)
+	if err := g.paramLimits.verify(params); err != nil {
+		log.WithContext(ctx).WithField("error", err).Warningf("Params of request of user %s are too large. Denied without evaluation.", email)
+		return err
+	}
+	ctx, cancel := g.withConditionTimeout(ctx)
+	defer cancel()
+
+	if ok, err := doesConditionalExpressionEvaluateToTrue(ctx, rule.Condition, params); err != nil {
+		log.WithContext(ctx).WithField("error", err).Errorf("Condition of route %s failed evaluation for user %s.", rule.Path, email)
+		return fmt.Errorf("%w: %s", ErrDeniedByRoute, rule.Path)
+	} else if !ok {
+		log.WithContext(ctx).Warningf("Condition of route %s evaluated to false for user %s.", rule.Path, email)
+		return fmt.Errorf("%w: %s", ErrDeniedByRoute, rule.Path)
+	}
+	return nil
+}
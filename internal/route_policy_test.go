@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// staticDenyPolicies denies identities by name of deny policy.
+type staticDenyPolicies map[GoogleServiceAccount]string
+
+func (s staticDenyPolicies) RefreshDenyPolicies(context.Context) error { return nil }
+
+func (s staticDenyPolicies) LoadDenyPolicyForGoogleServiceAccount(uid GoogleServiceAccount) (string, bool, error) {
+	policy, ok := s[uid]
+	return policy, ok, nil
+}
+
+func TestRoutePolicy(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"ops":     "ops@example.com",
+			"dev":     "dev@example.com",
+			"unbound": "unbound@example.com",
+			"denied":  "denied@example.com",
+			"other":   "other@example.com",
+		}}
+		bindings = fakeIdentityAccessManagementReader{
+			"ops@example.com":    {{}},
+			"dev@example.com":    {{}},
+			"denied@example.com": {{}},
+		}
+		groups = fakeGoogleWorkspaceClient{"ops-group@example.com": {"ops@example.com", "unbound@example.com", "denied@example.com"}}
+		rules  = []RouteRule{
+			{Path: "/metrics", Members: []string{"group:ops-group@example.com"}},
+			{Path: "/admin/*", Members: []string{"user:dev@example.com"}, Condition: "request.scheme == \"https\""},
+		}
+	)
+	var tests = []struct {
+		name       string
+		mode       RouteMode
+		token      string
+		requestUrl string
+		statusCode int
+	}{
+		{"TestAndMemberOfRouteWithBindings", RouteModeAnd, "ops", "https://myurl.com/metrics", http.StatusOK},
+		{"TestAndNotMemberOfRoute", RouteModeAnd, "dev", "https://myurl.com/metrics", http.StatusForbidden},
+		{"TestAndMemberOfRouteWithoutBindings", RouteModeAnd, "unbound", "https://myurl.com/metrics", http.StatusForbidden},
+		{"TestAndTraversalIsMatched", RouteModeAnd, "dev", "https://myurl.com/static/../metrics", http.StatusForbidden},
+		{"TestAndPathWithoutRule", RouteModeAnd, "dev", "https://myurl.com/hello", http.StatusOK},
+		{"TestAndConditionOfRoute", RouteModeAnd, "dev", "https://myurl.com/admin/users", http.StatusOK},
+		{"TestAndConditionOfRouteIsFalse", RouteModeAnd, "dev", "http://myurl.com/admin/users", http.StatusForbidden},
+		{"TestOrMemberOfRouteWithoutBindings", RouteModeOr, "unbound", "https://myurl.com/metrics", http.StatusOK},
+		{"TestOrNotMemberOfRouteWithBindings", RouteModeOr, "dev", "https://myurl.com/metrics", http.StatusOK},
+		{"TestOrNeitherRouteNorBindings", RouteModeOr, "other", "https://myurl.com/metrics", http.StatusForbidden},
+		{"TestOrDenyPolicyTakesPrecedence", RouteModeOr, "denied", "https://myurl.com/metrics", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+			authenticator.gwsClient = groups
+			authenticator.SetDenyPolicyReader(staticDenyPolicies{"denied@example.com": "policies/deny"})
+			if err := authenticator.SetRoutePolicy(context.Background(), RoutePolicy{Mode: tt.mode, Rules: rules}); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			listener := newFakeAuthServiceListener(t, authenticator)
+			if rsp := doAuthRequest(listener, tt.token, tt.requestUrl); rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+		})
+	}
+}
+
+func TestReadRoutePolicy(t *testing.T) {
+	var (
+		dir           = t.TempDir()
+		authenticator = newFakeAuthenticator(t, &fakeTokenVerifier{}, fakeIdentityAccessManagementReader{}, EmailDomainFilter{})
+	)
+	var tests = []struct {
+		name    string
+		content string
+		err     error
+	}{
+		{"TestValidRoutePolicy", `{"mode": "or", "rules": [{"path": "/metrics", "members": ["user:ops@example.com"]}]}`, nil},
+		{"TestInvalidJson", `{"rules": `, ErrInvalidRoutePolicy},
+		{"TestUnknownMode", `{"mode": "xor"}`, ErrInvalidRoutePolicy},
+		{"TestInvalidCondition", `{"rules": [{"path": "/metrics", "condition": "request.unknown == 1"}]}`, ErrInvalidRoutePolicy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(dir, tt.name+".json")
+			if err := os.WriteFile(name, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			}
+			policy, err := ReadRoutePolicy(name)
+			if err == nil {
+				err = authenticator.SetRoutePolicy(context.Background(), policy)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SelfCheck is a named check of configuration or connectivity, i.e. load of policy bindings, run by RunSelfCheck.
+type SelfCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// SelfCheckResult is outcome of a SelfCheck.
+type SelfCheckResult struct {
+	Name     string        `json:"name"`
+	Ok       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// SelfCheckReport is outcome of every SelfCheck. Status is ok or failed given any failed check.
+type SelfCheckReport struct {
+	Status string            `json:"status"`
+	Checks []SelfCheckResult `json:"checks"`
+}
+
+// ErrSelfCheckFailed is given when any SelfCheck fails.
+var ErrSelfCheckFailed = errors.New("self-check failed")
+
+// HealthCheck returns SelfCheck of health of component, failing given unhealthy, i.e. a failed initial load.
+func HealthCheck(component HealthReporter) SelfCheck {
+	health := component.Health()
+	return SelfCheck{Name: health.Name, Check: func(context.Context) error {
+		if health = component.Health(); !health.Healthy {
+			return errors.New(health.LastError)
+		}
+		return nil
+	}}
+}
+
+// RunSelfCheck runs checks in order, each bounded by timeout, and writes a SelfCheckReport as JSON to w. Zero timeout
+// is unbounded. ErrSelfCheckFailed is returned given any failed check.
+func RunSelfCheck(ctx context.Context, w io.Writer, timeout time.Duration, checks ...SelfCheck) error {
+	var (
+		report = SelfCheckReport{Status: "ok", Checks: make([]SelfCheckResult, 0, len(checks))}
+		failed []string
+	)
+	for _, check := range checks {
+		result := SelfCheckResult{Name: check.Name, Ok: true}
+		start := time.Now()
+		if err := runCheck(ctx, timeout, check); err != nil {
+			result.Ok, result.Error = false, err.Error()
+			failed = append(failed, check.Name)
+		}
+		result.Duration = time.Since(start)
+		report.Checks = append(report.Checks, result)
+	}
+	if len(failed) > 0 {
+		report.Status = "failed"
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	} else if len(failed) > 0 {
+		return fmt.Errorf("%w: %v", ErrSelfCheckFailed, failed)
+	}
+	return nil
+}
+
+// runCheck runs check bounded by timeout.
+func runCheck(ctx context.Context, timeout time.Duration, check SelfCheck) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return check.Check(ctx)
+}
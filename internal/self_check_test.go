@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRunSelfCheck(t *testing.T) {
+	var tests = []struct {
+		name   string
+		fail   func(issuer *fakeOpenIDIssuer, fake *fakeResourceManager)
+		status string
+		failed string
+	}{
+		{"TestPassingSelfCheck", func(*fakeOpenIDIssuer, *fakeResourceManager) {}, "ok", ""},
+		{"TestFailingPolicyBindings", func(_ *fakeOpenIDIssuer, fake *fakeResourceManager) {
+			fake.setBindings(http.StatusInternalServerError)
+		}, "failed", "bindings"},
+		{"TestFailingJwks", func(issuer *fakeOpenIDIssuer, _ *fakeResourceManager) {
+			issuer.server.Close()
+		}, "failed", "jwks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				issuer          = newFakeOpenIDIssuer(t)
+				tokenService    = issuer.newTokenService(t, PrincipalClaimEmail)
+				iamClient, fake = newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+				report          bytes.Buffer
+			)
+			tt.fail(issuer, fake)
+			err := RunSelfCheck(context.Background(), &report, time.Second,
+				SelfCheck{Name: "bindings", Check: iamClient.RefreshRoleAndBindingsForIdentityAwareProxy},
+				SelfCheck{Name: "jwks", Check: tokenService.refreshPublicCerts},
+				HealthCheck(iamClient),
+			)
+			var result SelfCheckReport
+			if len(tt.failed) == 0 && err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			} else if len(tt.failed) > 0 && !errors.Is(err, ErrSelfCheckFailed) {
+				t.Fatalf("Expected error %v, error %v was returned.", ErrSelfCheckFailed, err)
+			} else if err = json.Unmarshal(report.Bytes(), &result); err != nil {
+				t.Fatalf("Unexpected error returned, error: %s.", err)
+			} else if result.Status != tt.status || len(result.Checks) != 3 {
+				t.Fatalf("Expected status %s of 3 checks, status %s of %d checks was reported.", tt.status,
+					result.Status, len(result.Checks))
+			}
+			for _, check := range result.Checks {
+				// Health of policy follows outcome of load of bindings.
+				failed := check.Name == tt.failed || (tt.failed == "bindings" && check.Name == "policy")
+				if check.Ok == failed || (failed && len(check.Error) == 0) {
+					t.Fatalf("Expected check %s failed %t, ok %t and error %q were reported.", check.Name, failed,
+						check.Ok, check.Error)
+				}
+			}
+		})
+	}
+}
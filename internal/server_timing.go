@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTimingMetrics are names of operations in Server-Timing header, in order.
+var serverTimingMetrics = []struct {
+	operation Operation
+	name      string
+}{
+	{OperationCacheLookup, "cache"},
+	{OperationVerifyToken, "verify"},
+	{OperationLoadBindings, "policy"},
+	{OperationEvaluateConditions, "cel"},
+}
+
+type serverTimingKey struct{}
+
+// serverTiming is elapsed time per operation of a request. Safe for concurrent use, authentication may continue
+// given exceeded request budget.
+type serverTiming struct {
+	mu      sync.Mutex
+	start   time.Time
+	elapsed map[Operation]time.Duration
+}
+
+// withServerTiming returns ctx recording elapsed time of operations of Authenticate.
+func withServerTiming(ctx context.Context) (context.Context, *serverTiming) {
+	timing := &serverTiming{start: time.Now(), elapsed: make(map[Operation]time.Duration, len(serverTimingMetrics))}
+	return context.WithValue(ctx, serverTimingKey{}, timing), timing
+}
+
+// withoutServerTiming returns ctx of which operations are not recorded, i.e. given shadow decisions.
+func withoutServerTiming(ctx context.Context) context.Context {
+	return context.WithValue(ctx, serverTimingKey{}, (*serverTiming)(nil))
+}
+
+// recordServerTiming adds elapsed time of operation given ctx of withServerTiming.
+func recordServerTiming(ctx context.Context, operation Operation, elapsed time.Duration) {
+	timing, ok := ctx.Value(serverTimingKey{}).(*serverTiming)
+	if !ok || timing == nil {
+		return
+	}
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	timing.elapsed[operation] += elapsed
+}
+
+// header returns value of Server-Timing of recorded operations and total of request, in milliseconds.
+func (s *serverTiming) header() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := make([]string, 0, len(serverTimingMetrics)+1)
+	for _, metric := range serverTimingMetrics {
+		if elapsed, ok := s.elapsed[metric.operation]; ok {
+			metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", metric.name, float64(elapsed.Microseconds())/1000))
+		}
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", float64(time.Since(s.start).Microseconds())/1000))
+	return strings.Join(metrics, ", ")
+}
+
+// serverTimingWriter sets Server-Timing before status of response is written. Given no status is written, i.e. 200
+// of allowed request, setHeader must be invoked before handler returns.
+type serverTimingWriter struct {
+	http.ResponseWriter
+	timing  *serverTiming
+	written bool
+}
+
+func (s *serverTimingWriter) setHeader() {
+	if !s.written {
+		s.written = true
+		s.Header().Set("Server-Timing", s.timing.header())
+	}
+}
+
+func (s *serverTimingWriter) WriteHeader(statusCode int) {
+	s.setHeader()
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (s *serverTimingWriter) Write(b []byte) (int, error) {
+	s.setHeader()
+	return s.ResponseWriter.Write(b)
+}
+
+// SetServerTiming sets Server-Timing on responses of /auth, of durations of cache, verify, policy and cel in
+// milliseconds, i.e. cache;dur=0.012, verify;dur=1.204, total;dur=1.5. Operations not performed are omitted. Must be
+// invoked before listener is started.
+func (a *AuthServiceListener) SetServerTiming(enabled bool) {
+	a.serverTiming = enabled
+}
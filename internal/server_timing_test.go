@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestServerTiming(t *testing.T) {
+	var (
+		email    = GoogleServiceAccount("sa@p.iam.gserviceaccount.com")
+		verifier = &fakeTokenVerifier{emails: map[string]string{"token": string(email)}}
+		bindings = fakeIdentityAccessManagementReader{email: {
+			{Expression: "request.path.startsWith(\"/hello\")", Title: "hello"},
+		}}
+		authenticator *GoogleCloudTokenAuthenticator
+		metric        = regexp.MustCompile(`^[a-z]+;dur=[0-9]+\.[0-9]{3}$`)
+	)
+	var tests = []struct {
+		name       string
+		enabled    bool
+		cached     bool
+		token      string
+		statusCode int
+		metrics    []string
+	}{
+		{"TestServerTimingIsDisabled", false, false, "token", http.StatusOK, nil},
+		{"TestServerTimingOfAllowedRequest", true, false, "token", http.StatusOK,
+			[]string{"cache", "verify", "policy", "cel", "total"}},
+		{"TestServerTimingOfCachedToken", true, true, "token", http.StatusOK, []string{"cache", "policy", "cel", "total"}},
+		{"TestServerTimingOfInvalidToken", true, false, "invalid", http.StatusUnauthorized, []string{"cache", "total"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.cached {
+				authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+			}
+			listener := newFakeAuthServiceListener(t, authenticator)
+			listener.SetServerTiming(tt.enabled)
+			rsp := doAuthRequest(listener, tt.token, "https://myurl.com/hello")
+			if rsp.Code != tt.statusCode {
+				t.Fatalf("Expected status code %d, status code %d was returned.", tt.statusCode, rsp.Code)
+			}
+			header := rsp.Header().Get("Server-Timing")
+			if len(tt.metrics) == 0 {
+				if len(header) > 0 {
+					t.Fatalf("Expected no Server-Timing, %s was returned.", header)
+				}
+				return
+			}
+			metrics := strings.Split(header, ", ")
+			if len(metrics) != len(tt.metrics) {
+				t.Fatalf("Expected metrics %v, Server-Timing %s was returned.", tt.metrics, header)
+			}
+			for i, name := range tt.metrics {
+				if !metric.MatchString(metrics[i]) || !strings.HasPrefix(metrics[i], name+";") {
+					t.Fatalf("Expected metric %s, metric %s was returned.", name, metrics[i])
+				}
+			}
+		})
+	}
+}
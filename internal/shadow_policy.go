@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+)
+
+// SetShadowPolicyReader registers reader as candidate source of policy bindings, i.e. given migration of policy
+// source. Decision given reader is computed in parallel with decision of live source and recorded given divergence,
+// but never affects response. Must be invoked before Authenticate is used.
+func (g *GoogleCloudTokenAuthenticator) SetShadowPolicyReader(reader IdentityAccessManagementReader) {
+	g.shadowReader = reader
+}
+
+// shadowAuthorize authorizes identity given shadow reader in background, nil given no shadow reader. Shadow
+// decision has no caches, timing hook or audit sink, such that live decisions are unaffected.
+func (g *GoogleCloudTokenAuthenticator) shadowAuthorize(ctx context.Context, email GoogleServiceAccount, requestUrl url.URL, now int64) <-chan error {
+	if g.shadowReader == nil {
+		return nil
+	}
+	shadow := &GoogleCloudTokenAuthenticator{
+		iamClient:        g.shadowReader,
+		gwsClient:        g.gwsClient,
+		denyPolicies:     g.denyPolicies,
+		accessLevels:     g.accessLevels,
+		emptyPolicy:      g.emptyPolicy,
+		aliasReader:      g.aliasReader,
+		aliases:          g.aliases,
+		aliasTTL:         g.aliasTTL,
+		conditionTimeout: g.conditionTimeout,
+		maxBindings:      g.maxBindings,
+		resources:        g.resources,
+		routes:           g.routes,
+		routeMode:        g.routeMode,
+	}
+	decision := make(chan error, 1)
+	// Shadow decision is never cancelled given completion of request.
+	ctx = withoutServerTiming(context.WithoutCancel(ctx))
+	go func() { decision <- shadow.authorize(ctx, email, requestUrl, now) }()
+	return decision
+}
+
+// compareShadow records divergence of shadow decision from live decision given err, without waiting on shadow.
+func compareShadow(ctx context.Context, shadow <-chan error, email GoogleServiceAccount, requestUrl url.URL, err error) {
+	if shadow == nil {
+		return
+	}
+	go func() {
+		shadowErr := <-shadow
+		if (err == nil) == (shadowErr == nil) {
+			shadowDecisionsCounter.WithLabelValues("match").Inc()
+			return
+		}
+		shadowDecisionsCounter.WithLabelValues("divergence").Inc()
+		log.WithContext(ctx).WithFields(log.Fields{
+			"user":   email,
+			"url":    requestUrl.String(),
+			"live":   decisionLabel(err),
+			"shadow": decisionLabel(shadowErr),
+			"error":  errors.Join(err, shadowErr),
+		}).Warning("Decision of shadow policy source diverges from live policy source.")
+	}()
+}
+
+// decisionLabel returns granted or denied given err of decision.
+func decisionLabel(err error) string {
+	if err != nil {
+		return "denied"
+	}
+	return "granted"
+}
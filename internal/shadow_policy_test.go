@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestShadowPolicyReader(t *testing.T) {
+	var (
+		verifier = &fakeTokenVerifier{emails: map[string]string{
+			"both":   "both@p.iam.gserviceaccount.com",
+			"live":   "live@p.iam.gserviceaccount.com",
+			"shadow": "shadow@p.iam.gserviceaccount.com",
+		}}
+		live = fakeIdentityAccessManagementReader{
+			"both@p.iam.gserviceaccount.com": {{}},
+			"live@p.iam.gserviceaccount.com": {{}},
+		}
+		shadow = fakeIdentityAccessManagementReader{
+			"both@p.iam.gserviceaccount.com":   {{}},
+			"shadow@p.iam.gserviceaccount.com": {{Expression: "request.host == \"myurl.com\"", Title: "myurl"}},
+		}
+		authenticator = newFakeAuthenticator(t, verifier, live, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	authenticator.SetShadowPolicyReader(shadow)
+
+	var tests = []struct {
+		name       string
+		token      string
+		error      error
+		divergence bool
+	}{
+		{"TestGrantedByBothIsMatch", "both", nil, false},
+		{"TestGrantedByLiveOnlyIsDivergence", "live", nil, true},
+		{"TestGrantedByShadowOnlyIsDivergenceAndDenied", "shadow", ErrNoIdentityAwareProxyRoleForUser, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				matches     = testutil.ToFloat64(shadowDecisionsCounter.WithLabelValues("match"))
+				divergences = testutil.ToFloat64(shadowDecisionsCounter.WithLabelValues("divergence"))
+			)
+			// Response is given by live policy source only.
+			if _, err := authenticator.Authenticate(context.Background(), tt.token, *requestUrl); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			}
+			// Shadow decision is compared in background.
+			for i := 0; i < 100; i++ {
+				if testutil.ToFloat64(shadowDecisionsCounter.WithLabelValues("match")) > matches ||
+					testutil.ToFloat64(shadowDecisionsCounter.WithLabelValues("divergence")) > divergences {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if diverged := testutil.ToFloat64(shadowDecisionsCounter.WithLabelValues("divergence")) > divergences; diverged != tt.divergence {
+				t.Fatalf("Expected divergence %t, divergence %t was recorded.", tt.divergence, diverged)
+			} else if matched := testutil.ToFloat64(shadowDecisionsCounter.WithLabelValues("match")) > matches; matched == tt.divergence {
+				t.Fatalf("Expected match %t, match %t was recorded.", !tt.divergence, matched)
+			}
+		})
+	}
+}
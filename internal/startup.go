@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// StartupDeadline bounds initial load of a client on creation. Failed load is retried up to Retries times with
+// Backoff between attempts, every attempt within Deadline. Zero Deadline is unbounded.
+type StartupDeadline struct {
+	Deadline time.Duration
+	Retries  int
+	Backoff  time.Duration
+}
+
+// ErrStartupDeadlineExceeded is given when initial load does not succeed within deadline or retries.
+var ErrStartupDeadlineExceeded = errors.New("initial load not completed within startup deadline")
+
+// load invokes fn until success, retries are exhausted or deadline is exceeded. Name identifies load in errors.
+func (s StartupDeadline) load(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	if s.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Deadline)
+		defer cancel()
+	}
+	var err error
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			break
+		}
+		log.WithField("error", err).Warningf("Initial load of %s failed, attempt %d of %d.", name, attempt+1, s.Retries+1)
+		if attempt == s.Retries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(s.Backoff):
+		}
+	}
+	return fmt.Errorf("%w: %s within %s: %s", ErrStartupDeadlineExceeded, name, s.Deadline, err)
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStartupDeadline(t *testing.T) {
+	var tests = []struct {
+		name     string
+		delay    time.Duration
+		failures int
+		startup  StartupDeadline
+		err      error
+	}{
+		{"TestLoadWithinDeadline", 10 * time.Millisecond, 0, StartupDeadline{Deadline: time.Second}, nil},
+		{"TestSlowLoadExceedsDeadline", 200 * time.Millisecond, 0, StartupDeadline{Deadline: 50 * time.Millisecond},
+			ErrStartupDeadlineExceeded},
+		{"TestRetriedLoadWithinDeadline", 0, 2, StartupDeadline{Deadline: time.Second, Retries: 2, Backoff: 10 * time.Millisecond}, nil},
+		{"TestRetriesExhausted", 0, 3, StartupDeadline{Deadline: time.Second, Retries: 2, Backoff: 10 * time.Millisecond},
+			ErrStartupDeadlineExceeded},
+		{"TestRetriesExceedDeadline", 0, 3, StartupDeadline{Deadline: 50 * time.Millisecond, Retries: 5, Backoff: time.Second},
+			ErrStartupDeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iamClient, fake := newFakeIdentityAccessManagementClient(t, fakeGoogleWorkspaceClient{})
+			fake.delay, fake.failures = tt.delay, tt.failures
+
+			start := time.Now()
+			err := tt.startup.load(context.Background(), "policy bindings", iamClient.RefreshRoleAndBindingsForIdentityAwareProxy)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.err, err)
+			} else if elapsed := time.Since(start); elapsed > tt.startup.Deadline+100*time.Millisecond {
+				t.Fatalf("Expected load to end within deadline %s, load took %s.", tt.startup.Deadline, elapsed)
+			} else if _, err = iamClient.LoadBindingForGoogleServiceAccount("sa@p.iam.gserviceaccount.com"); tt.err == nil &&
+				errors.Is(err, ErrPolicyBindingsUnavailable) {
+				t.Fatal("Expected policy bindings to be loaded.")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// TLSPolicy is minimum version and cipher suites of ListenAndServeWithTLS. MinVersion is 1.0, 1.1, 1.2 or 1.3, empty is
+// 1.2. CipherSuites are names of secure cipher suites as of crypto/tls, i.e. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+// applied to TLS 1.2 and below. Empty is default cipher suites. Cipher suites of TLS 1.3 are not configurable.
+type TLSPolicy struct {
+	MinVersion   string
+	CipherSuites []string
+}
+
+// ErrInvalidTLSPolicy is given when version or cipher suite of TLSPolicy is unknown, or cipher suite is insecure.
+var ErrInvalidTLSPolicy = errors.New("invalid tls policy")
+
+// tlsVersions are versions of TLSPolicy.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsPolicy is parsed TLSPolicy.
+type tlsPolicy struct {
+	minVersion   uint16
+	cipherSuites []uint16
+}
+
+// defaultTLSPolicy is TLSPolicy given SetTLSPolicy is not invoked.
+var defaultTLSPolicy = tlsPolicy{minVersion: tls.VersionTLS12}
+
+// SetTLSPolicy sets minimum version and cipher suites of ListenAndServeWithTLS. Must be invoked before listener is
+// started.
+func (a *AuthServiceListener) SetTLSPolicy(policy TLSPolicy) error {
+	parsed, err := parseTLSPolicy(policy)
+	if err != nil {
+		return err
+	}
+	a.tlsPolicy = parsed
+	return nil
+}
+
+// parseTLSPolicy parses policy, insecure cipher suites as of crypto/tls are rejected.
+func parseTLSPolicy(policy TLSPolicy) (tlsPolicy, error) {
+	parsed := defaultTLSPolicy
+	if len(policy.MinVersion) > 0 {
+		version, ok := tlsVersions[policy.MinVersion]
+		if !ok {
+			return tlsPolicy{}, fmt.Errorf("%w: unknown version %s", ErrInvalidTLSPolicy, policy.MinVersion)
+		}
+		parsed.minVersion = version
+	}
+	suites := tls.CipherSuites()
+	for _, name := range policy.CipherSuites {
+		i := slices.IndexFunc(suites, func(suite *tls.CipherSuite) bool { return suite.Name == name })
+		if i < 0 {
+			return tlsPolicy{}, fmt.Errorf("%w: unknown or insecure cipher suite %s", ErrInvalidTLSPolicy, name)
+		}
+		parsed.cipherSuites = append(parsed.cipherSuites, suites[i].ID)
+	}
+	return parsed, nil
+}
+
+// tlsConfig returns configuration of TLS of certificate given policy.
+func (p tlsPolicy) tlsConfig(certificate tls.Certificate) *tls.Config {
+	return &tls.Config{
+		MinVersion:   p.minVersion,
+		CipherSuites: p.cipherSuites,
+		NextProtos:   []string{"http/1.1"},
+		Certificates: []tls.Certificate{certificate},
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newFakeCertificate returns PEM encoded key and self-signed certificate of 127.0.0.1.
+func newFakeCertificate(t *testing.T) (key, cert []byte) {
+	t.Helper()
+	pKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Open IAP"}},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &pKey.PublicKey, pKey)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	privBytes, err := x509.MarshalPKCS8PrivateKey(pKey)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestTLSPolicy(t *testing.T) {
+	var (
+		key, cert = newFakeCertificate(t)
+		listener  = newFakeAuthServiceListener(t, nil)
+		ctx, stop = context.WithCancel(context.Background())
+	)
+	t.Cleanup(stop)
+	if err := listener.SetTLSPolicy(TLSPolicy{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	go func() {
+		if err := listener.ListenAndServeWithTLS(ctx, key, cert); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Unexpected error returned, error: %s.", err)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close(context.Background()) })
+	for listener.Port() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var tests = []struct {
+		name         string
+		version      uint16
+		cipherSuites []uint16
+		handshake    bool
+	}{
+		{"TestHandshakeOfTLS10IsRejected", tls.VersionTLS10, nil, false},
+		{"TestHandshakeOfTLS11IsRejected", tls.VersionTLS11, nil, false},
+		{"TestHandshakeOfTLS12", tls.VersionTLS12, nil, true},
+		{"TestHandshakeOfTLS13", tls.VersionTLS13, nil, true},
+		{"TestHandshakeOfAllowedCipherSuite", tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, true},
+		{"TestHandshakeOfOtherCipherSuiteIsRejected", tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", listener.Port()), &tls.Config{
+				InsecureSkipVerify: true,
+				MinVersion:         tt.version,
+				MaxVersion:         tt.version,
+				CipherSuites:       tt.cipherSuites,
+			})
+			if err == nil {
+				_ = conn.Close()
+			}
+			if handshake := err == nil; handshake != tt.handshake {
+				t.Fatalf("Expected handshake %t, handshake %t was given, error: %v.", tt.handshake, handshake, err)
+			}
+		})
+	}
+}
+
+func TestInvalidTLSPolicy(t *testing.T) {
+	listener := newFakeAuthServiceListener(t, nil)
+	for _, policy := range []TLSPolicy{
+		{MinVersion: "1.4"},
+		{CipherSuites: []string{"TLS_UNKNOWN"}},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+	} {
+		if err := listener.SetTLSPolicy(policy); !errors.Is(err, ErrInvalidTLSPolicy) {
+			t.Fatalf("Expected error %v, error returned: %v.", ErrInvalidTLSPolicy, err)
+		}
+	}
+}
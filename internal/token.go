@@ -9,8 +9,13 @@ import (
 	"github.com/anderslauri/open-iap/internal/cache"
 	"github.com/golang-jwt/jwt/v5"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -19,23 +24,86 @@ const (
 	googleConfigurationOpenID = "https://accounts.google.com/.well-known/openid-configuration"
 	googleServiceAccountJwk   = "https://www.googleapis.com/service_accounts/v1/jwk/"
 	googlePublicIssuerIdToken = "https://accounts.google.com"
+	openIDConfigurationPath   = "/.well-known/openid-configuration"
+	// unknownKidRefreshInterval is minimum interval between refreshes of JWK of an issuer given unknown kid.
+	unknownKidRefreshInterval = time.Minute
+	// unknownKidRefreshTimeout bounds coalesced refresh of JWK given unknown kid, not bound by context of any token.
+	unknownKidRefreshTimeout = 10 * time.Second
+	// defaultJwkTTL is lifetime of cached JWK of an issuer given no max-age of Cache-Control of upstream.
+	defaultJwkTTL = 24 * time.Hour
 )
 
 // GoogleTokenService is a backend representation to manage authn/authz of Google Tokens.
 type GoogleTokenService struct {
-	jwkClient http.Client
-	leeway    time.Duration
-	jwkCache  cache.Cache[string, cache.ExpiryCacheValue[keyfunc.Keyfunc]]
+	jwkClient      http.Client
+	leeway         time.Duration
+	claimLeeway    ClaimLeeway
+	principalClaim string
+	jwkCache       cache.Cache[string, cache.ExpiryCacheValue[keyfunc.Keyfunc]]
 	// publicKey is issuer accounts.google.com, only self-signed in cache.
 	publicKey atomic.Pointer[keyfunc.Keyfunc]
+	// openIDConfigurationURL and serviceAccountJwkURL are sources of JWK, Google unless given for tests.
+	openIDConfigurationURL, serviceAccountJwkURL string
+	assurance                                    AuthenticationAssurance
+	limiter                                      *APILimiter
+	// federated is trusted issuers of workforce or workload identity pools by issuer.
+	federated map[string]FederatedIssuer
+	// health is outcome of latest refresh of public certificates.
+	health healthState
+	// audienceRules are audience verification by issuer, others are verified given derived audience of request url.
+	audienceRules map[string]AudienceRule
+	// kidRefreshes is latest refresh of JWK by issuer given unknown kid, guarded by kidMu.
+	kidMu              sync.Mutex
+	kidRefreshes       map[string]time.Time
+	kidRefreshInterval time.Duration
+	// kidFlights coalesces concurrent refreshes of JWK by issuer given unknown kid, unless kidUncoalesced.
+	kidFlights     singleflight.Group
+	kidUncoalesced bool
+	// jwkMaxAge bounds age of cached JWK regardless of Cache-Control of upstream. Zero is unbounded.
+	jwkMaxAge time.Duration
+	// publicLoaded is time of latest load of public certificates in unix nanoseconds, publicRefreshing is held by the
+	// single request refreshing public certificates given jwkMaxAge.
+	publicLoaded     atomic.Int64
+	publicRefreshing atomic.Bool
+}
+
+// AudienceRule is audience verification of an issuer. Claim aud must hold any of Audiences, i.e. a client id of a
+// custom issuer, rather than derived audience of request url.
+type AudienceRule struct {
+	Audiences []string
+}
+
+// ClaimLeeway is leeway of claims exp, nbf and iat. Zero is leeway of GoogleTokenService.
+type ClaimLeeway struct {
+	Exp, Nbf, Iat time.Duration
+}
+
+// AuthenticationAssurance is minimum authentication assurance required of tokens. Given Acr, claim acr must be any
+// of Acr. Given Amr, claim amr must hold every entry of Amr, i.e. mfa. Claims are only trusted of federated issuers,
+// tokens of other issuers never satisfy a required assurance.
+type AuthenticationAssurance struct {
+	Acr []string
+	Amr []string
 }
 
 // GoogleTokenClaims extends standard JWT claims with claim email.
 type GoogleTokenClaims struct {
 	Email string `json:"email"`
+	// Principal is value of configured principal claim, used as identity for role bindings.
+	Principal string `json:"-"`
+	// Acr and Amr are authentication context class and methods, verified given AuthenticationAssurance.
+	Acr string   `json:"acr,omitempty"`
+	Amr []string `json:"amr,omitempty"`
 	jwt.RegisteredClaims
 }
 
+const (
+	// PrincipalClaimEmail uses claim email as principal, default.
+	PrincipalClaimEmail = "email"
+	// PrincipalClaimSubject uses claim sub as principal.
+	PrincipalClaimSubject = "sub"
+)
+
 // TokenVerifier is a generic interface as implemented by Google Token.
 type TokenVerifier[V any] interface {
 	Verify(ctx context.Context, tokenString, aud string, token V) error
@@ -46,14 +114,42 @@ var (
 	ErrUnknownTokenType = errors.New("unknown token type")
 	// ErrMissingJWK is given when no JWK can be found in cache or retrieved.
 	ErrMissingJWK = errors.New("missing jwk")
+	// ErrInsufficientAssurance is given when claims acr or amr don't satisfy AuthenticationAssurance.
+	ErrInsufficientAssurance = errors.New("insufficient authentication assurance")
+	// ErrMissingIdentity is given when principal claim of a verified token is absent or empty.
+	ErrMissingIdentity = errors.New("missing identity")
+	// ErrInvalidAudience is given when claim aud, target_audience for service account minted id-token, is not backend.
+	ErrInvalidAudience = errors.New("invalid audience")
+	// ErrUnknownKid is given when kid of token is not in JWK of issuer after refresh, i.e. key is withdrawn. Given
+	// rate-limited or failed refresh, kid was not refreshed.
+	ErrUnknownKid = errors.New("unknown kid")
 )
 
-// NewGoogleTokenService creates a new token service for Google Tokens.
+// NewGoogleTokenService creates a new token service for Google Tokens. Principal claim is either email, sub or
+// name of a custom claim, of which value is used as identity of tokens of accounts.google.com. Self-signed tokens are
+// identified by issuer, tokens of federated issuers by subject. Requests of JWK are bounded by limiter, nil is unbounded.
 func NewGoogleTokenService(ctx context.Context,
-	jwkCache cache.Cache[string, cache.ExpiryCacheValue[keyfunc.Keyfunc]], refreshPublicCertsInterval, leeway time.Duration) (*GoogleTokenService, error) {
+	jwkCache cache.Cache[string, cache.ExpiryCacheValue[keyfunc.Keyfunc]], refreshPublicCertsInterval, leeway time.Duration, principalClaim string, limiter *APILimiter) (*GoogleTokenService, error) {
+	return newGoogleTokenService(ctx, jwkCache, refreshPublicCertsInterval, leeway, principalClaim,
+		googleConfigurationOpenID, googleServiceAccountJwk, limiter)
+}
+
+func newGoogleTokenService(ctx context.Context,
+	jwkCache cache.Cache[string, cache.ExpiryCacheValue[keyfunc.Keyfunc]], refreshPublicCertsInterval, leeway time.Duration,
+	principalClaim, openIDConfigurationURL, serviceAccountJwkURL string, limiter *APILimiter) (*GoogleTokenService, error) {
+	if len(principalClaim) == 0 {
+		principalClaim = PrincipalClaimEmail
+	}
 	googleTokenService := &GoogleTokenService{
-		jwkCache: jwkCache,
-		leeway:   leeway,
+		jwkCache:               jwkCache,
+		leeway:                 leeway,
+		claimLeeway:            ClaimLeeway{leeway, leeway, leeway},
+		principalClaim:         principalClaim,
+		openIDConfigurationURL: openIDConfigurationURL,
+		serviceAccountJwkURL:   serviceAccountJwkURL,
+		limiter:                limiter,
+		kidRefreshes:           make(map[string]time.Time),
+		kidRefreshInterval:     unknownKidRefreshInterval,
 	}
 	// Load initial public certificates before starting.
 	if err := googleTokenService.googleCertsRefresher(ctx, refreshPublicCertsInterval); err != nil {
@@ -62,51 +158,171 @@ func NewGoogleTokenService(ctx context.Context,
 	return googleTokenService, nil
 }
 
-// readGoogleCerts is used when requesting JWK from Google Cloud.
-func (t *GoogleTokenService) readGoogleCerts(ctx context.Context, url string, writer io.Writer) error {
+// SetFederatedIssuers trusts tokens of issuers, i.e. external identity providers of workforce or workload identity pools.
+// JWK is discovered given OpenID configuration of issuer. Must be invoked before Verify is used.
+func (t *GoogleTokenService) SetFederatedIssuers(issuers []FederatedIssuer) {
+	t.federated = make(map[string]FederatedIssuer, len(issuers))
+	for _, issuer := range issuers {
+		t.federated[issuer.Issuer] = issuer
+	}
+}
+
+// SetUnknownKidRefreshInterval sets minimum interval between refreshes of JWK of an issuer given unknown kid, tokens of
+// unknown kid are denied with ErrUnknownKid within interval. Zero refreshes for every token of unknown kid. Must be
+// invoked before Verify is used.
+func (t *GoogleTokenService) SetUnknownKidRefreshInterval(interval time.Duration) {
+	t.kidRefreshInterval = interval
+}
+
+// SetUnknownKidCoalescing coalesces concurrent refreshes of JWK of an issuer given unknown kid, such that a single
+// request is made of which outcome is shared by every waiting token. Not coalesced, concurrent tokens of unknown kid are
+// denied given refresh in flight, without waiting. Enabled by default. Must be invoked before Verify is used.
+func (t *GoogleTokenService) SetUnknownKidCoalescing(enabled bool) {
+	t.kidUncoalesced = !enabled
+}
+
+// SetJwkMaxAge bounds age of cached JWK, such that JWK is refreshed at maxAge even when max-age of Cache-Control of
+// upstream is longer. Public certificates are refreshed at refresh interval or maxAge, whichever is first. Zero is
+// unbounded. Must be invoked before Verify is used.
+func (t *GoogleTokenService) SetJwkMaxAge(maxAge time.Duration) {
+	t.jwkMaxAge = maxAge
+}
+
+// jwkTTL returns lifetime of cached JWK given max-age of upstream, zero is defaultJwkTTL. Bounded by jwkMaxAge.
+func (t *GoogleTokenService) jwkTTL(maxAge time.Duration) time.Duration {
+	if maxAge <= 0 {
+		maxAge = defaultJwkTTL
+	}
+	if t.jwkMaxAge > 0 && maxAge > t.jwkMaxAge {
+		return t.jwkMaxAge
+	}
+	return maxAge
+}
+
+// cacheControlMaxAge returns max-age of Cache-Control header, zero given none.
+func cacheControlMaxAge(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		val, ok := strings.CutPrefix(strings.TrimSpace(directive), "max-age=")
+		if !ok {
+			continue
+		}
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// SetClaimLeeway sets leeway per claim, i.e. a larger leeway of nbf than of exp. Zero retains leeway of claim. Must be
+// invoked before Verify is used.
+func (t *GoogleTokenService) SetClaimLeeway(leeway ClaimLeeway) {
+	if leeway.Exp > 0 {
+		t.claimLeeway.Exp = leeway.Exp
+	}
+	if leeway.Nbf > 0 {
+		t.claimLeeway.Nbf = leeway.Nbf
+	}
+	if leeway.Iat > 0 {
+		t.claimLeeway.Iat = leeway.Iat
+	}
+}
+
+// verifyClaimLeeway verifies exp, nbf and iat given leeway of each claim. Claims are already verified given largest
+// leeway.
+func (t *GoogleTokenService) verifyClaimLeeway(claims *GoogleTokenClaims) error {
+	now := time.Now()
+	if claims.ExpiresAt != nil && now.After(claims.ExpiresAt.Add(t.claimLeeway.Exp)) {
+		return fmt.Errorf("%w: exp exceeded by %s", jwt.ErrTokenExpired, now.Sub(claims.ExpiresAt.Time))
+	} else if claims.NotBefore != nil && now.Before(claims.NotBefore.Add(-t.claimLeeway.Nbf)) {
+		return fmt.Errorf("%w: nbf in %s", jwt.ErrTokenNotValidYet, claims.NotBefore.Sub(now))
+	} else if claims.IssuedAt != nil && now.Before(claims.IssuedAt.Add(-t.claimLeeway.Iat)) {
+		return fmt.Errorf("%w: iat in %s", jwt.ErrTokenUsedBeforeIssued, claims.IssuedAt.Sub(now))
+	}
+	return nil
+}
+
+// SetAudienceRules verifies audience of tokens of issuer given rule, i.e. a fixed client id of a custom issuer. Issuers
+// without rule, i.e. accounts.google.com, are verified given derived audience of request url. Rule takes precedence over
+// audience of FederatedIssuer. Must be invoked before Verify is used.
+func (t *GoogleTokenService) SetAudienceRules(rules map[string]AudienceRule) {
+	t.audienceRules = rules
+}
+
+// SetAuthenticationAssurance requires minimum authentication assurance of tokens, only satisfied by tokens of
+// federated issuers. Self-signed tokens carry claims chosen by service account, id-tokens of accounts.google.com carry
+// neither acr nor amr. Must be invoked before Verify is used.
+func (t *GoogleTokenService) SetAuthenticationAssurance(assurance AuthenticationAssurance) {
+	t.assurance = assurance
+}
+
+// verifyAssurance verifies if claims satisfy required authentication assurance, given claims of a trusted issuer.
+func (t *GoogleTokenService) verifyAssurance(claims *GoogleTokenClaims, trusted bool) error {
+	if len(t.assurance.Acr) == 0 && len(t.assurance.Amr) == 0 {
+		return nil
+	} else if !trusted {
+		return fmt.Errorf("%w: acr and amr of issuer %s are not trusted", ErrInsufficientAssurance, claims.Issuer)
+	}
+	if len(t.assurance.Acr) > 0 && !slices.Contains(t.assurance.Acr, claims.Acr) {
+		return fmt.Errorf("%w: acr %q is not any of %v", ErrInsufficientAssurance, claims.Acr, t.assurance.Acr)
+	}
+	for _, amr := range t.assurance.Amr {
+		if !slices.Contains(claims.Amr, amr) {
+			return fmt.Errorf("%w: amr %v is missing %s", ErrInsufficientAssurance, claims.Amr, amr)
+		}
+	}
+	return nil
+}
+
+// readGoogleCerts is used when requesting JWK from Google Cloud. Max-age of Cache-Control of JWK is returned, zero
+// given none.
+func (t *GoogleTokenService) readGoogleCerts(ctx context.Context, url string, writer io.Writer) (time.Duration, error) {
 	jwkReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return err
+		return 0, err
+	} else if err = t.limiter.Acquire(ctx); err != nil {
+		return 0, err
 	}
+	defer t.limiter.Release()
+
 	rsp, err := t.jwkClient.Do(jwkReq)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer rsp.Body.Close()
-	// Self-signed Google Service Account JWK. For public endpoint,
+	// Self-signed Google Service Account JWK. For public endpoint and federated issuers,
 	// we need to first identify url - value part of key "jwks_uri".
-	if url != googleConfigurationOpenID {
+	if !strings.HasSuffix(url, openIDConfigurationPath) {
 		if _, err = io.Copy(writer, rsp.Body); err != nil {
-			return err
+			return 0, err
 		}
-		return nil
+		return cacheControlMaxAge(rsp.Header), nil
 	}
 	buf := getBuffer()
 	defer putBuffer(buf)
 
 	oidConfig := make(map[string]any)
 	if _, err = io.Copy(buf, rsp.Body); err != nil {
-		return err
+		return 0, err
 	} else if err = json.Unmarshal(buf.Bytes(), &oidConfig); err != nil {
-		return fmt.Errorf("%w: open-id discovery document unmarshal json failed", err)
+		return 0, fmt.Errorf("%w: open-id discovery document unmarshal json failed", err)
 	} else if val, ok := oidConfig["jwks_uri"]; !ok {
-		return fmt.Errorf("%w: jwks_uri in openid discovery not found", ErrMissingJWK)
+		return 0, fmt.Errorf("%w: jwks_uri in openid discovery not found", ErrMissingJWK)
 	} else if reqUrl, ok := val.(string); !ok {
-		return fmt.Errorf("%w: jwks_uri in openid discovery is not of type string", ErrMissingJWK)
+		return 0, fmt.Errorf("%w: jwks_uri in openid discovery is not of type string", ErrMissingJWK)
 	} else {
 		jwkReq, _ = http.NewRequestWithContext(ctx, "GET", reqUrl, nil)
 
 		jwkRsp, err := t.jwkClient.Do(jwkReq)
 		if err != nil {
-			return ErrMissingJWK
+			return 0, ErrMissingJWK
 		}
 		defer jwkRsp.Body.Close()
 
 		if _, err = io.Copy(writer, jwkRsp.Body); err == nil {
-			return nil
+			return cacheControlMaxAge(jwkRsp.Header), nil
 		}
 	}
-	return ErrMissingJWK
+	return 0, ErrMissingJWK
 }
 
 // googleCertsRefresher starts a background routine to fetch JWK every 10 minutes,
@@ -116,7 +332,7 @@ func (t *GoogleTokenService) googleCertsRefresher(ctx context.Context, interval
 	buffer := getBuffer()
 	defer putBuffer(buffer)
 
-	if err := t.readGoogleCerts(ctx, googleConfigurationOpenID, buffer); err != nil {
+	if _, err := t.readGoogleCerts(ctx, t.openIDConfigurationURL, buffer); err != nil {
 		return err
 	}
 
@@ -126,6 +342,8 @@ func (t *GoogleTokenService) googleCertsRefresher(ctx context.Context, interval
 	}
 	log.Info("Public certificates successfully loaded. Persisting in cache.")
 	t.publicKey.Store(&keySet)
+	t.publicLoaded.Store(time.Now().UnixNano())
+	t.health.observe(nil)
 	// Listener to ensure public certificates are kept fresh.
 	go func() {
 		log.Infof("Background routine started, ensuring fresh certificates. Interval is %s.", interval.String())
@@ -137,63 +355,237 @@ func (t *GoogleTokenService) googleCertsRefresher(ctx context.Context, interval
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				buffer = getBuffer()
-				if err := t.readGoogleCerts(ctx, googleConfigurationOpenID, buffer); err == nil {
-					if keySet, err := keyfunc.NewJWKSetJSON(buffer.Bytes()); err == nil {
-						t.publicKey.Store(&keySet)
-					}
+				if err := t.refreshPublicCerts(ctx); err != nil {
+					log.WithField("error", err).Error("Could not refresh public certificates.")
 				}
-				putBuffer(buffer)
 			}
 		}
 	}()
 	return nil
 }
 
+// refreshPublicCerts reads public certificates, previous certificates are retained given failure.
+func (t *GoogleTokenService) refreshPublicCerts(ctx context.Context) (err error) {
+	defer func() { t.health.observe(err) }()
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+
+	if _, err = t.readGoogleCerts(ctx, t.openIDConfigurationURL, buffer); err != nil {
+		return err
+	}
+	keySet, err := keyfunc.NewJWKSetJSON(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	t.publicKey.Store(&keySet)
+	t.publicLoaded.Store(time.Now().UnixNano())
+	return nil
+}
+
+// publicKeySet returns public certificates, refreshed given age exceeds jwkMaxAge. A single request refreshes, other
+// requests are given current certificates, which are retained given failure.
+func (t *GoogleTokenService) publicKeySet(ctx context.Context) keyfunc.Keyfunc {
+	if t.jwkMaxAge > 0 && time.Since(time.Unix(0, t.publicLoaded.Load())) >= t.jwkMaxAge &&
+		t.publicRefreshing.CompareAndSwap(false, true) {
+		defer t.publicRefreshing.Store(false)
+		log.Infof("Public certificates exceed max age of %s. Refreshing.", t.jwkMaxAge)
+		if err := t.refreshPublicCerts(ctx); err != nil {
+			log.WithField("error", err).Error("Could not refresh public certificates given max age.")
+		}
+	}
+	return *t.publicKey.Load()
+}
+
+// Health returns health of refresh of public certificates.
+func (t *GoogleTokenService) Health() ComponentHealth {
+	return t.health.health("jwks")
+}
+
+// WarmJwkCache synchronously loads JWK of issuers into cache, i.e. self-signing service accounts or federated issuers,
+// such that first request of issuer is not delayed. Invoke before listener is started, readiness is not given until
+// done or timeout is exceeded.
+func (t *GoogleTokenService) WarmJwkCache(ctx context.Context, issuers []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, issuer := range issuers {
+		if issuer == googlePublicIssuerIdToken {
+			continue
+		}
+		keySet, maxAge, err := t.readJwk(ctx, issuer)
+		if err != nil {
+			return fmt.Errorf("%w: issuer %s", err, issuer)
+		}
+		t.setJwk(issuer, keySet, maxAge)
+	}
+	log.Infof("JWK of %d issuers successfully loaded. Persisted in cache.", len(issuers))
+	return nil
+}
+
 // keyFunc retrieves JWK from Google API or local cache. Mostly cache.
 func (t *GoogleTokenService) keyFunc(ctx context.Context, issuer string) (keyfunc.Keyfunc, error) {
 	if issuer == googlePublicIssuerIdToken {
-		return *t.publicKey.Load(), nil
+		return t.publicKeySet(ctx), nil
+	}
+	// Only for self-signed tokens and federated issuers.
+	if keySet, ok := t.jwkCache.Get(issuer); ok && keySet.Exp > time.Now().Unix() {
+		return keySet.Val, nil
+	}
+	keySet, maxAge, err := t.readJwk(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	writeCache(func() { t.setJwk(issuer, keySet, maxAge) })
+	return keySet, nil
+}
+
+// refreshUnknownKid refreshes JWK of issuer given kid is not in keySet, i.e. given rotation of keys before refresh of
+// public certificates. Concurrent refreshes of an issuer are coalesced, keySet is returned given limited or failed
+// refresh. Refresh is refreshed, limited or failed, empty given kid is known.
+func (t *GoogleTokenService) refreshUnknownKid(ctx context.Context, issuer, kid string, keySet keyfunc.Keyfunc) (keyfunc.Keyfunc, string) {
+	if _, err := keySet.Storage().KeyRead(ctx, kid); err == nil {
+		return keySet, ""
+	} else if t.kidUncoalesced {
+		return t.refreshJwk(ctx, issuer, kid, keySet)
+	}
+	// Refresh is shared by waiters, never cancelled given cancellation of first token.
+	flight := t.kidFlights.DoChan(issuer, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), unknownKidRefreshTimeout)
+		defer cancel()
+		refreshed, refresh := t.refreshJwk(ctx, issuer, kid, keySet)
+		return kidRefresh{refreshed, refresh}, nil
+	})
+	select {
+	case <-ctx.Done():
+		return keySet, "failed"
+	case result := <-flight:
+		refresh := result.Val.(kidRefresh)
+		return refresh.keySet, refresh.refresh
+	}
+}
+
+// kidRefresh is outcome of refreshJwk shared by coalesced waiters.
+type kidRefresh struct {
+	keySet  keyfunc.Keyfunc
+	refresh string
+}
+
+// refreshJwk refreshes JWK of issuer given unknown kid, rate-limited per issuer by kidRefreshInterval.
+func (t *GoogleTokenService) refreshJwk(ctx context.Context, issuer, kid string, keySet keyfunc.Keyfunc) (keyfunc.Keyfunc, string) {
+	t.kidMu.Lock()
+	if latest, ok := t.kidRefreshes[issuer]; ok && time.Since(latest) < t.kidRefreshInterval {
+		t.kidMu.Unlock()
+		return keySet, "limited"
+	}
+	t.kidRefreshes[issuer] = time.Now()
+	t.kidMu.Unlock()
+
+	log.Infof("Kid %s is unknown for issuer %s. Refreshing JWK.", kid, issuer)
+	if issuer == googlePublicIssuerIdToken {
+		if err := t.refreshPublicCerts(ctx); err != nil {
+			log.WithField("error", err).Warning("Could not refresh public certificates given unknown kid.")
+			return keySet, "failed"
+		}
+		return *t.publicKey.Load(), "refreshed"
+	}
+	refreshed, maxAge, err := t.readJwk(ctx, issuer)
+	if err != nil {
+		log.WithField("error", err).Warningf("Could not refresh JWK of issuer %s given unknown kid.", issuer)
+		return keySet, "failed"
 	}
+	t.setJwk(issuer, refreshed, maxAge)
+	return refreshed, "refreshed"
+}
+
+// readJwk reads JWK of self-signing service account or federated issuer, max-age of upstream is returned.
+func (t *GoogleTokenService) readJwk(ctx context.Context, issuer string) (keyfunc.Keyfunc, time.Duration, error) {
 	buf := getBuffer()
 	defer putBuffer(buf)
 
-	// Only for self-signed tokens.
-	keySet, ok := t.jwkCache.Get(issuer)
-	if ok {
-		return keySet.Val, nil
-	} else if err := t.readGoogleCerts(ctx, fmt.Sprintf("%s%s", googleServiceAccountJwk, issuer), buf); err != nil {
-		return nil, ErrMissingJWK
-	} else if keySet.Val, err = keyfunc.NewJWKSetJSON(buf.Bytes()); err != nil {
-		return nil, ErrMissingJWK
+	jwkURL := fmt.Sprintf("%s%s", t.serviceAccountJwkURL, issuer)
+	if _, ok := t.federated[issuer]; ok {
+		jwkURL = strings.TrimSuffix(issuer, "/") + openIDConfigurationPath
+	}
+	maxAge, err := t.readGoogleCerts(ctx, jwkURL, buf)
+	if err != nil {
+		return nil, 0, ErrMissingJWK
 	}
-	go t.jwkCache.Set(issuer,
+	keySet, err := keyfunc.NewJWKSetJSON(buf.Bytes())
+	if err != nil {
+		return nil, 0, ErrMissingJWK
+	}
+	return keySet, maxAge, nil
+}
+
+// setJwk caches JWK of issuer given max-age of upstream, bounded by jwkMaxAge.
+func (t *GoogleTokenService) setJwk(issuer string, keySet keyfunc.Keyfunc, maxAge time.Duration) {
+	t.jwkCache.Set(issuer,
 		cache.ExpiryCacheValue[keyfunc.Keyfunc]{
-			Val: keySet.Val,
-			Exp: time.Now().Add(24 * time.Hour).Unix(),
+			Val: keySet,
+			Exp: time.Now().Add(t.jwkTTL(maxAge)).Unix(),
 		})
-	return keySet.Val, nil
 }
 
 // Verify transform base64 encoded token string into a Token representation while verifying claims and audience.
-func (t *GoogleTokenService) Verify(ctx context.Context, tokenString, aud string, tokenClaims *GoogleTokenClaims) error {
+func (t *GoogleTokenService) Verify(ctx context.Context, tokenString, aud string, tokenClaims *GoogleTokenClaims) (err error) {
+	issuerLabel, algLabel := labelUnknown, labelUnknown
+	defer func() {
+		observeTokenVerification(issuerLabel, algLabel, err)
+		if errors.Is(err, jwt.ErrTokenUsedBeforeIssued) {
+			// Likely clock skew of issuer beyond leeway of iat, or tampering.
+			futureIssuedTokensCounter.WithLabelValues(issuerLabel).Inc()
+			log.WithField("error", err).Warningf("Token of issuer %s denied given iat in future.", issuerLabel)
+		}
+	}()
+
 	// FIXME: Identify issuer. Required for JWK as part of keyFunc for second pass. Optimize away.
 	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, tokenClaims)
 	if err != nil {
 		return err
 	}
 	issuer, _ := token.Claims.GetIssuer()
+	issuerLabel, algLabel = issuerMetricLabel(issuer), token.Method.Alg()
+	federated, isFederated := t.federated[issuer]
 	if len(issuer) == 0 {
 		return fmt.Errorf("%w: issuer claim missing", ErrUnknownTokenType)
+	} else if isFederated {
+		// Federated issuers are bounded by configuration.
+		issuerLabel = issuer
+		if len(federated.Audience) > 0 {
+			aud = federated.Audience
+		}
 	}
 	// Retrieve jwk keys to verify integrity.
 	keySet, err := t.keyFunc(ctx, issuer)
 	if err != nil {
 		return fmt.Errorf("%w: found no jwk to verify integrity of token", err)
+	} else if kid, ok := token.Header["kid"].(string); ok {
+		var refresh string
+		if keySet, refresh = t.refreshUnknownKid(ctx, issuer, kid, keySet); len(refresh) > 0 {
+			if _, err = keySet.Storage().KeyRead(ctx, kid); err != nil {
+				// Token of withdrawn key is never verified given a former key set.
+				unknownKidsCounter.WithLabelValues(issuerLabel, refresh).Inc()
+				return fmt.Errorf("%w: kid %s of issuer %s given refresh %s", ErrUnknownKid, kid, issuer, refresh)
+			}
+		}
 	}
-	token, err = jwt.ParseWithClaims(tokenString, tokenClaims, keySet.Keyfunc, jwt.WithLeeway(t.leeway),
-		jwt.WithAudience(aud), jwt.WithExpirationRequired(), jwt.WithIssuedAt())
-	if err != nil {
+	options := []jwt.ParserOption{jwt.WithLeeway(max(t.claimLeeway.Exp, t.claimLeeway.Nbf, t.claimLeeway.Iat)),
+		jwt.WithExpirationRequired(), jwt.WithIssuedAt()}
+	rule, hasRule := t.audienceRules[issuer]
+	if hasRule = hasRule && len(rule.Audiences) > 0; !hasRule {
+		options = append(options, jwt.WithAudience(aud))
+	}
+	token, err = jwt.ParseWithClaims(tokenString, tokenClaims, keySet.Keyfunc, options...)
+	if err == nil && hasRule && !slices.ContainsFunc(tokenClaims.Audience, func(aud string) bool {
+		return slices.Contains(rule.Audiences, aud)
+	}) {
+		return fmt.Errorf("%w: token audience %v is not any of %v", ErrInvalidAudience, tokenClaims.Audience, rule.Audiences)
+	} else if errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		// Service account minted id-tokens carry target_audience as claim aud.
+		return fmt.Errorf("%w: token audience %v is not equal to %s", ErrInvalidAudience, tokenClaims.Audience, aud)
+	} else if err != nil {
+		return err
+	} else if err = t.verifyClaimLeeway(tokenClaims); err != nil {
 		return err
 	}
 
@@ -202,18 +594,66 @@ func (t *GoogleTokenService) Verify(ctx context.Context, tokenString, aud string
 	case !ok || !token.Valid:
 		return ErrUnknownTokenType
 	case issuer == googlePublicIssuerIdToken:
-		if len(googleToken.Email) > 0 {
-			return nil
+	case isFederated:
+		if len(googleToken.Subject) == 0 {
+			return fmt.Errorf("%w: subject claim missing for federated token", ErrUnknownTokenType)
 		}
-		return fmt.Errorf("%w: missing email claim in public id-token", ErrUnknownTokenType)
 	case issuer != googleToken.Subject:
 		return fmt.Errorf("%w: token issuer not equal subject for self-signed token", ErrUnknownTokenType)
 		// https://cloud.google.com/iam/docs/create-short-lived-credentials-direct#create-jwt
 		// The exp (expiration time) claim must be no more than 12 hours in the future
 	case (googleToken.ExpiresAt.Unix() - googleToken.IssuedAt.Unix()) > 43200:
 		return fmt.Errorf("%w: exp must be no more than 12 hours in the future from iat", ErrUnknownTokenType)
+	default:
+		// Use Email as claim for upstream caller, as they don't care which type of token this is.
+		googleToken.Email = googleToken.Issuer
+	}
+	if err = t.verifyAssurance(googleToken, isFederated); err != nil {
+		return err
+	} else if isFederated {
+		googleToken.Principal = federated.principal(googleToken.Subject)
+		return nil
+	} else if issuer != googlePublicIssuerIdToken {
+		// Claims of self-signed tokens are chosen by service account, identity is always issuer.
+		googleToken.Principal = googleToken.Issuer
+		return nil
+	} else if googleToken.Principal, err = t.principal(tokenString, googleToken); err != nil {
+		return err
 	}
-	// Use Email as claim for upstream caller, as they don't care which type of token this is.
-	googleToken.Email = googleToken.Issuer
 	return nil
 }
+
+// issuerMetricLabel returns issuer as metric label. Self-signed tokens are labeled self-signed, bounding cardinality
+// of label given issuer is email of service account.
+func issuerMetricLabel(issuer string) string {
+	switch {
+	case len(issuer) == 0:
+		return labelUnknown
+	case issuer == googlePublicIssuerIdToken:
+		return issuer
+	}
+	return labelSelfSigned
+}
+
+// principal returns value of configured principal claim, used as identity of token of accounts.google.com.
+func (t *GoogleTokenService) principal(tokenString string, claims *GoogleTokenClaims) (string, error) {
+	var principal string
+
+	switch t.principalClaim {
+	case PrincipalClaimEmail:
+		principal = claims.Email
+	case PrincipalClaimSubject:
+		principal = claims.Subject
+	default:
+		// Token is already verified, custom claims are read from second pass.
+		customClaims := jwt.MapClaims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, customClaims); err != nil {
+			return "", err
+		}
+		principal, _ = customClaims[t.principalClaim].(string)
+	}
+	if len(principal) == 0 {
+		return "", fmt.Errorf("%w: principal claim %s is absent or empty", ErrMissingIdentity, t.principalClaim)
+	}
+	return principal, nil
+}
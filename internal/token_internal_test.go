@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// unsignedToken returns a token string with given claims, signature is not relevant for principal extraction.
+func unsignedToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	return tokenString
+}
+
+// unverifiedTokenVerifier parse claims without signature verification and extract principal as GoogleTokenService.
+type unverifiedTokenVerifier struct {
+	tokenService *GoogleTokenService
+}
+
+func (u unverifiedTokenVerifier) Verify(_ context.Context, tokenString, _ string, claims *GoogleTokenClaims) error {
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims); err != nil {
+		return err
+	}
+	principal, err := u.tokenService.principal(tokenString, claims)
+	claims.Principal = principal
+	return err
+}
+
+func TestPrincipalClaim(t *testing.T) {
+	var (
+		issuer     = newFakeOpenIDIssuer(t)
+		email      = "sa@p.iam.gserviceaccount.com"
+		idToken    = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email, "sub": "1234567890", "uid": "custom-id"})
+		selfSigned = issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "iss": email, "sub": email,
+			"email": "admin@example.com", "uid": "admin@example.com"})
+	)
+	var tests = []struct {
+		name      string
+		token     string
+		claim     string
+		principal string
+		error     error
+	}{
+		{"TestEmailPrincipalClaim", idToken, PrincipalClaimEmail, email, nil},
+		{"TestSubjectPrincipalClaim", idToken, PrincipalClaimSubject, "1234567890", nil},
+		{"TestCustomPrincipalClaim", idToken, "uid", "custom-id", nil},
+		{"TestMissingCustomPrincipalClaim", idToken, "missing", "", ErrMissingIdentity},
+		{"TestSelfSignedSpoofedEmailIsIssuer", selfSigned, PrincipalClaimEmail, email, nil},
+		{"TestSelfSignedSpoofedCustomClaimIsIssuer", selfSigned, "uid", email, nil},
+		{"TestSelfSignedMissingCustomClaimIsIssuer", selfSigned, "missing", email, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &GoogleTokenClaims{}
+			err := issuer.newTokenService(t, tt.claim).Verify(context.Background(), tt.token, "https://myurl.com", claims)
+			if !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			} else if err == nil && claims.Principal != tt.principal {
+				t.Fatalf("Expected principal %s, principal %s was returned.", tt.principal, claims.Principal)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithSubjectPrincipal(t *testing.T) {
+	var (
+		verifier      = unverifiedTokenVerifier{&GoogleTokenService{principalClaim: PrincipalClaimSubject}}
+		bindings      = fakeIdentityAccessManagementReader{"1234567890": {{}}}
+		authenticator = newFakeAuthenticator(t, verifier, bindings, EmailDomainFilter{})
+		requestUrl, _ = url.Parse("https://myurl.com/hello")
+	)
+	var tests = []struct {
+		name  string
+		sub   string
+		error error
+	}{
+		{"TestSubjectWithMatchingBinding", "1234567890", nil},
+		{"TestSubjectWithoutBinding", "0987654321", ErrNoIdentityAwareProxyRoleForUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenString := unsignedToken(t, jwt.MapClaims{
+				"sub": tt.sub,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			})
+			if _, err := authenticator.Authenticate(context.Background(), tokenString, *requestUrl); !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %v, error returned: %v.", tt.error, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticationAssurance(t *testing.T) {
+	var (
+		issuer, federated = newFakeOpenIDIssuer(t), newFakeOpenIDIssuer(t)
+		tokenService      = issuer.newTokenService(t, PrincipalClaimEmail)
+		email             = "sa@p.iam.gserviceaccount.com"
+		mint              = func(claims jwt.MapClaims) string {
+			claims["aud"], claims["iss"], claims["sub"] = "https://myurl.com", federated.server.URL, "alice"
+			return federated.mint(t, claims)
+		}
+		satisfying = jwt.MapClaims{"acr": "urn:example:loa:2", "amr": []string{"pwd", "mfa"}}
+	)
+	tokenService.SetFederatedIssuers([]FederatedIssuer{{Issuer: federated.server.URL, Pool: "locations/global/workforcePools/corp"}})
+	tokenService.SetAuthenticationAssurance(AuthenticationAssurance{
+		Acr: []string{"urn:example:loa:2", "urn:example:loa:3"},
+		Amr: []string{"mfa"},
+	})
+	var tests = []struct {
+		name          string
+		token         string
+		expectedError error
+	}{
+		{"TestSatisfyingAcrAndAmr", mint(jwt.MapClaims{"acr": satisfying["acr"], "amr": satisfying["amr"]}), nil},
+		{"TestOtherAcr", mint(jwt.MapClaims{"acr": "urn:example:loa:1", "amr": []string{"mfa"}}), ErrInsufficientAssurance},
+		{"TestMissingAmrEntry", mint(jwt.MapClaims{"acr": "urn:example:loa:3", "amr": []string{"pwd"}}), ErrInsufficientAssurance},
+		{"TestMissingAcrAndAmr", mint(jwt.MapClaims{}), ErrInsufficientAssurance},
+		{"TestSelfSignedAcrAndAmrAreNotTrusted", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "iss": email,
+			"sub": email, "acr": satisfying["acr"], "amr": satisfying["amr"]}), ErrInsufficientAssurance},
+		{"TestIdTokenAcrAndAmrAreNotTrusted", issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email,
+			"acr": satisfying["acr"], "amr": satisfying["amr"]}), ErrInsufficientAssurance},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := getGoogleTokenClaims()
+			defer putGoogleTokenClaims(claims)
+
+			if err := tokenService.Verify(context.Background(), tt.token, "https://myurl.com", claims); !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.expectedError, err)
+			}
+		})
+	}
+
+	// Without required assurance, tokens of any issuer are verified.
+	tokenService.SetAuthenticationAssurance(AuthenticationAssurance{})
+	if err := tokenService.Verify(context.Background(), issuer.mint(t, jwt.MapClaims{"aud": "https://myurl.com", "email": email}),
+		"https://myurl.com", &GoogleTokenClaims{}); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+}
+
+func TestClaimLeeway(t *testing.T) {
+	var (
+		issuer       = newFakeOpenIDIssuer(t)
+		tokenService = issuer.newTokenService(t, PrincipalClaimEmail)
+		now          = time.Now()
+		mint         = func(claims jwt.MapClaims) string {
+			claims["aud"], claims["email"] = "https://myurl.com", "user@example.com"
+			return issuer.mint(t, claims)
+		}
+	)
+	// Leeway of iat is retained, one minute.
+	tokenService.SetClaimLeeway(ClaimLeeway{Exp: 10 * time.Second, Nbf: 5 * time.Minute})
+	var tests = []struct {
+		name          string
+		token         string
+		expectedError error
+	}{
+		{"TestExpWithinLeeway", mint(jwt.MapClaims{"exp": now.Add(-5 * time.Second).Unix()}), nil},
+		{"TestExpBeyondLeeway", mint(jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()}), jwt.ErrTokenExpired},
+		{"TestNbfWithinLeeway", mint(jwt.MapClaims{"nbf": now.Add(3 * time.Minute).Unix()}), nil},
+		{"TestNbfBeyondLeeway", mint(jwt.MapClaims{"nbf": now.Add(10 * time.Minute).Unix()}), jwt.ErrTokenNotValidYet},
+		{"TestIatWithinLeeway", mint(jwt.MapClaims{"iat": now.Add(30 * time.Second).Unix()}), nil},
+		{"TestIatBeyondLeeway", mint(jwt.MapClaims{"iat": now.Add(2 * time.Minute).Unix()}), jwt.ErrTokenUsedBeforeIssued},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := getGoogleTokenClaims()
+			defer putGoogleTokenClaims(claims)
+
+			if err := tokenService.Verify(context.Background(), tt.token, "https://myurl.com", claims); !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestAudienceRules(t *testing.T) {
+	var (
+		google, custom = newFakeOpenIDIssuer(t), newFakeOpenIDIssuer(t)
+		tokenService   = google.newTokenService(t, PrincipalClaimEmail)
+		derived        = "https://myurl.com"
+	)
+	tokenService.SetFederatedIssuers([]FederatedIssuer{{Issuer: custom.server.URL, Pool: "locations/global/workforcePools/corp"}})
+	tokenService.SetAudienceRules(map[string]AudienceRule{custom.server.URL: {Audiences: []string{"client-123", "client-456"}}})
+
+	var tests = []struct {
+		name          string
+		token         string
+		expectedError error
+	}{
+		{"TestGoogleDerivedAudience", google.mint(t, jwt.MapClaims{"aud": derived, "email": "user@example.com"}), nil},
+		{"TestGoogleClientIdAudience", google.mint(t, jwt.MapClaims{"aud": "client-123", "email": "user@example.com"}), ErrInvalidAudience},
+		{"TestCustomClientIdAudience", custom.mint(t, jwt.MapClaims{"iss": custom.server.URL, "sub": "alice", "aud": "client-456"}), nil},
+		{"TestCustomAnyOfAudiences", custom.mint(t, jwt.MapClaims{"iss": custom.server.URL, "sub": "alice",
+			"aud": []string{"other", "client-123"}}), nil},
+		{"TestCustomDerivedAudience", custom.mint(t, jwt.MapClaims{"iss": custom.server.URL, "sub": "alice", "aud": derived}), ErrInvalidAudience},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := getGoogleTokenClaims()
+			defer putGoogleTokenClaims(claims)
+
+			if err := tokenService.Verify(context.Background(), tt.token, derived, claims); !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, error %v was returned.", tt.expectedError, err)
+			}
+		})
+	}
+}
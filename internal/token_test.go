@@ -3,6 +3,7 @@ package internal_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/MicahParks/keyfunc/v3"
 	"github.com/anderslauri/open-iap/internal"
@@ -70,7 +71,7 @@ func requestGoogleServiceAccountSelfSignedIdToken(ctx context.Context, aud strin
 func newTokenService(ctx context.Context) (*internal.GoogleTokenService, error) {
 	defaultInterval := 5 * time.Minute
 	jwkCache := cache.NewExpiryCache[keyfunc.Keyfunc](ctx, defaultInterval)
-	tokenService, err := internal.NewGoogleTokenService(ctx, jwkCache, defaultInterval, 1*time.Minute)
+	tokenService, err := internal.NewGoogleTokenService(ctx, jwkCache, defaultInterval, 1*time.Minute, internal.PrincipalClaimEmail, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +92,35 @@ func TestGoogleServiceAccountIdTokenVerification(t *testing.T) {
 	}
 }
 
+func TestGoogleServiceAccountIdTokenTargetAudience(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tokenService, _ := newTokenService(ctx)
+	idToken, err := requestGoogleServiceAccountIdToken(ctx, "https://myurl.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name     string
+		audience string
+		error    error
+	}{
+		{"TestIdTokenWithMatchingTargetAudience", "https://myurl.com", nil},
+		{"TestIdTokenWithOtherTargetAudience", "https://other.com", internal.ErrInvalidAudience},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tokenService.Verify(ctx, idToken, tt.audience, &internal.GoogleTokenClaims{})
+			if tt.error == nil && err != nil {
+				t.Fatalf("Expected no error from token, error returned: %s", err)
+			} else if tt.error != nil && !errors.Is(err, tt.error) {
+				t.Fatalf("Expected error %s, error returned: %v", tt.error, err)
+			}
+		})
+	}
+}
+
 func TestGoogleSelfSignedTokenVerification(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
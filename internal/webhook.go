@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WebhookSignatureHeader holds HMAC-SHA256 of body of each post of WebhookAuditSink, hex encoded and prefixed sha256=.
+const WebhookSignatureHeader = "X-IAP-Signature"
+
+// webhookBackoff is backoff of first retry of post, doubled for each retry.
+const webhookBackoff = 500 * time.Millisecond
+
+// ErrInvalidWebhook is given when url of webhook is not absolute http or https, or key is empty.
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// WebhookAuditSink is an AuditSink posting each record as JSON to url, signed with key in WebhookSignatureHeader.
+// Records are posted in order from a bounded queue, and retried given failed request or 5xx.
+type WebhookAuditSink struct {
+	client      *http.Client
+	url         string
+	key         []byte
+	denialsOnly bool
+	retries     int
+	backoff     time.Duration
+	records     chan AuditRecord
+	closing     chan context.Context
+	flushed     chan struct{}
+	once        sync.Once
+}
+
+// webhookRecord is payload of post of WebhookAuditSink.
+type webhookRecord struct {
+	Principal        GoogleServiceAccount `json:"principal"`
+	RequestURL       string               `json:"requestUrl"`
+	Granted          bool                 `json:"granted"`
+	FailOpen         bool                 `json:"failOpen"`
+	Denial           string               `json:"denial,omitempty"`
+	Reason           string               `json:"reason,omitempty"`
+	TokenFingerprint string               `json:"tokenFingerprint,omitempty"`
+	RequestID        string               `json:"requestId,omitempty"`
+	PolicySource     string               `json:"policySource,omitempty"`
+	Timestamp        time.Time            `json:"timestamp"`
+}
+
+// NewWebhookAuditSink creates an AuditSink posting records to webhookUrl, of denials only given denialsOnly. Records are
+// dropped given queueSize records are pending, or given post failed after retries. Each post is bound by timeout.
+func NewWebhookAuditSink(webhookUrl string, key []byte, denialsOnly bool, queueSize, retries int,
+	timeout time.Duration) (*WebhookAuditSink, error) {
+	if u, err := url.Parse(webhookUrl); err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("%w: url %s is not absolute http or https", ErrInvalidWebhook, webhookUrl)
+	} else if len(key) == 0 {
+		return nil, fmt.Errorf("%w: key is empty", ErrInvalidWebhook)
+	}
+	sink := &WebhookAuditSink{
+		client:      &http.Client{Timeout: timeout},
+		url:         webhookUrl,
+		key:         key,
+		denialsOnly: denialsOnly,
+		retries:     max(retries, 0),
+		backoff:     webhookBackoff,
+		records:     make(chan AuditRecord, max(queueSize, 1)),
+		closing:     make(chan context.Context, 1),
+		flushed:     make(chan struct{}),
+	}
+	go sink.run()
+	return sink, nil
+}
+
+// Record enqueues record for post. Never blocks, record is dropped given queue is full.
+func (w *WebhookAuditSink) Record(record AuditRecord) {
+	if w.denialsOnly && record.Granted {
+		return
+	}
+	select {
+	case w.records <- record:
+	default:
+		auditRecordsDroppedCounter.Inc()
+		log.Warningf("Webhook record for user %s dropped, queue is full.", record.Principal)
+	}
+}
+
+// Close posts pending records. Records recorded after Close are not posted.
+func (w *WebhookAuditSink) Close(ctx context.Context) error {
+	w.once.Do(func() { w.closing <- ctx })
+
+	select {
+	case <-w.flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *WebhookAuditSink) run() {
+	defer close(w.flushed)
+	for {
+		select {
+		case record := <-w.records:
+			w.post(context.Background(), record)
+		case ctx := <-w.closing:
+			// Drain pending records, run is single consumer of records.
+			for len(w.records) > 0 {
+				w.post(ctx, <-w.records)
+			}
+			return
+		}
+	}
+}
+
+// post record, retried with exponential backoff given failed request or 5xx. Failed posts are logged and dropped.
+func (w *WebhookAuditSink) post(ctx context.Context, record AuditRecord) {
+	body, _ := json.Marshal(w.payload(record))
+	mac := hmac.New(sha256.New, w.key)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	retry, err := w.do(ctx, body, signature)
+	for attempt := 0; retry && attempt < w.retries; attempt++ {
+		select {
+		case <-time.After(w.backoff << attempt):
+			retry, err = w.do(ctx, body, signature)
+		case <-ctx.Done():
+			retry, err = false, ctx.Err()
+		}
+	}
+	if err != nil {
+		auditRecordsDroppedCounter.Inc()
+		log.WithField("error", err).Errorf("Failed to post webhook record for user %s.", record.Principal)
+	}
+}
+
+// do posts body, retry is true given post failed and can be retried.
+func (w *WebhookAuditSink) do(ctx context.Context, body []byte, signature string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signature)
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	_ = rsp.Body.Close()
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		return true, fmt.Errorf("webhook returned status code %d", rsp.StatusCode)
+	} else if rsp.StatusCode >= http.StatusBadRequest {
+		return false, fmt.Errorf("webhook returned status code %d", rsp.StatusCode)
+	}
+	return false, nil
+}
+
+// payload transforms record into payload of post.
+func (w *WebhookAuditSink) payload(record AuditRecord) webhookRecord {
+	payload := webhookRecord{
+		Principal:        record.Principal,
+		RequestURL:       record.RequestURL.String(),
+		Granted:          record.Granted,
+		FailOpen:         record.FailOpen,
+		Reason:           record.Reason,
+		TokenFingerprint: record.TokenFingerprint,
+		RequestID:        record.RequestID,
+		PolicySource:     record.PolicySource,
+		Timestamp:        record.Timestamp.UTC(),
+	}
+	if !record.Granted {
+		payload.Denial = "implicit"
+		if record.ExplicitDeny {
+			payload.Denial = "explicit"
+		}
+	}
+	return payload
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebhookReceiver responds to each post with next of statusCodes, else 200, and records bodies and signatures.
+type fakeWebhookReceiver struct {
+	mu          sync.Mutex
+	statusCodes []int
+	bodies      [][]byte
+	signatures  []string
+}
+
+func (f *fakeWebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bodies = append(f.bodies, body)
+	f.signatures = append(f.signatures, r.Header.Get(WebhookSignatureHeader))
+	if len(f.statusCodes) > 0 {
+		w.WriteHeader(f.statusCodes[0])
+		f.statusCodes = f.statusCodes[1:]
+	}
+}
+
+func (f *fakeWebhookReceiver) posts() ([][]byte, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bodies, f.signatures
+}
+
+func newFakeWebhookAuditSink(t *testing.T, denialsOnly bool, statusCodes ...int) (*WebhookAuditSink, *fakeWebhookReceiver) {
+	receiver := &fakeWebhookReceiver{statusCodes: statusCodes}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	sink, err := NewWebhookAuditSink(server.URL, []byte("key"), denialsOnly, 10, 2, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	sink.backoff = time.Millisecond
+	return sink, receiver
+}
+
+func TestWebhookAuditSinkRetriesOn5xx(t *testing.T) {
+	sink, receiver := newFakeWebhookAuditSink(t, true, http.StatusInternalServerError, http.StatusBadGateway)
+	record := auditRecord("sa@p.iam.gserviceaccount.com", false)
+	record.ExplicitDeny, record.Reason = true, ErrDeniedByPolicy.Error()
+
+	sink.Record(auditRecord("sa@p.iam.gserviceaccount.com", true))
+	sink.Record(record)
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	bodies, signatures := receiver.posts()
+	if len(bodies) != 3 {
+		t.Fatalf("Expected denial to be posted 3 times given 2 retries, %d posts were given.", len(bodies))
+	}
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write(bodies[2])
+	if signatures[2] != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("Expected signature of body, signature %s was given.", signatures[2])
+	}
+	var payload webhookRecord
+	if err := json.Unmarshal(bodies[2], &payload); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	} else if payload.Principal != "sa@p.iam.gserviceaccount.com" || payload.Granted || payload.Denial != "explicit" ||
+		payload.Reason != ErrDeniedByPolicy.Error() || payload.RequestURL != "https://myurl.com/hello" {
+		t.Fatalf("Expected explicit denial of principal, payload %s was given.", bodies[2])
+	}
+}
+
+func TestWebhookAuditSinkDoesNotRetry4xx(t *testing.T) {
+	sink, receiver := newFakeWebhookAuditSink(t, false, http.StatusBadRequest)
+
+	sink.Record(auditRecord("sa@p.iam.gserviceaccount.com", true))
+	sink.Record(auditRecord("sa@p.iam.gserviceaccount.com", false))
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Unexpected error returned, error: %s.", err)
+	}
+	// First record is rejected and not retried, second record is posted given all decisions.
+	if bodies, _ := receiver.posts(); len(bodies) != 2 {
+		t.Fatalf("Expected 2 posts, %d posts were given.", len(bodies))
+	}
+}
+
+func TestNewWebhookAuditSinkIsInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		url  string
+		key  string
+	}{
+		{"TestRelativeUrl", "/decisions", "key"},
+		{"TestUnsupportedScheme", "ftp://example.com/decisions", "key"},
+		{"TestEmptyKey", "https://example.com/decisions", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewWebhookAuditSink(tt.url, []byte(tt.key), true, 10, 0, time.Second); !errors.Is(err, ErrInvalidWebhook) {
+				t.Fatalf("Expected ErrInvalidWebhook, error %v was given.", err)
+			}
+		})
+	}
+}
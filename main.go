@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"github.com/MicahParks/keyfunc/v3"
 	config "github.com/anderslauri/open-iap/gen"
 	"github.com/anderslauri/open-iap/internal"
@@ -15,10 +16,15 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"time"
 )
 
 func main() {
+	check := flag.Bool("check", false, "Validate configuration and connectivity to Google APIs, then exit without listener.")
+	flag.Parse()
 	log.SetFormatter(&log.JSONFormatter{})
+	log.AddHook(internal.RequestIDHook{})
 
 	appConfigFile := "app_config.pkl"
 	if customConfigFile := os.Getenv("APPLICATION_CONFIG_FILE"); len(customConfigFile) > 0 {
@@ -34,32 +40,105 @@ func main() {
 	log.SetLevel(lvl)
 	log.SetReportCaller(cfg.Logger.ReportCaller)
 	log.Info("Loading Google IAM-credentials using ADC.")
-	credentials, err := google.FindDefaultCredentials(ctx,
-		admin.AdminDirectoryGroupReadonlyScope,
-		iamcredentials.CloudPlatformScope,
-	)
+	scopes := []string{admin.AdminDirectoryGroupReadonlyScope, iamcredentials.CloudPlatformScope}
+	if cfg.EmailAliases.Enabled {
+		scopes = append(scopes, admin.AdminDirectoryUserReadonlyScope)
+	}
+	credentials, err := google.FindDefaultCredentials(ctx, scopes...)
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google IAM-credentials.")
 	}
+	// Outbound calls of policy refresh, group resolution and JWK are bounded by a shared limiter.
+	limiter := internal.NewAPILimiter(cfg.GoogleApiConcurrency)
 	log.Info("Creating Google Workspace client.")
-	gwsClient, err := internal.NewGoogleWorkspaceClient(ctx, credentials)
+	gwsClient, err := internal.NewGoogleWorkspaceClient(ctx, credentials, limiter)
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google Workspace client.")
 	}
+	// Initial loads of policy bindings and deny policies fail creation once exceeding startup deadline.
+	startup := internal.StartupDeadline{
+		Deadline: cfg.Startup.Deadline.GoDuration(),
+		Retries:  cfg.Startup.Retries,
+		Backoff:  cfg.Startup.Backoff.GoDuration(),
+	}
 	log.Info("Creating Identity Access Management client.")
 	iamClient, err := internal.NewIdentityAccessManagementClient(ctx, gwsClient,
-		credentials, cfg.IamPolicy.RefreshInterval.GoDuration())
+		credentials, cfg.IamPolicy.RefreshInterval.GoDuration(), internal.BindingDropGuard{
+			Threshold: cfg.IamPolicy.DropThreshold,
+			Grace:     cfg.IamPolicy.DropGrace,
+		}, limiter, startup)
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google Cloud IAM-policy client.")
 	}
+	if cfg.EmailAliases.Enabled {
+		// Bindings of users are matched given email aliases, refreshed as user members were ignored on creation.
+		iamClient.SetUserMembers(true)
+		if err = iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+			log.WithField("error", err).Fatal("Couldn't refresh Google Cloud IAM-policy bindings of users.")
+		}
+	}
+	if cfg.IamPolicy.ResourcePolicies {
+		resources := make([]string, 0, len(cfg.Resources))
+		for _, resource := range cfg.Resources {
+			resources = append(resources, resource.Name)
+		}
+		slices.Sort(resources)
+		if err = iamClient.SetResourcePolicies(ctx, credentials, slices.Compact(resources)); err != nil {
+			log.WithField("error", err).Fatal("Couldn't create Identity Aware Proxy client.")
+		} else if err = iamClient.RefreshRoleAndBindingsForIdentityAwareProxy(ctx); err != nil {
+			log.WithField("error", err).Fatal("Couldn't refresh Google Cloud IAM-policy bindings of resources.")
+		}
+	}
+	if len(cfg.IamPolicy.Subscription) > 0 {
+		log.Infof("Subscribing to policy change notifications of %s.", cfg.IamPolicy.Subscription)
+		subscriber, err := internal.NewPolicyChangeSubscriber(ctx, credentials, cfg.IamPolicy.Subscription, iamClient)
+		if err != nil {
+			log.WithField("error", err).Fatal("Couldn't create policy change subscriber.")
+		}
+		go subscriber.Run(ctx)
+	}
 	log.Info("Creating Google Cloud token service.")
 
 	tokenService, err := internal.NewGoogleTokenService(ctx,
 		cache.NewExpiryCache[keyfunc.Keyfunc](ctx, cfg.JwkCache.Cleaner.GoDuration()),
-		cfg.GoogleCerts.RefreshInterval.GoDuration(), cfg.Leeway.GoDuration())
+		cfg.GoogleCerts.RefreshInterval.GoDuration(), cfg.Leeway.GoDuration(), cfg.PrincipalClaim, limiter)
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google Cloud token service.")
 	}
+	tokenService.SetClaimLeeway(internal.ClaimLeeway{
+		Exp: cfg.ClaimLeeway.Exp.GoDuration(),
+		Nbf: cfg.ClaimLeeway.Nbf.GoDuration(),
+		Iat: cfg.ClaimLeeway.Iat.GoDuration(),
+	})
+	tokenService.SetJwkMaxAge(cfg.GoogleCerts.MaxAge.GoDuration())
+	tokenService.SetUnknownKidRefreshInterval(cfg.GoogleCerts.UnknownKidRefreshInterval.GoDuration())
+	tokenService.SetUnknownKidCoalescing(cfg.GoogleCerts.CoalesceUnknownKidRefresh)
+	tokenService.SetAuthenticationAssurance(internal.AuthenticationAssurance{
+		Acr: cfg.Assurance.Acr,
+		Amr: cfg.Assurance.Amr,
+	})
+	federatedIssuers := make([]internal.FederatedIssuer, 0, len(cfg.FederatedIssuers))
+	for _, issuer := range cfg.FederatedIssuers {
+		federatedIssuers = append(federatedIssuers, internal.FederatedIssuer{
+			Issuer:   issuer.Issuer,
+			Pool:     issuer.Pool,
+			Audience: issuer.Audience,
+		})
+	}
+	tokenService.SetFederatedIssuers(federatedIssuers)
+	audienceRules := make(map[string]internal.AudienceRule, len(cfg.AudienceRules))
+	for issuer, audiences := range cfg.AudienceRules {
+		audienceRules[issuer] = internal.AudienceRule{Audiences: audiences}
+	}
+	tokenService.SetAudienceRules(audienceRules)
+	warmIssuers := slices.Clone(cfg.GoogleCerts.WarmIssuers)
+	for _, issuer := range federatedIssuers {
+		warmIssuers = append(warmIssuers, issuer.Issuer)
+	}
+	// Listener is not started, readiness is not given until warm-up is done.
+	if err = tokenService.WarmJwkCache(ctx, warmIssuers, cfg.GoogleCerts.WarmTimeout.GoDuration()); err != nil {
+		log.WithField("error", err).Warning("Couldn't warm JWK cache, JWK is loaded on first request.")
+	}
 	log.Info("Creating Google Cloud authenticator service.")
 
 	excludedHosts := make([]url.URL, 0, len(cfg.ExcludedHosts))
@@ -71,17 +150,257 @@ func main() {
 		excludedHosts = append(excludedHosts, *excludedHost)
 	}
 
-	authenticator, err := internal.NewGoogleCloudTokenAuthenticator(tokenService,
-		cache.NewExpiryCache[internal.GoogleServiceAccount](ctx, cfg.JwtCache.Cleaner.GoDuration()),
-		iamClient, gwsClient, excludedHosts)
+	jwtCache := cache.NewExpiryCache[internal.GoogleServiceAccount](ctx, cfg.JwtCache.Cleaner.GoDuration())
+	// Stale entries are retained for window of stale while revalidate.
+	jwtCache.SetRetention(cfg.StaleWhileRevalidate.GoDuration())
+	if len(cfg.JwtCacheSnapshot.File) > 0 {
+		restored, err := internal.ReadCacheSnapshot(cfg.JwtCacheSnapshot.File, []byte(cfg.JwtCacheSnapshot.Key), jwtCache)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.WithField("error", err).Warning("Couldn't restore snapshot of jwt cache. Starting with empty cache.")
+		} else {
+			log.Infof("Restored %d entries of jwt cache from snapshot.", restored)
+		}
+	}
+	var verifier internal.TokenVerifier[*internal.GoogleTokenClaims] = tokenService
+	if cfg.AccessTokens.Enabled {
+		fallback := internal.NewAccessTokenFallbackVerifier(tokenService, cfg.AccessTokens.Audiences,
+			cfg.AccessTokens.Timeout.GoDuration(), limiter)
+		fallback.SetExpiryGrace(cfg.AccessTokens.ExpiryGrace.GoDuration())
+		verifier = fallback
+	}
+	var policyReader internal.IdentityAccessManagementReader = iamClient
+	if len(cfg.IamPolicy.Failover.Project) > 0 {
+		log.Infof("Creating secondary Identity Access Management client of project %s.", cfg.IamPolicy.Failover.Project)
+		secondaryClient, err := internal.NewIdentityAccessManagementClient(ctx, gwsClient, &google.Credentials{
+			ProjectID:   cfg.IamPolicy.Failover.Project,
+			TokenSource: credentials.TokenSource,
+			JSON:        credentials.JSON,
+		}, cfg.IamPolicy.RefreshInterval.GoDuration(), internal.BindingDropGuard{
+			Threshold: cfg.IamPolicy.DropThreshold,
+			Grace:     cfg.IamPolicy.DropGrace,
+		}, limiter, startup)
+		if err != nil {
+			log.WithField("error", err).Fatal("Couldn't create secondary Google Cloud IAM-policy client.")
+		}
+		secondaryClient.SetUserMembers(cfg.EmailAliases.Enabled)
+		policyReader = internal.NewFailoverPolicyReader(iamClient, secondaryClient, cfg.IamPolicy.Failover.StaleAfter.GoDuration())
+	}
+	authenticator, err := internal.NewGoogleCloudTokenAuthenticator(verifier, jwtCache,
+		policyReader, gwsClient, excludedHosts, internal.EmailDomainFilter{
+			Allowed: cfg.EmailDomains.Allowed,
+			Denied:  cfg.EmailDomains.Denied,
+		}, cfg.ConditionTimeout.GoDuration(), internal.FailOpen{
+			Enabled:    cfg.FailOpen.Enabled,
+			StaleAfter: cfg.FailOpen.StaleAfter.GoDuration(),
+		})
 	if err != nil {
 		log.WithField("error", err).Fatal("Couldn't create Google Cloud authenticator service.")
 	}
+	authenticator.SetEmptyPolicy(internal.EmptyPolicy(cfg.IamPolicy.EmptyPolicy.String()))
+	if err = authenticator.SetIdentityPatterns(cfg.IdentityPatterns); err != nil {
+		log.WithField("error", err).Fatal("Couldn't parse identity patterns.")
+	}
+	if len(cfg.IdentityMapping.Table) > 0 || cfg.IdentityMapping.StripDomain {
+		table := make(map[internal.GoogleServiceAccount]internal.GoogleServiceAccount, len(cfg.IdentityMapping.Table))
+		for from, to := range cfg.IdentityMapping.Table {
+			table[internal.GoogleServiceAccount(from)] = internal.GoogleServiceAccount(to)
+		}
+		authenticator.SetIdentityResolver(internal.TableIdentityResolver{
+			Table:       table,
+			StripDomain: cfg.IdentityMapping.StripDomain,
+		})
+	}
+	if cfg.IamPolicy.DenyPolicies {
+		log.Info("Creating deny policy client.")
+		denyPolicies, err := internal.NewDenyPolicyClient(ctx, gwsClient, credentials,
+			cfg.IamPolicy.RefreshInterval.GoDuration(), limiter, startup)
+		if err != nil {
+			log.WithField("error", err).Fatal("Couldn't create deny policy client.")
+		}
+		authenticator.SetDenyPolicyReader(denyPolicies)
+	}
+	if len(cfg.IamPolicy.ShadowProject) > 0 {
+		log.Infof("Creating shadow Identity Access Management client of project %s.", cfg.IamPolicy.ShadowProject)
+		shadowClient, err := internal.NewIdentityAccessManagementClient(ctx, gwsClient, &google.Credentials{
+			ProjectID:   cfg.IamPolicy.ShadowProject,
+			TokenSource: credentials.TokenSource,
+			JSON:        credentials.JSON,
+		}, cfg.IamPolicy.RefreshInterval.GoDuration(), internal.BindingDropGuard{}, limiter, startup)
+		if err != nil {
+			log.WithField("error", err).Fatal("Couldn't create shadow Google Cloud IAM-policy client.")
+		}
+		shadowClient.SetUserMembers(cfg.EmailAliases.Enabled)
+		authenticator.SetShadowPolicyReader(shadowClient)
+	}
+	resources := make(map[string]internal.Resource, len(cfg.Resources))
+	for host, resource := range cfg.Resources {
+		resources[host] = internal.Resource{Name: resource.Name, Type: resource.Type}
+	}
+	authenticator.SetResources(resources)
+	authenticator.SetTokenFingerprint(cfg.TokenFingerprint)
+	authenticator.SetMaxBindings(cfg.MaxBindings)
+	authenticator.SetBindingMetrics(cfg.MaxBindingTitles)
+	authenticator.SetParamLimits(internal.ParamLimits{
+		MaxValueBytes: cfg.MaxParamBytes,
+		MaxTotalBytes: cfg.MaxTotalParamBytes,
+	})
+	authenticator.SetStaleWhileRevalidate(cfg.StaleWhileRevalidate.GoDuration())
+	audienceMaxTTL := make(map[string]time.Duration, len(cfg.JwtCache.AudienceMaxTtl))
+	for aud, ttl := range cfg.JwtCache.AudienceMaxTtl {
+		audienceMaxTTL[aud] = ttl.GoDuration()
+	}
+	authenticator.SetMaxCacheTTL(cfg.JwtCache.MaxTtl.GoDuration(), audienceMaxTTL)
+	authenticator.SetMetricHosts(cfg.MetricHosts)
+	if cfg.DecisionCache.Enabled {
+		authenticator.SetDecisionCache(cache.NewExpiryCache[time.Time](ctx, cfg.JwtCache.Cleaner.GoDuration()),
+			cfg.DecisionCache.Ttl.GoDuration())
+		authenticator.SetEvaluateTimeConditions(cfg.DecisionCache.EvaluateTimeConditions)
+	}
+	if cfg.ConditionResultCache.Enabled {
+		authenticator.SetConditionResultCache(cache.NewExpiryCache[bool](ctx, cfg.JwtCache.Cleaner.GoDuration()),
+			cfg.ConditionResultCache.Bucket.GoDuration())
+	}
+	if cfg.EmailAliases.Enabled {
+		authenticator.SetEmailAliases(gwsClient, cache.NewExpiryCache[[]internal.GoogleServiceAccount](ctx,
+			cfg.JwtCache.Cleaner.GoDuration()), cfg.EmailAliases.Ttl.GoDuration())
+	}
+	if cfg.NegativeCache.Enabled {
+		authenticator.SetNegativeCache(cache.NewExpiryCache[time.Time](ctx, cfg.JwtCache.Cleaner.GoDuration()),
+			cfg.NegativeCache.Ttl.GoDuration())
+	}
+	if cfg.ReplayProtection.Enabled {
+		authenticator.SetReplayProtection(cache.NewExpiryCache[time.Time](ctx, cfg.JwtCache.Cleaner.GoDuration()),
+			cfg.ReplayProtection.MaxWindow.GoDuration())
+	}
+	var auditSinks internal.AuditSinks
+	if cfg.AuditLog.Enabled {
+		log.Info("Creating Google Cloud Logging audit sink.")
+		var auditSink internal.AuditSink
+		if auditSink, err = internal.NewCloudLoggingAuditSink(ctx, credentials, cfg.AuditLog.LogName,
+			cfg.AuditLog.BatchSize, cfg.AuditLog.FlushInterval.GoDuration()); err != nil {
+			log.WithField("error", err).Fatal("Couldn't create Google Cloud Logging audit sink.")
+		}
+		if cfg.AuditLog.DenialSampleRate < 1 {
+			auditSink = internal.NewSampledAuditSink(auditSink, cfg.AuditLog.DenialSampleRate,
+				cfg.AuditLog.DenialSampleWindow.GoDuration())
+		}
+		auditSinks = append(auditSinks, auditSink)
+	}
+	if len(cfg.DecisionWebhook.Url) > 0 {
+		log.Infof("Creating decision webhook of %s.", cfg.DecisionWebhook.Url)
+		webhook, err := internal.NewWebhookAuditSink(cfg.DecisionWebhook.Url, []byte(cfg.DecisionWebhook.Key),
+			!cfg.DecisionWebhook.AllDecisions, cfg.DecisionWebhook.QueueSize, cfg.DecisionWebhook.Retries,
+			cfg.DecisionWebhook.Timeout.GoDuration())
+		if err != nil {
+			log.WithField("error", err).Fatal("Couldn't create decision webhook.")
+		}
+		auditSinks = append(auditSinks, webhook)
+	}
+	if len(auditSinks) > 0 {
+		authenticator.SetAuditSink(auditSinks)
+	}
+	if *check {
+		// Clients are created and initial loads are done, failure of creation is fatal before.
+		err = internal.RunSelfCheck(ctx, os.Stdout, cfg.GoogleCerts.WarmTimeout.GoDuration(),
+			internal.HealthCheck(tokenService),
+			internal.SelfCheck{Name: "bindings", Check: iamClient.RefreshRoleAndBindingsForIdentityAwareProxy},
+			internal.SelfCheck{Name: "warmIssuers", Check: func(ctx context.Context) error {
+				return tokenService.WarmJwkCache(ctx, warmIssuers, cfg.GoogleCerts.WarmTimeout.GoDuration())
+			}},
+			internal.HealthCheck(gwsClient),
+		)
+		cancel()
+		if err != nil {
+			log.WithField("error", err).Error("Self-check failed.")
+			os.Exit(1)
+		}
+		log.Info("Self-check successful.")
+		return
+	}
 	log.Info("Application configuration successfully loaded. Starting new authentication service listener..")
-	authService, err := internal.NewAuthServiceListener(ctx, cfg.Host, cfg.HeaderMapping.Url, cfg.Port, authenticator)
+	authService, err := internal.NewAuthServiceListenerWithConfig(ctx, internal.ListenerConfig{
+		Host:             cfg.Host,
+		URLHeaders:       cfg.HeaderMapping.Urls,
+		StrictRequestURL: cfg.HeaderMapping.Strict,
+		Port:             cfg.Port,
+		DrainPeriod:      cfg.DrainPeriod.GoDuration(),
+		MaxTokenLength:   cfg.MaxTokenLength,
+	}, authenticator)
 	if err != nil {
 		log.WithField("error", err).Fatalf("Not possible to start listener.")
 	}
+	authService.SetHealthReporters(tokenService, iamClient, gwsClient)
+	authService.SetAuthMethods(cfg.AuthMethods)
+	authService.SetMaxBodyBytes(int64(cfg.MaxBodyBytes))
+	authService.SetServerTiming(cfg.ServerTiming)
+	authService.SetDecisionReason(cfg.DecisionReason)
+	authService.SetEarlyHints(cfg.EarlyHints)
+	authService.SetKeepAlive(internal.KeepAlive{
+		Disabled:    !cfg.KeepAlive.Enabled,
+		IdleTimeout: cfg.KeepAlive.IdleTimeout.GoDuration(),
+	})
+
+	if cfg.Assertion.Enabled {
+		signer, err := internal.NewAssertionSigner(ctx, cfg.Assertion.Issuer, cfg.Assertion.Lifetime.GoDuration(),
+			cfg.Assertion.RotationInterval.GoDuration())
+		if err != nil {
+			log.WithField("error", err).Fatal("Couldn't create assertion signer.")
+		}
+		authService.SetAssertionSigner(signer)
+	}
+	if cfg.ClaimsBundle.Enabled {
+		authService.SetClaimsBundle(internal.ClaimsBundle{
+			Header: cfg.ClaimsBundle.Header,
+			Claims: cfg.ClaimsBundle.Claims,
+		})
+	}
+	authService.SetCORS(internal.CORS{
+		AllowedOrigins: cfg.Cors.AllowedOrigins,
+		AllowedMethods: cfg.Cors.AllowedMethods,
+		AllowedHeaders: cfg.Cors.AllowedHeaders,
+		MaxAge:         cfg.Cors.MaxAge.GoDuration(),
+	})
+	authService.SetExemplars(cfg.Exemplars)
+	authService.SetBypassPaths(cfg.BypassPaths)
+	if err = authService.SetIPDenylist(internal.IPDenylist{
+		Denied:         cfg.IpDenylist.Denied,
+		TrustedProxies: cfg.IpDenylist.TrustedProxies,
+	}); err != nil {
+		log.WithField("error", err).Fatal("Invalid ip denylist.")
+	}
+	authService.SetAdminToken(cfg.AdminToken)
+	if cfg.RequestId.Enabled {
+		authService.SetRequestID(cfg.RequestId.Header, cfg.RequestId.Trusted)
+	}
+	authService.SetRetryAfter(cfg.RetryAfter.GoDuration())
+	authService.SetRequestBudget(cfg.RequestBudget.GoDuration())
+	authService.SetTrustForwardedProto(cfg.HeaderMapping.TrustForwardedProto)
+	if len(cfg.HeaderMapping.Device) > 0 {
+		authService.SetDeviceHeader(cfg.HeaderMapping.Device)
+	}
+	headerVariables := make([]internal.HeaderVariable, 0, len(cfg.HeaderMapping.Variables))
+	for _, variable := range cfg.HeaderMapping.Variables {
+		headerVariables = append(headerVariables, internal.HeaderVariable{
+			Header:   variable.Header,
+			Variable: variable.Variable,
+			Type:     variable.Type,
+		})
+	}
+	if err = authService.SetHeaderVariables(headerVariables); err != nil {
+		log.WithField("error", err).Fatal("Invalid header variables.")
+	}
+	// Conditions of route policy may reference header variables.
+	if len(cfg.RoutePolicyFile) > 0 {
+		routePolicy, err := internal.ReadRoutePolicy(cfg.RoutePolicyFile)
+		if err != nil {
+			log.WithField("error", err).Fatal("Couldn't read route policy.")
+		} else if err = authenticator.SetRoutePolicy(ctx, routePolicy); err != nil {
+			log.WithField("error", err).Fatal("Couldn't load route policy.")
+		}
+	}
+	if len(cfg.HeaderMapping.ClientCertificate) > 0 {
+		authService.SetClientCertificateHeader(cfg.HeaderMapping.ClientCertificate)
+	}
 
 	if cfg.Tls != nil && len(cfg.Tls.CertFile) > 0 && len(cfg.Tls.KeyFile) > 0 {
 		log.Info("Starting TLS-listener.")
@@ -93,6 +412,12 @@ func main() {
 		if err != nil {
 			log.WithField("error", err).Fatal("Not possible to read certificate key file.")
 		}
+		if err = authService.SetTLSPolicy(internal.TLSPolicy{
+			MinVersion:   cfg.Tls.MinVersion.String(),
+			CipherSuites: cfg.Tls.CipherSuites,
+		}); err != nil {
+			log.WithField("error", err).Fatal("Invalid TLS policy.")
+		}
 		go func() {
 			if err = authService.ListenAndServeWithTLS(ctx, pKey, cert); err != nil && !errors.Is(http.ErrServerClosed, err) {
 				log.WithField("error", err).Fatal("Failed to start TLS-listener.")
@@ -107,7 +432,15 @@ func main() {
 	}
 	defer func() {
 		log.Info("Exiting application.")
-		_ = authService.Close(ctx)
+		_ = authService.Drain(ctx)
+		if len(cfg.JwtCacheSnapshot.File) > 0 {
+			if written, err := internal.WriteCacheSnapshot(cfg.JwtCacheSnapshot.File, []byte(cfg.JwtCacheSnapshot.Key), jwtCache); err != nil {
+				log.WithField("error", err).Error("Couldn't write snapshot of jwt cache.")
+			} else {
+				log.Infof("Wrote %d entries of jwt cache to snapshot.", written)
+			}
+		}
+		_ = auditSinks.Close(ctx)
 		// In memory only, no reason to wait.
 		cancel()
 	}()